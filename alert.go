@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bitcoinfees/feesim/sim"
+)
+
+const alertWebhookTimeout = 10 * time.Second
+
+// AlertConfig configures the fee spike alert. The alert fires when the
+// estimate for Target blocks exceeds FeeRate (or if there is no estimate for
+// Target blocks, i.e. it's unboundedly high), and clears when it no longer
+// does. On each change, a message is logged and, if Webhook is set, POSTed to
+// Webhook as JSON.
+type AlertConfig struct {
+	// In satoshis per kB. If 0, the alert is disabled.
+	FeeRate sim.FeeRate `yaml:"feerate" json:"feerate"`
+	Target  int         `yaml:"target" json:"target"`
+	Webhook string      `yaml:"webhook" json:"webhook"`
+}
+
+// Alert is the JSON body POSTed to the alert webhook.
+type Alert struct {
+	Active    bool    `json:"active"`
+	Target    int     `json:"target"`
+	FeeRate   float64 `json:"feerate"`   // BTC/kB; -1 if no estimate
+	Threshold float64 `json:"threshold"` // BTC/kB
+	Time      int64   `json:"time"`
+}
+
+func (a Alert) String() string {
+	if !a.Active {
+		return fmt.Sprintf("Alert cleared: estimate for %d blocks is %.8f BTC/kB, at or below %.8f BTC/kB.",
+			a.Target, a.FeeRate, a.Threshold)
+	}
+	if a.FeeRate == -1 {
+		return fmt.Sprintf("Alert: no estimate for %d blocks, threshold is %.8f BTC/kB.",
+			a.Target, a.Threshold)
+	}
+	return fmt.Sprintf("Alert: estimate for %d blocks is %.8f BTC/kB, above %.8f BTC/kB.",
+		a.Target, a.FeeRate, a.Threshold)
+}
+
+// checkAlert updates the alert with a new sim result, and notifies if it
+// changed.
+func (s *FeeSim) checkAlert(result []sim.FeeRate) {
+	c := s.cfg.Alert
+	if c.FeeRate <= 0 || c.Target < 1 || c.Target > len(result) {
+		return
+	}
+	feerate := result[c.Target-1]
+	active := feerate == -1 || feerate > c.FeeRate
+
+	s.mux.Lock()
+	changed := active != s.alert
+	s.alert = active
+	s.mux.Unlock()
+	if !changed {
+		return
+	}
+
+	a := Alert{
+		Active:    active,
+		Target:    c.Target,
+		FeeRate:   toBTC([]sim.FeeRate{feerate})[0],
+		Threshold: satoshisToBTC(c.FeeRate),
+		Time:      time.Now().Unix(),
+	}
+	logger := s.cfg.logger
+	if active {
+		logger.Println("[WARNING]", a)
+	} else {
+		logger.Println(a)
+	}
+	if c.Webhook != "" {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if err := postAlert(c.Webhook, a); err != nil {
+				logger.Println("[ERROR] Alert webhook:", err)
+			}
+		}()
+	}
+}
+
+// Alerting returns whether the alert is active.
+func (s *FeeSim) Alerting() bool {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.alert
+}
+
+func postAlert(url string, a Alert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: alertWebhookTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s: %v", url, resp.Status)
+	}
+	return nil
+}
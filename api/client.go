@@ -14,6 +14,7 @@ import (
 
 	col "github.com/bitcoinfees/feesim/collect"
 	"github.com/bitcoinfees/feesim/collect/corerpc"
+	est "github.com/bitcoinfees/feesim/estimate"
 	"github.com/bitcoinfees/feesim/sim"
 )
 
@@ -64,6 +65,194 @@ func (c *Client) EstimateFee(n int) (interface{}, error) {
 	return result, nil
 }
 
+// ClampedEstimate is the fee estimate for a target, or for the max available
+// target (with Clamped set) if the target exceeds it.
+type ClampedEstimate struct {
+	FeeRate float64 `json:"feerate"`
+	Target  int     `json:"target"`
+	Clamped bool    `json:"clamped"`
+	Stale   bool    `json:"stale"`
+}
+
+func (c *Client) EstimateFeeClamped(n int) (ClampedEstimate, error) {
+	r, err := c.doRPC("estimatefeeclamped", n)
+	if err != nil {
+		return ClampedEstimate{}, err
+	}
+
+	var result ClampedEstimate
+	if err := json.Unmarshal(r, &result); err != nil {
+		return ClampedEstimate{}, err
+	}
+	return result, nil
+}
+
+// DefaultEstimate is the fee estimate for the default target.
+type DefaultEstimate struct {
+	FeeRate float64 `json:"feerate"`
+	Target  int     `json:"target"`
+	Stale   bool    `json:"stale"`
+}
+
+func (c *Client) EstimateFeeDefault() (DefaultEstimate, error) {
+	r, err := c.doRPC("estimatefeedefault", nil)
+	if err != nil {
+		return DefaultEstimate{}, err
+	}
+
+	var result DefaultEstimate
+	if err := json.Unmarshal(r, &result); err != nil {
+		return DefaultEstimate{}, err
+	}
+	return result, nil
+}
+
+// EstimateFeeInfo is the fee estimate along with its update times.
+type EstimateFeeInfo struct {
+	FeeRates        []float64 `json:"feerates"`
+	LastUpdate      int64     `json:"lastupdate"`
+	RefreshInterval int       `json:"refreshinterval"`
+	NextUpdate      int64     `json:"nextupdate"`
+	Stale           bool      `json:"stale"`
+	LowConfidence   bool      `json:"lowconfidence"`
+}
+
+func (c *Client) EstimateFeeInfo() (EstimateFeeInfo, error) {
+	r, err := c.doRPC("estimatefeeinfo", nil)
+	if err != nil {
+		return EstimateFeeInfo{}, err
+	}
+
+	var result EstimateFeeInfo
+	if err := json.Unmarshal(r, &result); err != nil {
+		return EstimateFeeInfo{}, err
+	}
+	return result, nil
+}
+
+// EstimateFeeBounds is the fee estimate along with its 95% confidence bounds.
+type EstimateFeeBounds struct {
+	FeeRates []float64 `json:"feerates"`
+	Lower    []float64 `json:"lower"`
+	Upper    []float64 `json:"upper"`
+}
+
+func (c *Client) EstimateFeeBounds() (EstimateFeeBounds, error) {
+	r, err := c.doRPC("estimatefeebounds", nil)
+	if err != nil {
+		return EstimateFeeBounds{}, err
+	}
+
+	var result EstimateFeeBounds
+	if err := json.Unmarshal(r, &result); err != nil {
+		return EstimateFeeBounds{}, err
+	}
+	return result, nil
+}
+
+// EstimateFeePercentiles is the fee estimate at each of the success
+// percentiles: FeeRates[k] are those at Percentiles[k], for all targets, or
+// only for target N if N > 0.
+type EstimateFeePercentiles struct {
+	Percentiles []float64   `json:"percentiles"`
+	FeeRates    [][]float64 `json:"feerates"`
+}
+
+func (c *Client) EstimateFeePercentiles(n int, pcts []float64) (EstimateFeePercentiles, error) {
+	r, err := c.doRPC("estimatefeepcts", struct {
+		N           int
+		Percentiles []float64
+	}{n, pcts})
+	if err != nil {
+		return EstimateFeePercentiles{}, err
+	}
+
+	var result EstimateFeePercentiles
+	if err := json.Unmarshal(r, &result); err != nil {
+		return EstimateFeePercentiles{}, err
+	}
+	return result, nil
+}
+
+func (c *Client) EstimateFeeScenario(maxBlockSize int64) ([]float64, error) {
+	r, err := c.doRPC("estimatefeescenario", struct{ MaxBlockSize int64 }{maxBlockSize})
+	if err != nil {
+		return nil, err
+	}
+
+	var result []float64
+	if err := json.Unmarshal(r, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *Client) EstimateFeeMode(mode string) ([]float64, error) {
+	r, err := c.doRPC("estimatefeemode", struct{ Mode string }{mode})
+	if err != nil {
+		return nil, err
+	}
+
+	var result []float64
+	if err := json.Unmarshal(r, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// TuneResult is the stability of the sim estimates at each NumIters tried,
+// and the recommended NumIters.
+type TuneResult struct {
+	Levels []struct {
+		NumIters  int     `json:"numiters"`
+		RelStdDev float64 `json:"relstddev"`
+	} `json:"levels"`
+	Recommended int `json:"recommended"`
+	Current     int `json:"current"`
+}
+
+func (c *Client) Tune(maxIters, runs int, tol float64) (TuneResult, error) {
+	args := struct {
+		MaxIters, Runs int
+		Tol            float64
+	}{maxIters, runs, tol}
+	r, err := c.doRPC("tune", args)
+	if err != nil {
+		return TuneResult{}, err
+	}
+
+	var result TuneResult
+	if err := json.Unmarshal(r, &result); err != nil {
+		return TuneResult{}, err
+	}
+	return result, nil
+}
+
+// TrimResult is the number of records removed by Trim, and whether a DB file
+// was compacted.
+type TrimResult struct {
+	BlockStats int  `json:"blockstats"`
+	Txs        int  `json:"txs"`
+	Compacted  bool `json:"compacted"`
+}
+
+func (c *Client) Trim(blockStatsBefore, txsBefore int64, force bool) (TrimResult, error) {
+	args := struct {
+		BlockStatsBefore, TxsBefore int64
+		Force                       bool
+	}{blockStatsBefore, txsBefore, force}
+	r, err := c.doRPC("trim", args)
+	if err != nil {
+		return TrimResult{}, err
+	}
+
+	var result TrimResult
+	if err := json.Unmarshal(r, &result); err != nil {
+		return TrimResult{}, err
+	}
+	return result, nil
+}
+
 func (c *Client) Scores() (map[string][]float64, error) {
 	r, err := c.doRPC("predictscores", nil)
 	if err != nil {
@@ -77,6 +266,26 @@ func (c *Client) Scores() (map[string][]float64, error) {
 	return result, nil
 }
 
+// FeeRateScores are the prediction scores by conf target and fee rate bucket.
+type FeeRateScores struct {
+	FeeRates []int64     `json:"feerates"`
+	Attained [][]float64 `json:"attained"`
+	Exceeded [][]float64 `json:"exceeded"`
+}
+
+func (c *Client) ScoresByFeeRate() (FeeRateScores, error) {
+	r, err := c.doRPC("predictscoresbyfee", nil)
+	if err != nil {
+		return FeeRateScores{}, err
+	}
+
+	var result FeeRateScores
+	if err := json.Unmarshal(r, &result); err != nil {
+		return FeeRateScores{}, err
+	}
+	return result, nil
+}
+
 func (c *Client) TxRate(n int) (map[string][]float64, error) {
 	r, err := c.doRPC("txrate", n)
 	if err != nil {
@@ -90,6 +299,41 @@ func (c *Client) TxRate(n int) (map[string][]float64, error) {
 	return result, nil
 }
 
+// RateHistory is a snapshot of a byte rate function, at Unix time Time.
+type RateHistory struct {
+	Time int64     `json:"time"`
+	X    []float64 `json:"x"`
+	Y    []float64 `json:"y"`
+}
+
+// TxRateHistory returns the tx byte rate snapshots within [start, end]. If end
+// is 0, there's no upper bound.
+func (c *Client) TxRateHistory(start, end int64) ([]RateHistory, error) {
+	return c.rateHistory("txratehistory", start, end)
+}
+
+// CapRateHistory is like TxRateHistory, for the capacity byte rate.
+func (c *Client) CapRateHistory(start, end int64) ([]RateHistory, error) {
+	return c.rateHistory("capratehistory", start, end)
+}
+
+func (c *Client) rateHistory(method string, start, end int64) ([]RateHistory, error) {
+	args := struct {
+		Start int64 `json:"start"`
+		End   int64 `json:"end"`
+	}{start, end}
+	r, err := c.doRPC(method, args)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []RateHistory
+	if err := json.Unmarshal(r, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
 func (c *Client) CapRate(n int) (map[string][]float64, error) {
 	r, err := c.doRPC("caprate", n)
 	if err != nil {
@@ -157,11 +401,31 @@ func (c *Client) Metrics() (map[string]interface{}, error) {
 	return v, nil
 }
 
-func (c *Client) BlockSource() (map[string]interface{}, error) {
+// BlockSource returns the estimated block source, reconstructed as its
+// concrete type (see sim.UnmarshalBlockSource).
+func (c *Client) BlockSource() (sim.BlockSource, error) {
 	r, err := c.doRPC("blocksource", nil)
 	if err != nil {
 		return nil, err
 	}
+	return sim.UnmarshalBlockSource(r)
+}
+
+// TxSource returns the estimated tx source, reconstructed as its concrete
+// type (see sim.UnmarshalTxSource).
+func (c *Client) TxSource() (sim.TxSource, error) {
+	r, err := c.doRPC("txsource", nil)
+	if err != nil {
+		return nil, err
+	}
+	return sim.UnmarshalTxSource(r)
+}
+
+func (c *Client) Summary() (map[string]interface{}, error) {
+	r, err := c.doRPC("summary", nil)
+	if err != nil {
+		return nil, err
+	}
 
 	v := make(map[string]interface{})
 	if err := json.Unmarshal(r, &v); err != nil {
@@ -170,6 +434,188 @@ func (c *Client) BlockSource() (map[string]interface{}, error) {
 	return v, nil
 }
 
+func (c *Client) Variates() ([]sim.TransientVariate, error) {
+	r, err := c.doRPC("variates", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var v []sim.TransientVariate
+	if err := json.Unmarshal(r, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (c *Client) NextBlockProb(feerate int64) (float64, error) {
+	r, err := c.doRPC("nextblockprob", struct{ FeeRate int64 }{feerate})
+	if err != nil {
+		return 0, err
+	}
+
+	var p float64
+	if err := json.Unmarshal(r, &p); err != nil {
+		return 0, err
+	}
+	return p, nil
+}
+
+// ConfTimeSeconds is the estimated time to confirmation of a fee rate.
+type ConfTimeSeconds struct {
+	Median     float64 `json:"median"`
+	Percentile float64 `json:"percentile"`
+	SuccessPct float64 `json:"successpct"`
+}
+
+func (c *Client) ConfTimeSeconds(feerate int64) (ConfTimeSeconds, error) {
+	r, err := c.doRPC("conftimeseconds", struct{ FeeRate int64 }{feerate})
+	if err != nil {
+		return ConfTimeSeconds{}, err
+	}
+
+	var result ConfTimeSeconds
+	if err := json.Unmarshal(r, &result); err != nil {
+		return ConfTimeSeconds{}, err
+	}
+	return result, nil
+}
+
+// TxSourceDebug is the tx source estimator's internal state.
+type TxSourceDebug struct {
+	Window    int64   `json:"window"`
+	MinWindow int64   `json:"minwindow"`
+	NumTxs    int     `json:"numtxs"`
+	R         float64 `json:"r"`
+	Decay     float64 `json:"decay"`
+	TxRate    float64 `json:"txrate"`
+	PrevTime  int64   `json:"prevtime"`
+}
+
+func (c *Client) TxSourceDebug() (TxSourceDebug, error) {
+	r, err := c.doRPC("txsourcedebug", nil)
+	if err != nil {
+		return TxSourceDebug{}, err
+	}
+
+	var result TxSourceDebug
+	if err := json.Unmarshal(r, &result); err != nil {
+		return TxSourceDebug{}, err
+	}
+	return result, nil
+}
+
+// SimFloors are the fee rate floors (satoshis/kB) of the last sim.
+type SimFloors struct {
+	StableFee     int64 `json:"stablefee"`
+	LowestFeeRate int64 `json:"lowestfeerate"`
+	Floor         int64 `json:"floor"`
+}
+
+func (c *Client) SimFloors() (SimFloors, error) {
+	r, err := c.doRPC("simfloors", nil)
+	if err != nil {
+		return SimFloors{}, err
+	}
+
+	var result SimFloors
+	if err := json.Unmarshal(r, &result); err != nil {
+		return SimFloors{}, err
+	}
+	return result, nil
+}
+
+// StableFee returns the stable fee rate (BTC/kB) of the tx and block sources.
+func (c *Client) StableFee() (float64, error) {
+	r, err := c.doRPC("stablefee", nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var stablefee float64
+	if err := json.Unmarshal(r, &stablefee); err != nil {
+		return 0, err
+	}
+	return stablefee, nil
+}
+
+func (c *Client) LatestBlockStat() (*est.BlockStat, error) {
+	r, err := c.doRPC("latestblockstat", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var result est.BlockStat
+	if err := json.Unmarshal(r, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// MethodInfo describes an RPC method: its description, and the JSON shapes of
+// its args and reply.
+type MethodInfo struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Args        json.RawMessage `json:"args"`
+	Reply       json.RawMessage `json:"reply"`
+}
+
+func (c *Client) Methods() ([]MethodInfo, error) {
+	r, err := c.doRPC("methods", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var methods []MethodInfo
+	if err := json.Unmarshal(r, &methods); err != nil {
+		return nil, err
+	}
+	return methods, nil
+}
+
+func (c *Client) Utilization(feerates []int64) (map[string]interface{}, error) {
+	if feerates == nil {
+		feerates = []int64{}
+	}
+	r, err := c.doRPC("utilization", feerates)
+	if err != nil {
+		return nil, err
+	}
+
+	v := make(map[string]interface{})
+	if err := json.Unmarshal(r, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (c *Client) CollectorErrors() ([]col.CollectorError, error) {
+	r, err := c.doRPC("collectorerrors", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []col.CollectorError
+	if err := json.Unmarshal(r, &errs); err != nil {
+		return nil, err
+	}
+	return errs, nil
+}
+
+// BlockRate returns the estimated block rate in blocks/hour.
+func (c *Client) BlockRate() (float64, error) {
+	r, err := c.doRPC("blockrate", nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var blockrate float64
+	if err := json.Unmarshal(r, &blockrate); err != nil {
+		return 0, err
+	}
+	return blockrate, nil
+}
+
 func (c *Client) MempoolState() (*col.MempoolState, error) {
 	// This depends on the corerpc implementation of col.MempoolEntry
 	r, err := c.doRPC("mempoolstate", nil)
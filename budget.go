@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/bitcoinfees/feesim/sim"
+)
+
+// Rough per-item memory footprints in bytes, for the memory budget.
+const (
+	simTxBytes    = 128 // Per mempool tx, per sim copy
+	sampleTxBytes = 32  // Per tx source sample tx, per sim copy
+
+	// The tx source is not downsampled below this size.
+	minSampleSize = 1000
+)
+
+// memoryPlan is the size of a transient sim run, for the purposes of the
+// memory budget.
+type memoryPlan struct {
+	NumProcs    int
+	SampleSize  int
+	MempoolSize int
+}
+
+// footprint returns the coarse memory footprint estimate of p, in bytes.
+func (p memoryPlan) footprint() int64 {
+	return int64(p.NumProcs) * p.perProc()
+}
+
+func (p memoryPlan) perProc() int64 {
+	return int64(p.MempoolSize)*simTxBytes + int64(p.SampleSize)*sampleTxBytes
+}
+
+// fitMemoryBudget adapts p so that its footprint is within budget (bytes), by
+// first reducing NumProcs, then downsampling the tx source (to no fewer than
+// minSampleSize txs), and finally trimming the mempool. It returns the adapted
+// plan, along with a description of each adaptation.
+func fitMemoryBudget(p memoryPlan, budget int64) (memoryPlan, []string) {
+	var adapted []string
+	if budget <= 0 || p.footprint() <= budget {
+		return p, nil
+	}
+
+	if n := int(budget / p.perProc()); n < p.NumProcs {
+		if n < 1 {
+			n = 1
+		}
+		adapted = append(adapted, fmt.Sprintf("numprocs reduced from %d to %d", p.NumProcs, n))
+		p.NumProcs = n
+	}
+	perProcBudget := budget / int64(p.NumProcs)
+
+	if p.footprint() > budget {
+		n := int((perProcBudget - int64(p.MempoolSize)*simTxBytes) / sampleTxBytes)
+		if n < minSampleSize {
+			n = minSampleSize
+		}
+		if n < p.SampleSize {
+			adapted = append(adapted, fmt.Sprintf(
+				"tx source downsampled from %d to %d txs", p.SampleSize, n))
+			p.SampleSize = n
+		}
+	}
+
+	if p.footprint() > budget {
+		n := int((perProcBudget - int64(p.SampleSize)*sampleTxBytes) / simTxBytes)
+		if n < 0 {
+			n = 0
+		}
+		adapted = append(adapted, fmt.Sprintf(
+			"mempool trimmed from %d to %d txs", p.MempoolSize, n))
+		p.MempoolSize = n
+	}
+	return p, adapted
+}
+
+// trimMempool returns the txs with the highest fee rates, at most n of them,
+// along with the lowest fee rate for which the trimmed mempool is complete.
+func trimMempool(txs []*sim.Tx, n int) ([]*sim.Tx, sim.FeeRate) {
+	if n >= len(txs) {
+		return txs, 0
+	}
+	feerates := make([]sim.FeeRate, len(txs))
+	for i, tx := range txs {
+		feerates[i] = tx.FeeRate
+	}
+	sort.Sort(sort.Reverse(feeRateSlice(feerates)))
+	// All txs with fee rate equal to the first excluded one are excluded too.
+	cutoff := feerates[n] + 1
+	var trimmed []*sim.Tx
+	for _, tx := range txs {
+		if tx.FeeRate >= cutoff {
+			trimmed = append(trimmed, tx)
+		}
+	}
+	return trimmed, cutoff
+}
+
+type feeRateSlice []sim.FeeRate
+
+func (s feeRateSlice) Len() int {
+	return len(s)
+}
+
+func (s feeRateSlice) Less(i, j int) bool {
+	return s[i] < s[j]
+}
+
+func (s feeRateSlice) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
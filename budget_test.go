@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/bitcoinfees/feesim/sim"
+	"github.com/bitcoinfees/feesim/testutil"
+)
+
+func TestFitMemoryBudget(t *testing.T) {
+	p := memoryPlan{NumProcs: 4, SampleSize: 100000, MempoolSize: 50000}
+	perProc := int64(50000*simTxBytes + 100000*sampleTxBytes)
+
+	for _, tc := range []struct {
+		budget     int64
+		ref        memoryPlan
+		numAdapted int
+	}{
+		// No budget, or within budget
+		{0, p, 0},
+		{4 * perProc, p, 0},
+		// Fewer procs
+		{2*perProc + 1, memoryPlan{2, 100000, 50000}, 1},
+		// One proc, downsampled
+		{50000*simTxBytes + 2000*sampleTxBytes, memoryPlan{1, 2000, 50000}, 2},
+		// One proc, min sample size, trimmed mempool
+		{10000*simTxBytes + minSampleSize*sampleTxBytes, memoryPlan{1, minSampleSize, 10000}, 3},
+		// Budget too small for even the min sample
+		{1, memoryPlan{1, minSampleSize, 0}, 3},
+	} {
+		adaptedPlan, adapted := fitMemoryBudget(p, tc.budget)
+		t.Log(adapted)
+		if err := testutil.CheckEqual(adaptedPlan, tc.ref); err != nil {
+			t.Error(err)
+		}
+		if err := testutil.CheckEqual(len(adapted), tc.numAdapted); err != nil {
+			t.Error(err)
+		}
+		if tc.budget >= minSampleSize*sampleTxBytes && adaptedPlan.footprint() > tc.budget {
+			t.Errorf("footprint %d exceeds budget %d", adaptedPlan.footprint(), tc.budget)
+		}
+	}
+}
+
+func TestTrimMempool(t *testing.T) {
+	var txs []*sim.Tx
+	for _, f := range []sim.FeeRate{5000, 20000, 10000, 10000, 30000, 1000} {
+		txs = append(txs, &sim.Tx{FeeRate: f, Size: 250})
+	}
+	feerates := func(txs []*sim.Tx) []sim.FeeRate {
+		var f []sim.FeeRate
+		for _, tx := range txs {
+			f = append(f, tx.FeeRate)
+		}
+		return f
+	}
+
+	for _, tc := range []struct {
+		n         int
+		ref       []sim.FeeRate
+		cutoffRef sim.FeeRate
+	}{
+		{6, []sim.FeeRate{5000, 20000, 10000, 10000, 30000, 1000}, 0},
+		{2, []sim.FeeRate{20000, 30000}, 10001},
+		// Txs with fee rate equal to the boundary are all excluded
+		{3, []sim.FeeRate{20000, 30000}, 10001},
+		{4, []sim.FeeRate{20000, 10000, 10000, 30000}, 5001},
+		{0, nil, 30001},
+	} {
+		trimmed, cutoff := trimMempool(txs, tc.n)
+		if err := testutil.CheckEqual(feerates(trimmed), tc.ref); err != nil {
+			t.Error(err)
+		}
+		if err := testutil.CheckEqual(cutoff, tc.cutoffRef); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestFeeSimFitMemoryBudget(t *testing.T) {
+	var logbuf bytes.Buffer
+	s := &FeeSim{cfg: FeeSimConfig{MemoryBudget: 1, logger: log.New(&logbuf, "", 0)}}
+
+	feerates := make([]sim.FeeRate, 100000)
+	sizes := make([]sim.TxSize, len(feerates))
+	for i := range feerates {
+		feerates[i], sizes[i] = sim.FeeRate(i), 250
+	}
+	txsource := sim.NewUniTxSource(feerates, sizes, 1)
+	var initmempool []*sim.Tx
+	for i := 0; i < 10000; i++ {
+		initmempool = append(initmempool, &sim.Tx{FeeRate: sim.FeeRate(i), Size: 250})
+	}
+
+	transientCfg := sim.TransientConfig{NumProcs: 4}
+	txsrc, trimmed, cutoff := s.fitMemoryBudget(&transientCfg, txsource, initmempool, 1000)
+	t.Log(logbuf.String())
+	if err := testutil.CheckEqual(transientCfg.NumProcs, 1); err != nil {
+		t.Error(err)
+	}
+	// 1MB: 1000 sample txs leave room for (2^20 - 32000) / 128 == 7942 mempool txs.
+	if err := testutil.CheckEqual(txsrc.(sim.SampledTxSource).SampleSize(), minSampleSize); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(len(trimmed), 7942); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(cutoff, sim.FeeRate(10000-7942)); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(strings.Count(logbuf.String(), "[WARNING]"), 3); err != nil {
+		t.Error(err)
+	}
+
+	// Within budget; nothing changes.
+	logbuf.Reset()
+	transientCfg = sim.TransientConfig{NumProcs: 1}
+	txsrc, trimmed, cutoff = s.fitMemoryBudget(&transientCfg, txsource.Downsample(1000), initmempool[:10], 1000)
+	if err := testutil.CheckEqual(len(trimmed), 10); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(cutoff, sim.FeeRate(1000)); err != nil {
+		t.Error(err)
+	}
+	if logbuf.Len() > 0 {
+		t.Error("nothing should be logged:", logbuf.String())
+	}
+}
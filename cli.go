@@ -1,14 +1,27 @@
 package main
 
 import (
+	"bytes"
+	"encoding/csv"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/bitcoinfees/feesim/api"
+	col "github.com/bitcoinfees/feesim/collect"
+	"github.com/bitcoinfees/feesim/collect/corerpc"
+	est "github.com/bitcoinfees/feesim/estimate"
+	"github.com/bitcoinfees/feesim/predict"
+	"github.com/bitcoinfees/feesim/sim"
 )
 
 func stop(args []string, c *api.Client) {
@@ -31,7 +44,7 @@ Stop the program.
 	}
 }
 
-func status(args []string, c *api.Client) {
+func status(args []string, c *api.Client, jsonOut bool) {
 	const usage = `
 feesim status
 
@@ -58,18 +71,52 @@ Show application status:
 	if err != nil {
 		log.Fatal(err)
 	}
+	if jsonOut {
+		printJSON(result)
+		return
+	}
 
 	for _, k := range []string{"result", "txsource", "blocksource", "mempool"} {
 		fmt.Printf("%-12s: %s\n", k, result[k])
 	}
 }
 
-func estimateFee(args []string, c *api.Client) {
+// simc is the client used for -mode, which runs a sim on demand.
+func estimateFee(args []string, c, simc *api.Client, defaultTarget int, jsonOut bool) {
 	const usage = `
-feesim estimatefee [N]
+feesim estimatefee [-info] [-ci] [-clamp] [-mode MODE] [-all] [N]
+feesim estimatefee -p PERCENTILES [-all] [N]
+feesim estimatefee -watch [-interval DURATION]
 
 Returns the required fee rate (in BTC/kB) for confirmation in N blocks.
-If N is omitted, give the result for all available N.
+If N is omitted, N is estimate.defaulttarget in the config, or if that's not
+set, give the result for all available N.
+
+With -all, give the result for all available N, even if
+estimate.defaulttarget is set.
+
+With -info, give the result for all N, along with the time of the last update
+and the estimated time of the next one.
+
+With -ci, give the result for all N, along with its 95 percent confidence
+interval (requires transient.withconfidence in the config).
+
+With -clamp, if N exceeds the max available target, give the result for the
+max available target instead (noting the target used).
+
+With -p, e.g. -p 0.5,0.8,0.95, give the result at each of those success
+percentiles instead of transient.minsuccesspct, to show how much more it costs
+to be surer of confirmation in N blocks: a row per percentile. For all N,
+there's a column per percentile instead, and a row per N.
+
+With -mode economical or -mode conservative, give the result for all N,
+assuming an optimistic or pessimistic block capacity respectively (see
+capacitypct in the config). This runs a sim on demand, so it may take a while.
+
+With -watch, give the result for all N every interval, clearing the screen
+each time, until interrupted. Errors (e.g. while Feesim restarts) are shown,
+and the next interval is tried regardless. It can't be combined with N, -json
+or the other options, except -interval.
 
 `
 	f := flag.NewFlagSet(args[0], flag.ExitOnError)
@@ -78,10 +125,92 @@ If N is omitted, give the result for all available N.
 		f.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "\n")
 	}
+	info := f.Bool("info", false, "Show the result update times.")
+	mode := f.String("mode", "default", "Estimate mode: economical, default or conservative.")
+	clamp := f.Bool("clamp", false, "Clamp N to the max available target.")
+	ci := f.Bool("ci", false, "Show the 95% confidence intervals.")
+	all := f.Bool("all", false, "Give the result for all N.")
+	pctList := f.String("p", "", "Comma-separated success percentiles in (0, 1].")
+	watch := f.Bool("watch", false, "Show the result for all N every interval.")
+	interval := f.Duration("interval", 30*time.Second, "With -watch, the refresh interval.")
 	if err := f.Parse(args[1:]); err != nil {
 		log.Fatal(err)
 	}
 
+	if *watch {
+		// -watch always gives the plain result for all N.
+		f.Visit(func(fl *flag.Flag) {
+			switch fl.Name {
+			case "watch", "interval", "all":
+			default:
+				log.Fatalf("-watch can't be used with -%s", fl.Name)
+			}
+		})
+		if jsonOut {
+			log.Fatal("-watch can't be used with -json")
+		}
+		if f.NArg() > 0 {
+			log.Fatal("-watch can't be used with N")
+		}
+		if *interval <= 0 {
+			log.Fatal("-interval must be > 0")
+		}
+		watchEstimateFee(c, *interval)
+		return
+	}
+
+	if *mode != "default" {
+		result, err := simc.EstimateFeeMode(*mode)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if jsonOut {
+			printJSON(result)
+			return
+		}
+		for i, feerate := range result {
+			fmt.Printf("%2d: %10.8f\n", i+1, feerate)
+		}
+		return
+	}
+
+	if *ci {
+		result, err := c.EstimateFeeBounds()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if jsonOut {
+			printJSON(result)
+			return
+		}
+		writeEstimateBounds(os.Stdout, result)
+		return
+	}
+
+	if *info {
+		result, err := c.EstimateFeeInfo()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if jsonOut {
+			printJSON(result)
+			return
+		}
+		for i, feerate := range result.FeeRates {
+			fmt.Printf("%2d: %10.8f\n", i+1, feerate)
+		}
+		fmt.Printf("Last update: %s\n", time.Unix(result.LastUpdate, 0).Format(time.RFC3339))
+		fmt.Printf("Next update: %s (every %ds)\n",
+			time.Unix(result.NextUpdate, 0).Format(time.RFC3339), result.RefreshInterval)
+		if result.Stale {
+			fmt.Println(staleNote)
+		}
+		if result.LowConfidence {
+			fmt.Println("Low confidence: the block source was estimated from the most recent blocks only.")
+		}
+		return
+	}
+
 	var n int
 	nStr := f.Arg(0)
 	if nStr != "" {
@@ -90,12 +219,56 @@ If N is omitted, give the result for all available N.
 		if err != nil {
 			log.Fatal(err)
 		}
+		if *all {
+			log.Fatal("-all can't be used with N")
+		}
+	}
+	n = estimateFeeTarget(n, defaultTarget, *all)
+
+	if *pctList != "" {
+		pcts, err := parsePercentiles(*pctList)
+		if err != nil {
+			log.Fatal(err)
+		}
+		result, err := c.EstimateFeePercentiles(n, pcts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if jsonOut {
+			printJSON(result)
+			return
+		}
+		writeEstimatePercentiles(os.Stdout, result, n)
+		return
+	}
+
+	if *clamp && n > 0 {
+		result, err := c.EstimateFeeClamped(n)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if jsonOut {
+			printJSON(result)
+			return
+		}
+		fmt.Printf("%10.8f\n", result.FeeRate)
+		if result.Stale {
+			fmt.Fprintln(os.Stderr, staleNote)
+		}
+		if result.Clamped {
+			fmt.Fprintf(os.Stderr, "Target clamped to the max available target %d.\n", result.Target)
+		}
+		return
 	}
 
 	result, err := c.EstimateFee(n)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if jsonOut {
+		printJSON(result)
+		return
+	}
 
 	if n == 0 {
 		result := result.([]interface{})
@@ -105,15 +278,180 @@ If N is omitted, give the result for all available N.
 	} else {
 		fmt.Printf("%10.8f\n", result.(float64))
 	}
+	// The reply doesn't say whether the result is stale (see staleresults in
+	// the config), so check separately.
+	if info, err := c.EstimateFeeInfo(); err == nil && info.Stale {
+		fmt.Fprintln(os.Stderr, staleNote)
+	}
+}
+
+// staleNote marks a stale estimate (see staleresults in the config).
+const staleNote = "Stale: the sim is paused or in progress; this is the last result."
+
+// watchEstimateFee prints the fee estimates of all targets every interval, until
+// interrupted.
+func watchEstimateFee(c *api.Client, interval time.Duration) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		result, err := c.EstimateFee(0)
+		fmt.Print(clearScreen)
+		writeEstimateWatch(os.Stdout, time.Now(), result, err)
+		select {
+		case <-ticker.C:
+		case <-sig:
+			return
+		}
+	}
+}
+
+// ANSI escape sequence to clear the terminal and move the cursor to the top.
+const clearScreen = "\033[H\033[2J"
+
+// writeEstimateWatch writes one cycle of estimatefee -watch: a timestamp
+// header, and the all-targets result of api.Client.EstimateFee, or its error.
+func writeEstimateWatch(w io.Writer, t time.Time, result interface{}, err error) {
+	fmt.Fprintf(w, "%s\n\n", t.Format(time.RFC3339))
+	if err != nil {
+		fmt.Fprintf(w, "Error: %v\n", err)
+		return
+	}
+	feerates, ok := result.([]interface{})
+	if !ok {
+		fmt.Fprintf(w, "Error: unexpected result %v\n", result)
+		return
+	}
+	for i, feerate := range feerates {
+		fmt.Fprintf(w, "%2d: %10.8f\n", i+1, feerate)
+	}
+}
+
+// writeEstimateBounds writes the fee estimate of each target along with its
+// confidence interval. An unbounded upper bound is shown as "inf".
+func writeEstimateBounds(w io.Writer, result api.EstimateFeeBounds) {
+	for i, feerate := range result.FeeRates {
+		upper := "inf"
+		if result.Upper[i] != -1 {
+			upper = fmt.Sprintf("%.8f", result.Upper[i])
+		}
+		fmt.Fprintf(w, "%2d: %10.8f [%10.8f, %10s]\n", i+1, feerate, result.Lower[i], upper)
+	}
+}
+
+// parsePercentiles parses the comma-separated percentiles of estimatefee -p.
+func parsePercentiles(s string) ([]float64, error) {
+	var pcts []float64
+	for _, field := range strings.Split(s, ",") {
+		pct, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid percentile %q", field)
+		}
+		if pct <= 0 || pct > 1 {
+			return nil, fmt.Errorf("percentile %v must be in (0, 1]", pct)
+		}
+		pcts = append(pcts, pct)
+	}
+	return pcts, nil
+}
+
+// writeEstimatePercentiles writes the result of estimatefee -p: for target
+// n > 0, a row per percentile, and for all targets (n == 0), a row per target
+// with a column per percentile.
+func writeEstimatePercentiles(w io.Writer, result api.EstimateFeePercentiles, n int) {
+	if n > 0 {
+		for k, pct := range result.Percentiles {
+			fmt.Fprintf(w, "%5s: %10.8f\n", formatPct(pct), result.FeeRates[k][0])
+		}
+		return
+	}
+	fmt.Fprint(w, "   ")
+	for _, pct := range result.Percentiles {
+		fmt.Fprintf(w, " %10s", formatPct(pct))
+	}
+	fmt.Fprintln(w)
+	if len(result.FeeRates) == 0 {
+		return
+	}
+	for i := range result.FeeRates[0] {
+		fmt.Fprintf(w, "%2d:", i+1)
+		for k := range result.Percentiles {
+			fmt.Fprintf(w, " %10.8f", result.FeeRates[k][i])
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// formatPct formats a fraction as a percentage, e.g. 0.5 as 50% and 0.955 as
+// 95.5%.
+func formatPct(pct float64) string {
+	return strconv.FormatFloat(pct*100, 'g', 4, 64) + "%"
+}
+
+// estimateFeeTarget returns the target of estimatefee, given the N argument
+// (0 if omitted): N if given, else defaultTarget unless all is set. 0 means
+// all targets.
+func estimateFeeTarget(n, defaultTarget int, all bool) int {
+	if n != 0 || all || defaultTarget <= 0 {
+		return n
+	}
+	return defaultTarget
+}
+
+func estimateFeeScenario(args []string, c *api.Client, jsonOut bool) {
+	const usage = `
+feesim estimatefeescenario MAXBLOCKSIZE
+
+Returns the required fee rate (in BTC/kB) for confirmation in N blocks, for all
+available N, assuming that all blocks have max size MAXBLOCKSIZE (bytes). This
+runs a sim on demand, so it may take a while.
+
+`
+	f := flag.NewFlagSet(args[0], flag.ExitOnError)
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage)
+		f.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+	if err := f.Parse(args[1:]); err != nil {
+		log.Fatal(err)
+	}
+
+	if f.NArg() != 1 {
+		f.Usage()
+		os.Exit(1)
+	}
+	maxBlockSize, err := strconv.ParseInt(f.Arg(0), 10, 64)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	result, err := c.EstimateFeeScenario(maxBlockSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if jsonOut {
+		printJSON(result)
+		return
+	}
+	for i, feerate := range result {
+		fmt.Printf("%2d: %10.8f\n", i+1, feerate)
+	}
 }
 
-func scores(args []string, c *api.Client) {
+func scores(args []string, c *api.Client, jsonOut bool) {
 	const usage = `
-feesim scores
+feesim scores [-byfee]
 
 Show prediction scores - the proportion of transactions which were confirmed
 within their predicted time, as a function of the predicted confirmation time.
 
+With -byfee, show the scores as a grid of predicted confirmation time (rows)
+by fee rate bucket (columns, labelled by the bucket lower bound in sats/kB).
+
 `
 	f := flag.NewFlagSet(args[0], flag.ExitOnError)
 	f.Usage = func() {
@@ -121,14 +459,32 @@ within their predicted time, as a function of the predicted confirmation time.
 		f.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "\n")
 	}
+	byFee := f.Bool("byfee", false, "Break down the scores by fee rate bucket.")
 	if err := f.Parse(args[1:]); err != nil {
 		log.Fatal(err)
 	}
 
+	if *byFee {
+		result, err := c.ScoresByFeeRate()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if jsonOut {
+			printJSON(result)
+			return
+		}
+		writeScoresGrid(os.Stdout, result)
+		return
+	}
+
 	result, err := c.Scores()
 	if err != nil {
 		log.Fatal(err)
 	}
+	if jsonOut {
+		printJSON(result)
+		return
+	}
 
 	for i, numAttained := range result["attained"] {
 		numTotal := result["exceeded"][i] + numAttained
@@ -137,14 +493,45 @@ within their predicted time, as a function of the predicted confirmation time.
 	}
 }
 
-func txRate(args []string, c *api.Client) {
+// writeScoresGrid writes the fee rate scores as a grid of the proportion
+// attained, with a row per conf target and a column per fee rate bucket.
+// Cells without any predicts are shown as "-".
+func writeScoresGrid(w io.Writer, scores api.FeeRateScores) {
+	fmt.Fprint(w, "   ")
+	for _, feerate := range scores.FeeRates {
+		fmt.Fprintf(w, " %7d", feerate)
+	}
+	fmt.Fprintln(w)
+	for i, row := range scores.Attained {
+		fmt.Fprintf(w, "%2d:", i+1)
+		for j, numAttained := range row {
+			numTotal := numAttained + scores.Exceeded[i][j]
+			if numTotal == 0 {
+				fmt.Fprintf(w, " %7s", "-")
+				continue
+			}
+			fmt.Fprintf(w, " %7.3f", numAttained/numTotal)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// defaultNumPoints is the number of points of the txrate, caprate and
+// mempoolsize output if numpoints isn't given.
+const defaultNumPoints = 20
+
+func txRate(args []string, c *api.Client, jsonOut bool) {
 	const usage = `
 feesim txrate [numpoints]
+feesim txrate -history [-since duration]
 
 Show the reverse cumulative tx byterate (bytes/s) as a function of fee rate (sats/kB).
 
 numpoints is an optional integer argument that specifies the number of points on the
-function to return.
+function to return (default 20); 0 means all the points.
+
+With -history, show the snapshots of the function over time instead, as CSV
+(requires ratehistoryretention in the config).
 
 `
 	f := flag.NewFlagSet(args[0], flag.ExitOnError)
@@ -153,11 +540,18 @@ function to return.
 		f.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "\n")
 	}
+	history := f.Bool("history", false, "Show the snapshots of the function over time.")
+	since := f.Duration("since", 24*time.Hour, "With -history, show the snapshots from this long ago.")
 	if err := f.Parse(args[1:]); err != nil {
 		log.Fatal(err)
 	}
 
-	var n int
+	if *history {
+		printRateHistory(c.TxRateHistory, *since, jsonOut)
+		return
+	}
+
+	n := defaultNumPoints
 	nStr := f.Arg(0)
 	if nStr != "" {
 		var err error
@@ -171,20 +565,28 @@ function to return.
 	if err != nil {
 		log.Fatal(err)
 	}
+	if jsonOut {
+		printJSON(result)
+		return
+	}
 
 	for i, feerate := range result["x"] {
 		fmt.Printf("%8d: %8.2f\n", int(feerate), result["y"][i])
 	}
 }
 
-func capRate(args []string, c *api.Client) {
+func capRate(args []string, c *api.Client, jsonOut bool) {
 	const usage = `
 feesim caprate [numpoints]
+feesim caprate -history [-since duration]
 
 Show the cumulative capacity byterate (bytes/s) as a function of fee rate (sats/kB).
 
 numpoints is an optional integer argument that specifies the number of points on the
-function to return.
+function to return (default 20); 0 means all the points.
+
+With -history, show the snapshots of the function over time instead, as CSV
+(requires ratehistoryretention in the config).
 
 `
 	f := flag.NewFlagSet(args[0], flag.ExitOnError)
@@ -193,11 +595,18 @@ function to return.
 		f.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "\n")
 	}
+	history := f.Bool("history", false, "Show the snapshots of the function over time.")
+	since := f.Duration("since", 24*time.Hour, "With -history, show the snapshots from this long ago.")
 	if err := f.Parse(args[1:]); err != nil {
 		log.Fatal(err)
 	}
 
-	var n int
+	if *history {
+		printRateHistory(c.CapRateHistory, *since, jsonOut)
+		return
+	}
+
+	n := defaultNumPoints
 	nStr := f.Arg(0)
 	if nStr != "" {
 		var err error
@@ -211,20 +620,71 @@ function to return.
 	if err != nil {
 		log.Fatal(err)
 	}
+	if jsonOut {
+		printJSON(result)
+		return
+	}
 
 	for i, feerate := range result["x"] {
 		fmt.Printf("%8d: %8.2f\n", int(feerate), result["y"][i])
 	}
 }
 
-func mempoolSize(args []string, c *api.Client) {
+// printRateHistory prints the rate history snapshots from since ago until now,
+// as CSV, or as JSON if jsonOut.
+func printRateHistory(get func(start, end int64) ([]api.RateHistory, error), since time.Duration,
+	jsonOut bool) {
+	start := time.Now().Add(-since).Unix()
+	if start < 0 {
+		start = 0
+	}
+	history, err := get(start, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if jsonOut {
+		printJSON(history)
+		return
+	}
+	if err := writeRateHistoryCSV(os.Stdout, history); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// writeRateHistoryCSV writes the rate history as CSV, with a row per point
+// of each snapshot, and a header row.
+func writeRateHistoryCSV(out io.Writer, history []api.RateHistory) error {
+	w := csv.NewWriter(out)
+	if err := w.Write([]string{"time", "feerate", "byterate"}); err != nil {
+		return err
+	}
+	for _, h := range history {
+		if len(h.X) != len(h.Y) {
+			return fmt.Errorf("time %d: mismatched x/y lengths %d/%d", h.Time, len(h.X), len(h.Y))
+		}
+		for i := range h.X {
+			record := []string{
+				strconv.FormatInt(h.Time, 10),
+				strconv.FormatFloat(h.X[i], 'f', -1, 64),
+				strconv.FormatFloat(h.Y[i], 'f', -1, 64),
+			}
+			if err := w.Write(record); err != nil {
+				return err
+			}
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func mempoolSize(args []string, c *api.Client, jsonOut bool) {
 	const usage = `
 feesim mempoolsize [numpoints]
 
 Show the cumulative mempool size (bytes) as a function of fee rate (sats/kB).
 
 numpoints is an optional integer argument that specifies the number of points on the
-function to return.
+function to return (default 20); 0 means all the points.
 
 `
 	f := flag.NewFlagSet(args[0], flag.ExitOnError)
@@ -237,7 +697,7 @@ function to return.
 		log.Fatal(err)
 	}
 
-	var n int
+	n := defaultNumPoints
 	nStr := f.Arg(0)
 	if nStr != "" {
 		var err error
@@ -251,12 +711,81 @@ function to return.
 	if err != nil {
 		log.Fatal(err)
 	}
+	if jsonOut {
+		printJSON(result)
+		return
+	}
 
 	for i, feerate := range result["x"] {
 		fmt.Printf("%8d: %9d\n", int(feerate), int(result["y"][i]))
 	}
 }
 
+func mempool(args []string, c *api.Client, jsonOut bool) {
+	const usage = `
+feesim [-json] mempool
+
+Show a summary of the current mempool state: the block height, the number of
+txs, their total size, and the mempool min fee rate (sats/kB).
+
+With -json, dump the full mempool state (including all the entries) as JSON.
+
+`
+	f := flag.NewFlagSet(args[0], flag.ExitOnError)
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage)
+		f.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+	if err := f.Parse(args[1:]); err != nil {
+		log.Fatal(err)
+	}
+
+	// The mempool is not available until the collector has polled Bitcoin
+	// Core successfully; the error says as much.
+	state, err := c.MempoolState()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if jsonOut {
+		printJSON(state)
+		return
+	}
+	writeMempoolSummary(os.Stdout, state)
+}
+
+// printJSON prints v as indented JSON, e.g. the decoded API response of a
+// command run with -json.
+func printJSON(v interface{}) {
+	if err := writeJSON(os.Stdout, v); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// writeJSON writes v to w as indented JSON, followed by a newline.
+func writeJSON(w io.Writer, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(b))
+	return err
+}
+
+// writeMempoolSummary writes a summary of the mempool state to w.
+func writeMempoolSummary(w io.Writer, state *col.MempoolState) {
+	var size int64
+	for _, entry := range state.Entries {
+		size += int64(entry.Size())
+	}
+	fmt.Fprintf(w, "Height:     %d\n", state.Height)
+	fmt.Fprintf(w, "Time:       %s\n", time.Unix(state.Time, 0).Format(time.RFC3339))
+	fmt.Fprintf(w, "Txs:        %d\n", len(state.Entries))
+	fmt.Fprintf(w, "Size:       %d bytes\n", size)
+	fmt.Fprintf(w, "MinFeeRate: %d sats/kB\n", state.MinFeeRate)
+}
+
 func pause(args []string, c *api.Client) {
 	const usage = `
 feesim pause
@@ -348,11 +877,7 @@ Show app config settings.
 		log.Fatal(err)
 	}
 
-	b, err := json.MarshalIndent(result, "", "\t")
-	if err != nil {
-		log.Fatal(err)
-	}
-	fmt.Println(string(b))
+	printJSON(result)
 }
 
 func appMetrics(args []string, c *api.Client) {
@@ -377,9 +902,1134 @@ Show app metrics.
 		log.Fatal(err)
 	}
 
-	b, err := json.MarshalIndent(result, "", "\t")
+	printJSON(result)
+}
+
+func summary(args []string, c *api.Client) {
+	const usage = `
+feesim summary
+
+Show a summary of the fee market: the fee estimates (BTC/kB), mempool size
+(bytes), min fee rate (sats/kB), tx and capacity byterates (bytes/s), the sim
+stable fee rate (sats/kB) and the prediction scores.
+
+`
+	f := flag.NewFlagSet(args[0], flag.ExitOnError)
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage)
+		f.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+	if err := f.Parse(args[1:]); err != nil {
+		log.Fatal(err)
+	}
+
+	result, err := c.Summary()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	printJSON(result)
+}
+
+func nextBlockProb(args []string, c *api.Client, jsonOut bool) {
+	const usage = `
+feesim nextblockprob FEERATE
+
+Returns the estimated probability that a transaction with fee rate FEERATE
+(satoshis/kB) is confirmed in the next block.
+
+`
+	f := flag.NewFlagSet(args[0], flag.ExitOnError)
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage)
+		f.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+	if err := f.Parse(args[1:]); err != nil {
+		log.Fatal(err)
+	}
+
+	if f.NArg() != 1 {
+		f.Usage()
+		os.Exit(1)
+	}
+	feerate, err := strconv.ParseInt(f.Arg(0), 10, 64)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	p, err := c.NextBlockProb(feerate)
 	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Println(string(b))
+	if jsonOut {
+		printJSON(p)
+		return
+	}
+	fmt.Printf("%.4f\n", p)
+}
+
+func confTime(args []string, c *api.Client, jsonOut bool) {
+	const usage = `
+feesim conftime FEERATE
+
+Returns the estimated time to confirmation of a transaction with fee rate
+FEERATE (satoshis/kB): the median, and the time within which it's confirmed
+with probability transient.minsuccesspct.
+
+`
+	f := flag.NewFlagSet(args[0], flag.ExitOnError)
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage)
+		f.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+	if err := f.Parse(args[1:]); err != nil {
+		log.Fatal(err)
+	}
+
+	if f.NArg() != 1 {
+		f.Usage()
+		os.Exit(1)
+	}
+	feerate, err := strconv.ParseInt(f.Arg(0), 10, 64)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	t, err := c.ConfTimeSeconds(feerate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if jsonOut {
+		printJSON(t)
+		return
+	}
+	fmt.Printf("Median: %s\n", formatMinutes(t.Median))
+	fmt.Printf("%.0f%%: %s\n", t.SuccessPct*100, formatMinutes(t.Percentile))
+}
+
+// formatMinutes formats a time in seconds as approximate minutes; negative
+// times are unattainable within the simulated number of blocks.
+func formatMinutes(seconds float64) string {
+	if seconds < 0 {
+		return "beyond the max simulated blocks"
+	}
+	return fmt.Sprintf("≈ %.0f minutes", seconds/60)
+}
+
+func utilization(args []string, c *api.Client) {
+	const usage = `
+feesim utilization [FEERATE...]
+
+Show the ratio of the tx byterate to the capacity byterate, at the mempool min
+fee rate, and at each of the optionally specified fee rates (sats/kB). When the
+ratio approaches 1, fees are about to spike.
+
+`
+	f := flag.NewFlagSet(args[0], flag.ExitOnError)
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage)
+		f.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+	if err := f.Parse(args[1:]); err != nil {
+		log.Fatal(err)
+	}
+
+	feerates := make([]int64, f.NArg())
+	for i, arg := range f.Args() {
+		var err error
+		feerates[i], err = strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	result, err := c.Utilization(feerates)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	printJSON(result)
+}
+
+func collectorErrors(args []string, c *api.Client, jsonOut bool) {
+	const usage = `
+feesim collectorerrors
+
+Show the most recent collector errors (i.e. errors polling Bitcoin Core), with
+their times.
+
+`
+	f := flag.NewFlagSet(args[0], flag.ExitOnError)
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage)
+		f.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+	if err := f.Parse(args[1:]); err != nil {
+		log.Fatal(err)
+	}
+
+	errs, err := c.CollectorErrors()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if jsonOut {
+		printJSON(errs)
+		return
+	}
+	for _, e := range errs {
+		fmt.Printf("%s: %s\n", time.Unix(e.Time, 0).Format(time.RFC3339), e.Error)
+	}
+}
+
+func export(args []string, c *api.Client) {
+	const usage = `
+feesim export -what caprate|txrate|mempoolsize [-format csv] [-n numpoints]
+
+Export a fee rate (sats/kB) function, e.g. for spreadsheet analysis. The
+function y values are as in the caprate, txrate and mempoolsize commands.
+
+To export the stored block stats, see feesim export blockstats -h.
+
+`
+	f := flag.NewFlagSet(args[0], flag.ExitOnError)
+	what := f.String("what", "", "function to export: caprate, txrate or mempoolsize")
+	format := f.String("format", "csv", "output format (only csv is supported)")
+	n := f.Int("n", 0, "number of points on the function; 0 means all")
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage)
+		f.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+	if err := f.Parse(args[1:]); err != nil {
+		log.Fatal(err)
+	}
+	if *format != "csv" {
+		log.Fatalf("Invalid format '%s'", *format)
+	}
+
+	var (
+		result map[string][]float64
+		err    error
+	)
+	switch *what {
+	case "caprate":
+		result, err = c.CapRate(*n)
+	case "txrate":
+		result, err = c.TxRate(*n)
+	case "mempoolsize":
+		result, err = c.MempoolSize(*n)
+	default:
+		f.Usage()
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := writeCSV(os.Stdout, result, "feerate", *what); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func exportBlockStats(args []string, cfg config) {
+	const usage = `
+feesim export blockstats -start H1 -end H2 [-o FILE]
+
+Export the stored block stats with heights in [H1, H2] as CSV, e.g. for
+offline analysis, to FILE, or stdout if FILE is "-". The block stat DB is
+opened read-only, so the app must not be running.
+
+`
+	f := flag.NewFlagSet(args[0], flag.ExitOnError)
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage)
+		f.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+	start := f.Int64("start", -1, "First block height.")
+	end := f.Int64("end", -1, "Last block height.")
+	outFile := f.String("o", "-", "Output file, or - for stdout.")
+	if err := f.Parse(args[1:]); err != nil {
+		log.Fatal(err)
+	}
+	if *start < 0 || *end < *start {
+		f.Usage()
+		os.Exit(1)
+	}
+
+	blkdb, err := loadBlockStatDBReadOnly(cfg)
+	if err != nil {
+		log.Fatal(fmt.Errorf("loadBlockStatDBReadOnly: %v", err))
+	}
+	defer blkdb.Close()
+
+	out := os.Stdout
+	if *outFile != "-" {
+		if out, err = os.Create(*outFile); err != nil {
+			blkdb.Close()
+			log.Fatal(err)
+		}
+	}
+	n, err := writeBlockStatsCSV(out, blkdb, *start, *end, blockStatsChunk)
+	if err == nil && out != os.Stdout {
+		err = out.Close()
+	}
+	if err != nil {
+		blkdb.Close()
+		log.Fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "%d block stats exported.\n", n)
+}
+
+// Number of block heights to Get at a time in writeBlockStatsCSV.
+const blockStatsChunk = 1000
+
+// writeBlockStatsCSV writes the block stats with heights in [start, end] as
+// CSV, with a header row. They're read chunk heights at a time, so that large
+// ranges aren't loaded into memory at once. Returns the number of stats
+// written.
+func writeBlockStatsCSV(out io.Writer, blkdb est.BlockStatDB, start, end, chunk int64) (int, error) {
+	w := csv.NewWriter(out)
+	header := []string{"height", "time", "size", "numhashes", "mempoolsize",
+		"mempoolsizeremain", "sfr", "ak", "an", "bk", "bn", "nosfr"}
+	if err := w.Write(header); err != nil {
+		return 0, err
+	}
+	var n int
+	for lo := start; lo <= end; lo += chunk {
+		hi := end
+		if end-lo >= chunk {
+			hi = lo + chunk - 1
+		}
+		stats, err := blkdb.Get(lo, hi)
+		if err != nil {
+			return n, err
+		}
+		for _, s := range stats {
+			record := []string{
+				strconv.FormatInt(s.Height, 10),
+				strconv.FormatInt(s.Time, 10),
+				strconv.FormatInt(s.Size, 10),
+				strconv.FormatFloat(s.NumHashes, 'f', -1, 64),
+				strconv.FormatInt(s.MempoolSize, 10),
+				strconv.FormatInt(s.MempoolSizeRemain, 10),
+				strconv.FormatInt(int64(s.SFRStat.SFR), 10),
+				strconv.FormatInt(s.SFRStat.AK, 10),
+				strconv.FormatInt(s.SFRStat.AN, 10),
+				strconv.FormatInt(s.SFRStat.BK, 10),
+				strconv.FormatInt(s.SFRStat.BN, 10),
+				strconv.FormatBool(s.NoSFR),
+			}
+			if err := w.Write(record); err != nil {
+				return n, err
+			}
+			n++
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return n, err
+		}
+		if hi == end {
+			// Avoids overflow if end is near math.MaxInt64
+			break
+		}
+	}
+	return n, nil
+}
+
+// writeCSV writes the {x,y} points of a function as CSV, with a header row.
+func writeCSV(out io.Writer, fn map[string][]float64, xname, yname string) error {
+	x, y := fn["x"], fn["y"]
+	if len(x) != len(y) {
+		return fmt.Errorf("mismatched x/y lengths %d/%d", len(x), len(y))
+	}
+	w := csv.NewWriter(out)
+	if err := w.Write([]string{xname, yname}); err != nil {
+		return err
+	}
+	for i := range x {
+		record := []string{
+			strconv.FormatFloat(x[i], 'f', -1, 64),
+			strconv.FormatFloat(y[i], 'f', -1, 64),
+		}
+		if err := w.Write(record); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func blockRate(args []string, c *api.Client, jsonOut bool) {
+	const usage = `
+feesim blockrate
+
+Show the block source's estimated block rate (blocks/hour), which reflects the
+network hashrate trend.
+
+`
+	f := flag.NewFlagSet(args[0], flag.ExitOnError)
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage)
+		f.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+	if err := f.Parse(args[1:]); err != nil {
+		log.Fatal(err)
+	}
+
+	blockrate, err := c.BlockRate()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if jsonOut {
+		printJSON(blockrate)
+		return
+	}
+	fmt.Printf("%.4f\n", blockrate)
+}
+
+func simFloors(args []string, c *api.Client, jsonOut bool) {
+	const usage = `
+feesim simfloors
+
+Show the fee rate floors (satoshis/kB) of the last sim, below which no estimate
+is returned: the stable fee rate (tx arrivals below it are discarded, since
+they'd exceed the spare capacity), and the mempool trimming cutoff (lower fee
+txs don't affect confirmation within transient.maxblockconfirms).
+
+`
+	f := flag.NewFlagSet(args[0], flag.ExitOnError)
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage)
+		f.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+	if err := f.Parse(args[1:]); err != nil {
+		log.Fatal(err)
+	}
+
+	floors, err := c.SimFloors()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if jsonOut {
+		printJSON(floors)
+		return
+	}
+	fmt.Printf("Stable fee:  %d\n", floors.StableFee)
+	fmt.Printf("Cutoff:      %d\n", floors.LowestFeeRate)
+	fmt.Printf("Floor:       %d\n", floors.Floor)
+}
+
+func stableFee(args []string, c *api.Client, jsonOut bool) {
+	const usage = `
+feesim stablefee
+
+Returns the stable fee rate (in BTC/kB) of the current tx and block sources,
+i.e. a "minimum fee to ever confirm" indicator: tx arrivals with a lower fee
+rate exceed the spare capacity, so they'd never clear. Unlike estimatefee, it
+doesn't depend on the mempool.
+
+`
+	f := flag.NewFlagSet(args[0], flag.ExitOnError)
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage)
+		f.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+	if err := f.Parse(args[1:]); err != nil {
+		log.Fatal(err)
+	}
+
+	stablefee, err := c.StableFee()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if jsonOut {
+		printJSON(stablefee)
+		return
+	}
+	fmt.Println(stablefee)
+}
+
+func latestBlockStat(args []string, c *api.Client) {
+	const usage = `
+feesim latestblockstat
+
+Show the stats of the latest block, as computed by the collector when it was
+found: the stranding fee rate (SFR) stats, the mempool size just before and
+after, the block size, and the expected number of hashes.
+
+`
+	f := flag.NewFlagSet(args[0], flag.ExitOnError)
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage)
+		f.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+	if err := f.Parse(args[1:]); err != nil {
+		log.Fatal(err)
+	}
+
+	stat, err := c.LatestBlockStat()
+	if err != nil {
+		log.Fatal(err)
+	}
+	printJSON(stat)
+}
+
+func tune(args []string, cfg config, jsonOut bool) {
+	const usage = `
+feesim tune [-runs N] [-tol TOL] [-maxiters N]
+
+Recommend a transient.numiters setting. The sim is run repeatedly on the
+current mempool, with numiters doubling from 250 up to maxiters, until the fee
+estimates vary across runs by at most tol (i.e. their std dev is at most tol
+times their mean, for every target). This can take a while, during which the
+sim runs alongside the regular one.
+
+`
+	f := flag.NewFlagSet(args[0], flag.ExitOnError)
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage)
+		f.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+	runs := f.Int("runs", 5, "Number of runs per numiters.")
+	tol := f.Float64("tol", 0.05, "Max relative std dev of the estimates across runs.")
+	maxIters := f.Int("maxiters", 4*cfg.Transient.NumIters, "Max numiters to try.")
+	timeout := f.Int("timeout", 3600, "RPC timeout in seconds.")
+	if err := f.Parse(args[1:]); err != nil {
+		log.Fatal(err)
+	}
+
+	// The usual client timeout is too short.
+	c := api.NewClient(api.Config{
+		Host:    cfg.AppRPC.Host,
+		Port:    cfg.AppRPC.Port,
+		Timeout: *timeout,
+	})
+	result, err := c.Tune(*maxIters, *runs, *tol)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if jsonOut {
+		printJSON(result)
+		return
+	}
+	for _, level := range result.Levels {
+		fmt.Printf("%8d: %6.2f%%\n", level.NumIters, level.RelStdDev*100)
+	}
+	if result.Recommended == 0 {
+		fmt.Printf("None of the numiters were stable enough; try a larger -maxiters.\n")
+		return
+	}
+	fmt.Printf("Recommended numiters: %d (currently %d)\n", result.Recommended, result.Current)
+}
+
+func trim(args []string, cfg config) {
+	const usage = `
+feesim trim [-blockstats-before H] [-txs-before T] [-force]
+
+Delete the block stats of heights before H, and the txs with Unix times before
+T, from the running Feesim's DBs, and show how many were removed. The DB files
+are compacted after a large delete. Deleting block stats within
+indblock.window blocks of the current height requires -force, since the block
+source estimate would have less data.
+
+`
+	f := flag.NewFlagSet(args[0], flag.ExitOnError)
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage)
+		f.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+	blockStatsBefore := f.Int64("blockstats-before", 0, "Delete the block stats of heights before this (0 for none).")
+	txsBefore := f.Int64("txs-before", 0, "Delete the txs with Unix times before this (0 for none).")
+	force := f.Bool("force", false, "Delete block stats even within indblock.window of the current height.")
+	timeout := f.Int("timeout", 600, "RPC timeout in seconds.")
+	if err := f.Parse(args[1:]); err != nil {
+		log.Fatal(err)
+	}
+	if *blockStatsBefore <= 0 && *txsBefore <= 0 {
+		f.Usage()
+		log.Fatal("nothing to trim; specify -blockstats-before and/or -txs-before")
+	}
+
+	// Compaction can take longer than the usual client timeout.
+	c := api.NewClient(api.Config{
+		Host:    cfg.AppRPC.Host,
+		Port:    cfg.AppRPC.Port,
+		Timeout: *timeout,
+	})
+	result, err := c.Trim(*blockStatsBefore, *txsBefore, *force)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Removed %d block stats and %d txs.\n", result.BlockStats, result.Txs)
+	if result.Compacted {
+		fmt.Println("DB files compacted.")
+	}
+}
+
+func txSourceDebug(args []string, c *api.Client, jsonOut bool) {
+	const usage = `
+feesim txsourcedebug
+
+Show the tx source estimator's internal state: the accumulated window, the
+number of txs in the reservoir, the decayed tx count r, and the resulting tx
+rate. Useful for diagnosing a tx rate estimate that looks off, or a window
+that's too small for estimation.
+
+`
+	f := flag.NewFlagSet(args[0], flag.ExitOnError)
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage)
+		f.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+	if err := f.Parse(args[1:]); err != nil {
+		log.Fatal(err)
+	}
+
+	state, err := c.TxSourceDebug()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if jsonOut {
+		printJSON(state)
+		return
+	}
+	fmt.Printf("Window:   %ds (min %ds)\n", state.Window, state.MinWindow)
+	fmt.Printf("Txs:      %d\n", state.NumTxs)
+	fmt.Printf("r:        %.2f\n", state.R)
+	fmt.Printf("Decay:    %.8f/s\n", state.Decay)
+	fmt.Printf("Tx rate:  %.4f tx/s\n", state.TxRate)
+	if state.PrevTime > 0 {
+		fmt.Printf("Last tx:  %s\n", time.Unix(state.PrevTime, 0).Format(time.RFC3339))
+	}
+	if state.Window < state.MinWindow {
+		fmt.Println("Window is below the min; the tx source can't be estimated yet.")
+	}
+}
+
+func configDiff(args []string) {
+	const usage = `
+feesim configdiff CONFIGFILE_A CONFIGFILE_B
+
+Show the effective differences between two config files, after defaults are
+applied.
+
+`
+	f := flag.NewFlagSet(args[0], flag.ExitOnError)
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage)
+		f.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+	if err := f.Parse(args[1:]); err != nil {
+		log.Fatal(err)
+	}
+	if f.NArg() != 2 {
+		f.Usage()
+		os.Exit(1)
+	}
+
+	a, err := loadConfig(f.Arg(0), "", "")
+	if err != nil {
+		log.Fatal(err)
+	}
+	b, err := loadConfig(f.Arg(1), "", "")
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, d := range diffConfig(a, b) {
+		fmt.Println(d)
+	}
+}
+
+func validate(args []string, cfg config) {
+	const usage = `
+feesim validate
+
+Check the config for problems, without starting the app: that the settings are
+in range, that bitcoind is reachable with the bitcoinrpc settings, and that the
+datadir is writable. The DBs aren't touched. Prints OK, or the problems found
+(and exits with status 1).
+
+`
+	f := flag.NewFlagSet(args[0], flag.ExitOnError)
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage)
+		f.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+	if err := f.Parse(args[1:]); err != nil {
+		log.Fatal(err)
+	}
+
+	errs := cfg.Validate()
+	// Report an unreachable node straight away, instead of after the retries.
+	rpcCfg := cfg.BitcoinRPC
+	rpcCfg.MaxRetries = 0
+	if err := corerpc.CheckConnection(rpcCfg); err != nil {
+		errs = append(errs, fmt.Errorf("bitcoinrpc: %v", err))
+	}
+	if err := checkDataDir(cfg.DataDir); err != nil {
+		errs = append(errs, err)
+	}
+	if !writeProblems(os.Stdout, errs) {
+		os.Exit(1)
+	}
+}
+
+// writeProblems writes OK if there are no errs, or else each of them, and
+// returns whether there were none.
+func writeProblems(w io.Writer, errs []error) bool {
+	if len(errs) == 0 {
+		fmt.Fprintln(w, "OK")
+		return true
+	}
+	for _, err := range errs {
+		fmt.Fprintf(w, "- %v\n", err)
+	}
+	return false
+}
+
+func rebuildBlockStats(args []string, cfg config) {
+	const usage = `
+feesim rebuild-blockstats -from H1 -to H2
+
+Re-fetch the blocks with heights in [H1, H2] from Bitcoin Core, and recompute
+their sizes and hash counts in the block stats DB. The app must not be running.
+
+This is only a partial rebuild: the SFR stats and mempool sizes can't be
+recomputed, since the mempool history isn't stored. The rebuilt stats are
+marked as SFR-less, and are only used to estimate the block rate.
+
+`
+	f := flag.NewFlagSet(args[0], flag.ExitOnError)
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage)
+		f.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+	from := f.Int64("from", -1, "First block height.")
+	to := f.Int64("to", -1, "Last block height.")
+	if err := f.Parse(args[1:]); err != nil {
+		log.Fatal(err)
+	}
+	if *from < 0 || *to < *from {
+		f.Usage()
+		os.Exit(1)
+	}
+
+	if err := checkDataDir(cfg.DataDir); err != nil {
+		log.Fatal(err)
+	}
+	blkdb, err := loadBlockStatDB(cfg)
+	if err != nil {
+		log.Fatal(fmt.Errorf("loadBlockStatDB: %v", err))
+	}
+	defer blkdb.Close()
+	timeNow := func() int64 { return time.Now().Unix() }
+	_, getBlock, err := loadGetters(timeNow, cfg)
+	if err != nil {
+		blkdb.Close()
+		log.Fatal(err)
+	}
+	n, err := col.RebuildBlockStats(blkdb, getBlock, *from, *to)
+	fmt.Printf("%d block stats rebuilt.\n", n)
+	if err != nil {
+		blkdb.Close()
+		log.Fatal(err)
+	}
+}
+
+func verifySFR(args []string, cfg config) {
+	const usage = `
+feesim verify-sfr -from H1 -to H2 [-nofetch]
+
+Verify the block stats with heights in [H1, H2]: check that the stored SFR
+stats are internally consistent, and (unless -nofetch) re-fetch the blocks
+from Bitcoin Core and compare their sizes and hash counts with the stored
+ones. Discrepancies are listed. The app must not be running.
+
+The SFR stats themselves can't be recomputed, since the mempool history isn't
+stored.
+
+`
+	f := flag.NewFlagSet(args[0], flag.ExitOnError)
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage)
+		f.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+	from := f.Int64("from", -1, "First block height.")
+	to := f.Int64("to", -1, "Last block height.")
+	nofetch := f.Bool("nofetch", false, "Only check consistency; don't re-fetch the blocks.")
+	if err := f.Parse(args[1:]); err != nil {
+		log.Fatal(err)
+	}
+	if *from < 0 || *to < *from {
+		f.Usage()
+		os.Exit(1)
+	}
+
+	if err := checkDataDir(cfg.DataDir); err != nil {
+		log.Fatal(err)
+	}
+	blkdb, err := loadBlockStatDB(cfg)
+	if err != nil {
+		log.Fatal(fmt.Errorf("loadBlockStatDB: %v", err))
+	}
+	defer blkdb.Close()
+	var getBlock col.BlockGetter
+	if !*nofetch {
+		timeNow := func() int64 { return time.Now().Unix() }
+		if _, getBlock, err = loadGetters(timeNow, cfg); err != nil {
+			blkdb.Close()
+			log.Fatal(err)
+		}
+	}
+	n, discrepancies, err := col.VerifyBlockStats(blkdb, getBlock, *from, *to)
+	for _, d := range discrepancies {
+		fmt.Println(d)
+	}
+	fmt.Printf("%d block stats verified, %d discrepancies.\n", n, len(discrepancies))
+	if err != nil {
+		blkdb.Close()
+		log.Fatal(err)
+	}
+}
+
+func recomputeScores(args []string, cfg config) {
+	const usage = `
+feesim recomputescores [-halflife N]
+
+Recompute the prediction scores from the retained prediction outcomes (see
+predict.retainoutcomes in the config), and replace the stored scores. The
+app must not be running.
+
+This is useful after changing predict.halflife, predict.maxblockconfirms or
+predict.weightbysize; only the retained outcomes contribute to the new scores.
+
+`
+	f := flag.NewFlagSet(args[0], flag.ExitOnError)
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage)
+		f.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+	halflife := f.Int("halflife", cfg.Predict.Halflife, "Score decay halflife in blocks.")
+	if err := f.Parse(args[1:]); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := checkDataDir(cfg.DataDir); err != nil {
+		log.Fatal(err)
+	}
+	predictdb, err := loadPredictDB(cfg)
+	if err != nil {
+		log.Fatal(fmt.Errorf("loadPredictDB: %v", err))
+	}
+	defer predictdb.Close()
+	predictCfg := cfg.Predict
+	predictCfg.Halflife = *halflife
+	// Don't require retention to be on now; the outcomes might have been
+	// retained with an earlier config.
+	predictCfg.RetainOutcomes = 0
+	predictor, err := predict.NewPredictor(predictdb, predictCfg)
+	if err != nil {
+		predictdb.Close()
+		log.Fatal(err)
+	}
+	n, err := predictor.RecomputeScores()
+	if err != nil {
+		predictdb.Close()
+		log.Fatal(err)
+	}
+	fmt.Printf("Scores recomputed from %d outcomes.\n", n)
+}
+
+func eval(args []string, cfg config, jsonOut bool) {
+	const usage = `
+feesim eval [-from H] [-to H] [-fixed F] [-window W] [-successpct P]
+
+Evaluate the predicts over the retained prediction outcomes (see
+predict.retainoutcomes in the config) of the txs confirmed in blocks -from to
+-to. This shows the calibration, i.e. the fraction of the predicts of each
+target which confirmed in time, and the fees the txs paid at their fee rates
+(feesim's policy), compared with those they would have paid for their targets
+with a fixed fee rate policy and with a Core-like one, which pays the lowest
+fee rate that would have confirmed within the target in successpct of the
+windows of the previous W blocks, judging by the block stats' SFRs. The fees
+saved and overpaid relative to each are totaled tx by tx. Outcomes stored
+without a fee rate, by earlier versions, aren't compared. The app must not be
+running.
+
+`
+	f := flag.NewFlagSet(args[0], flag.ExitOnError)
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage)
+		f.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+	from := f.Int64("from", 0, "First confirmation height of the outcomes.")
+	to := f.Int64("to", 0, "Last confirmation height of the outcomes (0 for the latest).")
+	fixed := f.Int64("fixed", 20000, "Fee rate (satoshis/kB) of the fixed fee policy.")
+	window := f.Int64("window", 144, "Blocks of history of the Core-like policy.")
+	successPct := f.Float64("successpct", 0.85, "Success threshold of the Core-like policy.")
+	if err := f.Parse(args[1:]); err != nil {
+		log.Fatal(err)
+	}
+	if *to == 0 {
+		*to = math.MaxInt64
+	}
+	if *from < 0 || *to < *from {
+		log.Fatal("the blocks must satisfy 0 <= from <= to")
+	}
+	if *fixed <= 0 || *window < 1 || *successPct <= 0 || *successPct > 1 {
+		log.Fatal("fixed and window must be > 0, and successpct in (0, 1]")
+	}
+	evalCfg := evalConfig{
+		From:         *from,
+		To:           *to,
+		FixedFeeRate: sim.FeeRate(*fixed),
+		Window:       *window,
+		SuccessPct:   *successPct,
+		Predict:      cfg.Predict,
+	}
+
+	if err := checkDataDir(cfg.DataDir); err != nil {
+		log.Fatal(err)
+	}
+	txdb, blkdb, predictdb, err := loadDBs(cfg)
+	if err != nil {
+		log.Fatal(fmt.Errorf("loadDBs: %v", err))
+	}
+	txdb.Close()
+	outcomes, stats, err := loadEvalData(blkdb, predictdb, evalCfg)
+	blkdb.Close()
+	predictdb.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	result := evaluate(outcomes, stats, evalCfg)
+	if jsonOut {
+		printJSON(result)
+		return
+	}
+	writeEval(os.Stdout, result, evalCfg)
+}
+
+// loadEvalData returns the retained outcomes, and the block stats needed to
+// evaluate them (see evaluate).
+func loadEvalData(blkdb BlockStatDB, db predict.DB, cfg evalConfig) ([]predict.Outcome, []*est.BlockStat, error) {
+	odb, ok := db.(predict.OutcomeDB)
+	if !ok {
+		return nil, nil, fmt.Errorf("predict DB doesn't retain outcomes")
+	}
+	outcomes, err := odb.GetOutcomes()
+	if err != nil {
+		return nil, nil, err
+	}
+	stats, err := blkdb.Get(evalStatsStart(outcomes, cfg), cfg.To)
+	if err != nil {
+		return nil, nil, err
+	}
+	return outcomes, stats, nil
+}
+
+func exportState(args []string, cfg config) {
+	const usage = `
+feesim export-state FILE
+
+Export the estimator state, i.e. the stored txs, block stats, and prediction
+txs / scores / outcomes, to FILE (gzipped JSON), e.g. for moving feesim to
+another host with import-state, without having to collect data for hours. The
+app must not be running.
+
+`
+	f := flag.NewFlagSet(args[0], flag.ExitOnError)
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage)
+		f.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+	if err := f.Parse(args[1:]); err != nil {
+		log.Fatal(err)
+	}
+	if f.NArg() != 1 {
+		f.Usage()
+		os.Exit(1)
+	}
+
+	txdb, blkdb, predictdb, err := loadStateDBs(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeStateDBs(txdb, blkdb, predictdb)
+
+	// Write to a temp file first, so that a failed export doesn't clobber
+	// an existing archive.
+	file := f.Arg(0)
+	tmp := file + ".tmp"
+	w, err := os.Create(tmp)
+	if err != nil {
+		log.Fatal(err)
+	}
+	a, err := writeStateArchive(w, txdb, blkdb, predictdb)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		closeStateDBs(txdb, blkdb, predictdb)
+		log.Fatal(err)
+	}
+	fmt.Printf("Exported %d txs, %d block stats, %d prediction txs and %d outcomes.\n",
+		len(a.Txs), len(a.BlockStats), len(a.PredictTxs), len(a.Outcomes))
+}
+
+func importState(args []string, cfg config) {
+	const usage = `
+feesim import-state [-shift] FILE
+
+Import the estimator state from FILE, as written by export-state, into the DBs
+in the datadir. Existing data with the same keys (tx times, block heights,
+txids) is overwritten, and the prediction scores and retained outcomes are
+replaced. The app must not be running.
+
+The txs are discarded on start if the latest is older than txgaptol, so
+importing such a file is refused. With -shift, the tx times are instead
+shifted forward so that the latest is at the current time.
+
+`
+	f := flag.NewFlagSet(args[0], flag.ExitOnError)
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage)
+		f.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+	shift := f.Bool("shift", false, "Shift the tx times forward to the current time.")
+	if err := f.Parse(args[1:]); err != nil {
+		log.Fatal(err)
+	}
+	if f.NArg() != 1 {
+		f.Usage()
+		os.Exit(1)
+	}
+
+	r, err := os.Open(f.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer r.Close()
+	txdb, blkdb, predictdb, err := loadStateDBs(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeStateDBs(txdb, blkdb, predictdb)
+
+	a, err := readStateArchive(r, txdb, blkdb, predictdb, time.Now().Unix(), cfg.TxGapTol, *shift)
+	if err != nil {
+		closeStateDBs(txdb, blkdb, predictdb)
+		log.Fatal(err)
+	}
+	fmt.Printf("Imported %d txs, %d block stats, %d prediction txs and %d outcomes.\n",
+		len(a.Txs), len(a.BlockStats), len(a.PredictTxs), len(a.Outcomes))
+}
+
+// loadStateDBs loads the DBs for export-state / import-state.
+func loadStateDBs(cfg config) (TxDB, BlockStatDB, statePredictDB, error) {
+	if err := checkDataDir(cfg.DataDir); err != nil {
+		return nil, nil, nil, err
+	}
+	txdb, blkdb, db, err := loadDBs(cfg)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	predictdb, ok := db.(statePredictDB)
+	if !ok {
+		txdb.Close()
+		blkdb.Close()
+		db.Close()
+		return nil, nil, nil, fmt.Errorf("predict DB doesn't support exporting / importing")
+	}
+	return txdb, blkdb, predictdb, nil
+}
+
+func closeStateDBs(txdb TxDB, blkdb BlockStatDB, predictdb statePredictDB) {
+	txdb.Close()
+	blkdb.Close()
+	predictdb.Close()
+}
+
+func helpRPC(args []string, c *api.Client, jsonOut bool) {
+	const usage = `
+feesim help-rpc [METHOD]
+
+List the RPC methods of the running app, with their descriptions. If METHOD is
+given, also show the JSON shapes of its args and reply. Structs are shown as
+objects of their fields' shapes, slices as one-element arrays, and maps as
+objects keyed by the key type; "any" means the shape depends on the value.
+
+`
+	f := flag.NewFlagSet(args[0], flag.ExitOnError)
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage)
+		f.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+	if err := f.Parse(args[1:]); err != nil {
+		log.Fatal(err)
+	}
+
+	methods, err := c.Methods()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if f.NArg() == 0 {
+		if jsonOut {
+			printJSON(methods)
+			return
+		}
+		for _, m := range methods {
+			fmt.Printf("%-20s %s\n", m.Name, m.Description)
+		}
+		return
+	}
+	for _, m := range methods {
+		if m.Name != f.Arg(0) {
+			continue
+		}
+		if jsonOut {
+			printJSON(m)
+			return
+		}
+		fmt.Println(m.Description)
+		for _, shape := range []struct {
+			label string
+			raw   json.RawMessage
+		}{{"Args", m.Args}, {"Reply", m.Reply}} {
+			var b bytes.Buffer
+			if err := json.Indent(&b, shape.raw, "", "\t"); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("%s: %s\n", shape.label, b.String())
+		}
+		return
+	}
+	log.Fatalf("Invalid method '%s'", f.Arg(0))
 }
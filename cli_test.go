@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitcoinfees/feesim/api"
+	col "github.com/bitcoinfees/feesim/collect"
+	"github.com/bitcoinfees/feesim/collect/corerpc"
+	est "github.com/bitcoinfees/feesim/estimate"
+	"github.com/bitcoinfees/feesim/testutil"
+)
+
+func TestWriteCSV(t *testing.T) {
+	fn := map[string][]float64{
+		"x": {0, 5000, 10000, 20000},
+		"y": {1234.5, 1000.25, 500, 0},
+	}
+	var b bytes.Buffer
+	if err := writeCSV(&b, fn, "feerate", "txrate"); err != nil {
+		t.Fatal(err)
+	}
+	ref := "feerate,txrate\n0,1234.5\n5000,1000.25\n10000,500\n20000,0\n"
+	if err := testutil.CheckEqual(b.String(), ref); err != nil {
+		t.Error(err)
+	}
+
+	// Large values are not in exponent form
+	b.Reset()
+	fn = map[string][]float64{"x": {1e12}, "y": {12345678}}
+	if err := writeCSV(&b, fn, "feerate", "mempoolsize"); err != nil {
+		t.Fatal(err)
+	}
+	ref = "feerate,mempoolsize\n1000000000000,12345678\n"
+	if err := testutil.CheckEqual(b.String(), ref); err != nil {
+		t.Error(err)
+	}
+
+	fn = map[string][]float64{"x": {1, 2}, "y": {1}}
+	if err := writeCSV(&b, fn, "feerate", "caprate"); err == nil {
+		t.Error("mismatched lengths should return an error")
+	}
+}
+
+func TestEstimateFeeTarget(t *testing.T) {
+	for _, tc := range []struct {
+		n, defaultTarget int
+		all              bool
+		ref              int
+	}{
+		{0, 0, false, 0}, // All targets, as without a default target
+		{0, 0, true, 0},
+		{0, 2, false, 2}, // The default target
+		{0, 2, true, 0},  // -all overrides the default target
+		{3, 0, false, 3}, // N overrides the default target
+		{3, 2, false, 3},
+	} {
+		target := estimateFeeTarget(tc.n, tc.defaultTarget, tc.all)
+		if err := testutil.CheckEqual(target, tc.ref); err != nil {
+			t.Errorf("%+v: %v", tc, err)
+		}
+	}
+}
+
+func TestWriteEstimateBounds(t *testing.T) {
+	var b bytes.Buffer
+	writeEstimateBounds(&b, api.EstimateFeeBounds{
+		FeeRates: []float64{0.0002, 0.0001},
+		Lower:    []float64{0.00015, 0.00008},
+		Upper:    []float64{-1, 0.00012},
+	})
+	ref := ` 1: 0.00020000 [0.00015000,        inf]
+ 2: 0.00010000 [0.00008000, 0.00012000]
+`
+	if err := testutil.CheckEqual(b.String(), ref); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWriteEstimatePercentiles(t *testing.T) {
+	result := api.EstimateFeePercentiles{
+		Percentiles: []float64{0.5, 0.95},
+		FeeRates:    [][]float64{{0.0001, 0.00005}, {0.0003, -1}},
+	}
+	var b bytes.Buffer
+	writeEstimatePercentiles(&b, result, 0)
+	ref := `           50%        95%
+ 1: 0.00010000 0.00030000
+ 2: 0.00005000 -1.00000000
+`
+	if err := testutil.CheckEqual(b.String(), ref); err != nil {
+		t.Error(err)
+	}
+
+	result.FeeRates = [][]float64{{0.0001}, {0.0003}}
+	b.Reset()
+	writeEstimatePercentiles(&b, result, 1)
+	ref = `  50%: 0.00010000
+  95%: 0.00030000
+`
+	if err := testutil.CheckEqual(b.String(), ref); err != nil {
+		t.Error(err)
+	}
+
+	pcts, err := parsePercentiles("0.5, 0.8,0.95")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(pcts, []float64{0.5, 0.8, 0.95}); err != nil {
+		t.Error(err)
+	}
+	for _, s := range []string{"", "0.5,", "0", "1.5", "x"} {
+		if _, err := parsePercentiles(s); err == nil {
+			t.Errorf("%q should not parse", s)
+		}
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	var b bytes.Buffer
+	if err := writeJSON(&b, map[string][]float64{"x": {1, 2}}); err != nil {
+		t.Fatal(err)
+	}
+	ref := "{\n\t\"x\": [\n\t\t1,\n\t\t2\n\t]\n}\n"
+	if err := testutil.CheckEqual(b.String(), ref); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWriteProblems(t *testing.T) {
+	var b bytes.Buffer
+	if !writeProblems(&b, nil) {
+		t.Error("no problems should return true")
+	}
+	if err := testutil.CheckEqual(b.String(), "OK\n"); err != nil {
+		t.Error(err)
+	}
+
+	b.Reset()
+	errs := []error{errors.New("a"), errors.New("b")}
+	if writeProblems(&b, errs) {
+		t.Error("problems should return false")
+	}
+	if err := testutil.CheckEqual(b.String(), "- a\n- b\n"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWriteEstimateWatch(t *testing.T) {
+	tm := time.Unix(1500000000, 0).UTC()
+	var b bytes.Buffer
+	writeEstimateWatch(&b, tm, []interface{}{0.0002, 0.0001}, nil)
+	ref := `2017-07-14T02:40:00Z
+
+ 1: 0.00020000
+ 2: 0.00010000
+`
+	if err := testutil.CheckEqual(b.String(), ref); err != nil {
+		t.Error(err)
+	}
+
+	// Errors are shown instead of the table
+	b.Reset()
+	writeEstimateWatch(&b, tm, nil, errors.New("connection refused"))
+	ref = `2017-07-14T02:40:00Z
+
+Error: connection refused
+`
+	if err := testutil.CheckEqual(b.String(), ref); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWriteMempoolSummary(t *testing.T) {
+	state := &col.MempoolState{
+		Height: 400000,
+		Entries: map[string]col.MempoolEntry{
+			"0": &corerpc.MempoolEntry{VSize_: 250},
+			"1": &corerpc.MempoolEntry{VSize_: 1000},
+		},
+		Time:       1500000000,
+		MinFeeRate: 1000,
+	}
+	var b bytes.Buffer
+	writeMempoolSummary(&b, state)
+	for _, line := range []string{
+		"Height:     400000\n",
+		"Txs:        2\n",
+		"Size:       1250 bytes\n",
+		"MinFeeRate: 1000 sats/kB\n",
+	} {
+		if !strings.Contains(b.String(), line) {
+			t.Errorf("summary should contain %q, got:\n%s", line, b.String())
+		}
+	}
+}
+
+func TestWriteRateHistoryCSV(t *testing.T) {
+	history := []api.RateHistory{
+		{Time: 100, X: []float64{1000, 5000}, Y: []float64{2.5, 1}},
+		{Time: 200, X: []float64{1000}, Y: []float64{3}},
+	}
+	var b bytes.Buffer
+	if err := writeRateHistoryCSV(&b, history); err != nil {
+		t.Fatal(err)
+	}
+	ref := "time,feerate,byterate\n100,1000,2.5\n100,5000,1\n200,1000,3\n"
+	if err := testutil.CheckEqual(b.String(), ref); err != nil {
+		t.Error(err)
+	}
+
+	history[0].Y = nil
+	if err := writeRateHistoryCSV(&b, history); err == nil {
+		t.Error("mismatched x/y lengths should return an error")
+	}
+}
+
+func TestWriteScoresGrid(t *testing.T) {
+	scores := api.FeeRateScores{
+		FeeRates: []int64{0, 10000},
+		Attained: [][]float64{{3, 0}, {0, 1}},
+		Exceeded: [][]float64{{1, 0}, {0, 0}},
+	}
+	var b bytes.Buffer
+	writeScoresGrid(&b, scores)
+	ref := "          0   10000\n" +
+		" 1:   0.750       -\n" +
+		" 2:       -   1.000\n"
+	if err := testutil.CheckEqual(b.String(), ref); err != nil {
+		t.Error(err)
+	}
+}
+
+// rangeBlockStatDB is an est.BlockStatDB which records the Get ranges.
+type rangeBlockStatDB struct {
+	stats  []*est.BlockStat
+	ranges [][2]int64
+}
+
+func (d *rangeBlockStatDB) Get(start, end int64) ([]*est.BlockStat, error) {
+	d.ranges = append(d.ranges, [2]int64{start, end})
+	var stats []*est.BlockStat
+	for _, s := range d.stats {
+		if s.Height >= start && s.Height <= end {
+			stats = append(stats, s)
+		}
+	}
+	return stats, nil
+}
+
+func TestWriteBlockStatsCSV(t *testing.T) {
+	db := &rangeBlockStatDB{stats: []*est.BlockStat{
+		{
+			Height:            100,
+			Size:              900000,
+			SFRStat:           est.SFRStat{SFR: 10000, AK: 5, AN: 6, BK: 3, BN: 4},
+			MempoolSize:       2000000,
+			MempoolSizeRemain: 1100000,
+			Time:              1500000000,
+			NumHashes:         1.5e20,
+		},
+		{Height: 103, Size: 1000, Time: 1500000600, NoSFR: true},
+		{Height: 110, Size: 2000},
+	}}
+	var b bytes.Buffer
+	n, err := writeBlockStatsCSV(&b, db, 100, 104, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(n, 2); err != nil {
+		t.Error(err)
+	}
+	ref := "height,time,size,numhashes,mempoolsize,mempoolsizeremain,sfr,ak,an,bk,bn,nosfr\n" +
+		"100,1500000000,900000,150000000000000000000,2000000,1100000,10000,5,6,3,4,false\n" +
+		"103,1500000600,1000,0,0,0,0,0,0,0,0,true\n"
+	if err := testutil.CheckEqual(b.String(), ref); err != nil {
+		t.Error(err)
+	}
+	// Read in chunks
+	if err := testutil.CheckEqual(db.ranges, [][2]int64{{100, 101}, {102, 103}, {104, 104}}); err != nil {
+		t.Error(err)
+	}
+
+	// No overflow at the top of the range
+	db.ranges = nil
+	b.Reset()
+	if _, err := writeBlockStatsCSV(&b, db, math.MaxInt64-2, math.MaxInt64, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(db.ranges, [][2]int64{
+		{math.MaxInt64 - 2, math.MaxInt64 - 1}, {math.MaxInt64, math.MaxInt64}}); err != nil {
+		t.Error(err)
+	}
+}
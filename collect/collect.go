@@ -5,10 +5,12 @@ which is then used by package estimate.
 package collect
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"sync"
+	"syscall"
 	"time"
 
 	est "github.com/bitcoinfees/feesim/estimate"
@@ -17,9 +19,34 @@ import (
 type Config struct {
 	PollPeriod int `yaml:"pollperiod" json:"pollperiod"`
 
+	// Max number of concurrent GetBlock calls when catching up on multiple
+	// blocks. 0 or 1 means blocks are fetched one at a time.
+	BlockFetchers int `yaml:"blockfetchers" json:"blockfetchers"`
+
+	// If a DB write fails because the disk is full, collection is paused for
+	// DiskFullPause seconds, rather than failing again every poll. 0 means
+	// no pause.
+	DiskFullPause int `yaml:"diskfullpause" json:"diskfullpause"`
+
+	// Skip the stranding fee rate (SFR) computation, which is the heaviest
+	// per-block work, for pure collection on a constrained host. The block
+	// stats are recorded without SFR stats (i.e. marked NoSFR), so they're
+	// only used to estimate the block rate.
+	SkipSFR bool `yaml:"skipsfr" json:"skipsfr"`
+
+	// If not nil, failed TxDB / BlockStatDB writes are queued in DeadLetter,
+	// to be retried later, instead of being dropped.
+	DeadLetter *DeadLetter `yaml:"-" json:"-"`
+
 	GetState MempoolStateGetter `yaml:"-" json:"-"`
 	GetBlock BlockGetter        `yaml:"-" json:"-"`
-	Logger   *log.Logger        `yaml:"-" json:"-"`
+
+	// If not nil, the mempool is also polled whenever Trigger receives, e.g.
+	// on a ZMQ notification (see corerpc.NewZMQGetters), in addition to
+	// every PollPeriod seconds.
+	Trigger <-chan struct{} `yaml:"-" json:"-"`
+
+	Logger *log.Logger `yaml:"-" json:"-"`
 }
 
 // NOTE: S,B,E channels must be serviced.
@@ -28,10 +55,11 @@ type Collector struct {
 	B <-chan []Block
 	E <-chan error
 
-	state *MempoolState
-	txdb  TxDB
-	blkdb BlockStatDB
-	cfg   Config
+	state      *MempoolState
+	pollPeriod int // cfg.PollPeriod, which may be changed (see SetPollPeriod)
+	txdb       TxDB
+	blkdb      BlockStatDB
+	cfg        Config
 
 	done chan struct{}
 	mux  sync.RWMutex
@@ -39,14 +67,34 @@ type Collector struct {
 
 func NewCollector(tdb TxDB, bdb BlockStatDB, cfg Config) *Collector {
 	c := &Collector{
-		txdb:  tdb,
-		blkdb: bdb,
-		cfg:   cfg,
-		done:  make(chan struct{}),
+		txdb:       tdb,
+		blkdb:      bdb,
+		cfg:        cfg,
+		pollPeriod: cfg.PollPeriod,
+		done:       make(chan struct{}),
 	}
 	return c
 }
 
+// PollPeriod returns the current seconds between mempool polls.
+func (c *Collector) PollPeriod() int {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.pollPeriod
+}
+
+// SetPollPeriod sets the seconds between mempool polls. It takes effect after
+// the next poll.
+func (c *Collector) SetPollPeriod(period int) error {
+	if period <= 0 {
+		return fmt.Errorf("pollperiod must be > 0, was %d", period)
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.pollPeriod = period
+	return nil
+}
+
 // NOTE: state can be nil, if getState returns errors.
 func (c *Collector) State() *MempoolState {
 	c.mux.RLock()
@@ -103,15 +151,26 @@ func (c *Collector) run(sc chan<- *MempoolState, blkc chan<- []Block, ec chan<-
 		logger = log.New(os.Stderr, "", log.LstdFlags)
 	}
 
-	ticker := time.NewTicker(time.Duration(c.cfg.PollPeriod) * time.Second)
-	defer ticker.Stop()
+	period := c.PollPeriod()
+	ticker := time.NewTicker(time.Duration(period) * time.Second)
+	defer func() { ticker.Stop() }() // The ticker is replaced if the period changes
+
+	// If block catch-up fails partway, this is the mempool state from which to
+	// resume block processing.
+	var resume *MempoolState
 
 	for {
 		select {
 		case <-ticker.C:
+		case <-c.cfg.Trigger:
 		case <-c.done:
 			return
 		}
+		if p := c.PollPeriod(); p != period {
+			period = p
+			ticker.Stop()
+			ticker = time.NewTicker(time.Duration(period) * time.Second)
+		}
 
 		curr, err := c.cfg.GetState()
 		if err != nil {
@@ -137,8 +196,14 @@ func (c *Collector) run(sc chan<- *MempoolState, blkc chan<- []Block, ec chan<-
 		newTxs := getNewTxs(prev, curr)
 		logger.Printf("[DEBUG] %d new txs, %s", len(newTxs), curr)
 		if err := c.txdb.Put(newTxs); err != nil {
+			if len(newTxs) > 0 {
+				c.deadLetter(DeadLetterTxs, newTxs, logger)
+			}
 			select {
 			case ec <- fmt.Errorf("TxDB.Put: %v", err):
+				if !c.pauseIfDiskFull(err, logger) {
+					return
+				}
 				continue
 			case <-c.done:
 				return
@@ -152,30 +217,40 @@ func (c *Collector) run(sc chan<- *MempoolState, blkc chan<- []Block, ec chan<-
 			return
 		}
 
+		if resume != nil {
+			prev = resume
+		}
 		if prev.Height == curr.Height {
 			continue
 		}
-		// Block height has increased; process the new block
-		b, blks, err := processBlock(prev, curr, c.cfg.GetBlock, logger)
-		if err != nil {
+		// Block height has increased; process the new block(s). Blocks are
+		// committed as far as they were successfully processed.
+		b, blks, r, errBlock := processBlock(prev, curr, c.cfg.GetBlock, c.cfg.BlockFetchers, c.cfg.SkipSFR, logger)
+		resume = r
+		if len(b) > 0 {
+			// Send out the new blocks
 			select {
-			case ec <- fmt.Errorf("processBlock: %v", err):
-				continue
+			case blkc <- blks:
 			case <-c.done:
 				return
 			}
+			// Add BlockStats to DB
+			if err := c.blkdb.Put(b); err != nil {
+				c.deadLetter(DeadLetterBlockStats, b, logger)
+				select {
+				case ec <- fmt.Errorf("BlockStatDB.Put: %v", err):
+					if !c.pauseIfDiskFull(err, logger) {
+						return
+					}
+					continue
+				case <-c.done:
+					return
+				}
+			}
 		}
-		// Send out the new blocks
-		select {
-		case blkc <- blks:
-		case <-c.done:
-			return
-		}
-		// Add BlockStats to DB
-		if err := c.blkdb.Put(b); err != nil {
+		if errBlock != nil {
 			select {
-			case ec <- fmt.Errorf("BlockStatDB.Put: %v", err):
-				continue
+			case ec <- fmt.Errorf("processBlock: %v", errBlock):
 			case <-c.done:
 				return
 			}
@@ -183,6 +258,39 @@ func (c *Collector) run(sc chan<- *MempoolState, blkc chan<- []Block, ec chan<-
 	}
 }
 
+// deadLetter queues a failed write in cfg.DeadLetter, if set.
+func (c *Collector) deadLetter(kind string, data interface{}, logger *log.Logger) {
+	if c.cfg.DeadLetter == nil {
+		return
+	}
+	if err := c.cfg.DeadLetter.Add(kind, data); err != nil {
+		logger.Printf("[ERROR] Dead letter: queueing failed %s write: %v", kind, err)
+		return
+	}
+	logger.Printf("[WARNING] Failed %s write queued in the dead letter for retry.", kind)
+}
+
+// pauseIfDiskFull pauses for cfg.DiskFullPause if err is due to a full disk.
+// Returns false if the collector was stopped meanwhile.
+func (c *Collector) pauseIfDiskFull(err error, logger *log.Logger) bool {
+	if !IsDiskFull(err) || c.cfg.DiskFullPause <= 0 {
+		return true
+	}
+	logger.Printf("[ERROR] Disk is full; pausing collection for %ds.", c.cfg.DiskFullPause)
+	select {
+	case <-time.After(time.Duration(c.cfg.DiskFullPause) * time.Second):
+		logger.Println("Resuming collection.")
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// IsDiskFull returns whether err is due to a full disk (or exceeded quota).
+func IsDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
+
 func (c *Collector) closeDone() error {
 	c.mux.Lock()
 	defer c.mux.Unlock()
@@ -4,9 +4,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"log"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -183,6 +188,161 @@ LoopD:
 	c.Stop()
 }
 
+func TestCollectDiskFull(t *testing.T) {
+	var numPolls int32
+	getState := func() (*MempoolState, error) {
+		atomic.AddInt32(&numPolls, 1)
+		return statedata(333931)
+	}
+	diskFull := &os.PathError{Op: "write", Path: "tx.db", Err: syscall.ENOSPC}
+	if !IsDiskFull(fmt.Errorf("wrapped: %w", diskFull)) {
+		t.Fatal("ENOSPC should be detected as disk full")
+	}
+	if IsDiskFull(fmt.Errorf("TxDB error")) {
+		t.Fatal("other errors should not be detected as disk full")
+	}
+
+	tdb := &MockTxDB{t: t, err: diskFull}
+	cfg := Config{
+		GetState:      getState,
+		GetBlock:      getBlock,
+		PollPeriod:    1,
+		DiskFullPause: 60,
+		Logger:        log.New(ioutil.Discard, "", 0),
+	}
+	c := NewCollector(tdb, &MockBlockStatDB{t: t}, cfg)
+	if err := c.Run(); err != nil {
+		t.Fatal(err)
+	}
+	errCol := <-c.E
+	if err := testutil.CheckEqual(errCol.Error(), "TxDB.Put: "+diskFull.Error()); err != nil {
+		t.Error(err)
+	}
+	// Collection is paused, so there should be no more polls
+	n := atomic.LoadInt32(&numPolls)
+	time.Sleep(2500 * time.Millisecond)
+	if err := testutil.CheckEqual(atomic.LoadInt32(&numPolls), n); err != nil {
+		t.Error(err)
+	}
+
+	// Stopping mid-pause shouldn't wait out the pause
+	stopped := make(chan struct{})
+	go func() {
+		c.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop blocked by the disk full pause")
+	}
+}
+
+func TestCollectTrigger(t *testing.T) {
+	polled := make(chan struct{}, 10)
+	getState := func() (*MempoolState, error) {
+		polled <- struct{}{}
+		return statedata(333931)
+	}
+	trigger := make(chan struct{})
+	cfg := Config{
+		GetState:   getState,
+		GetBlock:   getBlock,
+		PollPeriod: 3600,
+		Trigger:    trigger,
+		Logger:     log.New(ioutil.Discard, "", 0),
+	}
+	c := NewCollector(&MockTxDB{t: t}, &MockBlockStatDB{t: t}, cfg)
+	if err := c.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	<-polled // The initial state
+	go func() {
+		for range c.S {
+		}
+	}()
+
+	// Polled on each trigger, long before the poll period
+	for i := 0; i < 3; i++ {
+		trigger <- struct{}{}
+		select {
+		case <-polled:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the trigger should cause a poll")
+		}
+	}
+}
+
+func TestCollectDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "feesim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d := NewDeadLetter(filepath.Join(dir, "deadletter.jsonl"))
+
+	numPolls := 0
+	getState := func() (*MempoolState, error) {
+		defer func() { numPolls++ }()
+		if numPolls == 0 {
+			return statedata(333931)
+		}
+		return statedata(333932)
+	}
+	tdb := &MockTxDB{t: t, err: errors.New("transient error")}
+	cfg := Config{
+		GetState:   getState,
+		GetBlock:   getBlock,
+		PollPeriod: 1,
+		DeadLetter: d,
+		Logger:     log.New(ioutil.Discard, "", 0),
+	}
+	c := NewCollector(tdb, &MockBlockStatDB{t: t}, cfg)
+	if err := c.Run(); err != nil {
+		t.Fatal(err)
+	}
+	errCol := <-c.E
+	c.Stop()
+	if err := testutil.CheckEqual(errCol.Error(), "TxDB.Put: transient error"); err != nil {
+		t.Error(err)
+	}
+
+	// The failed write was queued
+	if n, err := d.Len(); err != nil {
+		t.Fatal(err)
+	} else if err := testutil.CheckEqual(n, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// The retry succeeds once the DB has recovered. MockTxDB checks the txs
+	// against the reference.
+	tdb.err = nil
+	n, err := d.Retry(map[string]func(json.RawMessage) error{
+		DeadLetterTxs: func(data json.RawMessage) error {
+			var txs []est.Tx
+			if err := json.Unmarshal(data, &txs); err != nil {
+				return err
+			}
+			if len(txs) == 0 {
+				return errors.New("no txs queued")
+			}
+			return tdb.Put(txs)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(n, 1); err != nil {
+		t.Error(err)
+	}
+	if n, err := d.Len(); err != nil {
+		t.Fatal(err)
+	} else if err := testutil.CheckEqual(n, 0); err != nil {
+		t.Error(err)
+	}
+}
+
 type MockBlockStatDB struct {
 	t   *testing.T
 	err error
@@ -198,8 +358,8 @@ func (d *MockBlockStatDB) Put(b []*est.BlockStat) error {
 			NumHashes:         1.718333983803821e+20,
 			Size:              153669,
 			Time:              b[0].Time,
-			MempoolSize:       681121,
-			MempoolSizeRemain: 535628,
+			MempoolSize:       688894,
+			MempoolSizeRemain: 541506,
 			SFRStat: est.SFRStat{
 				SFR: 23310,
 				AK:  305,
@@ -2,6 +2,7 @@ package collect
 
 import (
 	"fmt"
+	"math/rand"
 	"sort"
 
 	est "github.com/bitcoinfees/feesim/estimate"
@@ -23,9 +24,45 @@ type MempoolEntry interface {
 	IsHighPriority() bool
 }
 
+// Weighter is implemented by mempool entries which report the tx weight,
+// which is more precise than Size() (the vsize) times
+// sim.WitnessScaleFactor.
+type Weighter interface {
+	Weight() sim.TxSize
+}
+
+// AncestorFeeRater is implemented by mempool entries which report the fee
+// rate of the tx together with its in-mempool ancestors.
+type AncestorFeeRater interface {
+	AncestorFeeRate() sim.FeeRate
+}
+
+// Hasher is implemented by blocks which report the block hash, e.g. so that
+// a reorg's replacement block can be told apart from the block it replaced.
+type Hasher interface {
+	Hash() string
+}
+
+// CollectorError is an error from the collector, with its Unix time, as
+// reported by the collectorerrors RPC method.
+type CollectorError struct {
+	Time  int64  `json:"time"`
+	Error string `json:"error"`
+}
+
 type BlockGetter func(height int64) (Block, error)
 type MempoolStateGetter func() (*MempoolState, error)
 
+// NodeTime is the time of the node's chain tip: its block timestamp, and its
+// median time past. Nodes which don't report the tip's timestamp (Bitcoin Core
+// before 23.0) leave Time 0.
+type NodeTime struct {
+	Time       int64 `json:"time"`
+	MedianTime int64 `json:"mediantime"`
+}
+
+type NodeTimeGetter func() (NodeTime, error)
+
 type TxDB interface {
 	Put([]est.Tx) error
 }
@@ -78,6 +115,46 @@ func (s *MempoolState) SizeFn() sim.MonotonicFn {
 	for _, entry := range s.Entries {
 		m[float64(entry.FeeRate())] += float64(entry.Size())
 	}
+	return sizeFn(m)
+}
+
+// SizeFnSample is like SizeFn, but if there are more than n entries, the
+// function is computed from a sample of n entries, drawn (with replacement)
+// with probability proportional to entry size. Each sampled entry contributes
+// totalsize/n bytes, so the total mempool size is preserved, and the size at
+// other fee rates is an unbiased estimate with std dev at most
+// totalsize/(2*sqrt(n)). The entries are drawn in txid order, so that the
+// sample only depends on the mempool and rng. If n <= 0, the exact SizeFn is
+// returned.
+func (s *MempoolState) SizeFnSample(n int, rng *rand.Rand) sim.MonotonicFn {
+	if n <= 0 || len(s.Entries) <= n {
+		return s.SizeFn()
+	}
+	txids := make([]string, 0, len(s.Entries))
+	for txid := range s.Entries {
+		txids = append(txids, txid)
+	}
+	sort.Strings(txids)
+	feerates := make([]float64, 0, len(s.Entries))
+	cumsizes := make([]float64, 0, len(s.Entries))
+	var total float64
+	for _, txid := range txids {
+		entry := s.Entries[txid]
+		total += float64(entry.Size())
+		feerates = append(feerates, float64(entry.FeeRate()))
+		cumsizes = append(cumsizes, total)
+	}
+	m := make(map[float64]float64)
+	for i := 0; i < n; i++ {
+		j := sort.SearchFloat64s(cumsizes, rng.Float64()*total)
+		m[feerates[j]] += total / float64(n)
+	}
+	return sizeFn(m)
+}
+
+// sizeFn returns the reverse cumulative size function, given a map of fee
+// rate to total size at that fee rate.
+func sizeFn(m map[float64]float64) sim.MonotonicFn {
 	x := make([]float64, 0, len(m))
 	for k := range m {
 		x = append(x, float64(k))
@@ -102,7 +179,13 @@ type MempoolStateDiff struct {
 // expected by Sim.
 // We check here that the mempool is closed; i.e. that all parents listed in
 // a tx's "depends" field are also in the mempool.
-func SimifyMempool(entries map[string]MempoolEntry) ([]*sim.Tx, error) {
+//
+// If ancestorFeeRate is true, a tx's fee rate is the max of its own and its
+// ancestor fee rate, for entries which implement AncestorFeeRater (see
+// entryFeeRate).
+//
+// If weightUnits is true, the tx sizes are in weight units (see entrySize).
+func SimifyMempool(entries map[string]MempoolEntry, ancestorFeeRate, weightUnits bool) ([]*sim.Tx, error) {
 	var txids []string
 	m := make(map[string]*sim.Tx)
 	for txid, entry := range entries {
@@ -111,7 +194,7 @@ func SimifyMempool(entries map[string]MempoolEntry) ([]*sim.Tx, error) {
 		if mtx == nil {
 			mtx = &sim.Tx{}
 		}
-		mtx.FeeRate, mtx.Size = entry.FeeRate(), entry.Size()
+		mtx.FeeRate, mtx.Size = entryFeeRate(entry, ancestorFeeRate), entrySize(entry, weightUnits)
 		m[txid] = mtx
 		for _, parent := range entry.Depends() {
 			if _, ok := entries[parent]; !ok {
@@ -135,8 +218,129 @@ func SimifyMempool(entries map[string]MempoolEntry) ([]*sim.Tx, error) {
 	return s, nil
 }
 
-// Remove mempool entries with a feerate lower than thresh, along with its descendants.
+// entrySize returns the entry's size, or if weightUnits is true, its weight:
+// as reported if the entry implements Weighter, or else its size times
+// sim.WitnessScaleFactor.
+func entrySize(entry MempoolEntry, weightUnits bool) sim.TxSize {
+	if !weightUnits {
+		return entry.Size()
+	}
+	if w, ok := entry.(Weighter); ok {
+		return w.Weight()
+	}
+	return entry.Size() * sim.WitnessScaleFactor
+}
+
+// entryFeeRate returns the entry's fee rate, or if ancestorFeeRate is true
+// and the entry reports it, the max of that and its ancestor fee rate. The
+// latter models package fee rates, as miners select txs by them.
+func entryFeeRate(entry MempoolEntry, ancestorFeeRate bool) sim.FeeRate {
+	feerate := entry.FeeRate()
+	if !ancestorFeeRate {
+		return feerate
+	}
+	if a, ok := entry.(AncestorFeeRater); ok {
+		if afr := a.AncestorFeeRate(); afr > feerate {
+			return afr
+		}
+	}
+	return feerate
+}
+
+// Remove mempool entries which don't clear the fee rate thresh, taking CPFP
+// (child pays for parent) into account.
+//
+// First, entries with a fee rate lower than thresh are removed, along with
+// their descendants. Then, as a miner would, the removed entries are added
+// back in packages (a tx together with its removed ancestors), highest package
+// fee rate first, while the package fee rate is at least thresh. So a low fee
+// parent is kept if a child pays for it, but a low fee child isn't kept just
+// because its parent pays a high fee.
 func PruneLowFee(entries map[string]MempoolEntry, thresh sim.FeeRate) {
+	removed := make(map[string]MempoolEntry)
+	for txid, entry := range entries {
+		removed[txid] = entry
+	}
+	prune(entries, func(entry MempoolEntry) bool {
+		return entry.FeeRate() < thresh
+	})
+	for txid := range entries {
+		delete(removed, txid)
+	}
+
+	// The kept entries are closed under ancestors, so the ancestors of a
+	// removed entry which are still to be paid for are all removed.
+	ancestors := make(map[string]map[string]bool)
+	for txid := range removed {
+		ancestors[txid] = ancestorSet(txid, removed)
+	}
+	for {
+		var (
+			best     string
+			bestRate float64
+		)
+		for txid, entry := range removed {
+			size := float64(entry.Size())
+			fee := float64(entry.FeeRate()) * size
+			for a := range ancestors[txid] {
+				if aentry, ok := removed[a]; ok {
+					asize := float64(aentry.Size())
+					size += asize
+					fee += float64(aentry.FeeRate()) * asize
+				}
+			}
+			if size <= 0 {
+				continue
+			}
+			// Break ties by txid, for determinism
+			if rate := fee / size; best == "" || rate > bestRate || (rate == bestRate && txid < best) {
+				best, bestRate = txid, rate
+			}
+		}
+		if best == "" || bestRate < float64(thresh) {
+			return
+		}
+		for a := range ancestors[best] {
+			if aentry, ok := removed[a]; ok {
+				entries[a] = aentry
+				delete(removed, a)
+			}
+		}
+		entries[best] = removed[best]
+		delete(removed, best)
+	}
+}
+
+// ancestorSet returns the txids of the in-mempool ancestors of txid.
+func ancestorSet(txid string, entries map[string]MempoolEntry) map[string]bool {
+	ancestors := make(map[string]bool)
+	stack := []string{txid}
+	for len(stack) > 0 {
+		newlen := len(stack) - 1
+		t := stack[newlen]
+		stack = stack[:newlen]
+		for _, parent := range entries[t].Depends() {
+			if _, ok := entries[parent]; !ok || ancestors[parent] {
+				continue
+			}
+			ancestors[parent] = true
+			stack = append(stack, parent)
+		}
+	}
+	return ancestors
+}
+
+// Remove mempool entries with a non-positive size, along with its descendants.
+// Such entries are malformed, and would otherwise poison the fee rate stats.
+func PruneInvalid(entries map[string]MempoolEntry) {
+	prune(entries, func(entry MempoolEntry) bool {
+		return entry.Size() <= 0
+	})
+}
+
+// prune removes mempool entries for which remove returns true, along with
+// its descendants.
+func prune(entries map[string]MempoolEntry, remove func(MempoolEntry) bool) {
 	// Maps txids to child txids
 	childMap := make(map[string][]string)
 	for txid, entry := range entries {
@@ -147,7 +351,7 @@ func PruneLowFee(entries map[string]MempoolEntry, thresh sim.FeeRate) {
 
 	var r []string // the "remove" stack
 	for txid, entry := range entries {
-		if entry.FeeRate() >= thresh {
+		if !remove(entry) {
 			continue
 		}
 		r = append(r, txid)
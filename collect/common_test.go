@@ -2,6 +2,9 @@ package collect
 
 import (
 	"fmt"
+	"math"
+	"math/rand"
+	"sort"
 	"strconv"
 	"testing"
 
@@ -21,6 +24,69 @@ func BenchmarkPruneLowFee(b *testing.B) {
 	}
 }
 
+func BenchmarkSizeFn(b *testing.B) {
+	state := bigMempoolState(200000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		state.SizeFn()
+	}
+}
+
+func BenchmarkSizeFnSample(b *testing.B) {
+	state := bigMempoolState(200000)
+	rng := rand.New(rand.NewSource(0))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		state.SizeFnSample(10000, rng)
+	}
+}
+
+func TestSizeFnSample(t *testing.T) {
+	const n = 2000
+	state := bigMempoolState(50000)
+	exact := state.SizeFn()
+	total := exact.Eval(0)
+	rng := rand.New(rand.NewSource(0))
+
+	// No more entries than n, so the result is exact
+	if err := testutil.CheckEqual(state.SizeFnSample(len(state.Entries), rng), exact); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(state.SizeFnSample(0, rng), exact); err != nil {
+		t.Error(err)
+	}
+
+	sampled := state.SizeFnSample(n, rng)
+	// The same mempool and seed give the same sample.
+	again := state.SizeFnSample(n, rand.New(rand.NewSource(0)))
+	if err := testutil.CheckEqual(again, state.SizeFnSample(n, rand.New(rand.NewSource(0)))); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckPctDiff(sampled.Eval(0), total, 1e-9); err != nil {
+		t.Error(err)
+	}
+	// The error std dev is at most total/(2*sqrt(n)); allow 4 std devs.
+	tol := 4 * total / (2 * math.Sqrt(n))
+	for _, x := range []float64{0, 5000, 10000, 20000, 50000, 80000, 100000} {
+		if d := math.Abs(sampled.Eval(x) - exact.Eval(x)); d > tol {
+			t.Errorf("x=%v: sampled %v, exact %v", x, sampled.Eval(x), exact.Eval(x))
+		}
+	}
+}
+
+// bigMempoolState returns a mempool state with n random entries.
+func bigMempoolState(n int) *MempoolState {
+	rng := rand.New(rand.NewSource(0))
+	entries := make(map[string]MempoolEntry)
+	for i := 0; i < n; i++ {
+		entries[strconv.Itoa(i)] = &testMempoolEntry{&testutil.MempoolEntry{
+			Fee:  float64(rng.Intn(100000)) / 1e8,
+			Size: int64(rng.Intn(1000) + 200),
+		}}
+	}
+	return &MempoolState{Entries: entries}
+}
+
 func TestPruneLowFee(t *testing.T) {
 	const thresh = 5000
 	for height := 333931; height < 333954; height++ {
@@ -39,66 +105,323 @@ func TestPruneLowFee(t *testing.T) {
 		PruneLowFee(pruned, thresh)
 		t.Logf("Height %d: %d pruned", height, len(entries)-len(pruned))
 
-		// Check that all pruned entries are correctly pruned
-		checked := make(map[string]error)
-		for txid := range entries {
-			if _, ok := pruned[txid]; !ok {
-				if err := pruneAssert(txid, entries, thresh, checked); err != nil {
-					t.Fatal(err)
-				}
+		// Check against a reference implementation: starting from an empty
+		// mempool, repeatedly add the package with the highest fee rate,
+		// while it's at least thresh.
+		keep := pruneReference(entries, thresh)
+		var numCPFP int
+		for txid, entry := range entries {
+			if _, ok := pruned[txid]; ok != keep[txid] {
+				t.Fatalf("%s: kept is %t, should be %t", txid, ok, keep[txid])
+			}
+			if keep[txid] && entry.FeeRate() < thresh {
+				numCPFP++
 			}
 		}
+		t.Logf("Height %d: %d low fee entries kept by CPFP", height, numCPFP)
 
-		// Check that none of the unpruned entries deserve to be pruned
-		checked = make(map[string]error)
-		for txid := range pruned {
-			if err := unpruneAssert(txid, entries, thresh, checked); err != nil {
-				t.Fatal(err)
+		// The pruned mempool must be closed
+		for _, entry := range pruned {
+			for _, parent := range entry.Depends() {
+				if _, ok := entries[parent]; !ok {
+					continue
+				}
+				if _, ok := pruned[parent]; !ok {
+					t.Fatal("parent of unpruned entry was pruned")
+				}
 			}
 		}
 	}
 }
 
-// pruneAssert asserts that at least one of the ancestors of the tx specified by
-// txid has a feerate < thresh
-func pruneAssert(txid string, entries map[string]MempoolEntry, thresh sim.FeeRate, checked map[string]error) error {
-	if err, ok := checked[txid]; ok {
-		return err
+func TestPruneLowFeeCPFP(t *testing.T) {
+	const thresh = 5000
+	// entry has size 1000, so that its fee in satoshis equals its fee rate.
+	entry := func(feerate int64, depends ...string) MempoolEntry {
+		return &testMempoolEntry{&testutil.MempoolEntry{
+			Fee:     (float64(feerate) + 0.1) / 1e8,
+			Size:    1000,
+			Depends: depends,
+		}}
+	}
+	testcases := []struct {
+		entries map[string]MempoolEntry
+		kept    []string
+	}{
+		// Child pays just enough for parent
+		{map[string]MempoolEntry{"p": entry(1000), "c": entry(9000, "p")}, []string{"c", "p"}},
+		// Child doesn't pay enough, so it's pruned along with the parent,
+		// even though its own fee rate is above thresh.
+		{map[string]MempoolEntry{"p": entry(1000), "c": entry(8999, "p")}, nil},
+		// Low fee child of a high fee parent
+		{map[string]MempoolEntry{"p": entry(10000), "c": entry(1000, "p")}, []string{"p"}},
+		// Grandchild pays for both ancestors
+		{map[string]MempoolEntry{
+			"a": entry(1000), "b": entry(1000, "a"), "c": entry(13000, "b")}, []string{"a", "b", "c"}},
+		{map[string]MempoolEntry{
+			"a": entry(1000), "b": entry(1000, "a"), "c": entry(12999, "b")}, nil},
+		// Of two children, only the high fee one is kept; the low fee one
+		// doesn't count against the parent.
+		{map[string]MempoolEntry{
+			"p": entry(1000), "c1": entry(9000, "p"), "c2": entry(0, "p")}, []string{"c1", "p"}},
+		// Child with two parents pays for both
+		{map[string]MempoolEntry{
+			"p1": entry(1000), "p2": entry(1000), "c": entry(13000, "p1", "p2")}, []string{"c", "p1", "p2"}},
+		// The high fee parent is kept on its own, so the child only needs
+		// to pay for the low fee one.
+		{map[string]MempoolEntry{
+			"p1": entry(1000), "p2": entry(6000), "c": entry(9000, "p1", "p2")}, []string{"c", "p1", "p2"}},
+		{map[string]MempoolEntry{
+			"p1": entry(1000), "p2": entry(6000), "c": entry(8999, "p1", "p2")}, []string{"p2"}},
+		// Parents not in the mempool are ignored
+		{map[string]MempoolEntry{"c": entry(5000, "x")}, []string{"c"}},
+	}
+	for i, tc := range testcases {
+		PruneLowFee(tc.entries, thresh)
+		var kept []string
+		for txid := range tc.entries {
+			kept = append(kept, txid)
+		}
+		sort.Strings(kept)
+		if err := testutil.CheckEqual(kept, tc.kept); err != nil {
+			t.Errorf("case %d: %v", i, err)
+		}
 	}
-	var err error
-	defer func() { checked[txid] = err }()
+}
+
+// pruneReference returns the entries which are kept by PruneLowFee, by
+// brute force.
+func pruneReference(entries map[string]MempoolEntry, thresh sim.FeeRate) map[string]bool {
+	memo := make(map[string]map[string]bool)
+	keep := make(map[string]bool)
+	for {
+		var (
+			best              string
+			bestFee, bestSize int64
+		)
+		for txid := range entries {
+			if keep[txid] {
+				continue
+			}
+			size := int64(entries[txid].Size())
+			fee := int64(entries[txid].FeeRate()) * size
+			for a := range ancestorsOf(txid, entries, memo) {
+				if !keep[a] {
+					fee += int64(entries[a].FeeRate()) * int64(entries[a].Size())
+					size += int64(entries[a].Size())
+				}
+			}
+			if best == "" || fee*bestSize > bestFee*size {
+				best, bestFee, bestSize = txid, fee, size
+			}
+		}
+		if best == "" || bestFee < int64(thresh)*bestSize {
+			return keep
+		}
+		keep[best] = true
+		for a := range ancestorsOf(best, entries, memo) {
+			keep[a] = true
+		}
+	}
+}
 
-	if entries[txid].FeeRate() < thresh {
-		return nil
+// ancestorsOf returns the in-mempool ancestors of txid, memoized in memo.
+func ancestorsOf(txid string, entries map[string]MempoolEntry, memo map[string]map[string]bool) map[string]bool {
+	if a, ok := memo[txid]; ok {
+		return a
 	}
+	a := make(map[string]bool)
 	for _, parent := range entries[txid].Depends() {
-		if err := pruneAssert(parent, entries, thresh, checked); err == nil {
-			return nil
+		if _, ok := entries[parent]; !ok {
+			continue
+		}
+		a[parent] = true
+		for pa := range ancestorsOf(parent, entries, memo) {
+			a[pa] = true
 		}
 	}
-	err = fmt.Errorf("all ancestors have feerate >= thresh.")
-	return err
+	memo[txid] = a
+	return a
 }
 
-// unpruneAssert asserts that all ancestors of the tx specified by txid have a
-// feerate >= thresh
-func unpruneAssert(txid string, entries map[string]MempoolEntry, thresh sim.FeeRate, checked map[string]error) error {
-	if err, ok := checked[txid]; ok {
-		return err
+func TestPruneInvalid(t *testing.T) {
+	entries := map[string]MempoolEntry{
+		"0": &testMempoolEntry{&testutil.MempoolEntry{
+			Fee:  0.0001,
+			Size: 0,
+		}},
+		"1": &testMempoolEntry{&testutil.MempoolEntry{
+			Fee:     0.0001,
+			Size:    1000,
+			Depends: []string{"0"},
+		}},
+		"2": &testMempoolEntry{&testutil.MempoolEntry{
+			Fee:  0.0001,
+			Size: 1000,
+		}},
+		"3": &testMempoolEntry{&testutil.MempoolEntry{
+			Fee:  0.0001,
+			Size: -1,
+		}},
+	}
+	// Zero-size entries must not panic
+	if err := testutil.CheckEqual(entries["0"].FeeRate(), sim.FeeRate(0)); err != nil {
+		t.Error(err)
 	}
-	var err error
-	defer func() { checked[txid] = err }()
 
-	if entries[txid].FeeRate() < thresh {
-		err = fmt.Errorf("ancestor has feerate < thresh")
-		return err
+	PruneInvalid(entries)
+	if err := testutil.CheckEqual(len(entries), 1); err != nil {
+		t.Fatal(err)
 	}
-	for _, parent := range entries[txid].Depends() {
-		if err = unpruneAssert(parent, entries, thresh, checked); err != nil {
-			return err
+	if _, ok := entries["2"]; !ok {
+		t.Error("Valid entry was pruned.")
+	}
+
+	// The SizeFn shouldn't be poisoned
+	state := &MempoolState{Entries: entries}
+	if err := testutil.CheckEqual(state.SizeFn().Eval(0), float64(1000)); err != nil {
+		t.Error(err)
+	}
+}
+
+// ancestorMempoolEntry is a testMempoolEntry which reports an ancestor fee
+// rate.
+type ancestorMempoolEntry struct {
+	*testMempoolEntry
+	ancestorFeeRate sim.FeeRate
+}
+
+func (e *ancestorMempoolEntry) AncestorFeeRate() sim.FeeRate {
+	return e.ancestorFeeRate
+}
+
+func TestSimifyMempoolAncestorFeeRate(t *testing.T) {
+	entries := map[string]MempoolEntry{
+		// The parent, whose ancestor fee rate is its own
+		"0": &ancestorMempoolEntry{&testMempoolEntry{&testutil.MempoolEntry{
+			Fee:  0.0005,
+			Size: 1000,
+		}}, 50000},
+		// A low fee child, whose package fee rate is higher
+		"1": &ancestorMempoolEntry{&testMempoolEntry{&testutil.MempoolEntry{
+			Fee:     0.00001,
+			Size:    1000,
+			Depends: []string{"0"},
+		}}, 25500},
+		// A high fee child, whose package fee rate is lower
+		"2": &ancestorMempoolEntry{&testMempoolEntry{&testutil.MempoolEntry{
+			Fee:     0.001,
+			Size:    1000,
+			Depends: []string{"0"},
+		}}, 75000},
+		// An entry which doesn't report the ancestor fee rate
+		"3": &testMempoolEntry{&testutil.MempoolEntry{
+			Fee:  0.00002,
+			Size: 1000,
+		}},
+	}
+	for _, tc := range []struct {
+		ancestorFeeRate bool
+		ref             []sim.FeeRate
+	}{
+		{false, []sim.FeeRate{50000, 1000, 100000, 2000}},
+		{true, []sim.FeeRate{50000, 25500, 100000, 2000}},
+	} {
+		txs, err := SimifyMempool(entries, tc.ancestorFeeRate, false)
+		if err != nil {
+			t.Fatal(err)
 		}
+		var feerates []sim.FeeRate
+		for _, tx := range txs {
+			feerates = append(feerates, tx.FeeRate)
+		}
+		if err := testutil.CheckEqual(feerates, tc.ref); err != nil {
+			t.Errorf("ancestorFeeRate %t: %v", tc.ancestorFeeRate, err)
+		}
+		// The parent is shared
+		if err := testutil.CheckEqual(txs[1].Parents[0] == txs[0], true); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// weightMempoolEntry is a testMempoolEntry which reports its weight.
+type weightMempoolEntry struct {
+	*testMempoolEntry
+	weight sim.TxSize
+}
+
+func (e *weightMempoolEntry) Weight() sim.TxSize {
+	return e.weight
+}
+
+func TestSimifyMempoolWeightUnits(t *testing.T) {
+	// A SegWit-heavy mempool: most txs have 250 vbytes but weigh 997, i.e.
+	// their vsizes are rounded up. The rest don't report their weight.
+	entries := make(map[string]MempoolEntry)
+	for i := 0; i < 2000; i++ {
+		entry := &testMempoolEntry{&testutil.MempoolEntry{
+			Fee:  float64(1000+i) * 1e-8,
+			Size: 250,
+		}}
+		txid := fmt.Sprintf("%04d", i)
+		if i%10 == 0 {
+			entries[txid] = entry
+		} else {
+			entries[txid] = &weightMempoolEntry{entry, 997}
+		}
+	}
+
+	vtxs, err := SimifyMempool(entries, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wtxs, err := SimifyMempool(entries, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range vtxs {
+		ref := sim.TxSize(997)
+		if i%10 == 0 {
+			ref = 250 * sim.WitnessScaleFactor
+		}
+		if err := testutil.CheckEqual(wtxs[i].Size, ref); err != nil {
+			t.Fatal(err)
+		}
+		if err := testutil.CheckEqual(vtxs[i].Size, sim.TxSize(250)); err != nil {
+			t.Fatal(err)
+		}
+		// The fee rates are per kvB regardless
+		if err := testutil.CheckEqual(wtxs[i].FeeRate, vtxs[i].FeeRate); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Sim the same block capacity in each accounting mode. The blocks fit
+	// slightly more txs in weight units, since the weights aren't rounded up,
+	// so the SFRs are no higher.
+	const mbs = 100000 // vbytes
+	vsim := sim.NewSim(sim.NewMultiTxSource(nil, nil, nil, 0),
+		sim.NewIndBlockSource([]sim.FeeRate{1000}, []sim.TxSize{mbs}, 1./600), vtxs)
+	wsim := sim.NewSim(sim.NewMultiTxSource(nil, nil, nil, 0),
+		sim.NewIndBlockSource([]sim.FeeRate{1000}, []sim.TxSize{mbs * sim.WitnessScaleFactor}, 1./600), wtxs)
+	var lower int
+	for i := 0; i < 4; i++ {
+		vsfr, vsize := vsim.NextBlock()
+		wsfr, wsize := wsim.NextBlock()
+		if wsfr > vsfr {
+			t.Errorf("block %d: weight units SFR %d > vsize SFR %d", i, wsfr, vsfr)
+		}
+		if wsfr < vsfr {
+			lower++
+		}
+		if vsize > mbs || wsize > mbs*sim.WitnessScaleFactor {
+			t.Errorf("block %d: sizes %d / %d exceed the max", i, vsize, wsize)
+		}
+	}
+	if lower == 0 {
+		t.Error("weight units SFRs should be lower")
 	}
-	return nil
 }
 
 // The reason why this is failing is due to commit 7db23474 I think
@@ -114,7 +437,7 @@ func TestSimifyMempool(t *testing.T) {
 	} else {
 		entries = s.Entries
 	}
-	initmempool, err := SimifyMempool(entries)
+	initmempool, err := SimifyMempool(entries, false, false)
 	if err != nil {
 		t.Fatal(err)
 	}
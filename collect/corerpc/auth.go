@@ -0,0 +1,74 @@
+package corerpc
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// The username in the cookie file written by bitcoind
+const cookieUser = "__cookie__"
+
+// loadAuth resolves the RPC credentials: cfg.Username / Password if either is
+// set, or else those in cfg.CookieFile, which bitcoind writes (as
+// "__cookie__:<password>") when rpcuser / rpcpassword aren't configured.
+func (c *client) loadAuth() error {
+	if c.cfg.Username != "" || c.cfg.Password != "" {
+		c.setAuth(c.cfg.Username, c.cfg.Password)
+		return nil
+	}
+	if c.cfg.CookieFile == "" {
+		return errors.New("no RPC credentials; set username and password, or cookiefile")
+	}
+	username, password, err := readCookie(c.cfg.CookieFile)
+	if err != nil {
+		return fmt.Errorf("RPC cookie file: %v", err)
+	}
+	c.setAuth(username, password)
+	return nil
+}
+
+// reloadCookie re-reads the cookie file after an authentication failure, since
+// bitcoind regenerates it on restart. It returns whether the credentials
+// changed, i.e. whether the request is worth retrying.
+func (c *client) reloadCookie() bool {
+	if c.cfg.Username != "" || c.cfg.Password != "" || c.cfg.CookieFile == "" {
+		return false
+	}
+	username, password, err := readCookie(c.cfg.CookieFile)
+	if err != nil {
+		return false
+	}
+	oldUsername, oldPassword := c.auth()
+	if username == oldUsername && password == oldPassword {
+		return false
+	}
+	c.setAuth(username, password)
+	return true
+}
+
+func (c *client) auth() (username, password string) {
+	c.authMux.Lock()
+	defer c.authMux.Unlock()
+	return c.username, c.password
+}
+
+func (c *client) setAuth(username, password string) {
+	c.authMux.Lock()
+	defer c.authMux.Unlock()
+	c.username, c.password = username, password
+}
+
+// readCookie returns the credentials in a bitcoind cookie file.
+func readCookie(cookieFile string) (username, password string, err error) {
+	b, err := ioutil.ReadFile(cookieFile)
+	if err != nil {
+		return "", "", err
+	}
+	parts := strings.SplitN(strings.TrimSpace(string(b)), ":", 2)
+	if len(parts) != 2 || parts[0] != cookieUser || parts[1] == "" {
+		return "", "", fmt.Errorf("%s: malformed cookie; expected %s:<password>", cookieFile, cookieUser)
+	}
+	return parts[0], parts[1], nil
+}
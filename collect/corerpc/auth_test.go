@@ -0,0 +1,119 @@
+package corerpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bitcoinfees/feesim/testutil"
+)
+
+func TestCookieAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "corerpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cookieFile := filepath.Join(dir, ".cookie")
+
+	// The node regenerates the cookie when it restarts.
+	var (
+		password string
+		mux      sync.Mutex
+	)
+	restart := func(newPassword string) {
+		mux.Lock()
+		defer mux.Unlock()
+		password = newPassword
+		if err := ioutil.WriteFile(cookieFile, []byte(cookieUser+":"+password), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+		if u, p, ok := r.BasicAuth(); !ok || u != cookieUser || p != password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		var req request
+		json.Unmarshal(body, &req)
+		fmt.Fprintf(w, `{"result": {"relayfee": 0.00001}, "error": null, "id": %d}`, req.Id)
+	}))
+	defer srv.Close()
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{Host: host, Port: port, Timeout: 15}
+
+	// No credentials
+	if err := CheckConnection(cfg); err == nil {
+		t.Error("CheckConnection should fail without credentials")
+	}
+	// Missing cookie file
+	cfg.CookieFile = cookieFile
+	if err := CheckConnection(cfg); err == nil {
+		t.Error("CheckConnection should fail without the cookie file")
+	}
+
+	restart("abc")
+	if err := CheckConnection(cfg); err != nil {
+		t.Fatal(err)
+	}
+	c := newClient(cfg)
+	if _, err := c.getRelayFee(); err != nil {
+		t.Fatal(err)
+	}
+	// The cookie is re-read after the node restarts.
+	restart("def")
+	if _, err := c.getRelayFee(); err != nil {
+		t.Error(err)
+	}
+
+	// Username / password take precedence.
+	cfg.Username, cfg.Password = "user", "pass"
+	if err := CheckConnection(cfg); err == nil {
+		t.Error("CheckConnection should fail with the wrong username / password")
+	}
+}
+
+func TestReadCookie(t *testing.T) {
+	dir, err := ioutil.TempDir("", "corerpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cookieFile := filepath.Join(dir, ".cookie")
+
+	if err := ioutil.WriteFile(cookieFile, []byte("__cookie__:a1b2:c3\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	username, password, err := readCookie(cookieFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual([]string{username, password}, []string{"__cookie__", "a1b2:c3"}); err != nil {
+		t.Error(err)
+	}
+
+	for _, cookie := range []string{"", "__cookie__", "__cookie__:", "user:pass"} {
+		if err := ioutil.WriteFile(cookieFile, []byte(cookie), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := readCookie(cookieFile); err == nil {
+			t.Errorf("%q: expected an error", cookie)
+		} else {
+			t.Log(err)
+		}
+	}
+}
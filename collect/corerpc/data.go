@@ -1,31 +1,116 @@
 package corerpc
 
 import (
+	"math"
+
 	"github.com/bitcoinfees/feesim/sim"
 )
 
 const (
 	priorityThresh = 57600000
 	coin           = 100000000
+
+	// Max block weight / 4, i.e. the block capacity in virtual bytes, which
+	// is what block sizes (see block.Size) are measured in.
+	maxBlockVSize = 1000000
 )
 
 // There is no longer any concept of priority in Bitcoin Core
 // So any mention of priority here is vestigial
 type MempoolEntry struct {
+	// Size_ is the deprecated "size" field, which is the vsize in Bitcoin
+	// Core >= 0.13, and removed in later versions in favor of VSize_.
 	Size_           int64    `json:"size"`
+	VSize_          int64    `json:"vsize"`
+	Weight_         int64    `json:"weight"`
 	Time_           int64    `json:"time"`
 	Depends_        []string `json:"depends"`
 	Fee             float64  `json:"fee"`
 	CurrentPriority float64  `json:"currentpriority"`
+	AncestorCount   int64    `json:"ancestorcount"`
+	AncestorSize    int64    `json:"ancestorsize"`
+	DescendantCount int64    `json:"descendantcount"`
+	DescendantSize  int64    `json:"descendantsize"`
+
+	// Fees is reported by Bitcoin Core >= 0.17.
+	Fees MempoolEntryFees `json:"fees"`
 }
 
+// MempoolEntryFees are the fees (BTC) of a mempool entry, and of its
+// in-mempool ancestors and descendants (including itself).
+type MempoolEntryFees struct {
+	Base       float64 `json:"base"`
+	Modified   float64 `json:"modified"`
+	Ancestor   float64 `json:"ancestor"`
+	Descendant float64 `json:"descendant"`
+}
+
+// Size returns the tx virtual size (i.e. witness-discounted), so that it's
+// consistent with the block sizes. It's taken from the vsize field, or else
+// weight / 4 (rounded up), or else the deprecated size field, whichever is
+// reported first.
+//
+// Returns 0 if the sizes are inconsistent, i.e. the vsize is less than weight
+// / 4 (so it's not witness-discounted), or the vsize exceeds the block
+// capacity, which should only happen if the entry is malformed.
 func (m *MempoolEntry) Size() sim.TxSize {
-	return sim.TxSize(m.Size_)
+	vsize := m.Size_
+	switch {
+	case m.VSize_ > 0:
+		vsize = m.VSize_
+	case m.Weight_ > 0:
+		vsize = (m.Weight_ + 3) / 4
+	}
+	if vsize > maxBlockVSize || vsize*4 < m.Weight_ {
+		return 0
+	}
+	return sim.TxSize(vsize)
 }
 
-// Panics if called with a zero-value receiver
+// FeeRate is computed as in Bitcoin Core (CFeeRate), i.e. fee * 1000 / size
+// in integer satoshis, truncated.
+//
+// Returns 0 if the entry has a non-positive size, which should only happen if
+// the entry is malformed.
 func (m *MempoolEntry) FeeRate() sim.FeeRate {
-	return sim.FeeRate(m.Fee*coin*1000) / sim.FeeRate(m.Size_)
+	size := m.Size()
+	if size <= 0 {
+		return 0
+	}
+	return sim.FeeRate(satoshis(m.Fee)*1000) / sim.FeeRate(size)
+}
+
+// AncestorFeeRate is the fee rate of the tx together with its in-mempool
+// ancestors (i.e. the package fee rate), computed as in FeeRate.
+//
+// Returns 0 if the ancestor fees or size aren't reported, e.g. by earlier
+// versions of Bitcoin Core.
+func (m *MempoolEntry) AncestorFeeRate() sim.FeeRate {
+	if m.AncestorSize <= 0 || m.Fees.Ancestor <= 0 {
+		return 0
+	}
+	return sim.FeeRate(satoshis(m.Fees.Ancestor)*1000) / sim.FeeRate(m.AncestorSize)
+}
+
+// Weight returns the tx weight, or if it's not reported, Size() times the
+// witness scale factor. Like Size, it returns 0 if the sizes are
+// inconsistent.
+func (m *MempoolEntry) Weight() sim.TxSize {
+	size := m.Size()
+	if size <= 0 {
+		return 0
+	}
+	if m.Weight_ > 0 {
+		return sim.TxSize(m.Weight_)
+	}
+	return size * sim.WitnessScaleFactor
+}
+
+// satoshis converts a BTC amount to satoshis. The amount is rounded, since
+// the float BTC amounts are inexact, e.g. 0.00000003*coin is slightly less
+// than 3, which would otherwise be truncated to 2.
+func satoshis(btc float64) int64 {
+	return int64(math.Round(btc * coin))
 }
 
 func (m *MempoolEntry) Time() int64 {
@@ -46,12 +131,18 @@ func (m *MempoolEntry) IsHighPriority() bool {
 }
 
 type block struct {
+	Hash_      string   `json:"hash"`
 	Height_    int64    `json:"height"`
 	Size_      int64    `json:"weight"`
 	Txids_     []string `json:"tx"`
 	Difficulty float64  `json:"difficulty"`
 }
 
+// Hash returns the block hash.
+func (b *block) Hash() string {
+	return b.Hash_
+}
+
 // Height returns the block height.
 func (b *block) Height() int64 {
 	return b.Height_
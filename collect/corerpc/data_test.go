@@ -1,6 +1,8 @@
 package corerpc
 
 import (
+	"encoding/json"
+	"os"
 	"testing"
 
 	"github.com/bitcoinfees/feesim/sim"
@@ -38,3 +40,146 @@ func TestMempoolEntry(t *testing.T) {
 		t.Error("Depends was mutated")
 	}
 }
+
+// The fee rate should be exact (as computed by Bitcoin Core) despite the float
+// BTC fees, so that for small txs, each extra satoshi of fee increases the fee
+// rate. Otherwise, txs paying different fees might tie in the SFR.
+func TestMempoolEntryFeeRateExact(t *testing.T) {
+	for _, size := range []int64{100, 141, 250, 999, 1000} {
+		prev := sim.FeeRate(-1)
+		for sat := int64(1); sat <= 20000; sat++ {
+			entry := &MempoolEntry{Size_: size, Fee: float64(sat) / coin}
+			f := entry.FeeRate()
+			if f != sim.FeeRate(sat*1000/size) {
+				t.Fatalf("size %d, fee %d: got %d, want %d", size, sat, f, sat*1000/size)
+			}
+			if f <= prev {
+				t.Fatalf("size %d, fee %d: fee rate %d not increasing", size, sat, f)
+			}
+			prev = f
+		}
+	}
+}
+
+func TestSatoshis(t *testing.T) {
+	for btc, ref := range map[float64]int64{
+		0.00000003: 3,
+		0.00001:    1000,
+		0.00000253: 253,
+		21000000:   2100000000000000,
+		0:          0,
+	} {
+		if err := testutil.CheckEqual(satoshis(btc), ref); err != nil {
+			t.Error(btc, err)
+		}
+	}
+}
+
+func TestMempoolEntryZeroSize(t *testing.T) {
+	entry := &MempoolEntry{Fee: 0.0001}
+	if err := testutil.CheckEqual(entry.FeeRate(), sim.FeeRate(0)); err != nil {
+		t.Error(err)
+	}
+	entry.Size_ = -1
+	if err := testutil.CheckEqual(entry.FeeRate(), sim.FeeRate(0)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMempoolEntryVSize(t *testing.T) {
+	f, err := os.Open("testdata/segwitmempool.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries map[string]*MempoolEntry
+	if err := json.NewDecoder(f).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+
+	sizeRef := map[string]sim.TxSize{
+		"segwit":       141,
+		"segwitold":    141, // Old nodes report the vsize as "size"
+		"weightonly":   141,
+		"sigops":       400, // Sigop-adjusted vsize exceeds weight / 4
+		"undiscounted": 0,
+		"child":        141,
+		"huge":         0,
+	}
+	weightRef := map[string]sim.TxSize{
+		"segwit":       561,
+		"segwitold":    564, // Not reported, so it's the vsize * 4
+		"weightonly":   561,
+		"sigops":       561, // The block weight limit applies to the raw weight
+		"undiscounted": 0,
+		"child":        561,
+		"huge":         0,
+	}
+	for txid, entry := range entries {
+		if err := testutil.CheckEqual(entry.Size(), sizeRef[txid]); err != nil {
+			t.Errorf("%s: %v", txid, err)
+		}
+		if err := testutil.CheckEqual(entry.Weight(), weightRef[txid]); err != nil {
+			t.Errorf("%s weight: %v", txid, err)
+		}
+		if sizeRef[txid] > 0 {
+			if err := testutil.CheckEqual(entry.FeeRate(), sim.FeeRate(1000)); err != nil {
+				t.Errorf("%s: %v", txid, err)
+			}
+		} else if err := testutil.CheckEqual(entry.FeeRate(), sim.FeeRate(0)); err != nil {
+			t.Errorf("%s: %v", txid, err)
+		}
+	}
+
+	// Inconsistent entries, and their descendants, are excluded from the state.
+	state := newMempoolState(100, entries, 1000, 0)
+	for txid := range sizeRef {
+		_, ok := state.Entries[txid]
+		valid := sizeRef[txid] > 0 && txid != "child"
+		if err := testutil.CheckEqual(ok, valid); err != nil {
+			t.Errorf("%s: %v", txid, err)
+		}
+	}
+}
+
+func TestMempoolEntryAncestorFeeRate(t *testing.T) {
+	// A child paying for its parent, as reported by getrawmempool
+	const data = `{
+		"vsize": 200,
+		"fee": 0.0001,
+		"time": 1500000000,
+		"depends": ["parent"],
+		"ancestorcount": 2,
+		"ancestorsize": 500,
+		"descendantcount": 1,
+		"descendantsize": 200,
+		"fees": {
+			"base": 0.0001,
+			"modified": 0.0001,
+			"ancestor": 0.0001003,
+			"descendant": 0.0001
+		}
+	}`
+	var entry MempoolEntry
+	if err := json.Unmarshal([]byte(data), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(entry.AncestorCount, int64(2)); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(entry.DescendantSize, int64(200)); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(entry.FeeRate(), sim.FeeRate(50000)); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(entry.AncestorFeeRate(), sim.FeeRate(20060)); err != nil {
+		t.Error(err)
+	}
+
+	// Not reported by earlier versions
+	entry = MempoolEntry{VSize_: 200, Fee: 0.0001}
+	if err := testutil.CheckEqual(entry.AncestorFeeRate(), sim.FeeRate(0)); err != nil {
+		t.Error(err)
+	}
+}
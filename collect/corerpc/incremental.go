@@ -0,0 +1,169 @@
+package corerpc
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Max number of getmempoolentry requests in a batch
+const maxEntryBatch = 10000
+
+// RPC error code of getmempoolentry for a tx which isn't in the mempool
+const rpcInvalidAddressOrKey = -5
+
+// incrementalPoller polls the mempool with the non-verbose getrawmempool,
+// which returns only the txids, and gets the entries of just the new txids
+// with getmempoolentry; the entries of the txids seen in the last poll are
+// reused. Since the full entries are most of the verbose getrawmempool
+// response, this transfers much less for a mostly unchanged mempool.
+//
+// The first poll, and the poll after a reorg which lowers the height, get the
+// full mempool as client.pollMempool does. When txs have left the mempool
+// (e.g. on a new block), the reused entries with in-mempool parents are
+// refetched, since their depends and ancestor stats may have changed. Other
+// changes to reused entries (e.g. prioritisetransaction) aren't picked up.
+// Not concurrent safe.
+type incrementalPoller struct {
+	c        *client
+	height   int64
+	sequence int64 // The mempool_sequence of the last poll, or -1 if unknown
+	entries  map[string]*MempoolEntry
+}
+
+func newIncrementalPoller(c *client) *incrementalPoller {
+	return &incrementalPoller{c: c, sequence: -1}
+}
+
+// pollMempool has the same contract as client.pollMempool. The returned
+// entries map is the poller's own; it must not be modified.
+func (p *incrementalPoller) pollMempool() (height int64, entries map[string]*MempoolEntry, err error) {
+	if p.entries == nil {
+		return p.pollFull()
+	}
+
+	reqs := []*request{
+		p.c.newRequest("getrawmempool", []bool{false, true}),
+		p.c.newRequest("getblockcount", nil),
+	}
+	resp, err := p.c.sendbatch(reqs)
+	if err != nil {
+		return
+	}
+	var mempool struct {
+		Txids    []string `json:"txids"`
+		Sequence int64    `json:"mempool_sequence"`
+	}
+	if err = json.Unmarshal(resp[0], &mempool); err != nil {
+		return
+	}
+	if err = json.Unmarshal(resp[1], &height); err != nil {
+		return
+	}
+	if height < p.height {
+		// A reorg; txs are returned to the mempool, and the depends of
+		// existing ones can grow.
+		return p.pollFull()
+	}
+	if height == p.height && mempool.Sequence == p.sequence {
+		return height, p.entries, nil
+	}
+
+	entries = make(map[string]*MempoolEntry, len(mempool.Txids))
+	var newTxids []string
+	for _, txid := range mempool.Txids {
+		if entry, ok := p.entries[txid]; ok {
+			entries[txid] = entry
+		} else {
+			newTxids = append(newTxids, txid)
+		}
+	}
+	if len(entries) < len(p.entries) {
+		// Some txs have left the mempool.
+		for txid, entry := range entries {
+			if len(entry.Depends_) > 0 {
+				newTxids = append(newTxids, txid)
+			}
+		}
+	}
+
+	newEntries, err := p.c.getMempoolEntries(newTxids)
+	if err != nil {
+		return
+	}
+	for _, txid := range newTxids {
+		if entry, ok := newEntries[txid]; ok {
+			entries[txid] = entry
+		} else {
+			// It left the mempool since getrawmempool.
+			delete(entries, txid)
+		}
+	}
+
+	p.height, p.sequence, p.entries = height, mempool.Sequence, entries
+	return height, entries, nil
+}
+
+// pollFull gets the full mempool, as client.pollMempool.
+func (p *incrementalPoller) pollFull() (height int64, entries map[string]*MempoolEntry, err error) {
+	height, entries, err = p.c.pollMempool()
+	if err != nil {
+		return
+	}
+	p.height, p.sequence, p.entries = height, -1, entries
+	return
+}
+
+// getMempoolEntries gets the mempool entries of txids with getmempoolentry, in
+// batches of at most maxEntryBatch requests. Txids which aren't in the mempool
+// are omitted.
+func (c *client) getMempoolEntries(txids []string) (map[string]*MempoolEntry, error) {
+	entries := make(map[string]*MempoolEntry, len(txids))
+	for start := 0; start < len(txids); start += maxEntryBatch {
+		end := start + maxEntryBatch
+		if end > len(txids) {
+			end = len(txids)
+		}
+		reqs := make([]*request, end-start)
+		for i, txid := range txids[start:end] {
+			reqs[i] = c.newRequest("getmempoolentry", []string{txid})
+		}
+		reqbody, err := json.Marshal(reqs)
+		if err != nil {
+			return nil, err
+		}
+		// Unlike in sendbatch, errors for individual requests are expected.
+		respbody, errHTTP := c.sendhttp(reqbody)
+		rpcresps, err := parseBatch(respbody, reqs)
+		if err != nil {
+			if errHTTP != nil {
+				return nil, errHTTP
+			}
+			return nil, err
+		}
+		byid := make(map[int64]response, len(rpcresps))
+		for _, rpcresp := range rpcresps {
+			byid[rpcresp.Id] = rpcresp
+		}
+		for i, req := range reqs {
+			rpcresp, ok := byid[req.Id]
+			if !ok {
+				return nil, fmt.Errorf("unmatched req/resp IDs")
+			}
+			if rpcresp.Error != nil {
+				if rpcresp.Error.Code == rpcInvalidAddressOrKey {
+					continue
+				}
+				return nil, rpcError(req.Method, rpcresp.Error)
+			}
+			entry := new(MempoolEntry)
+			if err := json.Unmarshal(rpcresp.Result, entry); err != nil {
+				return nil, err
+			}
+			entries[txids[start+i]] = entry
+		}
+		if errHTTP != nil {
+			return nil, errHTTP
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,208 @@
+package corerpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bitcoinfees/feesim/testutil"
+)
+
+// fakeNode serves getrawmempool, getblockcount and getmempoolentry batches
+// from a mempool of raw JSON entries, and counts the response bytes.
+type fakeNode struct {
+	mux      sync.Mutex
+	height   int64
+	sequence int64
+	mempool  map[string]string
+	numBytes int
+}
+
+func newFakeNode(n int) *fakeNode {
+	node := &fakeNode{height: 100, mempool: make(map[string]string)}
+	for i := 0; i < n; i++ {
+		node.add(fmt.Sprintf("%064d", i), nil)
+	}
+	return node
+}
+
+func (node *fakeNode) add(txid string, depends []string) {
+	d, _ := json.Marshal(depends)
+	if depends == nil {
+		d = []byte("[]")
+	}
+	// As in Bitcoin Core, most of an entry isn't used by Feesim.
+	node.mempool[txid] = fmt.Sprintf(`{"vsize": 250, "weight": 1000, "fee": 0.0001, "time": 1,
+		"height": %d, "descendantcount": 1, "descendantsize": 250, "ancestorcount": 1, "ancestorsize": 250,
+		"wtxid": %q, "fees": {"base": 0.0001, "modified": 0.0001, "ancestor": 0.0001, "descendant": 0.0001},
+		"depends": %s, "spentby": [], "bip125-replaceable": false, "unbroadcast": false}`, node.height, txid, d)
+	node.sequence++
+}
+
+func (node *fakeNode) remove(txid string) {
+	delete(node.mempool, txid)
+	node.sequence++
+}
+
+func (node *fakeNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	node.mux.Lock()
+	defer node.mux.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	var reqs []struct {
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+		Id     int64             `json:"id"`
+	}
+	json.Unmarshal(body, &reqs)
+
+	var resps []string
+	for _, req := range reqs {
+		var result string
+		switch req.Method {
+		case "getblockcount":
+			result = fmt.Sprint(node.height)
+		case "getrawmempool":
+			var txids, entries []string
+			for txid, entry := range node.mempool {
+				txids = append(txids, fmt.Sprintf("%q", txid))
+				entries = append(entries, fmt.Sprintf("%q: %s", txid, entry))
+			}
+			if string(req.Params[0]) == "true" {
+				result = "{" + strings.Join(entries, ",") + "}"
+			} else {
+				result = fmt.Sprintf(`{"txids": [%s], "mempool_sequence": %d}`, strings.Join(txids, ","), node.sequence)
+			}
+		case "getmempoolentry":
+			var txid string
+			json.Unmarshal(req.Params[0], &txid)
+			entry, ok := node.mempool[txid]
+			if !ok {
+				resps = append(resps, fmt.Sprintf(
+					`{"result": null, "error": {"code": -5, "message": "Transaction not in mempool"}, "id": %d}`, req.Id))
+				continue
+			}
+			result = entry
+		}
+		resps = append(resps, fmt.Sprintf(`{"result": %s, "error": null, "id": %d}`, result, req.Id))
+	}
+	n, _ := w.Write([]byte("[" + strings.Join(resps, ",") + "]"))
+	node.numBytes += n
+}
+
+func newFakeNodeClient(t testing.TB, node *fakeNode) (*client, func()) {
+	srv := httptest.NewServer(node)
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newClient(Config{Host: host, Port: port, Timeout: 15}), srv.Close
+}
+
+func TestIncrementalPoller(t *testing.T) {
+	node := newFakeNode(100)
+	c, cleanup := newFakeNodeClient(t, node)
+	defer cleanup()
+	p := newIncrementalPoller(c)
+
+	// checkPoll checks that the poller's entries are those of a full poll.
+	checkPoll := func() {
+		t.Helper()
+		height, entries, err := p.pollMempool()
+		if err != nil {
+			t.Fatal(err)
+		}
+		refHeight, refEntries, err := c.pollMempool()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := testutil.CheckEqual(height, refHeight); err != nil {
+			t.Error(err)
+		}
+		if err := testutil.CheckEqual(entries, refEntries); err != nil {
+			t.Error(err)
+		}
+	}
+	checkPoll()
+
+	// Unchanged mempool; only the txids are transferred.
+	node.numBytes = 0
+	if _, _, err := c.pollMempool(); err != nil {
+		t.Fatal(err)
+	}
+	fullBytes := node.numBytes
+	node.numBytes = 0
+	checkPoll()
+	incrementalBytes := node.numBytes - fullBytes
+	t.Logf("%d bytes incremental, %d bytes full", incrementalBytes, fullBytes)
+	if incrementalBytes*2 > fullBytes {
+		t.Error("incremental poll should transfer much less than a full poll")
+	}
+
+	// New txs, with a parent
+	parent, child := fmt.Sprintf("%064d", 1000), fmt.Sprintf("%064d", 1001)
+	node.add(parent, nil)
+	node.add(child, []string{parent})
+	checkPoll()
+
+	// The parent confirms; the child's depends are refetched.
+	node.remove(parent)
+	node.add(child, nil)
+	node.height++
+	checkPoll()
+
+	// A reorg
+	node.height -= 2
+	node.add(parent, nil)
+	checkPoll()
+
+	// A tx which leaves the mempool before getmempoolentry is omitted.
+	entries, err := c.getMempoolEntries([]string{parent, "notinmempool"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(len(entries), 1); err != nil {
+		t.Error(err)
+	}
+}
+
+// BenchmarkPollMempool compares the bytes transferred by the full and
+// incremental mempool polls, for a mempool of 20000 txs of which 1% changes
+// between polls.
+func BenchmarkPollMempool(b *testing.B) {
+	for _, incremental := range []bool{false, true} {
+		name := "full"
+		if incremental {
+			name = "incremental"
+		}
+		b.Run(name, func(b *testing.B) {
+			node := newFakeNode(20000)
+			c, cleanup := newFakeNodeClient(b, node)
+			defer cleanup()
+			poll := c.pollMempool
+			if incremental {
+				poll = newIncrementalPoller(c).pollMempool
+			}
+			if _, _, err := poll(); err != nil {
+				b.Fatal(err)
+			}
+			node.numBytes = 0
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < 200; j++ {
+					node.remove(fmt.Sprintf("%064d", i*200+j))
+					node.add(fmt.Sprintf("%064d", 20000+i*200+j), nil)
+				}
+				if _, _, err := poll(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(node.numBytes)/float64(b.N), "respbytes/op")
+		})
+	}
+}
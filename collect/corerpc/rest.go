@@ -0,0 +1,141 @@
+package corerpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	col "github.com/bitcoinfees/feesim/collect"
+	"github.com/bitcoinfees/feesim/sim"
+)
+
+// RESTGetters is like Getters, but uses the Bitcoin Core REST interface, which
+// requires bitcoind to be run with -rest. No RPC credentials are needed.
+func RESTGetters(timeNow UnixNow, cfg Config) (col.MempoolStateGetter, col.BlockGetter, error) {
+	c := newRESTClient(cfg)
+	relayfee, err := c.getRelayFee()
+	if err != nil {
+		return nil, nil, err
+	}
+	getState := func() (*col.MempoolState, error) {
+		height, rawEntries, err := c.pollMempool()
+		if err != nil {
+			return nil, err
+		}
+		return newMempoolState(height, rawEntries, relayfee, timeNow()), nil
+	}
+	getBlock := func(height int64) (col.Block, error) {
+		return c.getBlock(height)
+	}
+	return getState, getBlock, nil
+}
+
+type restClient struct {
+	httpclient *http.Client
+	cfg        Config
+}
+
+func newRESTClient(cfg Config) *restClient {
+	c := &http.Client{Timeout: time.Duration(cfg.Timeout) * time.Second}
+	return &restClient{cfg: cfg, httpclient: c}
+}
+
+func (c *restClient) getRelayFee() (sim.FeeRate, error) {
+	var info struct {
+		MinRelayTxFee float64 `json:"minrelaytxfee"`
+	}
+	if err := c.get("mempool/info.json", &info); err != nil {
+		return 0, err
+	}
+	return sim.FeeRate(satoshis(info.MinRelayTxFee)), nil
+}
+
+func (c *restClient) getBlockCount() (int64, error) {
+	var info struct {
+		Blocks int64 `json:"blocks"`
+	}
+	err := c.get("chaininfo.json", &info)
+	return info.Blocks, err
+}
+
+// Unlike the JSON-RPC batch request, the mempool and the block count can't be
+// fetched atomically. So the block count is fetched before and after the
+// mempool, and an error is returned if a block arrived in between.
+func (c *restClient) pollMempool() (height int64, entries map[string]*MempoolEntry, err error) {
+	height, err = c.getBlockCount()
+	if err != nil {
+		return
+	}
+	if err = c.get("mempool/contents.json", &entries); err != nil {
+		return
+	}
+	after, err := c.getBlockCount()
+	if err != nil {
+		return
+	}
+	if after != height {
+		err = fmt.Errorf("block count changed from %d to %d while polling mempool", height, after)
+	}
+	return
+}
+
+// Get a Block by height
+func (c *restClient) getBlock(height int64) (*block, error) {
+	var hash struct {
+		BlockHash string `json:"blockhash"`
+	}
+	if err := c.get("blockhashbyheight/"+strconv.FormatInt(height, 10)+".json", &hash); err != nil {
+		return nil, err
+	}
+
+	// The REST block has tx objects instead of txids.
+	var b struct {
+		block
+		Txs []struct {
+			Txid string `json:"txid"`
+		} `json:"tx"`
+	}
+	if err := c.get("block/"+hash.BlockHash+".json", &b); err != nil {
+		return nil, err
+	}
+	b.Txids_ = make([]string, len(b.Txs))
+	for i, tx := range b.Txs {
+		b.Txids_[i] = tx.Txid
+	}
+	return &b.block, nil
+}
+
+// get fetches /rest/<path> and decodes the JSON response into v. Transient
+// failures are retried (see Config.MaxRetries).
+func (c *restClient) get(path string, v interface{}) error {
+	b, err := c.cfg.withRetry(func() (int, []byte, error) {
+		return c.getOnce(path)
+	})
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// getOnce makes a single HTTP GET request for /rest/<path>, returning the
+// status code (0 if there was no response) and the response body.
+func (c *restClient) getOnce(path string) (int, []byte, error) {
+	url := "http://" + net.JoinHostPort(c.cfg.Host, c.cfg.Port) + "/rest/" + path
+	resp, err := c.httpclient.Get(url)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := readLimited(resp.Body, c.cfg.maxResponseBytes())
+	if err != nil {
+		return 0, nil, err
+	}
+	if resp.StatusCode != 200 {
+		return resp.StatusCode, b, fmt.Errorf("REST %s: %v: %s", path, resp.Status, b)
+	}
+	return resp.StatusCode, b, nil
+}
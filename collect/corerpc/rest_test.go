@@ -0,0 +1,141 @@
+package corerpc
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	col "github.com/bitcoinfees/feesim/collect"
+	"github.com/bitcoinfees/feesim/sim"
+	"github.com/bitcoinfees/feesim/testutil"
+)
+
+func TestRESTGetters(t *testing.T) {
+	const tm int64 = 11
+	blocks := []string{"100", "100"}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body string
+		switch r.URL.Path {
+		case "/rest/mempool/info.json":
+			body = `{"size": 2, "minrelaytxfee": 0.00001000}`
+		case "/rest/chaininfo.json":
+			body = `{"chain": "main", "blocks": ` + blocks[0] + `}`
+			if len(blocks) > 1 {
+				blocks = blocks[1:]
+			}
+		case "/rest/mempool/contents.json":
+			body = `{
+				"a": {"vsize": 250, "weight": 997, "fee": 0.0001, "time": 5, "depends": []},
+				"b": {"size": 500, "fee": 0.00000100, "time": 6, "depends": []},
+				"c": {"size": 0, "fee": 0.0001, "time": 7, "depends": []}
+			}`
+		case "/rest/blockhashbyheight/100.json":
+			body = `{"blockhash": "00ff"}`
+		case "/rest/block/00ff.json":
+			body = `{"height": 100, "weight": 4000, "difficulty": 1,
+				"tx": [{"txid": "a", "vin": []}, {"txid": "d", "vin": []}]}`
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeNow := func() int64 { return tm }
+	getState, getBlock, err := RESTGetters(timeNow, Config{Host: host, Port: port, Timeout: 15, REST: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := getState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(state.Height, int64(100)); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(state.Time, tm); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(state.MinFeeRate, sim.FeeRate(1000)); err != nil {
+		t.Error(err)
+	}
+	// Low fee and invalid entries are pruned
+	if err := testutil.CheckEqual(len(state.Entries), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(state.Entries["a"].FeeRate(), sim.FeeRate(40000)); err != nil {
+		t.Error(err)
+	}
+
+	var b col.Block
+	if b, err = getBlock(100); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(b.Height(), int64(100)); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(b.Size(), int64(1000)); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(b.Txids(), []string{"a", "d"}); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := getBlock(101); err == nil {
+		t.Error("expected an error for a missing block")
+	}
+
+	// A block arrives while polling the mempool
+	blocks = []string{"100", "101", "101"}
+	if _, err := getState(); err == nil {
+		t.Error("expected an error for a block count change")
+	} else {
+		t.Log(err)
+	}
+	state, err = getState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(state.Height, int64(101)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNodeTimeGetter(t *testing.T) {
+	const chaininfo = `{"chain": "main", "blocks": 100, "time": 1700000600, "mediantime": 1700000000}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/rest/chaininfo.json":
+			w.Write([]byte(chaininfo))
+		case "/":
+			w.Write([]byte(`{"result": ` + chaininfo + `, "error": null, "id": 1}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{Host: host, Port: port, Timeout: 15, Username: "user", Password: "pass"}
+	for _, rest := range []bool{false, true} {
+		cfg.REST = rest
+		nt, err := NodeTimeGetter(cfg)()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := testutil.CheckEqual(nt, col.NodeTime{Time: 1700000600, MedianTime: 1700000000}); err != nil {
+			t.Error(err)
+		}
+	}
+}
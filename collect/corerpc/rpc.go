@@ -1,15 +1,19 @@
 // Package corerpc implements the data collection abstractions in package
-// collect by using the Bitcoin Core JSON-RPC API.
+// collect by using the Bitcoin Core JSON-RPC API (or the REST interface).
 package corerpc
 
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	col "github.com/bitcoinfees/feesim/collect"
@@ -18,27 +22,23 @@ import (
 
 func Getters(timeNow UnixNow, cfg Config) (col.MempoolStateGetter, col.BlockGetter, error) {
 	c := newClient(cfg)
+	if err := c.loadAuth(); err != nil {
+		return nil, nil, err
+	}
 	relayfee, err := c.getRelayFee()
 	if err != nil {
 		return nil, nil, err
 	}
+	pollMempool := c.pollMempool
+	if cfg.Incremental {
+		pollMempool = newIncrementalPoller(c).pollMempool
+	}
 	getState := func() (*col.MempoolState, error) {
-		height, rawEntries, err := c.pollMempool()
+		height, rawEntries, err := pollMempool()
 		if err != nil {
 			return nil, err
 		}
-		entries := make(map[string]col.MempoolEntry)
-		for txid, rawEntry := range rawEntries {
-			entries[txid] = rawEntry
-		}
-		col.PruneLowFee(entries, relayfee)
-		s := &col.MempoolState{
-			Height:     height,
-			Entries:    entries,
-			Time:       timeNow(),
-			MinFeeRate: relayfee,
-		}
-		return s, nil
+		return newMempoolState(height, rawEntries, relayfee, timeNow()), nil
 	}
 	getBlock := func(height int64) (col.Block, error) {
 		return c.getBlock(height)
@@ -46,6 +46,63 @@ func Getters(timeNow UnixNow, cfg Config) (col.MempoolStateGetter, col.BlockGett
 	return getState, getBlock, nil
 }
 
+// NodeTimeGetter returns a getter of the node's tip time, with
+// getblockchaininfo (or if cfg.REST, the REST chain info), for checking the
+// clock skew between the local and node clocks.
+func NodeTimeGetter(cfg Config) col.NodeTimeGetter {
+	if cfg.REST {
+		c := newRESTClient(cfg)
+		return func() (t col.NodeTime, err error) {
+			err = c.get("chaininfo.json", &t)
+			return
+		}
+	}
+	c := newClient(cfg)
+	return func() (t col.NodeTime, err error) {
+		resp, err := c.send(c.newRequest("getblockchaininfo", nil))
+		if err != nil {
+			return
+		}
+		err = json.Unmarshal(resp, &t)
+		return
+	}
+}
+
+// CheckConnection checks that the node is reachable with cfg, by getting the
+// relay fee as Getters does at startup (with getnetworkinfo, or if cfg.REST,
+// the REST mempool info).
+func CheckConnection(cfg Config) error {
+	var err error
+	if cfg.REST {
+		_, err = newRESTClient(cfg).getRelayFee()
+		return err
+	}
+	c := newClient(cfg)
+	if err := c.loadAuth(); err != nil {
+		return err
+	}
+	_, err = c.getRelayFee()
+	return err
+}
+
+func newMempoolState(height int64, rawEntries map[string]*MempoolEntry,
+	relayfee sim.FeeRate, t int64) *col.MempoolState {
+	entries := make(map[string]col.MempoolEntry)
+	for txid, rawEntry := range rawEntries {
+		entries[txid] = rawEntry
+	}
+	// Malformed entries with non-positive size are removed first, so
+	// that one bad entry doesn't poison the fee rate stats.
+	col.PruneInvalid(entries)
+	col.PruneLowFee(entries, relayfee)
+	return &col.MempoolState{
+		Height:     height,
+		Entries:    entries,
+		Time:       t,
+		MinFeeRate: relayfee,
+	}
+}
+
 // Unix time in seconds
 type UnixNow func() int64
 
@@ -57,6 +114,138 @@ type Config struct {
 
 	// HTTP timeout in seconds
 	Timeout int `json:"timeout" yaml:"timeout"`
+
+	// Max HTTP response size in MB. A larger response (e.g. an implausibly
+	// huge mempool from a misbehaving node) is aborted with an error. If <= 0,
+	// defaultMaxResponseSize is used.
+	MaxResponseSize int `json:"maxresponsesize" yaml:"maxresponsesize"`
+
+	// Use the REST interface (bitcoind -rest) instead of JSON-RPC. The
+	// username and password are not needed in that case.
+	REST bool `json:"rest" yaml:"rest"`
+
+	// Path of the cookie file which bitcoind writes in its datadir (e.g.
+	// ~/.bitcoin/.cookie), used for authentication if Username and Password
+	// are empty.
+	CookieFile string `json:"cookiefile" yaml:"cookiefile"`
+
+	// Poll the mempool incrementally, getting the full entries of only the
+	// txids which weren't in the last poll (see incrementalPoller). Requires
+	// Bitcoin Core >= 0.21 (for mempool_sequence). Ignored if REST.
+	Incremental bool `json:"incremental" yaml:"incremental"`
+
+	// If ZMQ.Endpoints is set, bitcoind's ZMQ notifications also trigger
+	// mempool polls (see NewZMQGetters). Ignored if REST.
+	ZMQ ZMQConfig `json:"zmq" yaml:"zmq"`
+
+	// Max number of retries of a request that failed transiently (connection
+	// refused, timeout, HTTP 503, or the node warming up), e.g. while the
+	// node restarts. Permanent errors (e.g. auth failure or method not found)
+	// are not retried.
+	MaxRetries int `json:"maxretries" yaml:"maxretries"`
+
+	// Delay in milliseconds before the first retry; it doubles with each
+	// retry, up to maxRetryDelay. If <= 0, defaultRetryDelay is used.
+	RetryDelay int `json:"retrydelay" yaml:"retrydelay"`
+}
+
+// Default max HTTP response size in MB. Mainnet mempools have been on the order
+// of 100MB as JSON.
+const defaultMaxResponseSize = 1024
+
+// Default delay in ms before the first retry, and the cap on the retry delay.
+const (
+	defaultRetryDelay = 500
+	maxRetryDelay     = 30 * time.Second
+)
+
+// retryDelay returns the delay before the retry following the given number of
+// failed attempts (>= 1).
+func (cfg Config) retryDelay(attempts int) time.Duration {
+	base := cfg.RetryDelay
+	if base <= 0 {
+		base = defaultRetryDelay
+	}
+	d := time.Duration(base) * time.Millisecond
+	for i := 1; i < attempts && d < maxRetryDelay; i++ {
+		d *= 2
+	}
+	if d > maxRetryDelay {
+		return maxRetryDelay
+	}
+	return d
+}
+
+// withRetry calls do, which performs an HTTP request and returns the status
+// code (0 if no response was received), the response body and any error.
+// Transient failures are retried with exponential backoff, up to MaxRetries
+// times; the result of the last attempt is returned.
+func (cfg Config) withRetry(do func() (int, []byte, error)) ([]byte, error) {
+	for attempts := 1; ; attempts++ {
+		status, b, err := do()
+		if err == nil || attempts > cfg.MaxRetries || !isTransient(status, b, err) {
+			return b, err
+		}
+		time.Sleep(cfg.retryDelay(attempts))
+	}
+}
+
+// isTransient reports whether a failed HTTP request is worth retrying.
+func isTransient(status int, body []byte, err error) bool {
+	switch status {
+	case 0:
+		// No response
+		if _, ok := err.(ResponseSizeError); ok {
+			return false
+		}
+		var nerr net.Error
+		if errors.As(err, &nerr) && nerr.Timeout() {
+			return true
+		}
+		return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+			errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	case http.StatusInternalServerError:
+		var rpcresp response
+		if json.Unmarshal(body, &rpcresp) != nil || rpcresp.Error == nil {
+			return false
+		}
+		return rpcresp.Error.Code == errCodeInWarmup
+	}
+	return false
+}
+
+// ResponseSizeError is returned if an HTTP response exceeds the max size.
+type ResponseSizeError struct {
+	Limit int64 // Bytes
+}
+
+func (err ResponseSizeError) Error() string {
+	return fmt.Sprintf("response exceeded the max size of %d bytes; "+
+		"the node might be misbehaving, or maxresponsesize should be raised", err.Limit)
+}
+
+// maxResponseBytes returns the max HTTP response size in bytes.
+func (cfg Config) maxResponseBytes() int64 {
+	size := cfg.MaxResponseSize
+	if size <= 0 {
+		size = defaultMaxResponseSize
+	}
+	return int64(size) << 20
+}
+
+// readLimited reads r to EOF, returning ResponseSizeError if there are more
+// than limit bytes.
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > limit {
+		return nil, ResponseSizeError{Limit: limit}
+	}
+	return b, nil
 }
 
 type request struct {
@@ -69,19 +258,65 @@ type request struct {
 type response struct {
 	Jsonrpc string          `json:"jsonrpc"`
 	Result  json.RawMessage `json:"result"`
-	Error   interface{}     `json:"error"`
+	Error   *RPCError       `json:"error"`
 	Id      int64           `json:"id"`
 }
 
+// JSON-RPC error code for "method not found".
+const errCodeMethodNotFound = -32601
+
+// Bitcoin Core RPC error code returned while the node is starting up.
+const errCodeInWarmup = -28
+
+// RPCError is an error object returned by the Bitcoin Core JSON-RPC API.
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (err *RPCError) Error() string {
+	return fmt.Sprintf("%s (code %d)", err.Message, err.Code)
+}
+
+// MethodNotFoundError is returned if Bitcoin Core doesn't provide a required
+// RPC method.
+type MethodNotFoundError struct {
+	Method string
+}
+
+func (err MethodNotFoundError) Error() string {
+	return fmt.Sprintf("RPC method '%s' is not available on the Bitcoin Core node; "+
+		"check that the node version is supported and that the method is not disabled",
+		err.Method)
+}
+
+// rpcError converts an RPC error object into the error to return to the
+// caller of method.
+func rpcError(method string, err *RPCError) error {
+	if err.Code == errCodeMethodNotFound {
+		return MethodNotFoundError{Method: method}
+	}
+	return err
+}
+
 type client struct {
 	currid     int64
 	httpclient *http.Client
 	cfg        Config
+
+	authMux            sync.Mutex
+	username, password string // Resolved from cfg (see loadAuth)
 }
 
+// newClient returns a client with the credentials of cfg. If they can't be
+// resolved, the requests are unauthenticated; Getters reports the error.
 func newClient(cfg Config) *client {
-	c := &http.Client{Timeout: time.Duration(cfg.Timeout) * time.Second}
-	return &client{cfg: cfg, httpclient: c}
+	c := &client{
+		cfg:        cfg,
+		httpclient: &http.Client{Timeout: time.Duration(cfg.Timeout) * time.Second},
+	}
+	c.loadAuth()
+	return c
 }
 
 func (r *client) newRequest(method string, params interface{}) *request {
@@ -159,7 +394,7 @@ func (c *client) getRelayFee() (sim.FeeRate, error) {
 	if err != nil {
 		return 0, err
 	}
-	relayfee := sim.FeeRate(info["relayfee"].(float64) * coin)
+	relayfee := sim.FeeRate(satoshis(info["relayfee"].(float64)))
 	return relayfee, nil
 }
 
@@ -169,12 +404,12 @@ func (c *client) send(rpcreq *request) (json.RawMessage, error) {
 	if err != nil {
 		return nil, err
 	}
-	respbody, err := c.sendhttp(reqbody)
-	if err != nil {
-		return nil, err
-	}
+	respbody, errHTTP := c.sendhttp(reqbody)
 	var rpcresp response
 	if err := json.Unmarshal(respbody, &rpcresp); err != nil {
+		if errHTTP != nil {
+			return nil, errHTTP
+		}
 		return nil, err
 	}
 	// Error on mismatched Id field
@@ -182,79 +417,131 @@ func (c *client) send(rpcreq *request) (json.RawMessage, error) {
 		return nil, fmt.Errorf("mismatched RPC id")
 	}
 	if rpcresp.Error != nil {
-		return nil, fmt.Errorf("%v", rpcresp.Error)
+		return nil, rpcError(rpcreq.Method, rpcresp.Error)
+	}
+	if errHTTP != nil {
+		return nil, errHTTP
 	}
 	return rpcresp.Result, nil
 }
 
-// Send batch RPC request
+// Send batch RPC request. Results are returned in the same order as the
+// requests, regardless of the order of the responses.
 func (c *client) sendbatch(rpcreqs []*request) ([]json.RawMessage, error) {
-	// Take note of ids
-	idlist := make([]int64, len(rpcreqs))
-	for i, rpcreq := range rpcreqs {
-		idlist[i] = rpcreq.Id
-	}
-
 	reqbody, err := json.Marshal(rpcreqs)
 	if err != nil {
 		return nil, err
 	}
 
-	respbody, err := c.sendhttp(reqbody)
+	respbody, errHTTP := c.sendhttp(reqbody)
+	rpcresps, err := parseBatch(respbody, rpcreqs)
 	if err != nil {
+		if errHTTP != nil {
+			return nil, errHTTP
+		}
 		return nil, err
 	}
 
-	// Match the Ids; return in the same order as the request
-	rpcresps := make([]response, len(rpcreqs))
-	if err := json.Unmarshal(respbody, &rpcresps); err != nil {
-		return nil, err
+	// Match the Ids
+	byid := make(map[int64]response, len(rpcresps))
+	for _, rpcresp := range rpcresps {
+		byid[rpcresp.Id] = rpcresp
 	}
-
 	result := make([]json.RawMessage, len(rpcreqs))
+	for i, rpcreq := range rpcreqs {
+		rpcresp, ok := byid[rpcreq.Id]
+		if !ok {
+			return nil, fmt.Errorf("unmatched req/resp IDs")
+		}
+		if rpcresp.Error != nil {
+			// Return an error if even one rpc request failed
+			return nil, rpcError(rpcreq.Method, rpcresp.Error)
+		}
+		if isNull(rpcresp.Result) {
+			return nil, fmt.Errorf("null result for RPC method '%s'", rpcreq.Method)
+		}
+		result[i] = rpcresp.Result
+	}
+	if errHTTP != nil {
+		return nil, errHTTP
+	}
+
+	return result, nil
+}
 
-IDLoop:
-	for i, reqid := range idlist {
-		for _, rpcresp := range rpcresps {
-			if reqid == rpcresp.Id {
-				if rpcresp.Error != nil {
-					// Return an error if even one rpc request failed
-					return nil, fmt.Errorf("%v", rpcresp.Error)
-				}
-				result[i] = rpcresp.Result
-				continue IDLoop
+// parseBatch parses the response body of the batch reqs. Some nodes and
+// proxies respond to a batch with a single error object instead of an array;
+// that error is converted with rpcError, as for a single request, with the
+// method of the request of the same Id (or else of the first request).
+func parseBatch(body []byte, reqs []*request) ([]response, error) {
+	var rpcresps []response
+	if err := json.Unmarshal(body, &rpcresps); err == nil {
+		return rpcresps, nil
+	}
+	var rpcresp response
+	if err := json.Unmarshal(body, &rpcresp); err != nil {
+		return nil, fmt.Errorf("malformed batch response: %v", err)
+	}
+	if rpcresp.Error != nil {
+		var method string
+		for i, req := range reqs {
+			if i == 0 || req.Id == rpcresp.Id {
+				method = req.Method
 			}
 		}
-		// No ID match was found
-		return nil, fmt.Errorf("unmatched req/resp IDs")
+		return nil, rpcError(method, rpcresp.Error)
 	}
+	return nil, fmt.Errorf("malformed batch response: expected an array")
+}
 
-	return result, nil
+func isNull(r json.RawMessage) bool {
+	return len(bytes.TrimSpace(r)) == 0 || bytes.Equal(bytes.TrimSpace(r), []byte("null"))
 }
 
-// Send the HTTP request
+// Send the HTTP request. Bitcoin Core responds with a non-200 status on RPC
+// errors (e.g. 404 for method not found); in that case the response body is
+// returned along with the error, so that the RPC error can be extracted.
+// Transient failures are retried (see Config.MaxRetries).
 func (c *client) sendhttp(body []byte) ([]byte, error) {
+	return c.cfg.withRetry(func() (int, []byte, error) {
+		return c.post(body)
+	})
+}
+
+// post makes a single HTTP POST request, returning the status code (0 if there
+// was no response) and the response body. If authentication fails with the
+// credentials of the cookie file, it's re-read, and if it has changed, the
+// request is made again.
+func (c *client) post(body []byte) (int, []byte, error) {
+	status, b, err := c.postOnce(body)
+	if status == http.StatusUnauthorized && c.reloadCookie() {
+		return c.postOnce(body)
+	}
+	return status, b, err
+}
+
+func (c *client) postOnce(body []byte) (int, []byte, error) {
 	url := "http://" + net.JoinHostPort(c.cfg.Host, c.cfg.Port)
 	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
 	if err != nil {
-		return nil, err
+		return 0, nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.SetBasicAuth(c.cfg.Username, c.cfg.Password)
+	req.SetBasicAuth(c.auth())
 	resp, err := c.httpclient.Do(req)
 	if err != nil {
-		return nil, err
+		return 0, nil, err
 	}
 	defer resp.Body.Close()
 
-	b, err := ioutil.ReadAll(resp.Body)
+	b, err := readLimited(resp.Body, c.cfg.maxResponseBytes())
 	if err != nil {
-		return nil, err
+		return 0, nil, err
 	}
 
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("%v: %s", resp.Status, b)
+		return resp.StatusCode, b, fmt.Errorf("%v: %s", resp.Status, b)
 	}
 
-	return b, nil
+	return resp.StatusCode, b, nil
 }
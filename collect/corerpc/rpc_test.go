@@ -1,11 +1,19 @@
 package corerpc
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/bitcoinfees/feesim/testutil"
 )
@@ -105,7 +113,7 @@ func TestRPC(t *testing.T) {
 			t.Fatal("Empty txid.")
 		}
 		if tx.Size() > maxtx.Size() {
-			maxtx.Size_ = tx.Size_
+			maxtx.VSize_ = int64(tx.Size())
 		}
 		if tx.Fee > maxtx.Fee {
 			maxtx.Fee = tx.Fee
@@ -153,3 +161,326 @@ func TestRPC(t *testing.T) {
 		t.Log("first txid:", txids[0])
 	}
 }
+
+func TestMethodNotFound(t *testing.T) {
+	// Stub node which doesn't provide any methods
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		notFound := func(id int64) response {
+			return response{
+				Error: &RPCError{Code: errCodeMethodNotFound, Message: "Method not found"},
+				Id:    id,
+			}
+		}
+		var reqs []request
+		if err := json.Unmarshal(body, &reqs); err == nil {
+			resps := make([]response, len(reqs))
+			for i, req := range reqs {
+				resps[i] = notFound(req.Id)
+			}
+			json.NewEncoder(w).Encode(resps)
+			return
+		}
+		var req request
+		json.Unmarshal(body, &req)
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(notFound(req.Id))
+	}))
+	defer srv.Close()
+
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newClient(Config{Host: host, Port: port, Timeout: 15})
+
+	_, err = c.getInfo()
+	if err := testutil.CheckEqual(err, MethodNotFoundError{Method: "getnetworkinfo"}); err != nil {
+		t.Error(err)
+	}
+	_, _, err = c.pollMempool()
+	if err := testutil.CheckEqual(err, MethodNotFoundError{Method: "getrawmempool"}); err != nil {
+		t.Error(err)
+	}
+	t.Log(err)
+}
+
+func TestSendBatch(t *testing.T) {
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newClient(Config{Host: host, Port: port, Timeout: 15})
+	reqs := []*request{
+		{Method: "getrawmempool", Id: 1},
+		{Method: "getblockcount", Id: 2},
+	}
+
+	// Out of order
+	body = `[{"result": 100, "error": null, "id": 2}, {"result": {}, "error": null, "id": 1}]`
+	result, err := c.sendbatch(reqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(string(result[0]), "{}"); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(string(result[1]), "100"); err != nil {
+		t.Error(err)
+	}
+
+	// Top-level error object
+	body = `{"result": null, "error": {"code": -32700, "message": "Parse error"}, "id": null}`
+	_, err = c.sendbatch(reqs)
+	if err := testutil.CheckEqual(err, &RPCError{Code: -32700, Message: "Parse error"}); err != nil {
+		t.Error(err)
+	}
+	// which is mapped like that of a single request.
+	body = `{"result": null, "error": {"code": -32601, "message": "Method not found"}, "id": 2}`
+	_, err = c.sendbatch(reqs)
+	if err := testutil.CheckEqual(err, MethodNotFoundError{Method: "getblockcount"}); err != nil {
+		t.Error(err)
+	}
+
+	// Per-request error
+	body = `[{"result": {}, "error": null, "id": 1}, {"result": null, "error": {"code": -32601, "message": "Method not found"}, "id": 2}]`
+	_, err = c.sendbatch(reqs)
+	if err := testutil.CheckEqual(err, MethodNotFoundError{Method: "getblockcount"}); err != nil {
+		t.Error(err)
+	}
+
+	for _, b := range []string{
+		// Null result
+		`[{"result": {}, "error": null, "id": 1}, {"result": null, "error": null, "id": 2}]`,
+		// Missing result
+		`[{"result": {}, "error": null, "id": 1}, {"error": null, "id": 2}]`,
+		// Unmatched ID
+		`[{"result": {}, "error": null, "id": 1}, {"result": 100, "error": null, "id": 3}]`,
+		// Malformed
+		`[{"result": {}, "error": null, "id": 1}`,
+		`{"result": {}, "error": null, "id": 1}`,
+		``,
+	} {
+		body = b
+		if _, err := c.sendbatch(reqs); err == nil {
+			t.Errorf("%s: expected an error", b)
+		} else {
+			t.Log(err)
+		}
+	}
+}
+
+func TestMaxResponseSize(t *testing.T) {
+	// A mempool of about 2MB
+	var mempool bytes.Buffer
+	mempool.WriteString("{")
+	for i := 0; i < 20000; i++ {
+		if i > 0 {
+			mempool.WriteString(",")
+		}
+		fmt.Fprintf(&mempool, `"%064d": {"size": 250, "fee": 0.0001, "time": 1, "depends": []}`, i)
+	}
+	mempool.WriteString("}")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/rest/chaininfo.json" {
+			w.Write([]byte(`{"blocks": 100}`))
+			return
+		}
+		if r.URL.Path == "/rest/mempool/contents.json" {
+			w.Write(mempool.Bytes())
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		var reqs []request
+		json.Unmarshal(body, &reqs)
+		fmt.Fprintf(w, `[{"result": %s, "error": null, "id": %d}, {"result": 100, "error": null, "id": %d}]`,
+			mempool.Bytes(), reqs[0].Id, reqs[1].Id)
+	}))
+	defer srv.Close()
+
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{Host: host, Port: port, Timeout: 15, MaxResponseSize: 1}
+	limitErr := ResponseSizeError{Limit: 1 << 20}
+
+	_, _, err = newClient(cfg).pollMempool()
+	if err := testutil.CheckEqual(err, limitErr); err != nil {
+		t.Error(err)
+	}
+	_, _, err = newRESTClient(cfg).pollMempool()
+	if err := testutil.CheckEqual(err, limitErr); err != nil {
+		t.Error(err)
+	}
+
+	// Within the limit
+	cfg.MaxResponseSize = 3
+	height, entries, err := newClient(cfg).pollMempool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(height, int64(100)); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(len(entries), 20000); err != nil {
+		t.Error(err)
+	}
+	if _, _, err = newRESTClient(cfg).pollMempool(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var numRequests, numFailures int
+	var failStatus int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numRequests++
+		if numRequests <= numFailures {
+			w.WriteHeader(failStatus)
+			return
+		}
+		if r.URL.Path == "/rest/chaininfo.json" {
+			w.Write([]byte(`{"blocks": 100}`))
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		var req request
+		json.Unmarshal(body, &req)
+		fmt.Fprintf(w, `{"result": "00", "error": null, "id": %d}`, req.Id)
+	}))
+	defer srv.Close()
+
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{Host: host, Port: port, Timeout: 15, MaxRetries: 3, RetryDelay: 1}
+	reset := func(failures, status int) {
+		numRequests, numFailures, failStatus = 0, failures, status
+	}
+
+	// Fails 3 times then succeeds
+	reset(3, http.StatusServiceUnavailable)
+	if _, err := newClient(cfg).getBlockHash(1); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(numRequests, 4); err != nil {
+		t.Error(err)
+	}
+	reset(3, http.StatusServiceUnavailable)
+	if _, err := newRESTClient(cfg).getBlockCount(); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(numRequests, 4); err != nil {
+		t.Error(err)
+	}
+
+	// Retries exhausted
+	reset(4, http.StatusServiceUnavailable)
+	if _, err := newClient(cfg).getBlockHash(1); err == nil {
+		t.Error("expected an error")
+	}
+	if err := testutil.CheckEqual(numRequests, 4); err != nil {
+		t.Error(err)
+	}
+
+	// Permanent errors fail fast
+	reset(1, http.StatusUnauthorized)
+	if _, err := newClient(cfg).getBlockHash(1); err == nil {
+		t.Error("expected an error")
+	}
+	if err := testutil.CheckEqual(numRequests, 1); err != nil {
+		t.Error(err)
+	}
+
+	// Connection refused
+	srv.Close()
+	cfg.MaxRetries = 1
+	if _, err := newClient(cfg).getBlockHash(1); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	warmup := []byte(`{"result": null, "error": {"code": -28, "message": "Loading block index..."}, "id": 1}`)
+	notFound := []byte(`{"result": null, "error": {"code": -32601, "message": "Method not found"}, "id": 1}`)
+	testcases := []struct {
+		status int
+		body   []byte
+		err    error
+		want   bool
+	}{
+		{0, nil, syscall.ECONNREFUSED, true},
+		{0, nil, ResponseSizeError{Limit: 1}, false},
+		{http.StatusServiceUnavailable, nil, errors.New("503"), true},
+		{http.StatusInternalServerError, warmup, errors.New("500"), true},
+		{http.StatusInternalServerError, []byte("x"), errors.New("500"), false},
+		{http.StatusNotFound, notFound, errors.New("404"), false},
+		{http.StatusUnauthorized, nil, errors.New("401"), false},
+	}
+	for _, tc := range testcases {
+		if err := testutil.CheckEqual(isTransient(tc.status, tc.body, tc.err), tc.want); err != nil {
+			t.Errorf("%d %v: %v", tc.status, tc.err, err)
+		}
+	}
+}
+
+func TestCheckConnection(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/rest/mempool/info.json" {
+			w.Write([]byte(`{"minrelaytxfee": 0.00001}`))
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		var req request
+		json.Unmarshal(body, &req)
+		fmt.Fprintf(w, `{"result": {"relayfee": 0.00001}, "error": null, "id": %d}`, req.Id)
+	}))
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{Host: host, Port: port, Timeout: 15, Username: "user", Password: "pass"}
+	if err := CheckConnection(cfg); err != nil {
+		t.Error(err)
+	}
+	cfg.REST = true
+	if err := CheckConnection(cfg); err != nil {
+		t.Error(err)
+	}
+
+	// Unreachable once the node is down
+	srv.Close()
+	if err := CheckConnection(cfg); err == nil {
+		t.Error("CheckConnection should fail with the node down")
+	}
+	cfg.REST = false
+	if err := CheckConnection(cfg); err == nil {
+		t.Error("CheckConnection should fail with the node down")
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	cfg := Config{RetryDelay: 1000}
+	for attempts, want := range map[int]time.Duration{
+		1:  time.Second,
+		2:  2 * time.Second,
+		3:  4 * time.Second,
+		10: maxRetryDelay,
+	} {
+		if err := testutil.CheckEqual(cfg.retryDelay(attempts), want); err != nil {
+			t.Error(attempts, err)
+		}
+	}
+	if err := testutil.CheckEqual(Config{}.retryDelay(1), defaultRetryDelay*time.Millisecond); err != nil {
+		t.Error(err)
+	}
+}
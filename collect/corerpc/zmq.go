@@ -0,0 +1,329 @@
+package corerpc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	col "github.com/bitcoinfees/feesim/collect"
+)
+
+// ZMQConfig configures the subscription to bitcoind's ZMQ notifications
+// (-zmqpubhashblock etc.), which trigger mempool polls in between those of the
+// poll period (see NewZMQGetters).
+type ZMQConfig struct {
+	// The endpoints of the notifications, e.g. "tcp://127.0.0.1:28332". Only
+	// tcp endpoints are supported. If empty, ZMQ isn't used.
+	Endpoints []string `json:"endpoints" yaml:"endpoints"`
+
+	// The topics subscribed to, at each endpoint. If empty, defaultZMQTopics
+	// is used.
+	Topics []string `json:"topics" yaml:"topics"`
+
+	// Min milliseconds between triggered polls, so that a burst of rawtx
+	// notifications doesn't cause back-to-back polls of a large mempool.
+	// Notifications in between are coalesced. If <= 0,
+	// defaultZMQMinInterval is used.
+	MinInterval int `json:"mininterval" yaml:"mininterval"`
+}
+
+var defaultZMQTopics = []string{"hashblock", "rawtx"}
+
+// Default min milliseconds between triggered polls. Each poll is a full
+// verbose getrawmempool (unless Config.Incremental), and rawtx notifications
+// arrive several times a second.
+const defaultZMQMinInterval = 5000
+
+// ZMQGetters are the getters of Getters, and a trigger channel for
+// col.Config.Trigger, which receives when a ZMQ notification arrives. If an
+// endpoint's connection drops, it's redialled with backoff (see
+// Config.retryDelay); meanwhile the collector still polls every poll period.
+type ZMQGetters struct {
+	GetState col.MempoolStateGetter
+	GetBlock col.BlockGetter
+	Trigger  <-chan struct{}
+
+	notify chan struct{}
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	mux   sync.Mutex
+	conns map[net.Conn]bool
+}
+
+// NewZMQGetters returns the getters of Getters (with cfg), and subscribes to
+// cfg.ZMQ.Topics at each of cfg.ZMQ.Endpoints until Close.
+func NewZMQGetters(timeNow UnixNow, cfg Config) (*ZMQGetters, error) {
+	if len(cfg.ZMQ.Endpoints) == 0 {
+		return nil, errors.New("no ZMQ endpoints")
+	}
+	var addrs []string
+	for _, endpoint := range cfg.ZMQ.Endpoints {
+		if !strings.HasPrefix(endpoint, "tcp://") {
+			return nil, fmt.Errorf("ZMQ endpoint %s: only tcp:// is supported", endpoint)
+		}
+		addrs = append(addrs, strings.TrimPrefix(endpoint, "tcp://"))
+	}
+	topics := cfg.ZMQ.Topics
+	if len(topics) == 0 {
+		topics = defaultZMQTopics
+	}
+
+	getState, getBlock, err := Getters(timeNow, cfg)
+	if err != nil {
+		return nil, err
+	}
+	trigger := make(chan struct{}, 1)
+	z := &ZMQGetters{
+		GetState: getState,
+		GetBlock: getBlock,
+		Trigger:  trigger,
+		notify:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		conns:    make(map[net.Conn]bool),
+	}
+	for _, addr := range addrs {
+		z.wg.Add(1)
+		go z.subscribe(addr, topics, cfg)
+	}
+	minInterval := cfg.ZMQ.MinInterval
+	if minInterval <= 0 {
+		minInterval = defaultZMQMinInterval
+	}
+	z.wg.Add(1)
+	go z.throttle(trigger, time.Duration(minInterval)*time.Millisecond)
+	return z, nil
+}
+
+// Close ends the subscriptions.
+func (z *ZMQGetters) Close() {
+	z.mux.Lock()
+	select {
+	case <-z.done:
+		z.mux.Unlock()
+		return
+	default:
+	}
+	close(z.done)
+	for conn := range z.conns {
+		conn.Close()
+	}
+	z.mux.Unlock()
+	z.wg.Wait()
+}
+
+// throttle forwards the notifications to trigger, at most once per
+// minInterval. Like notify, trigger is buffered, so that notifications are
+// coalesced while the collector is busy.
+func (z *ZMQGetters) throttle(trigger chan<- struct{}, minInterval time.Duration) {
+	defer z.wg.Done()
+	for {
+		select {
+		case <-z.notify:
+		case <-z.done:
+			return
+		}
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+		select {
+		case <-time.After(minInterval):
+		case <-z.done:
+			return
+		}
+	}
+}
+
+// subscribe receives the notifications from addr, redialling whenever the
+// connection fails.
+func (z *ZMQGetters) subscribe(addr string, topics []string, cfg Config) {
+	defer z.wg.Done()
+	for attempts := 0; ; {
+		err := z.receive(addr, topics, cfg, func() { attempts = 0 })
+		select {
+		case <-z.done:
+			return
+		default:
+		}
+		if err != nil {
+			attempts++
+			select {
+			case <-time.After(cfg.retryDelay(attempts)):
+			case <-z.done:
+				return
+			}
+		}
+	}
+}
+
+// receive dials addr, subscribes to topics, and notifies on each message
+// until the connection fails. connected is called once it's subscribed.
+func (z *ZMQGetters) receive(addr string, topics []string, cfg Config, connected func()) error {
+	conn, err := net.DialTimeout("tcp", addr, time.Duration(cfg.Timeout)*time.Second)
+	if err != nil {
+		return err
+	}
+	z.mux.Lock()
+	select {
+	case <-z.done:
+		z.mux.Unlock()
+		conn.Close()
+		return nil
+	default:
+	}
+	z.conns[conn] = true
+	z.mux.Unlock()
+	defer func() {
+		z.mux.Lock()
+		delete(z.conns, conn)
+		z.mux.Unlock()
+		conn.Close()
+	}()
+
+	s, err := newZMTPSub(conn, topics)
+	if err != nil {
+		return err
+	}
+	connected()
+	for {
+		if _, err := s.recv(); err != nil {
+			return err
+		}
+		select {
+		case z.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// zmtpSub is a minimal ZMQ SUB socket over one connection, speaking ZMTP 3.0
+// with the NULL security mechanism, as bitcoind's PUB sockets do.
+type zmtpSub struct {
+	r *bufio.Reader
+}
+
+const (
+	zmtpFlagMore    = 0x01
+	zmtpFlagLong    = 0x02
+	zmtpFlagCommand = 0x04
+
+	// Max frame size accepted; bitcoind's largest are rawblock
+	// notifications.
+	zmtpMaxFrameSize = 16 << 20
+)
+
+// newZMTPSub performs the ZMTP handshake on conn, as a SUB socket subscribed
+// to topics.
+func newZMTPSub(conn io.ReadWriter, topics []string) (*zmtpSub, error) {
+	greeting := make([]byte, 64)
+	greeting[0], greeting[9] = 0xff, 0x7f // Signature
+	greeting[10], greeting[11] = 3, 0     // Version
+	copy(greeting[12:32], "NULL")         // Mechanism
+	if _, err := conn.Write(greeting); err != nil {
+		return nil, err
+	}
+
+	s := &zmtpSub{r: bufio.NewReader(conn)}
+	peer := make([]byte, 64)
+	if _, err := io.ReadFull(s.r, peer); err != nil {
+		return nil, err
+	}
+	if peer[0] != 0xff || peer[9] != 0x7f || peer[10] < 3 {
+		return nil, errors.New("ZMTP: peer doesn't speak ZMTP 3")
+	}
+	if mechanism := string(bytes.TrimRight(peer[12:32], "\x00")); mechanism != "NULL" {
+		return nil, fmt.Errorf("ZMTP: unsupported mechanism %s", mechanism)
+	}
+
+	// READY command, with our socket type
+	var ready bytes.Buffer
+	ready.WriteByte(5)
+	ready.WriteString("READY")
+	ready.WriteByte(byte(len("Socket-Type")))
+	ready.WriteString("Socket-Type")
+	binary.Write(&ready, binary.BigEndian, uint32(len("SUB")))
+	ready.WriteString("SUB")
+	if err := writeZMTPFrame(conn, zmtpFlagCommand, ready.Bytes()); err != nil {
+		return nil, err
+	}
+	flags, body, err := s.readFrame()
+	if err != nil {
+		return nil, err
+	}
+	if flags&zmtpFlagCommand == 0 || len(body) < 6 || string(body[1:6]) != "READY" {
+		return nil, errors.New("ZMTP: expected READY from peer")
+	}
+
+	// In ZMTP 3.0, subscriptions are messages of 0x01 followed by the topic.
+	for _, topic := range topics {
+		if err := writeZMTPFrame(conn, 0, append([]byte{1}, topic...)); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// recv returns the frames of the next message; for bitcoind's notifications,
+// the topic, the body and the sequence number.
+func (s *zmtpSub) recv() ([][]byte, error) {
+	var msg [][]byte
+	for {
+		flags, body, err := s.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		if flags&zmtpFlagCommand != 0 {
+			// e.g. PING; there's no heartbeating to respond to in 3.0.
+			continue
+		}
+		msg = append(msg, body)
+		if flags&zmtpFlagMore == 0 {
+			return msg, nil
+		}
+	}
+}
+
+func (s *zmtpSub) readFrame() (flags byte, body []byte, err error) {
+	if flags, err = s.r.ReadByte(); err != nil {
+		return
+	}
+	var size uint64
+	if flags&zmtpFlagLong != 0 {
+		err = binary.Read(s.r, binary.BigEndian, &size)
+	} else {
+		var b byte
+		b, err = s.r.ReadByte()
+		size = uint64(b)
+	}
+	if err != nil {
+		return
+	}
+	if size > zmtpMaxFrameSize {
+		return 0, nil, fmt.Errorf("ZMTP: frame of %d bytes exceeds the max size", size)
+	}
+	body = make([]byte, size)
+	_, err = io.ReadFull(s.r, body)
+	return
+}
+
+func writeZMTPFrame(w io.Writer, flags byte, body []byte) error {
+	var frame bytes.Buffer
+	if len(body) > 255 {
+		frame.WriteByte(flags | zmtpFlagLong)
+		binary.Write(&frame, binary.BigEndian, uint64(len(body)))
+	} else {
+		frame.WriteByte(flags)
+		frame.WriteByte(byte(len(body)))
+	}
+	frame.Write(body)
+	_, err := w.Write(frame.Bytes())
+	return err
+}
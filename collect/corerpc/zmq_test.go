@@ -0,0 +1,144 @@
+package corerpc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitcoinfees/feesim/testutil"
+)
+
+// fakePub is a ZMTP 3.0 PUB socket, as bitcoind's, which sends a notification
+// to each subscriber on publish.
+type fakePub struct {
+	ln    net.Listener
+	subs  chan []string // The topics subscribed to by each subscriber
+	conns chan net.Conn
+}
+
+func newFakePub(t *testing.T) *fakePub {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakePub{ln: ln, subs: make(chan []string, 10), conns: make(chan net.Conn, 10)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go p.handshake(conn, len(defaultZMQTopics))
+		}
+	}()
+	return p
+}
+
+func (p *fakePub) handshake(conn net.Conn, numTopics int) {
+	greeting := make([]byte, 64)
+	greeting[0], greeting[9], greeting[10], greeting[11] = 0xff, 0x7f, 3, 1
+	copy(greeting[12:], "NULL")
+	greeting[32] = 1 // as-server
+	conn.Write(greeting)
+
+	s := &zmtpSub{r: bufio.NewReader(conn)}
+	if _, err := io.ReadFull(s.r, make([]byte, 64)); err != nil {
+		return
+	}
+	if _, _, err := s.readFrame(); err != nil { // READY
+		return
+	}
+	var ready bytes.Buffer
+	ready.WriteString("\x05READY\x0bSocket-Type")
+	binary.Write(&ready, binary.BigEndian, uint32(3))
+	ready.WriteString("PUB")
+	writeZMTPFrame(conn, zmtpFlagCommand, ready.Bytes())
+
+	var topics []string
+	for i := 0; i < numTopics; i++ {
+		_, body, err := s.readFrame()
+		if err != nil || len(body) == 0 || body[0] != 1 {
+			return
+		}
+		topics = append(topics, string(body[1:]))
+	}
+	p.subs <- topics
+	p.conns <- conn
+}
+
+// publish sends a notification on conn, with a long body frame.
+func publish(conn net.Conn, seq uint32) error {
+	if err := writeZMTPFrame(conn, zmtpFlagMore, []byte("rawtx")); err != nil {
+		return err
+	}
+	if err := writeZMTPFrame(conn, zmtpFlagMore, make([]byte, 300)); err != nil {
+		return err
+	}
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, seq)
+	return writeZMTPFrame(conn, 0, b)
+}
+
+func TestZMQGetters(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var req request
+		json.Unmarshal(body, &req)
+		fmt.Fprintf(w, `{"result": {"relayfee": 0.00001}, "error": null, "id": %d}`, req.Id)
+	}))
+	defer srv.Close()
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := newFakePub(t)
+	defer pub.ln.Close()
+
+	cfg := Config{Host: host, Port: port, Timeout: 15, Username: "user", Password: "pass", RetryDelay: 10}
+	cfg.ZMQ.MinInterval = 10
+	cfg.ZMQ.Endpoints = []string{"udp://" + pub.ln.Addr().String()}
+	if _, err := NewZMQGetters(nil, cfg); err == nil {
+		t.Error("non-tcp endpoints should be rejected")
+	}
+	cfg.ZMQ.Endpoints = []string{"tcp://" + pub.ln.Addr().String()}
+	z, err := NewZMQGetters(nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer z.Close()
+
+	checkTrigger := func(conn net.Conn, seq uint32) {
+		t.Helper()
+		if err := publish(conn, seq); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-z.Trigger:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the notification should trigger a poll")
+		}
+	}
+	if err := testutil.CheckEqual(<-pub.subs, defaultZMQTopics); err != nil {
+		t.Error(err)
+	}
+	conn := <-pub.conns
+	checkTrigger(conn, 0)
+	checkTrigger(conn, 1)
+
+	// Resubscribed after the connection drops
+	conn.Close()
+	if err := testutil.CheckEqual(<-pub.subs, defaultZMQTopics); err != nil {
+		t.Error(err)
+	}
+	checkTrigger(<-pub.conns, 2)
+}
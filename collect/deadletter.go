@@ -0,0 +1,149 @@
+package collect
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Dead letter kinds of the collector's writes
+const (
+	DeadLetterTxs        = "txs"
+	DeadLetterBlockStats = "blockstats"
+)
+
+// DeadLetter is an on-disk queue of failed DB writes, stored as JSONL, so
+// that they can be retried later (see Retry) instead of being lost.
+type DeadLetter struct {
+	path string
+	mux  sync.Mutex
+}
+
+// DeadLetterRecord is a failed write. Kind identifies the DB, and Data is the
+// JSON encoded argument of the write.
+type DeadLetterRecord struct {
+	Kind string          `json:"kind"`
+	Time int64           `json:"time"`
+	Data json.RawMessage `json:"data"`
+}
+
+func NewDeadLetter(path string) *DeadLetter {
+	return &DeadLetter{path: path}
+}
+
+// Add appends a failed write of the kind, with argument data, to the queue.
+func (d *DeadLetter) Add(kind string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	rec, err := json.Marshal(DeadLetterRecord{Kind: kind, Time: time.Now().Unix(), Data: b})
+	if err != nil {
+		return err
+	}
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	f, err := os.OpenFile(d.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(rec, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Len returns the number of queued writes.
+func (d *DeadLetter) Len() (int, error) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	recs, err := d.read()
+	return len(recs), err
+}
+
+// Retry retries the queued writes in order, by calling the function of each
+// one's kind with its data. Writes which fail again, or whose kind has no
+// function, are kept in the queue. Returns the number of writes which
+// succeeded.
+func (d *DeadLetter) Retry(fns map[string]func(data json.RawMessage) error) (int, error) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	recs, err := d.read()
+	if err != nil || len(recs) == 0 {
+		return 0, err
+	}
+
+	var remain []DeadLetterRecord
+	for _, rec := range recs {
+		fn, ok := fns[rec.Kind]
+		if !ok || fn(rec.Data) != nil {
+			remain = append(remain, rec)
+		}
+	}
+	if len(remain) == len(recs) {
+		return 0, nil
+	}
+	return len(recs) - len(remain), d.write(remain)
+}
+
+// read returns the queued records. A missing file is an empty queue.
+func (d *DeadLetter) read() ([]DeadLetterRecord, error) {
+	f, err := os.Open(d.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var recs []DeadLetterRecord
+	scanner := bufio.NewScanner(f)
+	// The lines can be large, e.g. the txs of a busy poll.
+	scanner.Buffer(nil, 1<<30)
+	for i := 1; scanner.Scan(); i++ {
+		var rec DeadLetterRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", d.path, i, err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs, scanner.Err()
+}
+
+// write replaces the queue with recs, atomically.
+func (d *DeadLetter) write(recs []DeadLetterRecord) error {
+	if len(recs) == 0 {
+		return os.Remove(d.path)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(d.path), filepath.Base(d.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, rec := range recs {
+		b, err := json.Marshal(rec)
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return err
+		}
+		w.Write(append(b, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), d.path)
+}
@@ -0,0 +1,93 @@
+package collect
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bitcoinfees/feesim/testutil"
+)
+
+func TestDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "feesim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "deadletter.jsonl")
+	d := NewDeadLetter(path)
+
+	// Empty queue
+	if n, err := d.Len(); err != nil {
+		t.Fatal(err)
+	} else if err := testutil.CheckEqual(n, 0); err != nil {
+		t.Error(err)
+	}
+
+	for _, x := range []int{1, 2, 3} {
+		if err := d.Add("a", []int{x}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Add("b", "x"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the write of 2 succeeds; "b" has no retry function.
+	var retried [][]int
+	retryA := func(data json.RawMessage) error {
+		var x []int
+		if err := json.Unmarshal(data, &x); err != nil {
+			return err
+		}
+		retried = append(retried, x)
+		if x[0] != 2 {
+			return errors.New("transient error")
+		}
+		return nil
+	}
+	n, err := d.Retry(map[string]func(json.RawMessage) error{"a": retryA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(n, 1); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(retried, [][]int{{1}, {2}, {3}}); err != nil {
+		t.Error(err)
+	}
+	if n, err := d.Len(); err != nil {
+		t.Fatal(err)
+	} else if err := testutil.CheckEqual(n, 3); err != nil {
+		t.Error(err)
+	}
+
+	// All succeed; the remaining writes are retried in order.
+	retried = nil
+	n, err = d.Retry(map[string]func(json.RawMessage) error{
+		"a": func(data json.RawMessage) error {
+			var x []int
+			if err := json.Unmarshal(data, &x); err != nil {
+				return err
+			}
+			retried = append(retried, x)
+			return nil
+		},
+		"b": func(data json.RawMessage) error { return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(n, 3); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(retried, [][]int{{1}, {3}}); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("an empty queue should have no file")
+	}
+}
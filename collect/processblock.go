@@ -5,14 +5,24 @@ import (
 	"os"
 	"sort"
 	"strings"
+	"sync"
 	"unicode"
 	"unicode/utf8"
 
 	est "github.com/bitcoinfees/feesim/estimate"
 )
 
-func processBlock(prev, curr *MempoolState, getBlock BlockGetter, logger *log.Logger) (
-	[]*est.BlockStat, []Block, error) {
+// processBlock processes the blocks with heights (prev.Height, curr.Height].
+// The blocks are fetched with up to fetchers concurrent getBlock calls, but
+// processed in height order.
+// If getBlock fails partway, the blocks processed so far are returned together
+// with the error, and resume is the mempool state from which processing can be
+// resumed, i.e. prev advanced to the last successfully processed height. On
+// success, resume is nil.
+// If skipSFR, the SFR stats aren't computed, and the stats are marked NoSFR;
+// see Config.SkipSFR.
+func processBlock(prev, curr *MempoolState, getBlock BlockGetter, fetchers int, skipSFR bool,
+	logger *log.Logger) (b []*est.BlockStat, blocks []Block, resume *MempoolState, err error) {
 
 	n := curr.Height - prev.Height
 	if n <= 0 {
@@ -23,16 +33,15 @@ func processBlock(prev, curr *MempoolState, getBlock BlockGetter, logger *log.Lo
 		logger = log.New(os.Stderr, "", log.LstdFlags)
 	}
 
-	b := make([]*est.BlockStat, 0, n)
+	b = make([]*est.BlockStat, 0, n)
 	s := make([]map[string]est.SFRTx, 0, n)
-	blocks := make([]Block, 0, n)
+	blocks = make([]Block, 0, n)
 	minLeadTime := make([]int64, 0, n)
-	for height := prev.Height + 1; height <= curr.Height; height++ {
-		block, err := getBlock(height)
-		if err != nil {
-			return nil, nil, err
-		}
-
+	// If fetching fails partway, process the blocks we have so far, and
+	// resume from there later.
+	fetched, err := fetchBlocks(prev.Height+1, curr.Height, getBlock, fetchers)
+	height := prev.Height + 1
+	for _, block := range fetched {
 		bi := &est.BlockStat{
 			Height:    height,
 			NumHashes: block.NumHashes(),
@@ -45,6 +54,24 @@ func processBlock(prev, curr *MempoolState, getBlock BlockGetter, logger *log.Lo
 			bi.MempoolSize += int64(entry.Size())
 		}
 
+		if skipSFR {
+			var inBlockSize int64
+			for _, txid := range block.Txids() {
+				if entry, ok := prev.Entries[txid]; ok {
+					inBlockSize += int64(entry.Size())
+					delete(prev.Entries, txid)
+				}
+			}
+			bi.MempoolSizeRemain = bi.MempoolSize - inBlockSize
+			bi.NoSFR = true
+			logger.Printf("Block %d: %d S, %d RS, %d MSR (no SFR)",
+				bi.Height, block.Size(), inBlockSize, bi.MempoolSizeRemain)
+			b = append(b, bi)
+			blocks = append(blocks, block)
+			height++
+			continue
+		}
+
 		blockTxids := block.Txids()
 		sort.Strings(blockTxids)
 		// Initialize SFR txs
@@ -64,7 +91,11 @@ func processBlock(prev, curr *MempoolState, getBlock BlockGetter, logger *log.Lo
 			// Shortlist the tx if it satisfies the criteria:
 			// 1. No mempool dependencies
 			// 2. Not high priority
-			if len(entry.Depends()) != 0 || entry.IsHighPriority() {
+			// 3. Fee rate at least the min fee rate. Lower fee rate txs are
+			//    only in the mempool state because a child pays for them (see
+			//    PruneLowFee), so their inclusion says nothing about miners'
+			//    min fee rates.
+			if len(entry.Depends()) != 0 || entry.IsHighPriority() || entry.FeeRate() < prev.MinFeeRate {
 				continue
 			}
 			si[txid] = stx
@@ -92,11 +123,26 @@ func processBlock(prev, curr *MempoolState, getBlock BlockGetter, logger *log.Lo
 		s = append(s, si)
 		blocks = append(blocks, block)
 		minLeadTime = append(minLeadTime, prev.Time-cutoff)
+		height++
+	}
+
+	if len(b) == 0 {
+		// Failed on the first block, so resume from prev.
+		return nil, nil, prev, err
+	}
+	if skipSFR {
+		if err != nil {
+			resume = prev
+			resume.Height = height - 1
+		}
+		return b, blocks, resume, err
 	}
 
 	// Check for conflicts. Conflicts are txs which were removed from mempool
 	// but yet were not included in any block, i.e. they were removed as a
 	// result of a UTXO conflict. We don't want these txs in the SFR calcs.
+	// If we failed partway, txs in the unprocessed blocks will also be counted
+	// as conflicts here, which is conservative.
 	conflicts := prev.Sub(curr).Entries
 	var (
 		conflictsize int64
@@ -127,7 +173,69 @@ func processBlock(prev, curr *MempoolState, getBlock BlockGetter, logger *log.Lo
 			b[i].MempoolSizeRemain, minLeadTime[i], b[i].SFRStat)
 	}
 
-	return b, blocks, nil
+	if err != nil {
+		resume = prev
+		resume.Height = height - 1
+	}
+	return b, blocks, resume, err
+}
+
+// fetchBlocks gets the blocks with heights [start, end], with up to n
+// concurrent getBlock calls. The blocks are returned in height order, up to
+// the first height for which getBlock failed, together with that error.
+// Heights above a failed one are not fetched, if they haven't been already.
+func fetchBlocks(start, end int64, getBlock BlockGetter, n int) ([]Block, error) {
+	num := int(end - start + 1)
+	if n < 1 {
+		n = 1
+	}
+	if n > num {
+		n = num
+	}
+	blocks := make([]Block, num)
+	errs := make([]error, num)
+
+	var (
+		failed = end + 1 // Lowest height for which getBlock failed
+		mux    sync.Mutex
+		wg     sync.WaitGroup
+	)
+	heights := make(chan int64)
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			for h := range heights {
+				mux.Lock()
+				skip := h > failed
+				mux.Unlock()
+				if skip {
+					continue
+				}
+				block, err := getBlock(h)
+				if err != nil {
+					mux.Lock()
+					if h < failed {
+						failed = h
+					}
+					mux.Unlock()
+				}
+				blocks[h-start], errs[h-start] = block, err
+			}
+		}()
+	}
+	for h := start; h <= end; h++ {
+		heights <- h
+	}
+	close(heights)
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return blocks[:i], err
+		}
+	}
+	return blocks, nil
 }
 
 // printable filters an input string, removing unprintable / undecodable UTF-8
@@ -1,7 +1,10 @@
 package collect
 
 import (
+	"errors"
+	"sync"
 	"testing"
+	"time"
 
 	est "github.com/bitcoinfees/feesim/estimate"
 	"github.com/bitcoinfees/feesim/sim"
@@ -20,7 +23,7 @@ func TestProcessBlock(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	b, blocks, err := processBlock(prev, curr, getBlock, nil)
+	b, blocks, resume, err := processBlock(prev, curr, getBlock, 1, false, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -33,8 +36,8 @@ func TestProcessBlock(t *testing.T) {
 			NumHashes:         1.718333983803821e+20,
 			Size:              153669,
 			Time:              prev.Time,
-			MempoolSize:       681121,
-			MempoolSizeRemain: 535628,
+			MempoolSize:       688894,
+			MempoolSizeRemain: 541506,
 			SFRStat: est.SFRStat{
 				SFR: 23310,
 				AK:  305,
@@ -51,6 +54,9 @@ func TestProcessBlock(t *testing.T) {
 	if len(blocks) != 1 {
 		t.Error("blocks should have len1")
 	}
+	if resume != nil {
+		t.Error("resume should be nil")
+	}
 	if err := testutil.CheckEqual(blocks[0].Height(), int64(height)); err != nil {
 		t.Error(err)
 	}
@@ -59,7 +65,7 @@ func TestProcessBlock(t *testing.T) {
 
 	// Test with conflicts
 	curr.Entries = nil
-	b, _, err = processBlock(prev, curr, getBlock, nil)
+	b, _, _, err = processBlock(prev, curr, getBlock, 1, false, nil)
 	b_ref[0].SFRStat = est.SFRStat{
 		SFR: minrelaytxfee,
 		AK:  305,
@@ -73,7 +79,7 @@ func TestProcessBlock(t *testing.T) {
 
 	// Test with empty mempool
 	prev.Entries = nil
-	b, _, err = processBlock(prev, curr, getBlock, nil)
+	b, _, _, err = processBlock(prev, curr, getBlock, 1, false, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -98,7 +104,7 @@ func TestProcessBlock(t *testing.T) {
 	// Three blocks later
 	curr = prev.Copy()
 	curr.Height += n
-	b, _, err = processBlock(prev, curr, getBlock, nil)
+	b, _, _, err = processBlock(prev, curr, getBlock, n, false, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -108,8 +114,8 @@ func TestProcessBlock(t *testing.T) {
 			NumHashes:         1.718333983803821e+20,
 			Size:              153669,
 			Time:              b[0].Time,
-			MempoolSize:       681121,
-			MempoolSizeRemain: 535628,
+			MempoolSize:       688894,
+			MempoolSizeRemain: 541506,
 			SFRStat: est.SFRStat{
 				SFR: 23310,
 				AK:  305,
@@ -123,8 +129,8 @@ func TestProcessBlock(t *testing.T) {
 			NumHashes:         1.718333983803821e+20,
 			Size:              499062,
 			Time:              b[0].Time,
-			MempoolSize:       535628,
-			MempoolSizeRemain: 55677,
+			MempoolSize:       541506,
+			MempoolSizeRemain: 59012,
 			SFRStat: est.SFRStat{
 				SFR: 10224,
 				AK:  207,
@@ -138,8 +144,8 @@ func TestProcessBlock(t *testing.T) {
 			NumHashes:         1.718333983803821e+20,
 			Size:              642771,
 			Time:              b[0].Time,
-			MempoolSize:       55677,
-			MempoolSizeRemain: 14512,
+			MempoolSize:       59012,
+			MempoolSizeRemain: 16873,
 			SFRStat: est.SFRStat{
 				SFR: 7427,
 				AK:  8,
@@ -155,7 +161,7 @@ func TestProcessBlock(t *testing.T) {
 
 	// Test multiple blocks with conflicts
 	curr.Entries = nil
-	b, _, err = processBlock(prev, curr, getBlock, nil)
+	b, _, _, err = processBlock(prev, curr, getBlock, 1, false, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -167,3 +173,206 @@ func TestProcessBlock(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestProcessBlockSkipSFR(t *testing.T) {
+	const (
+		height = 333931
+		n      = 3
+	)
+	prev, err := statedata(height)
+	if err != nil {
+		t.Fatal(err)
+	}
+	curr := prev.Copy()
+	curr.Height += n
+	ref, _, _, err := processBlock(prev, curr, getBlock, 1, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, blocks, resume, err := processBlock(prev, curr, getBlock, 1, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(len(blocks), n); err != nil {
+		t.Fatal(err)
+	}
+	if resume != nil {
+		t.Error("resume should be nil")
+	}
+	// Same stats, but without the SFR stats.
+	for i := range ref {
+		ref[i].SFRStat = est.SFRStat{}
+		ref[i].NoSFR = true
+		if err := b[i].Check(); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := testutil.CheckEqual(b, ref); err != nil {
+		t.Error(err)
+	}
+}
+func TestProcessBlockResume(t *testing.T) {
+	const height = 333931
+	const n = 3
+	prev, err := statedata(height)
+	if err != nil {
+		t.Fatal(err)
+	}
+	curr := prev.Copy()
+	curr.Height += n
+
+	// Fail on the 2nd of 3 blocks
+	fail := true
+	failingGetBlock := func(h int64) (Block, error) {
+		if h == height+1 && fail {
+			return nil, errors.New("getBlock failed")
+		}
+		return getBlock(h)
+	}
+	b, blocks, resume, err := processBlock(prev, curr, failingGetBlock, n, false, nil)
+	if err == nil {
+		t.Fatal("error should be returned")
+	}
+	if err := testutil.CheckEqual(len(b), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(len(blocks), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(b[0].Height, int64(height)); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(resume.Height, int64(height)); err != nil {
+		t.Fatal(err)
+	}
+	// The txs in the processed block are no longer in the resume state
+	if err := testutil.CheckEqual(resume.SizeFn().Eval(0), float64(541506)); err != nil {
+		t.Error(err)
+	}
+
+	// Resume the remaining blocks
+	fail = false
+	b, _, resume, err = processBlock(resume, curr, failingGetBlock, 1, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resume != nil {
+		t.Error("resume should be nil")
+	}
+	if err := testutil.CheckEqual(len(b), n-1); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(b[0].Height, int64(height+1)); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(b[0].MempoolSize, int64(541506)); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(b[1].MempoolSizeRemain, int64(16873)); err != nil {
+		t.Error(err)
+	}
+
+	// Failing on the first block returns prev as the resume state
+	fail = true
+	prev, _ = statedata(height + 1)
+	curr = prev.Copy()
+	curr.Height++
+	b, _, resume, err = processBlock(prev, curr, failingGetBlock, 1, false, nil)
+	if err == nil {
+		t.Fatal("error should be returned")
+	}
+	if err := testutil.CheckEqual(len(b), 0); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(resume.Height, prev.Height); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFetchBlocks(t *testing.T) {
+	const (
+		start    = 1000
+		end      = 1099 // A large gap of 100 blocks
+		fetchers = 8
+	)
+	var (
+		inflight, maxInflight int
+		mux                   sync.Mutex
+	)
+	failAt := int64(-1)
+	stubGetBlock := func(h int64) (Block, error) {
+		mux.Lock()
+		inflight++
+		if inflight > maxInflight {
+			maxInflight = inflight
+		}
+		mux.Unlock()
+		defer func() {
+			mux.Lock()
+			inflight--
+			mux.Unlock()
+		}()
+		time.Sleep(5 * time.Millisecond) // Slow RPC
+		if h == failAt {
+			return nil, errors.New("getBlock failed")
+		}
+		return stubBlock(h), nil
+	}
+
+	blocks, err := fetchBlocks(start, end, stubGetBlock, fetchers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(len(blocks), end-start+1); err != nil {
+		t.Fatal(err)
+	}
+	for i, block := range blocks {
+		if err := testutil.CheckEqual(block.Height(), int64(start+i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Log("max inflight:", maxInflight)
+	if maxInflight < 2 || maxInflight > fetchers {
+		t.Errorf("max inflight was %d, should be in [2, %d]", maxInflight, fetchers)
+	}
+
+	// Sequential
+	maxInflight = 0
+	if _, err := fetchBlocks(start, start+9, stubGetBlock, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(maxInflight, 1); err != nil {
+		t.Error(err)
+	}
+
+	// Blocks are returned up to the failed height
+	failAt = start + 20
+	blocks, err = fetchBlocks(start, end, stubGetBlock, fetchers)
+	if err == nil {
+		t.Fatal("error should be returned")
+	}
+	if err := testutil.CheckEqual(len(blocks), 20); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(blocks[19].Height(), int64(start+19)); err != nil {
+		t.Error(err)
+	}
+}
+
+type stubBlock int64
+
+func (b stubBlock) Height() int64 {
+	return int64(b)
+}
+
+func (b stubBlock) Size() int64 {
+	return 0
+}
+
+func (b stubBlock) Txids() []string {
+	return nil
+}
+
+func (b stubBlock) NumHashes() float64 {
+	return 0
+}
@@ -0,0 +1,46 @@
+package collect
+
+import (
+	est "github.com/bitcoinfees/feesim/estimate"
+)
+
+type RebuildBlockStatDB interface {
+	est.BlockStatDB
+	BlockStatDB
+}
+
+// RebuildBlockStats re-fetches the blocks of the stats in db with heights in
+// [start, end], and recomputes their Size and NumHashes. Stats which aren't in
+// db can't be rebuilt, since the block time is the local time of discovery.
+//
+// This is only a partial rebuild: the SFR stats and mempool sizes need the
+// mempool history, which isn't stored. So the rebuilt stats are marked NoSFR,
+// and their SFR stats are zeroed.
+//
+// Returns the number of stats rebuilt. If an error occurs, the stats rebuilt
+// so far are stored.
+func RebuildBlockStats(db RebuildBlockStatDB, getBlock BlockGetter, start, end int64) (int, error) {
+	stats, err := db.Get(start, end)
+	if err != nil {
+		return 0, err
+	}
+	rebuilt := make([]*est.BlockStat, 0, len(stats))
+	for _, stat := range stats {
+		block, err := getBlock(stat.Height)
+		if err != nil {
+			if perr := db.Put(rebuilt); perr != nil {
+				return 0, perr
+			}
+			return len(rebuilt), err
+		}
+		stat.Size = block.Size()
+		stat.NumHashes = block.NumHashes()
+		stat.SFRStat = est.SFRStat{}
+		stat.NoSFR = true
+		rebuilt = append(rebuilt, stat)
+	}
+	if err := db.Put(rebuilt); err != nil {
+		return 0, err
+	}
+	return len(rebuilt), nil
+}
@@ -0,0 +1,118 @@
+package collect
+
+import (
+	"errors"
+	"sort"
+	"testing"
+
+	est "github.com/bitcoinfees/feesim/estimate"
+	"github.com/bitcoinfees/feesim/testutil"
+)
+
+func TestRebuildBlockStats(t *testing.T) {
+	db := memBlockStatDB{}
+	for _, h := range []int64{10, 11, 13, 20} {
+		db[h] = &est.BlockStat{
+			Height:            h,
+			Size:              1,
+			SFRStat:           est.SFRStat{SFR: 5000, AK: 1, AN: 1, BK: 1, BN: 1},
+			MempoolSize:       1000,
+			MempoolSizeRemain: 500,
+			Time:              600 * h,
+			NumHashes:         1,
+		}
+	}
+	var failAt int64 = -1
+	getBlock := func(h int64) (Block, error) {
+		if h == failAt {
+			return nil, errors.New("getBlock failed")
+		}
+		return rebuildBlock(h), nil
+	}
+
+	n, err := RebuildBlockStats(db, getBlock, 11, 15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(n, 2); err != nil {
+		t.Error(err)
+	}
+	for _, h := range []int64{11, 13} {
+		ref := &est.BlockStat{
+			Height:            h,
+			Size:              1000 * h,
+			MempoolSize:       1000,
+			MempoolSizeRemain: 500,
+			Time:              600 * h,
+			NumHashes:         float64(h),
+			NoSFR:             true,
+		}
+		if err := testutil.CheckEqual(db[h], ref); err != nil {
+			t.Error(err)
+		}
+	}
+	// Out of range stats are untouched
+	for _, h := range []int64{10, 20} {
+		if db[h].NoSFR || db[h].Size != 1 {
+			t.Errorf("stat at height %d should not be rebuilt", h)
+		}
+	}
+	// Missing stats aren't created
+	if _, ok := db[12]; ok {
+		t.Error("missing stat should not be rebuilt")
+	}
+
+	// The stats rebuilt before a getBlock failure are kept
+	failAt = 13
+	n, err = RebuildBlockStats(db, getBlock, 0, 100)
+	if err == nil {
+		t.Fatal("error should be returned")
+	}
+	if err := testutil.CheckEqual(n, 2); err != nil {
+		t.Error(err)
+	}
+	if !db[10].NoSFR || db[20].NoSFR {
+		t.Error("only stats before the failure should be rebuilt")
+	}
+}
+
+// rebuildBlock at height h has size 1000*h and h hashes.
+type rebuildBlock int64
+
+func (b rebuildBlock) Height() int64 {
+	return int64(b)
+}
+
+func (b rebuildBlock) Size() int64 {
+	return 1000 * int64(b)
+}
+
+func (b rebuildBlock) Txids() []string {
+	return nil
+}
+
+func (b rebuildBlock) NumHashes() float64 {
+	return float64(b)
+}
+
+type memBlockStatDB map[int64]*est.BlockStat
+
+func (d memBlockStatDB) Get(start, end int64) ([]*est.BlockStat, error) {
+	var stats []*est.BlockStat
+	for h, stat := range d {
+		if h >= start && h <= end {
+			s := *stat
+			stats = append(stats, &s)
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Height < stats[j].Height })
+	return stats, nil
+}
+
+func (d memBlockStatDB) Put(b []*est.BlockStat) error {
+	for _, stat := range b {
+		s := *stat
+		d[stat.Height] = &s
+	}
+	return nil
+}
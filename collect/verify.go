@@ -0,0 +1,44 @@
+package collect
+
+import (
+	"fmt"
+
+	est "github.com/bitcoinfees/feesim/estimate"
+)
+
+// VerifyBlockStats checks the stats in db with heights in [start, end] for
+// internal consistency (see est.BlockStat.Check). If getBlock is not nil, the
+// blocks are also re-fetched, and their sizes and hash counts compared
+// against the stored ones. The SFR stats themselves can't be recomputed,
+// since the mempool history isn't stored.
+//
+// Returns the number of stats verified, and the discrepancies found. A
+// getBlock error aborts the verification.
+func VerifyBlockStats(db est.BlockStatDB, getBlock BlockGetter, start, end int64) (int, []error, error) {
+	stats, err := db.Get(start, end)
+	if err != nil {
+		return 0, nil, err
+	}
+	var discrepancies []error
+	for i, stat := range stats {
+		if err := stat.Check(); err != nil {
+			discrepancies = append(discrepancies, fmt.Errorf("block %d: %v", stat.Height, err))
+		}
+		if getBlock == nil {
+			continue
+		}
+		block, err := getBlock(stat.Height)
+		if err != nil {
+			return i, discrepancies, err
+		}
+		if size := block.Size(); size != stat.Size {
+			discrepancies = append(discrepancies,
+				fmt.Errorf("block %d: stored size %d, block has %d", stat.Height, stat.Size, size))
+		}
+		if numHashes := block.NumHashes(); numHashes != stat.NumHashes {
+			discrepancies = append(discrepancies,
+				fmt.Errorf("block %d: stored numhashes %g, block has %g", stat.Height, stat.NumHashes, numHashes))
+		}
+	}
+	return len(stats), discrepancies, nil
+}
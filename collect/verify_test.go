@@ -0,0 +1,72 @@
+package collect
+
+import (
+	"errors"
+	"testing"
+
+	est "github.com/bitcoinfees/feesim/estimate"
+	"github.com/bitcoinfees/feesim/testutil"
+)
+
+func TestVerifyBlockStats(t *testing.T) {
+	db := memBlockStatDB{}
+	for _, h := range []int64{10, 11, 12, 13} {
+		db[h] = &est.BlockStat{
+			Height:            h,
+			Size:              1000 * h,
+			SFRStat:           est.SFRStat{SFR: 5000, AK: 1, AN: 1, BK: 1, BN: 1},
+			MempoolSize:       1000,
+			MempoolSizeRemain: 500,
+			Time:              600 * h,
+			NumHashes:         float64(h),
+		}
+	}
+	db[11].SFRStat.AK = 2 // Inconsistent
+	db[12].Size = 1       // Doesn't match the block
+	var failAt int64 = -1
+	getBlock := func(h int64) (Block, error) {
+		if h == failAt {
+			return nil, errors.New("getBlock failed")
+		}
+		return rebuildBlock(h), nil
+	}
+
+	n, discrepancies, err := VerifyBlockStats(db, getBlock, 10, 13)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(n, 4); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(len(discrepancies), 2); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range discrepancies {
+		t.Log(d)
+	}
+
+	// Without fetching, only the consistency is checked
+	n, discrepancies, err = VerifyBlockStats(db, nil, 10, 13)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(n, 4); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(len(discrepancies), 1); err != nil {
+		t.Error(err)
+	}
+
+	// A getBlock failure aborts
+	failAt = 12
+	n, discrepancies, err = VerifyBlockStats(db, getBlock, 10, 13)
+	if err == nil {
+		t.Fatal("error should be returned")
+	}
+	if err := testutil.CheckEqual(n, 2); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(len(discrepancies), 1); err != nil {
+		t.Error(err)
+	}
+}
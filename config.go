@@ -1,9 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 
 	"gopkg.in/yaml.v2"
 
@@ -18,12 +21,15 @@ const (
 	defaultConfigFileName = "config.yml"
 	configFileEnv         = "FEESIM_CONFIG"
 	dataDirEnv            = "FEESIM_DATADIR"
+	profileEnv            = "FEESIM_PROFILE"
 )
 
 var (
 	defaultFeeSimConfig = FeeSimConfig{
 		Collect: col.Config{
-			PollPeriod: 10,
+			PollPeriod:    10,
+			BlockFetchers: 1,
+			DiskFullPause: 300,
 		},
 		Transient: sim.TransientConfig{
 			MaxBlockConfirms: 12,
@@ -37,13 +43,33 @@ var (
 		SimPeriod: 60,
 		TxMaxAge:  10800, // 3 hours
 		TxGapTol:  3600,  // 1 hour
+
+		CollectErrors: 10,
+		CapacityWarn:  0.9,
+		ClockSkewWarn: 7200, // 2 hours
+		CapacityPct:   CapacityPctConfig{Economical: 0.9, Conservative: 0.1},
+		RBF:           sim.RBFConfig{ReplaceProb: 0.1, MeanBump: 0.25},
 	}
 	defaultConfig = config{
 		FeeSimConfig: defaultFeeSimConfig,
+		Estimate:     EstimateConfig{Alert: AlertConfig{Target: 1}},
 		UniTx: est.UniTxSourceConfig{
 			MinWindow: 600,   // 10 minutes
 			MaxWindow: 10800, // 3 hours
 			Halflife:  3600,  // 1 hour
+
+			MaxFeeRate: 10000000, // 0.1 BTC/kB
+		},
+		TxSourceModel:    "uni",
+		BlockSourceModel: "smfr",
+		DBBackend:        "bolt",
+		MultiTx: est.MultiTxSourceConfig{
+			MinWindow: 600,   // 10 minutes
+			MaxWindow: 10800, // 3 hours
+			Halflife:  3600,  // 1 hour
+			MaxTxs:    10000,
+
+			MaxFeeRate: 10000000, // 0.1 BTC/kB
 		},
 		IndBlock: est.IndBlockSourceConfig{
 			Window:        2016,
@@ -55,6 +81,10 @@ var (
 			Host:    "localhost",
 			Port:    "8332",
 			Timeout: 30,
+
+			MaxResponseSize: 1024,
+			MaxRetries:      3,
+			RetryDelay:      500,
 		},
 		AppRPC: AppRPCConfig{
 			Host: "localhost",
@@ -69,24 +99,49 @@ var (
 type config struct {
 	FeeSimConfig `yaml:",inline"`
 	UniTx        est.UniTxSourceConfig    `yaml:"unitx" json:"unitx"`
+	MultiTx      est.MultiTxSourceConfig  `yaml:"multitx" json:"multitx"`
 	IndBlock     est.IndBlockSourceConfig `yaml:"indblock" json:"indblock"`
+	Estimate     EstimateConfig           `yaml:"estimate" json:"estimate"`
 	BitcoinRPC   corerpc.Config           `yaml:"bitcoinrpc" json:"bitcoinrpc"`
 	AppRPC       AppRPCConfig             `yaml:"apprpc" json:"apprpc"`
 	DataDir      string                   `yaml:"datadir" json:"datadir"`
 	LogFile      string                   `yaml:"logfile" json:"logfile"`
+
+	// The tx source model: "uni" (UniTx) or "multi" (MultiTx).
+	TxSourceModel string `yaml:"txsourcemodel" json:"txsourcemodel"`
+	// The block source model: "ind" (est.IndBlockSource), "smfr"
+	// (est.IndBlockSourceSMFR) or "paired" (est.PairedBlockSource).
+	BlockSourceModel string `yaml:"blocksourcemodel" json:"blocksourcemodel"`
+
+	// The backend of the tx, block stat and predict DBs: "bolt" or "sqlite".
+	DBBackend string `yaml:"dbbackend" json:"dbbackend"`
+}
+
+// EstimateConfig sets the behavior of the fee estimate commands.
+type EstimateConfig struct {
+	// Confirmation target of estimatefee without N, and of the
+	// estimatefeedefault RPC method. If 0, estimatefee without N gives all
+	// the targets.
+	DefaultTarget int `yaml:"defaulttarget" json:"defaulttarget"`
+
+	Alert AlertConfig `yaml:"alert" json:"alert"`
 }
 
 type AppRPCConfig struct {
 	Host string `json:"host" yaml:"host"`
 	Port string `json:"port" yaml:"port"`
+
+	// If not empty, the metrics are served in the Prometheus text format at
+	// this path, e.g. "/metrics".
+	MetricsPath string `json:"metricspath" yaml:"metricspath"`
 }
 
 // loadConfig loads the config. The input arguments specify the path to the
-// config file / data directory.
-// They can also be specified through env variables (configFileEnv / dataDirEnv),
-// with lower precedence.
+// config file / data directory, and the profile to use (if any).
+// They can also be specified through env variables (configFileEnv / dataDirEnv
+// / profileEnv), with lower precedence.
 // If not specified, they are set to default values.
-func loadConfig(configFile, dataDir string) (config, error) {
+func loadConfig(configFile, dataDir, profile string) (config, error) {
 	cfg := defaultConfig
 
 	if configFile == "" {
@@ -95,13 +150,16 @@ func loadConfig(configFile, dataDir string) (config, error) {
 	if dataDir == "" {
 		dataDir = os.Getenv(dataDirEnv)
 	}
+	if profile == "" {
+		profile = os.Getenv(profileEnv)
+	}
 
 	if configFile != "" {
 		// Config file was specified explicitly, so return an error if it
 		// couldn't be read.
 		if c, err := ioutil.ReadFile(configFile); err != nil {
 			return cfg, err
-		} else if err := yaml.Unmarshal(c, &cfg); err != nil {
+		} else if err := unmarshalConfig(c, profile, &cfg); err != nil {
 			return cfg, err
 		}
 	} else {
@@ -113,9 +171,11 @@ func loadConfig(configFile, dataDir string) (config, error) {
 			configFile = filepath.Join(dataDir, defaultConfigFileName)
 		}
 		if c, err := ioutil.ReadFile(configFile); err == nil {
-			if err := yaml.Unmarshal(c, &cfg); err != nil {
+			if err := unmarshalConfig(c, profile, &cfg); err != nil {
 				return cfg, err
 			}
+		} else if profile != "" {
+			return cfg, fmt.Errorf("profile '%s': %v", profile, err)
 		}
 	}
 
@@ -135,3 +195,150 @@ func loadConfig(configFile, dataDir string) (config, error) {
 
 	return cfg, nil
 }
+
+// Validate returns the problems with cfg, e.g. out of range values, which
+// would otherwise only surface when Feesim is running. It doesn't check the
+// node connection or the datadir (see the validate command).
+func (cfg config) Validate() []error {
+	errs := tunableErrors(cfg.FeeSimConfig)
+	if cfg.Predict.MaxBlockConfirms <= 0 {
+		errs = append(errs, fmt.Errorf("predict.maxblockconfirms must be > 0, was %d",
+			cfg.Predict.MaxBlockConfirms))
+	}
+	if cfg.UniTx.MaxWindow <= cfg.UniTx.MinWindow {
+		errs = append(errs, fmt.Errorf("unitx.maxwindow (%d) must be > unitx.minwindow (%d)",
+			cfg.UniTx.MaxWindow, cfg.UniTx.MinWindow))
+	}
+	if cfg.MultiTx.MaxWindow <= cfg.MultiTx.MinWindow {
+		errs = append(errs, fmt.Errorf("multitx.maxwindow (%d) must be > multitx.minwindow (%d)",
+			cfg.MultiTx.MaxWindow, cfg.MultiTx.MinWindow))
+	}
+	if cfg.RBF.Enabled {
+		if p := cfg.RBF.ReplaceProb; p < 0 || p > 1 {
+			errs = append(errs, fmt.Errorf("rbf.replaceprob must be in [0, 1], was %g", p))
+		}
+		if cfg.RBF.MeanBump <= 0 {
+			errs = append(errs, fmt.Errorf("rbf.meanbump must be > 0, was %g", cfg.RBF.MeanBump))
+		}
+	}
+	for _, endpoint := range cfg.BitcoinRPC.ZMQ.Endpoints {
+		if !strings.HasPrefix(endpoint, "tcp://") {
+			errs = append(errs, fmt.Errorf("bitcoinrpc.zmq.endpoints: only tcp:// is supported, was '%s'", endpoint))
+		}
+	}
+	if t := cfg.IndBlock.TailPct; t <= 0 || t > 1 {
+		errs = append(errs, fmt.Errorf("indblock.tailpct must be in (0, 1], was %g", t))
+	}
+	// With emptyprob >= 1, no block would ever confirm a tx.
+	if p := cfg.IndBlock.EmptyProb; p < 0 || p >= 1 {
+		errs = append(errs, fmt.Errorf("indblock.emptyprob must be in [0, 1), was %g", p))
+	}
+	// The RPC API and the dashboard are served at "/".
+	if p := cfg.AppRPC.MetricsPath; p != "" && (!strings.HasPrefix(p, "/") || p == "/") {
+		errs = append(errs, fmt.Errorf("apprpc.metricspath must be a path other than \"/\", was '%s'", p))
+	}
+	switch cfg.TxSourceModel {
+	case txSourceModelUni, txSourceModelMulti, "":
+	default:
+		errs = append(errs, fmt.Errorf("txsourcemodel must be %s or %s, was '%s'",
+			txSourceModelUni, txSourceModelMulti, cfg.TxSourceModel))
+	}
+	switch cfg.BlockSourceModel {
+	case blockSourceModelInd, blockSourceModelSMFR, blockSourceModelPaired, "":
+	default:
+		errs = append(errs, fmt.Errorf("blocksourcemodel must be %s, %s or %s, was '%s'",
+			blockSourceModelInd, blockSourceModelSMFR, blockSourceModelPaired, cfg.BlockSourceModel))
+	}
+	if _, err := dbFile(cfg, "tx"); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// unmarshalConfig unmarshals the yaml config c over cfg. If profile is not
+// empty, the block of that name in the "profiles" map is then unmarshaled over
+// cfg as well; i.e. the top-level settings are shared by all profiles.
+func unmarshalConfig(c []byte, profile string, cfg *config) error {
+	if err := yaml.Unmarshal(c, cfg); err != nil {
+		return err
+	}
+	if profile == "" {
+		return nil
+	}
+	var p struct {
+		Profiles map[string]interface{} `yaml:"profiles"`
+	}
+	if err := yaml.Unmarshal(c, &p); err != nil {
+		return err
+	}
+	block, ok := p.Profiles[profile]
+	if !ok {
+		return fmt.Errorf("profile '%s' not found in config", profile)
+	}
+	b, err := yaml.Marshal(block)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(b, cfg)
+}
+
+// diffConfig returns the effective differences between configs a and b, one
+// per field, in the form "field: a -> b". Fields are named by their yaml
+// keys, and nested fields are joined with ".". Passwords are masked.
+func diffConfig(a, b config) []string {
+	var diffs []string
+	diffValues(reflect.ValueOf(a), reflect.ValueOf(b), "", &diffs)
+	return diffs
+}
+
+// ignoredConfigChanges returns the differences (see diffConfig) between the
+// running config and a reloaded one, other than in the settings applied by
+// FeeSim.Reconfigure; i.e. the changes which need a restart.
+func ignoredConfigChanges(running, reloaded config) []string {
+	reloaded.SimPeriod = running.SimPeriod
+	reloaded.Transient = running.Transient
+	reloaded.Collect.PollPeriod = running.Collect.PollPeriod
+	reloaded.Predict.Halflife = running.Predict.Halflife
+	return diffConfig(running, reloaded)
+}
+
+func diffValues(a, b reflect.Value, prefix string, diffs *[]string) {
+	t := a.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue // unexported
+		}
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		path := name
+		if strings.Contains(field.Tag.Get("yaml"), ",inline") {
+			path = strings.TrimSuffix(prefix, ".")
+		} else if prefix != "" {
+			path = prefix + name
+		}
+
+		fa, fb := a.Field(i), b.Field(i)
+		if fa.Kind() == reflect.Struct {
+			p := path
+			if p != "" {
+				p += "."
+			}
+			diffValues(fa, fb, p, diffs)
+			continue
+		}
+		if reflect.DeepEqual(fa.Interface(), fb.Interface()) {
+			continue
+		}
+		va, vb := fa.Interface(), fb.Interface()
+		if field.Name == "Password" {
+			va, vb = "********", "********"
+		}
+		*diffs = append(*diffs, fmt.Sprintf("%s: %v -> %v", path, va, vb))
+	}
+}
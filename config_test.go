@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bitcoinfees/feesim/sim"
+	"github.com/bitcoinfees/feesim/testutil"
+)
+
+func TestLoadConfigProfiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "feesim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configFile := filepath.Join(dir, "config.yml")
+	const c = `
+bitcoinrpc:
+    username: user
+simperiod: 30
+estimate:
+    alert:
+        feerate: 20000
+profiles:
+    mainnet:
+        bitcoinrpc:
+            port: 8332
+    testnet:
+        bitcoinrpc:
+            port: 18332
+        apprpc:
+            port: 8351
+        simperiod: 120
+`
+	if err := ioutil.WriteFile(configFile, []byte(c), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flat config; profiles are ignored
+	cfg, err := loadConfig(configFile, dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	flat := defaultConfig
+	flat.BitcoinRPC.Username = "user"
+	flat.SimPeriod = 30
+	flat.Estimate.Alert.FeeRate = 20000 // The default target is kept
+	flat.DataDir = dir
+	flat.LogFile = filepath.Join(dir, defaultLogFileName)
+	if err := testutil.CheckEqual(diffConfig(flat, cfg), []string(nil)); err != nil {
+		t.Error(err)
+	}
+
+	// The profile is merged over the top-level settings and defaults
+	cfg, err = loadConfig(configFile, dir, "testnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testnet := flat
+	testnet.BitcoinRPC.Port = "18332"
+	testnet.AppRPC.Port = "8351"
+	testnet.SimPeriod = 120
+	if err := testutil.CheckEqual(diffConfig(testnet, cfg), []string(nil)); err != nil {
+		t.Error(err)
+	}
+
+	cfg, err = loadConfig(configFile, dir, "mainnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(diffConfig(flat, cfg), []string(nil)); err != nil {
+		t.Error(err)
+	}
+
+	// Profile from env var
+	os.Setenv(profileEnv, "testnet")
+	cfg, err = loadConfig(configFile, dir, "")
+	os.Unsetenv(profileEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(cfg.AppRPC.Port, "8351"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := loadConfig(configFile, dir, "regtest"); err == nil {
+		t.Error("missing profile should return an error")
+	}
+	// No config file in the datadir
+	if _, err := loadConfig("", filepath.Join(dir, "empty"), "testnet"); err == nil {
+		t.Error("profile without a config file should return an error")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	if errs := defaultConfig.Validate(); len(errs) > 0 {
+		t.Errorf("default config should be valid: %v", errs)
+	}
+
+	cfg := defaultConfig
+	cfg.Collect.PollPeriod = 0
+	cfg.UniTx.MaxWindow = cfg.UniTx.MinWindow
+	cfg.Predict.MaxBlockConfirms = 0
+	cfg.IndBlock.TailPct = 0
+	cfg.IndBlock.EmptyProb = 1
+	cfg.Transient.MinSuccessPct = 1
+	cfg.DBBackend = "mysql"
+	cfg.AppRPC.MetricsPath = "/"
+	cfg.RBF = sim.RBFConfig{Enabled: true, ReplaceProb: 1.5, MeanBump: 0.25}
+	// All the problems are reported, not just the first.
+	if err := testutil.CheckEqual(len(cfg.Validate()), 9); err != nil {
+		t.Error(err)
+	}
+
+	cfg = defaultConfig
+	cfg.IndBlock.TailPct = 1
+	cfg.Transient.MinSuccessPct = 0
+	cfg.AppRPC.MetricsPath = "/metrics"
+	if errs := cfg.Validate(); len(errs) > 0 {
+		t.Errorf("boundary values should be valid: %v", errs)
+	}
+}
+
+func TestIgnoredConfigChanges(t *testing.T) {
+	running := defaultConfig
+	reloaded := defaultConfig
+	reloaded.SimPeriod = 2 * running.SimPeriod
+	reloaded.Transient.NumIters = 2 * running.Transient.NumIters
+	reloaded.Collect.PollPeriod = 2 * running.Collect.PollPeriod
+	reloaded.Predict.Halflife = 2 * running.Predict.Halflife
+	if err := testutil.CheckEqual(ignoredConfigChanges(running, reloaded), []string(nil)); err != nil {
+		t.Error(err)
+	}
+
+	reloaded.DataDir = "/tmp/feesim"
+	reloaded.AppRPC.Port = "1234"
+	ref := []string{
+		"apprpc.port: " + running.AppRPC.Port + " -> 1234",
+		"datadir: " + running.DataDir + " -> /tmp/feesim",
+	}
+	if err := testutil.CheckEqual(ignoredConfigChanges(running, reloaded), ref); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDiffConfig(t *testing.T) {
+	a, b := defaultConfig, defaultConfig
+	b.Transient.NumIters = 2 * a.Transient.NumIters // Inline FeeSimConfig
+	b.Estimate.Alert.Target = 3                     // Nested two levels
+	b.BitcoinRPC.Password = "secret"                // Masked
+	b.TxSourceModel = "multi"
+	ref := []string{
+		fmt.Sprintf("transient.numiters: %d -> %d", a.Transient.NumIters, b.Transient.NumIters),
+		"estimate.alert.target: 1 -> 3",
+		"bitcoinrpc.password: ******** -> ********",
+		"txsourcemodel: uni -> multi",
+	}
+	if err := testutil.CheckEqual(diffConfig(a, b), ref); err != nil {
+		t.Error(err)
+	}
+
+	// The diff is from a to b
+	ref = []string{
+		fmt.Sprintf("transient.numiters: %d -> %d", b.Transient.NumIters, a.Transient.NumIters),
+		"estimate.alert.target: 3 -> 1",
+		"bitcoinrpc.password: ******** -> ********",
+		"txsourcemodel: multi -> uni",
+	}
+	if err := testutil.CheckEqual(diffConfig(b, a), ref); err != nil {
+		t.Error(err)
+	}
+}
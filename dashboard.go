@@ -0,0 +1,29 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// dashboardHTML is a minimal status page, which polls the RPC API from the
+// browser.
+//
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// withDashboard serves the dashboard for GET requests of /, and passes all
+// other requests (i.e. the RPC POSTs) to rpcHandler.
+func withDashboard(rpcHandler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			rpcHandler.ServeHTTP(w, r)
+			return
+		}
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(dashboardHTML)
+	})
+}
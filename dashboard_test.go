@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/bitcoinfees/feesim/sim"
+	"github.com/bitcoinfees/feesim/testutil"
+)
+
+func TestDashboard(t *testing.T) {
+	s := &Service{FeeSim: &FeeSim{}}
+	s.FeeSim.tunables.simPeriod = 60
+	s.FeeSim.SetResult([]sim.FeeRate{20000, 10000}, nil)
+	srv := httptest.NewServer(s.handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(resp.StatusCode, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Error("Content-Type should be text/html, was", ct)
+	}
+	if !bytes.Equal(body, dashboardHTML) || len(body) == 0 {
+		t.Error("GET / should return the embedded dashboard")
+	}
+
+	resp, err = http.Get(srv.URL + "/nonexistent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if err := testutil.CheckEqual(resp.StatusCode, http.StatusNotFound); err != nil {
+		t.Error(err)
+	}
+
+	// The page's RPC calls are registered Service methods.
+	calls := regexp.MustCompile(`rpc\("(\w+)"`).FindAllSubmatch(dashboardHTML, -1)
+	if len(calls) == 0 {
+		t.Fatal("no RPC calls found in the dashboard")
+	}
+	for _, call := range calls {
+		method := string(call[1])
+		m, ok := rpcMethods[method]
+		if !ok {
+			t.Errorf("RPC method %s is not registered", method)
+			continue
+		}
+		if _, ok := reflect.TypeOf(s).MethodByName(strings.TrimPrefix(m.name, "Service.")); !ok {
+			t.Errorf("RPC method %s maps to nonexistent %s", method, m.name)
+		}
+	}
+
+	// RPC POSTs are still served, in the way the page makes them.
+	req := `{"method": "estimatefeeinfo", "params": [{}], "id": 1}`
+	resp, err = http.Post(srv.URL+"/", "application/json", strings.NewReader(req))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), `"feerates":[0.0002,0.0001]`) {
+		t.Error("unexpected RPC response:", string(body))
+	}
+}
@@ -3,46 +3,71 @@ package bolt
 import (
 	"bytes"
 	"encoding/binary"
-	"time"
+	"os"
 
 	est "github.com/bitcoinfees/feesim/estimate"
 	"github.com/boltdb/bolt"
 )
 
 type blockstatdb struct {
-	db          *bolt.DB
+	db          *ref
 	byteOrder   binary.ByteOrder
 	statsBucket []byte
 }
 
+// LoadBlockStatDB loads the block stat DB only from dbfile (see LoadDB).
 func LoadBlockStatDB(dbfile string) (*blockstatdb, error) {
-	db, err := bolt.Open(dbfile, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	h, err := openHandle(dbfile, false)
 	if err != nil {
 		return nil, err
 	}
-	d := &blockstatdb{
-		db:          db,
-		byteOrder:   binary.BigEndian,
-		statsBucket: []byte("blockstats"),
+	d := newBlockStatDB(h)
+	if err := h.createBuckets([][]byte{d.statsBucket}); err != nil {
+		return nil, err
 	}
-	err = d.db.Update(func(tr *bolt.Tx) error {
-		_, err = tr.CreateBucketIfNotExists(d.statsBucket)
-		return err
-	})
+	return d, nil
+}
+
+// LoadBlockStatDBReadOnly loads the DB for Get only, e.g. for export. Unlike
+// LoadBlockStatDB, it can be loaded more than once concurrently, but not
+// while it's loaded by LoadBlockStatDB.
+func LoadBlockStatDBReadOnly(dbfile string) (*blockstatdb, error) {
+	if _, err := os.Stat(dbfile); err != nil {
+		// bolt.Open would create it.
+		return nil, err
+	}
+	h, err := openHandle(dbfile, true)
 	if err != nil {
 		return nil, err
 	}
-	return d, nil
+	return newBlockStatDB(h), nil
+}
+
+func newBlockStatDB(h *handle) *blockstatdb {
+	return &blockstatdb{
+		db:          h.ref(),
+		byteOrder:   binary.BigEndian,
+		statsBucket: []byte("blockstats"),
+	}
 }
 
 func (d *blockstatdb) Get(start, end int64) ([]*est.BlockStat, error) {
 	var stats []*est.BlockStat
-	err := d.db.View(func(tr *bolt.Tx) error {
+	err := d.db.view(func(tr *bolt.Tx) error {
 		bkt := tr.Bucket(d.statsBucket)
+		if bkt == nil {
+			// A read-only DB which was never written to
+			return nil
+		}
 		c := bkt.Cursor()
 		startkey, endkey := itob(start), itob(end)
 		for k, v := c.Seek(startkey); k != nil && bytes.Compare(k, endkey) <= 0; k, v = c.Next() {
 			b := new(est.BlockStat)
+			// Records written before fields were appended to BlockStat are
+			// shorter; zero-pad them, so that the new fields are zero.
+			if n := binary.Size(b); len(v) < n {
+				v = append(append([]byte(nil), v...), make([]byte, n-len(v))...)
+			}
 			if err := binary.Read(bytes.NewBuffer(v), d.byteOrder, b); err != nil {
 				return err
 			}
@@ -57,7 +82,7 @@ func (d *blockstatdb) Get(start, end int64) ([]*est.BlockStat, error) {
 }
 
 func (d *blockstatdb) Put(b []*est.BlockStat) error {
-	err := d.db.Update(func(tr *bolt.Tx) error {
+	err := d.db.update(func(tr *bolt.Tx) error {
 		bkt := tr.Bucket(d.statsBucket)
 		for _, bi := range b {
 			key := itob(bi.Height)
@@ -74,8 +99,22 @@ func (d *blockstatdb) Put(b []*est.BlockStat) error {
 	return err
 }
 
+// Count returns the number of stats with height in between start and end.
+func (d *blockstatdb) Count(start, end int64) (int, error) {
+	var n int
+	err := d.db.view(func(tr *bolt.Tx) error {
+		c := tr.Bucket(d.statsBucket).Cursor()
+		startkey, endkey := itob(start), itob(end)
+		for k, _ := c.Seek(startkey); k != nil && bytes.Compare(k, endkey) <= 0; k, _ = c.Next() {
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
 func (d *blockstatdb) Delete(start, end int64) error {
-	err := d.db.Update(func(tr *bolt.Tx) error {
+	err := d.db.update(func(tr *bolt.Tx) error {
 		b := tr.Bucket(d.statsBucket)
 		c := b.Cursor()
 		startkey, endkey := itob(start), itob(end)
@@ -93,6 +132,20 @@ func (d *blockstatdb) Delete(start, end int64) error {
 	return err
 }
 
+// Compact shrinks the DB file after a large Delete (see compact). It fails for
+// a read-only DB.
+func (d *blockstatdb) Compact() error {
+	return d.db.compact()
+}
+
+// File returns the path of the DB file, which it may share with other DBs (see
+// LoadDB).
+func (d *blockstatdb) File() string {
+	return d.db.file()
+}
+
+// Close closes the DB, and the file if no other DB loaded with it by LoadDB
+// is open.
 func (d *blockstatdb) Close() error {
-	return d.db.Close()
+	return d.db.close()
 }
@@ -1,11 +1,15 @@
 package bolt
 
 import (
+	"bytes"
+	"encoding/binary"
 	"os"
 	"testing"
 
+	"github.com/bitcoinfees/feesim/db/dbtest"
 	est "github.com/bitcoinfees/feesim/estimate"
 	"github.com/bitcoinfees/feesim/testutil"
+	"github.com/boltdb/bolt"
 )
 
 func TestBlockStatDB(t *testing.T) {
@@ -32,6 +36,7 @@ func TestBlockStatDB(t *testing.T) {
 			MempoolSizeRemain: 2,
 			Time:              2,
 			NumHashes:         200,
+			NoSFR:             true,
 		},
 		{
 			Height:            2,
@@ -98,8 +103,71 @@ func TestBlockStatDB(t *testing.T) {
 		t.Error(err)
 	}
 
+	// Records written before NoSFR was added are one byte shorter
+	old := *statsRef[0]
+	old.Height = 5
+	value := new(bytes.Buffer)
+	if err := binary.Write(value, d.byteOrder, &old); err != nil {
+		t.Fatal(err)
+	}
+	err = d.db.update(func(tr *bolt.Tx) error {
+		v := value.Bytes()
+		return tr.Bucket(d.statsBucket).Put(itob(old.Height), v[:len(v)-1])
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats, err = d.Get(5, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(stats, []*est.BlockStat{&old}); err != nil {
+		t.Error(err)
+	}
+
+	// Read-only access isn't possible while it's loaded
+	if _, err := LoadBlockStatDBReadOnly(dbfile); err == nil {
+		t.Error("read-only load should time out while the DB is loaded")
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Read-only access can be concurrent
+	r1, err := LoadBlockStatDBReadOnly(dbfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := LoadBlockStatDBReadOnly(dbfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats, err = r2.Get(0, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(stats, []*est.BlockStat{statsRef[2], &old}); err != nil {
+		t.Error(err)
+	}
+	if err := r2.Put(statsRef); err == nil {
+		t.Error("read-only DB Put should fail")
+	}
+	r1.Close()
+	r2.Close()
+	if _, err := LoadBlockStatDBReadOnly("testdata/.nonexistent.db"); err == nil {
+		t.Error("read-only load of a nonexistent DB should fail")
+	}
+
 	// Remove dbfile, finally
 	if err := os.Remove(dbfile); err != nil {
 		t.Fatal(err)
 	}
 }
+
+func TestBlockStatDBSuite(t *testing.T) {
+	const dbfile = "testdata/.blockstatsuite.db"
+	os.Remove(dbfile)
+	defer os.Remove(dbfile)
+	dbtest.BlockStatDBSuite(t, func() (dbtest.BlockStatDB, error) {
+		return LoadBlockStatDB(dbfile)
+	}, func() (dbtest.BlockStatDB, error) {
+		return LoadBlockStatDBReadOnly(dbfile)
+	})
+}
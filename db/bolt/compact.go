@@ -0,0 +1,97 @@
+package bolt
+
+import (
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// compact rewrites the DB into a new file with copy, which copies the contents
+// of src into dst, and replaces the DB file with it. Bolt doesn't shrink its
+// file when data is deleted; the freed pages are only reused. The returned DB
+// is the reopened one, or if the DB was closed but couldn't be reopened, the
+// closed db (on which operations fail with bolt.ErrDatabaseNotOpen). If there's
+// an error, the DB file is left as it was.
+func compact(db *bolt.DB, copy func(src, dst *bolt.Tx) error) (*bolt.DB, error) {
+	dbfile := db.Path()
+	tmpfile := dbfile + ".compact"
+	options := &bolt.Options{Timeout: 1 * time.Second}
+
+	os.Remove(tmpfile)
+	tmp, err := bolt.Open(tmpfile, 0600, options)
+	if err != nil {
+		return db, err
+	}
+	err = db.View(func(src *bolt.Tx) error {
+		return tmp.Update(func(dst *bolt.Tx) error {
+			return copy(src, dst)
+		})
+	})
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpfile)
+		return db, err
+	}
+
+	if err := db.Close(); err != nil {
+		os.Remove(tmpfile)
+		return db, err
+	}
+	renameErr := os.Rename(tmpfile, dbfile)
+	if renameErr != nil {
+		os.Remove(tmpfile)
+	}
+	newdb, err := bolt.Open(dbfile, 0600, options)
+	if err != nil {
+		return db, err
+	}
+	return newdb, renameErr
+}
+
+// sequencedDepth is the depth, under each top-level bucket which has them, of
+// the buckets keyed by NextSequence: txdb's txs are in a bucket per tx time,
+// and predictdb's outcomes are in the top-level bucket.
+var sequencedDepth = map[string]int{"txs": 1, "outcomes": 0}
+
+// copyBuckets copies all the buckets of src into dst, for compact. Bolt doesn't
+// copy a bucket's sequence, so the keys of the sequenced buckets are
+// renumbered with NextSequence, in order, so that the sequences continue after
+// the copied keys.
+func copyBuckets(src, dst *bolt.Tx) error {
+	return src.ForEach(func(name []byte, b *bolt.Bucket) error {
+		bdst, err := dst.CreateBucket(name)
+		if err != nil {
+			return err
+		}
+		depth, ok := sequencedDepth[string(name)]
+		if !ok {
+			depth = -1
+		}
+		return copyBucket(b, bdst, depth)
+	})
+}
+
+// copyBucket copies src into dst recursively, renumbering the keys of the
+// buckets at seqDepth below src.
+func copyBucket(src, dst *bolt.Bucket, seqDepth int) error {
+	return src.ForEach(func(k, v []byte) error {
+		if nested := src.Bucket(k); nested != nil {
+			ndst, err := dst.CreateBucket(k)
+			if err != nil {
+				return err
+			}
+			return copyBucket(nested, ndst, seqDepth-1)
+		}
+		if seqDepth == 0 {
+			seq, err := dst.NextSequence()
+			if err != nil {
+				return err
+			}
+			k = itob(int64(seq))
+		}
+		return dst.Put(k, v)
+	})
+}
@@ -0,0 +1,159 @@
+package bolt
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// DB is a single bolt DB file holding the buckets of the tx, block stat and
+// predict DBs, which share its handle, so that the file is locked and synced
+// once rather than three times.
+type DB struct {
+	tx        *txdb
+	blockstat *blockstatdb
+	predict   *predictdb
+}
+
+// LoadDB loads the tx, block stat and predict DBs from dbfile. Each of them
+// must be closed; the file is closed with the last of them.
+func LoadDB(dbfile string) (*DB, error) {
+	h, err := openHandle(dbfile, false)
+	if err != nil {
+		return nil, err
+	}
+	d := &DB{
+		tx:        newTxDB(h),
+		blockstat: newBlockStatDB(h),
+		predict:   newPredictDB(h),
+	}
+	buckets := [][]byte{
+		d.tx.txBucket,
+		d.blockstat.statsBucket,
+		d.predict.txBucket,
+		d.predict.countsBucket,
+		d.predict.outcomesBucket,
+	}
+	if err := h.createBuckets(buckets); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *DB) TxDB() *txdb {
+	return d.tx
+}
+
+func (d *DB) BlockStatDB() *blockstatdb {
+	return d.blockstat
+}
+
+func (d *DB) PredictDB() *predictdb {
+	return d.predict
+}
+
+// handle is a bolt DB shared by the sub-DBs loaded from its file, which is
+// closed when the last of their refs is.
+type handle struct {
+	mux  sync.RWMutex // Write-locked only to replace db (see compact), or to close a ref
+	db   *bolt.DB
+	refs int
+}
+
+func openHandle(dbfile string, readOnly bool) (*handle, error) {
+	db, err := bolt.Open(dbfile, 0600, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: readOnly})
+	if err != nil {
+		return nil, err
+	}
+	return &handle{db: db}, nil
+}
+
+// createBuckets creates the buckets if they don't exist. If that fails, the
+// handle is closed.
+func (h *handle) createBuckets(buckets [][]byte) error {
+	err := h.db.Update(func(tr *bolt.Tx) error {
+		for _, bucket := range buckets {
+			if _, err := tr.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		h.db.Close()
+	}
+	return err
+}
+
+func (h *handle) ref() *ref {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.refs++
+	return &ref{h: h}
+}
+
+// ref is a sub-DB's reference to its handle. Once closed, its operations fail
+// with bolt.ErrDatabaseNotOpen, as they would on a closed bolt.DB, even if
+// the handle is still open for the other sub-DBs.
+type ref struct {
+	h      *handle
+	closed bool // Guarded by h.mux
+}
+
+func (r *ref) view(fn func(*bolt.Tx) error) error {
+	r.h.mux.RLock()
+	defer r.h.mux.RUnlock()
+	if r.closed {
+		return bolt.ErrDatabaseNotOpen
+	}
+	return r.h.db.View(fn)
+}
+
+func (r *ref) update(fn func(*bolt.Tx) error) error {
+	r.h.mux.RLock()
+	defer r.h.mux.RUnlock()
+	if r.closed {
+		return bolt.ErrDatabaseNotOpen
+	}
+	return r.h.db.Update(fn)
+}
+
+// compact shrinks the whole file, i.e. including the buckets of the other
+// sub-DBs sharing it (see compact). It fails for a read-only DB.
+func (r *ref) compact() error {
+	r.h.mux.Lock()
+	defer r.h.mux.Unlock()
+	if r.closed {
+		return bolt.ErrDatabaseNotOpen
+	}
+	if r.h.db.IsReadOnly() {
+		return errors.New("can't compact a read-only DB")
+	}
+	var err error
+	r.h.db, err = compact(r.h.db, copyBuckets)
+	return err
+}
+
+// file returns the path of the DB file.
+func (r *ref) file() string {
+	r.h.mux.RLock()
+	defer r.h.mux.RUnlock()
+	return r.h.db.Path()
+}
+
+// close closes the ref, and the handle if it's the last one. Closing a ref
+// again is a no-op.
+func (r *ref) close() error {
+	r.h.mux.Lock()
+	defer r.h.mux.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	if r.h.refs--; r.h.refs > 0 {
+		return nil
+	}
+	return r.h.db.Close()
+}
@@ -0,0 +1,162 @@
+package bolt
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	est "github.com/bitcoinfees/feesim/estimate"
+	"github.com/bitcoinfees/feesim/predict"
+	"github.com/bitcoinfees/feesim/testutil"
+	"github.com/boltdb/bolt"
+)
+
+func TestDB(t *testing.T) {
+	const (
+		dbfile = "testdata/.feesim.db"
+	)
+	txsRef := []est.Tx{
+		{FeeRate: 5000, Size: 1000, Time: 0},
+		{FeeRate: 10000, Size: 500, Time: 1},
+	}
+	statsRef := []*est.BlockStat{{Height: 1, Size: 250000, Time: 1}}
+	var outcomesRef []predict.Outcome
+	for i := int64(0); i < 5; i++ {
+		outcomesRef = append(outcomesRef, predict.Outcome{ConfirmIn: 1, ConfirmBy: i, Height: i})
+	}
+
+	os.Remove(dbfile)
+	d, err := LoadDB(dbfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txdb, blkdb, predictdb := d.TxDB(), d.BlockStatDB(), d.PredictDB()
+
+	// Shouldn't be able to load again, including a single DB
+	if _, err := LoadDB(dbfile); err == nil {
+		t.Fatal("DB shouldn't load twice")
+	}
+	if _, err := LoadBlockStatDB(dbfile); err == nil {
+		t.Fatal("DB shouldn't load twice")
+	}
+
+	if err := txdb.Put(txsRef); err != nil {
+		t.Fatal(err)
+	}
+	if err := blkdb.Put(statsRef); err != nil {
+		t.Fatal(err)
+	}
+	if err := predictdb.PutOutcomes(outcomesRef[:3], 10); err != nil {
+		t.Fatal(err)
+	}
+
+	// Compacting through one DB keeps the others' data, and the outcomes'
+	// sequence continues after the copied ones.
+	if err := blkdb.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := predictdb.PutOutcomes(outcomesRef[3:], 4); err != nil {
+		t.Fatal(err)
+	}
+	txs, err := txdb.Get(0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(txs, txsRef); err != nil {
+		t.Error(err)
+	}
+	outcomes, err := predictdb.GetOutcomes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(outcomes, outcomesRef[1:]); err != nil {
+		t.Error(err)
+	}
+
+	// Closing one DB doesn't close the others; closing it again is a no-op.
+	if err := txdb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := txdb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := txdb.Get(0, 1); err != bolt.ErrDatabaseNotOpen {
+		t.Errorf("closed DB Get should fail with ErrDatabaseNotOpen, got %v", err)
+	}
+	stats, err := blkdb.Get(0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(stats, statsRef); err != nil {
+		t.Error(err)
+	}
+	if err := blkdb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadDB(dbfile); err == nil {
+		t.Fatal("DB shouldn't load until all its DBs are closed")
+	}
+
+	// The file is closed with the last DB
+	if err := predictdb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ptxdb, err := LoadTxDB(dbfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txs, err = ptxdb.Get(0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(txs, txsRef); err != nil {
+		t.Error(err)
+	}
+	if err := ptxdb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(dbfile); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadSingleDB(t *testing.T) {
+	const dbfile = "testdata/.single.db"
+	for _, tc := range []struct {
+		load    func() (io.Closer, error)
+		buckets []string
+	}{
+		{func() (io.Closer, error) { return LoadTxDB(dbfile) }, []string{"txs"}},
+		{func() (io.Closer, error) { return LoadBlockStatDB(dbfile) }, []string{"blockstats"}},
+		{func() (io.Closer, error) { return LoadPredictDB(dbfile) }, []string{"counts", "outcomes", "tx"}},
+	} {
+		os.Remove(dbfile)
+		d, err := tc.load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Only the loaded DB's buckets are created.
+		db, err := bolt.Open(dbfile, 0600, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buckets []string
+		err = db.View(func(tr *bolt.Tx) error {
+			return tr.ForEach(func(name []byte, _ *bolt.Bucket) error {
+				buckets = append(buckets, string(name))
+				return nil
+			})
+		})
+		db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := testutil.CheckEqual(buckets, tc.buckets); err != nil {
+			t.Error(err)
+		}
+	}
+	os.Remove(dbfile)
+}
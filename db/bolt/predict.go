@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/gob"
-	"time"
 
 	"github.com/boltdb/bolt"
 
@@ -12,49 +11,47 @@ import (
 )
 
 type predictdb struct {
-	db           *bolt.DB
-	byteOrder    binary.ByteOrder
-	txBucket     []byte
-	countsBucket []byte
+	db             *ref
+	byteOrder      binary.ByteOrder
+	txBucket       []byte
+	countsBucket   []byte
+	outcomesBucket []byte
 }
 
+// LoadPredictDB loads the predict DB only from dbfile (see LoadDB).
 func LoadPredictDB(dbfile string) (*predictdb, error) {
-	db, err := bolt.Open(dbfile, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	h, err := openHandle(dbfile, false)
 	if err != nil {
 		return nil, err
 	}
-	d := &predictdb{
-		db:           db,
-		byteOrder:    binary.BigEndian,
-		txBucket:     []byte("tx"),
-		countsBucket: []byte("counts"),
-	}
-	err = d.db.Update(func(tr *bolt.Tx) error {
-		if _, err := tr.CreateBucketIfNotExists(d.txBucket); err != nil {
-			return err
-		}
-		if _, err := tr.CreateBucketIfNotExists(d.countsBucket); err != nil {
-			return err
-		}
-		return nil
-	})
-	if err != nil {
+	d := newPredictDB(h)
+	if err := h.createBuckets([][]byte{d.txBucket, d.countsBucket, d.outcomesBucket}); err != nil {
 		return nil, err
 	}
 	return d, nil
 }
 
+func newPredictDB(h *handle) *predictdb {
+	return &predictdb{
+		db:             h.ref(),
+		byteOrder:      binary.BigEndian,
+		txBucket:       []byte("tx"),
+		countsBucket:   []byte("counts"),
+		outcomesBucket: []byte("outcomes"),
+	}
+}
+
 func (d *predictdb) GetTxs(txids []string) (map[string]predict.Tx, error) {
 	txs := make(map[string]predict.Tx)
-	err := d.db.View(func(tr *bolt.Tx) error {
+	err := d.db.view(func(tr *bolt.Tx) error {
 		bkt := tr.Bucket(d.txBucket)
 		for _, txid := range txids {
 			v := bkt.Get([]byte(txid))
 			if v == nil {
 				continue
 			}
-			var tx predict.Tx
-			if err := binary.Read(bytes.NewBuffer(v), d.byteOrder, &tx); err != nil {
+			tx, err := d.decodeTx(v)
+			if err != nil {
 				return err
 			}
 			txs[txid] = tx
@@ -67,8 +64,43 @@ func (d *predictdb) GetTxs(txids []string) (map[string]predict.Tx, error) {
 	return txs, nil
 }
 
+// AllTxs returns all the stored txs, e.g. for exporting them.
+func (d *predictdb) AllTxs() (map[string]predict.Tx, error) {
+	txs := make(map[string]predict.Tx)
+	err := d.db.view(func(tr *bolt.Tx) error {
+		return tr.Bucket(d.txBucket).ForEach(func(k, v []byte) error {
+			tx, err := d.decodeTx(v)
+			if err != nil {
+				return err
+			}
+			txs[string(k)] = tx
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return txs, nil
+}
+
+func (d *predictdb) decodeTx(v []byte) (predict.Tx, error) {
+	var tx predict.Tx
+	err := binary.Read(bytes.NewBuffer(padRecord(v, binary.Size(&tx))), d.byteOrder, &tx)
+	return tx, err
+}
+
+// padRecord zero-pads v to n bytes. Records written before fields were
+// appended to predict.Tx or predict.Outcome are shorter; padding them makes
+// the new fields zero.
+func padRecord(v []byte, n int) []byte {
+	if len(v) < n {
+		v = append(append([]byte(nil), v...), make([]byte, n-len(v))...)
+	}
+	return v
+}
+
 func (d *predictdb) PutTxs(txs map[string]predict.Tx) error {
-	err := d.db.Update(func(tr *bolt.Tx) error {
+	err := d.db.update(func(tr *bolt.Tx) error {
 		bkt := tr.Bucket(d.txBucket)
 		for txid, tx := range txs {
 			buf := new(bytes.Buffer)
@@ -85,7 +117,7 @@ func (d *predictdb) PutTxs(txs map[string]predict.Tx) error {
 }
 
 func (d *predictdb) GetScores() (attained, exceeded []float64, err error) {
-	err = d.db.View(func(tr *bolt.Tx) error {
+	err = d.db.view(func(tr *bolt.Tx) error {
 		bkt := tr.Bucket(d.countsBucket)
 		if v := bkt.Get([]byte("attained")); v != nil {
 			buf := bytes.NewBuffer(v)
@@ -105,7 +137,7 @@ func (d *predictdb) GetScores() (attained, exceeded []float64, err error) {
 }
 
 func (d *predictdb) PutScores(attained, exceeded []float64) error {
-	err := d.db.Update(func(tr *bolt.Tx) error {
+	err := d.db.update(func(tr *bolt.Tx) error {
 		bkt := tr.Bucket(d.countsBucket)
 		buf := new(bytes.Buffer)
 		if err := gob.NewEncoder(buf).Encode(attained); err != nil {
@@ -128,12 +160,148 @@ func (d *predictdb) PutScores(attained, exceeded []float64) error {
 	return err
 }
 
+// GetFeeScores returns the scores by fee rate bucket, which are nil if none
+// have been stored.
+func (d *predictdb) GetFeeScores() (attained, exceeded [][]float64, err error) {
+	err = d.db.view(func(tr *bolt.Tx) error {
+		bkt := tr.Bucket(d.countsBucket)
+		if v := bkt.Get([]byte("feeattained")); v != nil {
+			buf := bytes.NewBuffer(v)
+			if err := gob.NewDecoder(buf).Decode(&attained); err != nil {
+				return err
+			}
+		}
+		if v := bkt.Get([]byte("feeexceeded")); v != nil {
+			buf := bytes.NewBuffer(v)
+			if err := gob.NewDecoder(buf).Decode(&exceeded); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return
+}
+
+func (d *predictdb) PutFeeScores(attained, exceeded [][]float64) error {
+	err := d.db.update(func(tr *bolt.Tx) error {
+		bkt := tr.Bucket(d.countsBucket)
+		buf := new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(attained); err != nil {
+			return err
+		}
+		if err := bkt.Put([]byte("feeattained"), buf.Bytes()); err != nil {
+			return err
+		}
+
+		buf = new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(exceeded); err != nil {
+			return err
+		}
+		if err := bkt.Put([]byte("feeexceeded"), buf.Bytes()); err != nil {
+			return err
+		}
+
+		return nil
+	})
+	return err
+}
+
+// lastBlock is the last processed block, stored in the counts bucket.
+type lastBlock struct {
+	Height int64
+	Hash   string
+}
+
+func (d *predictdb) GetLastBlock() (height int64, hash string, err error) {
+	height = -1
+	err = d.db.view(func(tr *bolt.Tx) error {
+		v := tr.Bucket(d.countsBucket).Get([]byte("lastblock"))
+		if v == nil {
+			return nil
+		}
+		var b lastBlock
+		if err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&b); err != nil {
+			return err
+		}
+		height, hash = b.Height, b.Hash
+		return nil
+	})
+	return
+}
+
+func (d *predictdb) PutLastBlock(height int64, hash string) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(lastBlock{Height: height, Hash: hash}); err != nil {
+		return err
+	}
+	return d.db.update(func(tr *bolt.Tx) error {
+		return tr.Bucket(d.countsBucket).Put([]byte("lastblock"), buf.Bytes())
+	})
+}
+
+// Outcomes are keyed by insertion sequence number.
+func (d *predictdb) PutOutcomes(outcomes []predict.Outcome, limit int) error {
+	err := d.db.update(func(tr *bolt.Tx) error {
+		bkt := tr.Bucket(d.outcomesBucket)
+		var seq uint64
+		for _, outcome := range outcomes {
+			var err error
+			if seq, err = bkt.NextSequence(); err != nil {
+				return err
+			}
+			buf := new(bytes.Buffer)
+			if err := binary.Write(buf, d.byteOrder, outcome); err != nil {
+				return err
+			}
+			if err := bkt.Put(itob(int64(seq)), buf.Bytes()); err != nil {
+				return err
+			}
+		}
+		// Remove all but the last limit outcomes
+		if int64(seq) <= int64(limit) {
+			return nil
+		}
+		cutoff := itob(int64(seq) - int64(limit))
+		var del [][]byte
+		c := bkt.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, cutoff) <= 0; k, _ = c.Next() {
+			del = append(del, k)
+		}
+		for _, k := range del {
+			if err := bkt.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+func (d *predictdb) GetOutcomes() ([]predict.Outcome, error) {
+	var outcomes []predict.Outcome
+	err := d.db.view(func(tr *bolt.Tx) error {
+		return tr.Bucket(d.outcomesBucket).ForEach(func(k, v []byte) error {
+			var outcome predict.Outcome
+			v = padRecord(v, binary.Size(&outcome))
+			if err := binary.Read(bytes.NewBuffer(v), d.byteOrder, &outcome); err != nil {
+				return err
+			}
+			outcomes = append(outcomes, outcome)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return outcomes, nil
+}
+
 func (d *predictdb) Reconcile(txids []string) error {
 	txidSet := make(map[string]bool)
 	for _, txid := range txids {
 		txidSet[txid] = true
 	}
-	err := d.db.Update(func(tr *bolt.Tx) error {
+	err := d.db.update(func(tr *bolt.Tx) error {
 		var del [][]byte
 		bkt := tr.Bucket(d.txBucket)
 		err := bkt.ForEach(func(k, v []byte) error {
@@ -155,6 +323,8 @@ func (d *predictdb) Reconcile(txids []string) error {
 	return err
 }
 
+// Close closes the DB, and the file if no other DB loaded with it by LoadDB
+// is open.
 func (d *predictdb) Close() error {
-	return d.db.Close()
+	return d.db.close()
 }
@@ -1,12 +1,16 @@
 package bolt
 
 import (
+	"bytes"
+	"encoding/binary"
 	"math"
 	"os"
 	"testing"
 
+	"github.com/bitcoinfees/feesim/db/dbtest"
 	"github.com/bitcoinfees/feesim/predict"
 	"github.com/bitcoinfees/feesim/testutil"
+	"github.com/boltdb/bolt"
 )
 
 func TestPredictDB(t *testing.T) {
@@ -19,6 +23,8 @@ func TestPredictDB(t *testing.T) {
 	}
 
 	var _ predict.DB = d // Test that the interface is satisfied
+	var _ predict.OutcomeDB = d
+	var _ predict.FeeScoreDB = d
 
 	// Shouldn't be able to load again
 	_, err = LoadPredictDB(dbfile)
@@ -51,11 +57,34 @@ func TestPredictDB(t *testing.T) {
 		t.Error(err)
 	}
 
+	// Put and Get fee rate scores; nil until put
+	feeAttainedGet, feeExceededGet, err := d.GetFeeScores()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if feeAttainedGet != nil || feeExceededGet != nil {
+		t.Error("fee rate scores should be nil before being put")
+	}
+	feeAttained := [][]float64{{1, 2}, {3, 4}}
+	feeExceeded := [][]float64{{4, 3}, {2, 1}}
+	if err := d.PutFeeScores(feeAttained, feeExceeded); err != nil {
+		t.Fatal(err)
+	}
+	if feeAttainedGet, feeExceededGet, err = d.GetFeeScores(); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(feeAttainedGet, feeAttained); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(feeExceededGet, feeExceeded); err != nil {
+		t.Error(err)
+	}
+
 	// Put and Get Txs
 	txsRef := map[string]predict.Tx{
 		"0": predict.Tx{ConfirmIn: 1, ConfirmBy: math.MaxInt64},
-		"1": predict.Tx{ConfirmIn: 3, ConfirmBy: 4},
-		"2": predict.Tx{ConfirmIn: 5, ConfirmBy: 1},
+		"1": predict.Tx{ConfirmIn: 3, ConfirmBy: 4, Size: 250},
+		"2": predict.Tx{ConfirmIn: 5, ConfirmBy: 1, Size: 1000, FeeRate: 20000},
 	}
 	if err := d.PutTxs(txsRef); err != nil {
 		t.Fatal(err)
@@ -72,6 +101,12 @@ func TestPredictDB(t *testing.T) {
 	if err := testutil.CheckEqual(len(txs), 2); err != nil {
 		t.Error(err)
 	}
+	if txs, err = d.AllTxs(); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(txs, txsRef); err != nil {
+		t.Error(err)
+	}
 
 	// Reconcile Txs
 	if err := d.Reconcile([]string{"1"}); err != nil {
@@ -88,8 +123,85 @@ func TestPredictDB(t *testing.T) {
 		t.Error(err)
 	}
 
+	// Put and Get Outcomes; only the last limit are kept
+	var outcomesRef []predict.Outcome
+	for i := int64(0); i < 10; i++ {
+		outcomesRef = append(outcomesRef, predict.Outcome{ConfirmIn: 1, ConfirmBy: i, Height: i, Size: 250, FeeRate: 10000})
+	}
+	if err := d.PutOutcomes(outcomesRef[:4], 6); err != nil {
+		t.Fatal(err)
+	}
+	outcomes, err := d.GetOutcomes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(outcomes, outcomesRef[:4]); err != nil {
+		t.Error(err)
+	}
+	if err := d.PutOutcomes(outcomesRef[4:], 6); err != nil {
+		t.Fatal(err)
+	}
+	if outcomes, err = d.GetOutcomes(); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(outcomes, outcomesRef[4:]); err != nil {
+		t.Error(err)
+	}
+
+	// Records written before Size and FeeRate were added are 16 bytes shorter
+	old := predict.Tx{ConfirmIn: 2, ConfirmBy: 3}
+	value := new(bytes.Buffer)
+	if err := binary.Write(value, d.byteOrder, old); err != nil {
+		t.Fatal(err)
+	}
+	err = d.db.update(func(tr *bolt.Tx) error {
+		v := value.Bytes()
+		return tr.Bucket(d.txBucket).Put([]byte("old"), v[:len(v)-16])
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txs, err = d.GetTxs([]string{"old"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(txs["old"], old); err != nil {
+		t.Error(err)
+	}
+
+	// Likewise outcomes written before FeeRate was added are 8 bytes shorter
+	oldOutcome := predict.Outcome{ConfirmIn: 1, ConfirmBy: 20, Height: 20, Size: 250}
+	value.Reset()
+	if err := binary.Write(value, d.byteOrder, oldOutcome); err != nil {
+		t.Fatal(err)
+	}
+	err = d.db.update(func(tr *bolt.Tx) error {
+		v := value.Bytes()
+		return tr.Bucket(d.outcomesBucket).Put(itob(math.MaxInt64), v[:len(v)-8])
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outcomes, err = d.GetOutcomes(); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(outcomes[len(outcomes)-1], oldOutcome); err != nil {
+		t.Error(err)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
 	// Remove dbfile, finally
 	if err := os.Remove(dbfile); err != nil {
 		t.Fatal(err)
 	}
 }
+
+func TestPredictDBSuite(t *testing.T) {
+	const dbfile = "testdata/.predictsuite.db"
+	os.Remove(dbfile)
+	defer os.Remove(dbfile)
+	dbtest.PredictDBSuite(t, func() (dbtest.PredictDB, error) {
+		return LoadPredictDB(dbfile)
+	})
+}
@@ -0,0 +1,96 @@
+package bolt
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	est "github.com/bitcoinfees/feesim/estimate"
+	"github.com/boltdb/bolt"
+)
+
+// ratehistorydb stores the rate snapshots as JSON, keyed by time.
+type ratehistorydb struct {
+	db             *bolt.DB
+	snapshotBucket []byte
+}
+
+func LoadRateHistoryDB(dbfile string) (*ratehistorydb, error) {
+	db, err := bolt.Open(dbfile, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	d := &ratehistorydb{
+		db:             db,
+		snapshotBucket: []byte("ratehistory"),
+	}
+	err = d.db.Update(func(tr *bolt.Tx) error {
+		_, err = tr.CreateBucketIfNotExists(d.snapshotBucket)
+		return err
+	})
+	if err != nil {
+		// Release the file lock, so that the file can be opened again.
+		db.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// Get returns the snapshots with time in between start and end, sorted by
+// time.
+func (d *ratehistorydb) Get(start, end int64) ([]est.RateSnapshot, error) {
+	var snapshots []est.RateSnapshot
+	err := d.db.View(func(tr *bolt.Tx) error {
+		c := tr.Bucket(d.snapshotBucket).Cursor()
+		startkey, endkey := itob(start), itob(end)
+		for k, v := c.Seek(startkey); k != nil && bytes.Compare(k, endkey) <= 0; k, v = c.Next() {
+			var snapshot est.RateSnapshot
+			if err := json.Unmarshal(v, &snapshot); err != nil {
+				return err
+			}
+			snapshots = append(snapshots, snapshot)
+		}
+		return nil
+	})
+	return snapshots, err
+}
+
+// Put stores the snapshots, replacing any with the same time.
+func (d *ratehistorydb) Put(snapshots []est.RateSnapshot) error {
+	return d.db.Update(func(tr *bolt.Tx) error {
+		bkt := tr.Bucket(d.snapshotBucket)
+		for _, snapshot := range snapshots {
+			v, err := json.Marshal(snapshot)
+			if err != nil {
+				return err
+			}
+			if err := bkt.Put(itob(snapshot.Time), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Delete deletes the snapshots with time in between start and end.
+func (d *ratehistorydb) Delete(start, end int64) error {
+	return d.db.Update(func(tr *bolt.Tx) error {
+		bkt := tr.Bucket(d.snapshotBucket)
+		var del [][]byte
+		c := bkt.Cursor()
+		startkey, endkey := itob(start), itob(end)
+		for k, _ := c.Seek(startkey); k != nil && bytes.Compare(k, endkey) <= 0; k, _ = c.Next() {
+			del = append(del, k)
+		}
+		for _, k := range del {
+			if err := bkt.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (d *ratehistorydb) Close() error {
+	return d.db.Close()
+}
@@ -0,0 +1,82 @@
+package bolt
+
+import (
+	"math"
+	"os"
+	"testing"
+
+	est "github.com/bitcoinfees/feesim/estimate"
+	"github.com/bitcoinfees/feesim/testutil"
+)
+
+func TestRateHistoryDB(t *testing.T) {
+	const dbfile = "testdata/.ratehistory.db"
+	os.Remove(dbfile)
+
+	d, err := LoadRateHistoryDB(dbfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Shouldn't be able to load again
+	_, err = LoadRateHistoryDB(dbfile)
+	if err := testutil.CheckEqual(err.Error(), "timeout"); err != nil {
+		t.Error(err)
+	}
+
+	var snapshotsRef []est.RateSnapshot
+	for tm := int64(100); tm < 500; tm += 100 {
+		snapshotsRef = append(snapshotsRef, est.RateSnapshot{
+			Time:    tm,
+			TxRate:  est.RatePoints{X: []float64{1000, 5000}, Y: []float64{float64(tm), 10}},
+			CapRate: est.RatePoints{X: []float64{1000}, Y: []float64{1500}},
+		})
+	}
+	// Put out of order
+	if err := d.Put(snapshotsRef[2:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(snapshotsRef[:2]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Close and reopen
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if d, err = LoadRateHistoryDB(dbfile); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshots, err := d.Get(0, math.MaxInt64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(snapshots, snapshotsRef); err != nil {
+		t.Error(err)
+	}
+	if snapshots, err = d.Get(150, 300); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(snapshots, snapshotsRef[1:3]); err != nil {
+		t.Error(err)
+	}
+
+	if err := d.Delete(0, 200); err != nil {
+		t.Fatal(err)
+	}
+	if snapshots, err = d.Get(0, math.MaxInt64); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(snapshots, snapshotsRef[2:]); err != nil {
+		t.Error(err)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Remove dbfile, finally
+	if err := os.Remove(dbfile); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -6,43 +6,42 @@ import (
 	"bytes"
 	"encoding/binary"
 	"sort"
-	"time"
 
 	est "github.com/bitcoinfees/feesim/estimate"
 	"github.com/boltdb/bolt"
 )
 
 type txdb struct {
-	db        *bolt.DB
+	db        *ref
 	byteOrder binary.ByteOrder
 	txBucket  []byte
 }
 
+// LoadTxDB loads the tx DB only from dbfile (see LoadDB).
 func LoadTxDB(dbfile string) (*txdb, error) {
-	db, err := bolt.Open(dbfile, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	h, err := openHandle(dbfile, false)
 	if err != nil {
 		return nil, err
 	}
-	d := &txdb{
-		db:        db,
-		byteOrder: binary.BigEndian,
-		txBucket:  []byte("txs"),
-	}
-
-	err = d.db.Update(func(tr *bolt.Tx) error {
-		_, err = tr.CreateBucketIfNotExists(d.txBucket)
-		return err
-	})
-	if err != nil {
+	d := newTxDB(h)
+	if err := h.createBuckets([][]byte{d.txBucket}); err != nil {
 		return nil, err
 	}
 	return d, nil
 }
 
+func newTxDB(h *handle) *txdb {
+	return &txdb{
+		db:        h.ref(),
+		byteOrder: binary.BigEndian,
+		txBucket:  []byte("txs"),
+	}
+}
+
 // Get wraps get inside a View tx.
 func (d *txdb) Get(start, end int64) ([]est.Tx, error) {
 	var txs []est.Tx
-	err := d.db.View(func(tr *bolt.Tx) error {
+	err := d.db.view(func(tr *bolt.Tx) error {
 		var err error
 		txs, err = d.get(start, end, tr)
 		return err
@@ -53,21 +52,51 @@ func (d *txdb) Get(start, end int64) ([]est.Tx, error) {
 // Put wraps put inside an Update tx.
 func (d *txdb) Put(txs []est.Tx) error {
 	estTxSlice(txs).Sort() // Faster Putting, I think
-	return d.db.Update(func(tr *bolt.Tx) error {
+	return d.db.update(func(tr *bolt.Tx) error {
 		return d.put(txs, tr)
 	})
 }
 
+// Count returns the number of txs with time in between start and end, without
+// decoding them.
+func (d *txdb) Count(start, end int64) (int, error) {
+	var n int
+	err := d.db.view(func(tr *bolt.Tx) error {
+		b := tr.Bucket(d.txBucket)
+		c := b.Cursor()
+		startkey, endkey := itob(start), itob(end)
+		for k, _ := c.Seek(startkey); k != nil && bytes.Compare(k, endkey) <= 0; k, _ = c.Next() {
+			n += b.Bucket(k).Stats().KeyN
+		}
+		return nil
+	})
+	return n, err
+}
+
 // Delete deletes all txs with time in between start and end.
 func (d *txdb) Delete(start, end int64) error {
-	err := d.db.Update(func(tr *bolt.Tx) error {
+	err := d.db.update(func(tr *bolt.Tx) error {
 		return d.delete(start, end, tr)
 	})
 	return err
 }
 
+// Compact shrinks the DB file after a large Delete (see compact). The tx
+// buckets' sequences continue after the copied txs (see copyBuckets).
+func (d *txdb) Compact() error {
+	return d.db.compact()
+}
+
+// File returns the path of the DB file, which it may share with other DBs (see
+// LoadDB).
+func (d *txdb) File() string {
+	return d.db.file()
+}
+
+// Close closes the DB, and the file if no other DB loaded with it by LoadDB
+// is open.
 func (d *txdb) Close() error {
-	return d.db.Close()
+	return d.db.close()
 }
 
 // get returns a slice of all txs that have Time in between start and end.
@@ -4,6 +4,7 @@ import (
 	"os"
 	"testing"
 
+	"github.com/bitcoinfees/feesim/db/dbtest"
 	est "github.com/bitcoinfees/feesim/estimate"
 	"github.com/bitcoinfees/feesim/testutil"
 )
@@ -75,3 +76,12 @@ func TestTxDB(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestTxDBSuite(t *testing.T) {
+	const dbfile = "testdata/.txsuite.db"
+	os.Remove(dbfile)
+	defer os.Remove(dbfile)
+	dbtest.TxDBSuite(t, func() (dbtest.TxDB, error) {
+		return LoadTxDB(dbfile)
+	})
+}
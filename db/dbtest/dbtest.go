@@ -0,0 +1,453 @@
+// Package dbtest contains the test suites shared by the DB implementations
+// (packages db/bolt and db/sqlite), so that they're tested for the same
+// behavior.
+package dbtest
+
+import (
+	"math"
+	"testing"
+
+	est "github.com/bitcoinfees/feesim/estimate"
+	"github.com/bitcoinfees/feesim/predict"
+	"github.com/bitcoinfees/feesim/testutil"
+)
+
+// TxDB is the tx DB interface of package main.
+type TxDB interface {
+	Get(start, end int64) ([]est.Tx, error)
+	Put([]est.Tx) error
+	Count(start, end int64) (int, error)
+	Delete(start, end int64) error
+	Close() error
+}
+
+// BlockStatDB is the block stat DB interface of package main.
+type BlockStatDB interface {
+	Get(start, end int64) ([]*est.BlockStat, error)
+	Put([]*est.BlockStat) error
+	Count(start, end int64) (int, error)
+	Delete(start, end int64) error
+	Close() error
+}
+
+// Compacter is the optional interface of the tx and block stat DBs of package
+// main, for shrinking the DB file after a large delete.
+type Compacter interface {
+	Compact() error
+}
+
+// PredictDB is the predict DB interface, with the optional interfaces which
+// both implementations satisfy.
+type PredictDB interface {
+	predict.DB
+	predict.OutcomeDB
+	predict.FeeScoreDB
+	predict.LastBlockDB
+	AllTxs() (map[string]predict.Tx, error)
+}
+
+// TxDBSuite tests the TxDB loaded by load, which should load the same, new
+// DB each time. The DB is closed afterwards.
+func TxDBSuite(t *testing.T, load func() (TxDB, error)) {
+	txsRef := []est.Tx{
+		{FeeRate: 5000, Size: 1000, Time: 0},
+		{FeeRate: 10000, Size: 500, Time: 1},
+		{FeeRate: 20000, Size: 250, Time: 2},
+	}
+
+	d, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Shouldn't be able to load again
+	if _, err := load(); err == nil {
+		t.Error("the DB shouldn't load while it's loaded")
+	}
+
+	// Close and reopen
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if d, err = load(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// Put and Get
+	if err := d.Put(txsRef); err != nil {
+		t.Fatal(err)
+	}
+	txs, err := d.Get(0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(txs, txsRef); err != nil {
+		t.Error(err)
+	}
+
+	// Get a subrange
+	if txs, err = d.Get(1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(txs, txsRef[1:]); err != nil {
+		t.Error(err)
+	}
+
+	// Count
+	n, err := d.Count(1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(n, 2); err != nil {
+		t.Error(err)
+	}
+
+	// Delete
+	if err := d.Delete(0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if txs, err = d.Get(0, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(txs, txsRef[2:]); err != nil {
+		t.Error(err)
+	}
+
+	// Compact keeps the txs, and txs can still be put at the same time
+	if c, ok := d.(Compacter); ok {
+		if err := c.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		if txs, err = d.Get(0, 3); err != nil {
+			t.Fatal(err)
+		}
+		if err := testutil.CheckEqual(txs, txsRef[2:]); err != nil {
+			t.Error(err)
+		}
+		if err := d.Put(txsRef[2:]); err != nil {
+			t.Fatal(err)
+		}
+		if txs, err = d.Get(0, 3); err != nil {
+			t.Fatal(err)
+		}
+		if err := testutil.CheckEqual(txs, []est.Tx{txsRef[2], txsRef[2]}); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// BlockStatDBSuite tests the BlockStatDB loaded by load, which should load the
+// same, new DB each time, and by loadReadOnly, which should load it read-only.
+func BlockStatDBSuite(t *testing.T, load, loadReadOnly func() (BlockStatDB, error)) {
+	// Just some random data
+	statsRef := []*est.BlockStat{
+		{
+			Height:            0,
+			Size:              250000,
+			SFRStat:           est.SFRStat{SFR: 10000, AK: 20, AN: 20, BK: 10, BN: 10},
+			MempoolSize:       100000,
+			MempoolSizeRemain: 1,
+			Time:              1,
+			NumHashes:         100,
+		},
+		{
+			Height:            1,
+			Size:              251100,
+			SFRStat:           est.SFRStat{SFR: 10100, AK: 21, AN: 22, BK: 9, BN: 14},
+			MempoolSize:       100001,
+			MempoolSizeRemain: 2,
+			Time:              2,
+			NumHashes:         200,
+			NoSFR:             true,
+		},
+		{
+			Height:            2,
+			Size:              251122,
+			SFRStat:           est.SFRStat{SFR: 10120, AK: 30, AN: 22, BK: 8, BN: 17},
+			MempoolSize:       100001,
+			MempoolSizeRemain: 9,
+			Time:              3,
+			NumHashes:         300,
+		},
+	}
+
+	d, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Shouldn't be able to load again
+	if _, err := load(); err == nil {
+		t.Fatal("the DB shouldn't load while it's loaded")
+	}
+
+	// Close and reopen
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if d, err = load(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Put and Get
+	if err := d.Put(statsRef); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := d.Get(0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(stats, statsRef); err != nil {
+		t.Error(err)
+	}
+
+	// Get a subrange
+	if stats, err = d.Get(1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(stats, statsRef[1:]); err != nil {
+		t.Error(err)
+	}
+
+	// Put replaces the stat of the same height
+	replaced := *statsRef[2]
+	replaced.Size++
+	if err := d.Put([]*est.BlockStat{&replaced}); err != nil {
+		t.Fatal(err)
+	}
+	if stats, err = d.Get(2, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(stats, []*est.BlockStat{&replaced}); err != nil {
+		t.Error(err)
+	}
+	if err := d.Put(statsRef[2:]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Count
+	n, err := d.Count(1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(n, 2); err != nil {
+		t.Error(err)
+	}
+
+	// Delete
+	if err := d.Delete(0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if stats, err = d.Get(0, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(stats, statsRef[2:]); err != nil {
+		t.Error(err)
+	}
+
+	// Compact keeps the stats
+	if c, ok := d.(Compacter); ok {
+		if err := c.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		if stats, err = d.Get(0, 3); err != nil {
+			t.Fatal(err)
+		}
+		if err := testutil.CheckEqual(stats, statsRef[2:]); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Read-only access isn't possible while it's loaded
+	if _, err := loadReadOnly(); err == nil {
+		t.Error("read-only load should fail while the DB is loaded")
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Read-only access can be concurrent
+	r1, err := loadReadOnly()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r1.Close()
+	r2, err := loadReadOnly()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r2.Close()
+	if stats, err = r2.Get(0, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(stats, statsRef[2:]); err != nil {
+		t.Error(err)
+	}
+	if err := r2.Put(statsRef); err == nil {
+		t.Error("read-only DB Put should fail")
+	}
+	if c, ok := r2.(Compacter); ok {
+		if err := c.Compact(); err == nil {
+			t.Error("read-only DB Compact should fail")
+		}
+	}
+}
+
+// PredictDBSuite tests the PredictDB loaded by load, which should load the
+// same, new DB each time. The DB is closed afterwards.
+func PredictDBSuite(t *testing.T, load func() (PredictDB, error)) {
+	d, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Shouldn't be able to load again
+	if _, err := load(); err == nil {
+		t.Fatal("the DB shouldn't load while it's loaded")
+	}
+
+	// Close and reopen
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if d, err = load(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// Scores are nil until put
+	attainedGet, exceededGet, err := d.GetScores()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attainedGet != nil || exceededGet != nil {
+		t.Error("scores should be nil before being put")
+	}
+
+	// Put and Get Counts
+	attained := []float64{1, 2, 3, 4}
+	exceeded := []float64{4, 3, 2, 1}
+	if err := d.PutScores(attained, exceeded); err != nil {
+		t.Fatal(err)
+	}
+	if attainedGet, exceededGet, err = d.GetScores(); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(attained, attainedGet); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(exceeded, exceededGet); err != nil {
+		t.Error(err)
+	}
+
+	// Put and Get fee rate scores; nil until put
+	feeAttainedGet, feeExceededGet, err := d.GetFeeScores()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if feeAttainedGet != nil || feeExceededGet != nil {
+		t.Error("fee rate scores should be nil before being put")
+	}
+	feeAttained := [][]float64{{1, 2}, {3, 4}}
+	feeExceeded := [][]float64{{4, 3}, {2, 1}}
+	if err := d.PutFeeScores(feeAttained, feeExceeded); err != nil {
+		t.Fatal(err)
+	}
+	if feeAttainedGet, feeExceededGet, err = d.GetFeeScores(); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(feeAttainedGet, feeAttained); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(feeExceededGet, feeExceeded); err != nil {
+		t.Error(err)
+	}
+
+	// Put and Get the last block; height -1 until put
+	height, hash, err := d.GetLastBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(height, int64(-1)); err != nil {
+		t.Error(err)
+	}
+	if err := d.PutLastBlock(100, "abc"); err != nil {
+		t.Fatal(err)
+	}
+	if height, hash, err = d.GetLastBlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(height, int64(100)); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(hash, "abc"); err != nil {
+		t.Error(err)
+	}
+
+	// Put and Get Txs
+	txsRef := map[string]predict.Tx{
+		"0": predict.Tx{ConfirmIn: 1, ConfirmBy: math.MaxInt64},
+		"1": predict.Tx{ConfirmIn: 3, ConfirmBy: 4, Size: 250},
+		"2": predict.Tx{ConfirmIn: 5, ConfirmBy: 1, Size: 1000, FeeRate: 20000},
+	}
+	if err := d.PutTxs(txsRef); err != nil {
+		t.Fatal(err)
+	}
+	txs, err := d.GetTxs([]string{"0", "2", "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, txid := range []string{"0", "2"} {
+		if err := testutil.CheckEqual(txs[txid], txsRef[txid]); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := testutil.CheckEqual(len(txs), 2); err != nil {
+		t.Error(err)
+	}
+	if txs, err = d.AllTxs(); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(txs, txsRef); err != nil {
+		t.Error(err)
+	}
+
+	// Reconcile Txs
+	if err := d.Reconcile([]string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	if txs, err = d.GetTxs([]string{"0", "1", "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(len(txs), 1); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(txs["1"], txsRef["1"]); err != nil {
+		t.Error(err)
+	}
+
+	// Put and Get Outcomes; only the last limit are kept
+	var outcomesRef []predict.Outcome
+	for i := int64(0); i < 10; i++ {
+		outcomesRef = append(outcomesRef, predict.Outcome{ConfirmIn: 1, ConfirmBy: i, Height: i, Size: 250, FeeRate: 10000})
+	}
+	if err := d.PutOutcomes(outcomesRef[:4], 6); err != nil {
+		t.Fatal(err)
+	}
+	outcomes, err := d.GetOutcomes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(outcomes, outcomesRef[:4]); err != nil {
+		t.Error(err)
+	}
+	if err := d.PutOutcomes(outcomesRef[4:], 6); err != nil {
+		t.Fatal(err)
+	}
+	if outcomes, err = d.GetOutcomes(); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(outcomes, outcomesRef[4:]); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,107 @@
+package sqlite
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	est "github.com/bitcoinfees/feesim/estimate"
+)
+
+// The stats are stored as JSON, so that fields appended to est.BlockStat
+// are zero in the older records.
+const blockStatSchema = `
+CREATE TABLE IF NOT EXISTS blockstats (
+	height INTEGER PRIMARY KEY,
+	stat   TEXT NOT NULL
+);
+`
+
+type blockstatdb struct {
+	db *sql.DB
+}
+
+func LoadBlockStatDB(dbfile string) (*blockstatdb, error) {
+	db, err := open(dbfile, blockStatSchema)
+	if err != nil {
+		return nil, err
+	}
+	return &blockstatdb{db: db}, nil
+}
+
+// LoadBlockStatDBReadOnly loads the DB for Get only, e.g. for export. Unlike
+// LoadBlockStatDB, it can be loaded more than once concurrently, but not
+// while it's loaded by LoadBlockStatDB.
+func LoadBlockStatDBReadOnly(dbfile string) (*blockstatdb, error) {
+	db, err := openReadOnly(dbfile)
+	if err != nil {
+		return nil, err
+	}
+	return &blockstatdb{db: db}, nil
+}
+
+func (d *blockstatdb) Get(start, end int64) ([]*est.BlockStat, error) {
+	rows, err := d.db.Query(
+		"SELECT stat FROM blockstats WHERE height BETWEEN ? AND ? ORDER BY height", start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stats []*est.BlockStat
+	for rows.Next() {
+		var v []byte
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		b := new(est.BlockStat)
+		if err := json.Unmarshal(v, b); err != nil {
+			return nil, err
+		}
+		stats = append(stats, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func (d *blockstatdb) Put(b []*est.BlockStat) error {
+	return update(d.db, func(tr *sql.Tx) error {
+		stmt, err := tr.Prepare("INSERT OR REPLACE INTO blockstats (height, stat) VALUES (?, ?)")
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, bi := range b {
+			v, err := json.Marshal(bi)
+			if err != nil {
+				return err
+			}
+			if _, err := stmt.Exec(bi.Height, string(v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Count returns the number of stats with height in between start and end.
+func (d *blockstatdb) Count(start, end int64) (int, error) {
+	var n int
+	err := d.db.QueryRow("SELECT COUNT(*) FROM blockstats WHERE height BETWEEN ? AND ?", start, end).Scan(&n)
+	return n, err
+}
+
+func (d *blockstatdb) Delete(start, end int64) error {
+	_, err := d.db.Exec("DELETE FROM blockstats WHERE height BETWEEN ? AND ?", start, end)
+	return err
+}
+
+// Compact shrinks the DB file after a large Delete (see vacuum).
+func (d *blockstatdb) Compact() error {
+	return vacuum(d.db)
+}
+
+func (d *blockstatdb) Close() error {
+	return d.db.Close()
+}
@@ -0,0 +1,42 @@
+package sqlite
+
+import (
+	"os"
+	"testing"
+
+	"github.com/bitcoinfees/feesim/db/dbtest"
+	est "github.com/bitcoinfees/feesim/estimate"
+	"github.com/bitcoinfees/feesim/testutil"
+)
+
+func TestBlockStatDB(t *testing.T) {
+	const dbfile = "testdata/.blockstat.sqlite"
+	os.Remove(dbfile)
+	defer os.Remove(dbfile)
+	dbtest.BlockStatDBSuite(t, func() (dbtest.BlockStatDB, error) {
+		return LoadBlockStatDB(dbfile)
+	}, func() (dbtest.BlockStatDB, error) {
+		return LoadBlockStatDBReadOnly(dbfile)
+	})
+
+	// Records written before NoSFR was added lack it
+	d, err := LoadBlockStatDB(dbfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if _, err := d.db.Exec(`INSERT INTO blockstats (height, stat) VALUES (5, '{"height": 5, "size": 1000}')`); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := d.Get(5, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(stats, []*est.BlockStat{{Height: 5, Size: 1000}}); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := LoadBlockStatDBReadOnly("testdata/.nonexistent.sqlite"); err == nil {
+		t.Error("read-only load of a nonexistent DB should fail")
+	}
+}
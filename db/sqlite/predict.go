@@ -0,0 +1,276 @@
+package sqlite
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	"github.com/bitcoinfees/feesim/predict"
+)
+
+// The scores, and the last processed block, are stored as JSON, keyed by
+// name.
+const predictSchema = `
+CREATE TABLE IF NOT EXISTS txs (
+	txid      TEXT PRIMARY KEY,
+	confirmin INTEGER NOT NULL,
+	confirmby INTEGER NOT NULL,
+	size      INTEGER NOT NULL DEFAULT 0,
+	feerate   INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS scores (
+	name  TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS outcomes (
+	seq       INTEGER PRIMARY KEY AUTOINCREMENT,
+	confirmin INTEGER NOT NULL,
+	confirmby INTEGER NOT NULL,
+	height    INTEGER NOT NULL,
+	size      INTEGER NOT NULL DEFAULT 0,
+	feerate   INTEGER NOT NULL DEFAULT 0
+);
+`
+
+type predictdb struct {
+	db *sql.DB
+}
+
+func LoadPredictDB(dbfile string) (*predictdb, error) {
+	db, err := open(dbfile, predictSchema)
+	if err != nil {
+		return nil, err
+	}
+	return &predictdb{db: db}, nil
+}
+
+func (d *predictdb) GetTxs(txids []string) (map[string]predict.Tx, error) {
+	txs := make(map[string]predict.Tx)
+	stmt, err := d.db.Prepare("SELECT confirmin, confirmby, size, feerate FROM txs WHERE txid = ?")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	for _, txid := range txids {
+		var tx predict.Tx
+		err := stmt.QueryRow(txid).Scan(&tx.ConfirmIn, &tx.ConfirmBy, &tx.Size, &tx.FeeRate)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		txs[txid] = tx
+	}
+	return txs, nil
+}
+
+// AllTxs returns all the stored txs, e.g. for exporting them.
+func (d *predictdb) AllTxs() (map[string]predict.Tx, error) {
+	rows, err := d.db.Query("SELECT txid, confirmin, confirmby, size, feerate FROM txs")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	txs := make(map[string]predict.Tx)
+	for rows.Next() {
+		var (
+			txid string
+			tx   predict.Tx
+		)
+		if err := rows.Scan(&txid, &tx.ConfirmIn, &tx.ConfirmBy, &tx.Size, &tx.FeeRate); err != nil {
+			return nil, err
+		}
+		txs[txid] = tx
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return txs, nil
+}
+
+func (d *predictdb) PutTxs(txs map[string]predict.Tx) error {
+	return update(d.db, func(tr *sql.Tx) error {
+		stmt, err := tr.Prepare(
+			"INSERT OR REPLACE INTO txs (txid, confirmin, confirmby, size, feerate) VALUES (?, ?, ?, ?, ?)")
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for txid, tx := range txs {
+			if _, err := stmt.Exec(txid, tx.ConfirmIn, tx.ConfirmBy, tx.Size, tx.FeeRate); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (d *predictdb) GetScores() (attained, exceeded []float64, err error) {
+	if err = d.getScore("attained", &attained); err != nil {
+		return
+	}
+	err = d.getScore("exceeded", &exceeded)
+	return
+}
+
+func (d *predictdb) PutScores(attained, exceeded []float64) error {
+	return d.putScores(map[string]interface{}{"attained": attained, "exceeded": exceeded})
+}
+
+// GetFeeScores returns the scores by fee rate bucket, which are nil if none
+// have been stored.
+func (d *predictdb) GetFeeScores() (attained, exceeded [][]float64, err error) {
+	if err = d.getScore("feeattained", &attained); err != nil {
+		return
+	}
+	err = d.getScore("feeexceeded", &exceeded)
+	return
+}
+
+func (d *predictdb) PutFeeScores(attained, exceeded [][]float64) error {
+	return d.putScores(map[string]interface{}{"feeattained": attained, "feeexceeded": exceeded})
+}
+
+// lastBlock is the last processed block, stored in the scores table.
+type lastBlock struct {
+	Height int64  `json:"height"`
+	Hash   string `json:"hash"`
+}
+
+func (d *predictdb) GetLastBlock() (height int64, hash string, err error) {
+	b := lastBlock{Height: -1}
+	if err = d.getScore("lastblock", &b); err != nil {
+		return
+	}
+	return b.Height, b.Hash, nil
+}
+
+func (d *predictdb) PutLastBlock(height int64, hash string) error {
+	return d.putScores(map[string]interface{}{"lastblock": lastBlock{Height: height, Hash: hash}})
+}
+
+// getScore decodes the named score into v, which is left as is if the score
+// hasn't been stored.
+func (d *predictdb) getScore(name string, v interface{}) error {
+	var value []byte
+	err := d.db.QueryRow("SELECT value FROM scores WHERE name = ?", name).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(value, v)
+}
+
+// putScores stores the scores, keyed by name, in one transaction.
+func (d *predictdb) putScores(scores map[string]interface{}) error {
+	return update(d.db, func(tr *sql.Tx) error {
+		for name, score := range scores {
+			value, err := json.Marshal(score)
+			if err != nil {
+				return err
+			}
+			if _, err := tr.Exec("INSERT OR REPLACE INTO scores (name, value) VALUES (?, ?)",
+				name, string(value)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Outcomes are keyed by insertion sequence number.
+func (d *predictdb) PutOutcomes(outcomes []predict.Outcome, limit int) error {
+	return update(d.db, func(tr *sql.Tx) error {
+		stmt, err := tr.Prepare(
+			"INSERT INTO outcomes (confirmin, confirmby, height, size, feerate) VALUES (?, ?, ?, ?, ?)")
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		var seq int64
+		for _, o := range outcomes {
+			res, err := stmt.Exec(o.ConfirmIn, o.ConfirmBy, o.Height, o.Size, o.FeeRate)
+			if err != nil {
+				return err
+			}
+			if seq, err = res.LastInsertId(); err != nil {
+				return err
+			}
+		}
+		// Remove all but the last limit outcomes
+		if seq <= int64(limit) {
+			return nil
+		}
+		_, err = tr.Exec("DELETE FROM outcomes WHERE seq <= ?", seq-int64(limit))
+		return err
+	})
+}
+
+func (d *predictdb) GetOutcomes() ([]predict.Outcome, error) {
+	rows, err := d.db.Query(
+		"SELECT confirmin, confirmby, height, size, feerate FROM outcomes ORDER BY seq")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var outcomes []predict.Outcome
+	for rows.Next() {
+		var o predict.Outcome
+		if err := rows.Scan(&o.ConfirmIn, &o.ConfirmBy, &o.Height, &o.Size, &o.FeeRate); err != nil {
+			return nil, err
+		}
+		outcomes = append(outcomes, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return outcomes, nil
+}
+
+func (d *predictdb) Reconcile(txids []string) error {
+	txidSet := make(map[string]bool)
+	for _, txid := range txids {
+		txidSet[txid] = true
+	}
+	return update(d.db, func(tr *sql.Tx) error {
+		rows, err := tr.Query("SELECT txid FROM txs")
+		if err != nil {
+			return err
+		}
+		var del []string
+		for rows.Next() {
+			var txid string
+			if err := rows.Scan(&txid); err != nil {
+				rows.Close()
+				return err
+			}
+			if !txidSet[txid] {
+				del = append(del, txid)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		stmt, err := tr.Prepare("DELETE FROM txs WHERE txid = ?")
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, txid := range del {
+			if _, err := stmt.Exec(txid); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (d *predictdb) Close() error {
+	return d.db.Close()
+}
@@ -0,0 +1,23 @@
+package sqlite
+
+import (
+	"os"
+	"testing"
+
+	"github.com/bitcoinfees/feesim/db/dbtest"
+	"github.com/bitcoinfees/feesim/predict"
+)
+
+func TestPredictDB(t *testing.T) {
+	const dbfile = "testdata/.predict.sqlite"
+	os.Remove(dbfile)
+	defer os.Remove(dbfile)
+
+	var _ predict.DB = &predictdb{} // Test that the interfaces are satisfied
+	var _ predict.OutcomeDB = &predictdb{}
+	var _ predict.FeeScoreDB = &predictdb{}
+
+	dbtest.PredictDBSuite(t, func() (dbtest.PredictDB, error) {
+		return LoadPredictDB(dbfile)
+	})
+}
@@ -0,0 +1,75 @@
+// Package sqlite contains implementations of the DB interfaces used by package
+// main, backed by SQLite. Unlike the bolt DBs, they can be inspected with the
+// usual SQLite tools (while Feesim isn't running).
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// open opens (creating if necessary) the DB in dbfile, and creates the tables
+// in schema if they don't exist. As with bolt, the DB is locked for exclusive
+// use until it's closed; opening it again meanwhile fails after a timeout of
+// 1 second.
+func open(dbfile, schema string) (*sql.DB, error) {
+	dsn := fmt.Sprintf("file:%s?_busy_timeout=1000&_locking_mode=EXCLUSIVE", dbfile)
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// The lock is held by the connection, so there must be just one.
+	db.SetMaxOpenConns(1)
+
+	// In exclusive locking mode, the lock is taken at the first write and
+	// then held, so take it now by writing the schema.
+	if _, err := db.Exec("BEGIN EXCLUSIVE;" + schema + "COMMIT;"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// openReadOnly opens the existing DB in dbfile for reading only. It can be
+// opened more than once concurrently, but not while it's opened by open.
+func openReadOnly(dbfile string) (*sql.DB, error) {
+	if _, err := os.Stat(dbfile); err != nil {
+		return nil, err
+	}
+	dsn := fmt.Sprintf("file:%s?mode=ro&_busy_timeout=1000", dbfile)
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// Check that it's not locked.
+	if _, err := db.Exec("SELECT count(*) FROM sqlite_master"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// vacuum rebuilds the DB, so that the space freed by deletes is returned to
+// the filesystem; SQLite otherwise only reuses it. It fails for a read-only
+// DB.
+func vacuum(db *sql.DB) error {
+	_, err := db.Exec("VACUUM")
+	return err
+}
+
+// update runs f in a transaction, which is committed if f returns nil, and
+// rolled back otherwise.
+func update(db *sql.DB, f func(*sql.Tx) error) error {
+	tr, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := f(tr); err != nil {
+		tr.Rollback()
+		return err
+	}
+	return tr.Commit()
+}
@@ -0,0 +1,120 @@
+package sqlite
+
+import (
+	"database/sql"
+	"sort"
+
+	est "github.com/bitcoinfees/feesim/estimate"
+)
+
+// The txs are indexed by time, for the range queries of Get and Delete.
+const txSchema = `
+CREATE TABLE IF NOT EXISTS txs (
+	time    INTEGER NOT NULL,
+	feerate INTEGER NOT NULL,
+	size    INTEGER NOT NULL,
+	type    INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS txs_time ON txs (time);
+`
+
+type txdb struct {
+	db *sql.DB
+}
+
+func LoadTxDB(dbfile string) (*txdb, error) {
+	db, err := open(dbfile, txSchema)
+	if err != nil {
+		return nil, err
+	}
+	return &txdb{db: db}, nil
+}
+
+// Get returns all txs with time in between start and end, in order of time,
+// and then of insertion.
+func (d *txdb) Get(start, end int64) ([]est.Tx, error) {
+	rows, err := d.db.Query(
+		"SELECT feerate, size, time, type FROM txs WHERE time BETWEEN ? AND ? ORDER BY time, rowid",
+		start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var txs []est.Tx
+	for rows.Next() {
+		var tx est.Tx
+		if err := rows.Scan(&tx.FeeRate, &tx.Size, &tx.Time, &tx.Type); err != nil {
+			return nil, err
+		}
+		txs = append(txs, tx)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return txs, nil
+}
+
+func (d *txdb) Put(txs []est.Tx) error {
+	estTxSlice(txs).Sort() // For the same Get order as the bolt DB
+	return update(d.db, func(tr *sql.Tx) error {
+		stmt, err := tr.Prepare("INSERT INTO txs (time, feerate, size, type) VALUES (?, ?, ?, ?)")
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, tx := range txs {
+			if _, err := stmt.Exec(tx.Time, tx.FeeRate, tx.Size, tx.Type); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Count returns the number of txs with time in between start and end.
+func (d *txdb) Count(start, end int64) (int, error) {
+	var n int
+	err := d.db.QueryRow("SELECT COUNT(*) FROM txs WHERE time BETWEEN ? AND ?", start, end).Scan(&n)
+	return n, err
+}
+
+// Delete deletes all txs with time in between start and end.
+func (d *txdb) Delete(start, end int64) error {
+	_, err := d.db.Exec("DELETE FROM txs WHERE time BETWEEN ? AND ?", start, end)
+	return err
+}
+
+// Compact shrinks the DB file after a large Delete (see vacuum).
+func (d *txdb) Compact() error {
+	return vacuum(d.db)
+}
+
+func (d *txdb) Close() error {
+	return d.db.Close()
+}
+
+// estTxSlice implements sort.Interface for []est.Tx
+type estTxSlice []est.Tx
+
+func (s estTxSlice) Len() int {
+	return len(s)
+}
+
+func (s estTxSlice) Less(i, j int) bool {
+	if s[i].Time != s[j].Time {
+		return s[i].Time < s[j].Time
+	}
+	if s[i].Size != s[j].Size {
+		return s[i].Size < s[j].Size
+	}
+	return s[i].FeeRate < s[j].FeeRate
+}
+
+func (s estTxSlice) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s estTxSlice) Sort() {
+	sort.Sort(s)
+}
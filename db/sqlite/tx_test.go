@@ -0,0 +1,49 @@
+package sqlite
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/bitcoinfees/feesim/db/dbtest"
+)
+
+func TestTxDB(t *testing.T) {
+	const dbfile = "testdata/.tx.sqlite"
+	os.Remove(dbfile)
+	defer os.Remove(dbfile)
+	dbtest.TxDBSuite(t, func() (dbtest.TxDB, error) {
+		return LoadTxDB(dbfile)
+	})
+
+	// The range queries use the time index
+	d, err := LoadTxDB(dbfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	for _, query := range []string{
+		"SELECT feerate FROM txs WHERE time BETWEEN 0 AND 1 ORDER BY time, rowid",
+		"DELETE FROM txs WHERE time BETWEEN 0 AND 1",
+	} {
+		rows, err := d.db.Query("EXPLAIN QUERY PLAN " + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var plan []string
+		for rows.Next() {
+			var (
+				id, parent, notused int
+				detail              string
+			)
+			if err := rows.Scan(&id, &parent, &notused, &detail); err != nil {
+				t.Fatal(err)
+			}
+			plan = append(plan, detail)
+		}
+		rows.Close()
+		if !strings.Contains(strings.Join(plan, "\n"), "txs_time") {
+			t.Errorf("%s: the time index isn't used: %v", query, plan)
+		}
+	}
+}
@@ -5,6 +5,11 @@ Package estimate produces estimates of the models defined in package sim
 package estimate
 
 import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+
 	"github.com/bitcoinfees/feesim/sim"
 )
 
@@ -26,6 +31,15 @@ type BlockStatDB interface {
 	Get(start, end int64) ([]*BlockStat, error) // Result must be height-sorted
 }
 
+// simSize converts the stored size (in virtual bytes, as are the Tx and
+// BlockStat sizes) to the sim's size units, i.e. weight units if weightUnits.
+func simSize(size sim.TxSize, weightUnits bool) sim.TxSize {
+	if weightUnits {
+		return size * sim.WitnessScaleFactor
+	}
+	return size
+}
+
 type Tx struct {
 	FeeRate sim.FeeRate `json:"feerate"`
 	Size    sim.TxSize  `json:"size"`
@@ -33,6 +47,21 @@ type Tx struct {
 	Type    int64       // Reserved; in the future we might want to model RBF txs
 }
 
+// RateSnapshot is a snapshot of the tx and capacity byte rate functions of
+// the estimated sources, taken at Unix time Time.
+type RateSnapshot struct {
+	Time    int64      `json:"time"`
+	TxRate  RatePoints `json:"txrate"`
+	CapRate RatePoints `json:"caprate"`
+}
+
+// RatePoints are the points of a byte rate function: the byte rate Y
+// (bytes/s) at fee rate X (satoshis/kB).
+type RatePoints struct {
+	X []float64 `json:"x"`
+	Y []float64 `json:"y"`
+}
+
 type BlockStat struct {
 	// Block height
 	Height int64 `json:"height"`
@@ -55,4 +84,101 @@ type BlockStat struct {
 
 	// Expected number of hashes used to solve this block (function of nBits)
 	NumHashes float64 `json:"numhashes"`
+
+	// Set if the stat was rebuilt from the block alone (see
+	// collect.RebuildBlockStats). The SFR stats and mempool sizes can't be
+	// recomputed without the mempool history, so they're not used.
+	NoSFR bool `json:"nosfr"`
+}
+
+// Check returns an error if the stat is internally inconsistent. The SFR
+// stats are checked with SFRStat.Check, unless NoSFR, in which case they must
+// be zero.
+func (b *BlockStat) Check() error {
+	if b.Size <= 0 {
+		return fmt.Errorf("non-positive size %d", b.Size)
+	}
+	if b.NumHashes <= 0 {
+		return fmt.Errorf("non-positive numhashes %g", b.NumHashes)
+	}
+	if b.MempoolSizeRemain < 0 || b.MempoolSizeRemain > b.MempoolSize {
+		return fmt.Errorf("mempool size remain %d not in [0, %d]",
+			b.MempoolSizeRemain, b.MempoolSize)
+	}
+	if b.NoSFR {
+		if b.SFRStat != (SFRStat{}) {
+			return fmt.Errorf("SFR stat %s should be zero if NoSFR", b.SFRStat)
+		}
+		return nil
+	}
+	return b.SFRStat.Check()
+}
+
+// quantizeFeeRates bounds the number of distinct positive fee rates to n, if
+// there are more than n of them, by rounding them in-place to the nearest
+// point of a geometric grid of n points spanning their range. Non-positive fee
+// rates are left as is. Returns the original number of distinct fee rates, and
+// whether quantization took place. n <= 0 means no bound.
+func quantizeFeeRates(feerates []sim.FeeRate, n int) (distinct int, quantized bool) {
+	min, max := sim.MaxFeeRate, sim.FeeRate(0)
+	set := make(map[sim.FeeRate]struct{})
+	for _, f := range feerates {
+		set[f] = struct{}{}
+		if f <= 0 {
+			continue
+		}
+		if f < min {
+			min = f
+		}
+		if f > max {
+			max = f
+		}
+	}
+	distinct = len(set)
+	if n <= 0 || distinct <= n || min >= max {
+		return distinct, false
+	}
+	// With a single point, the grid is the log-midpoint of the range.
+	grid := func(float64) sim.FeeRate {
+		return sim.FeeRate(math.Sqrt(float64(min)*float64(max)) + 0.5)
+	}
+	if n > 1 {
+		logmin := math.Log(float64(min))
+		step := (math.Log(float64(max)) - logmin) / float64(n-1)
+		grid = func(x float64) sim.FeeRate {
+			k := math.Floor((math.Log(x)-logmin)/step + 0.5)
+			return sim.FeeRate(math.Exp(logmin+k*step) + 0.5)
+		}
+	}
+	for i, f := range feerates {
+		if f > 0 {
+			feerates[i] = grid(float64(f))
+		}
+	}
+	return distinct, true
+}
+
+// logQuantize logs a warning if the fee rates of a tx source estimate were
+// quantized.
+func logQuantize(logger *log.Logger, distinct, n int) {
+	if logger == nil {
+		logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	logger.Printf("[WARNING] TxSource has %d distinct fee rates; quantized to at most %d.",
+		distinct, n)
+}
+
+// excludeTx returns whether tx is anomalous, i.e. has fee rate greater than
+// maxfeerate (if maxfeerate > 0).
+func excludeTx(tx Tx, maxfeerate sim.FeeRate) bool {
+	return maxfeerate > 0 && tx.FeeRate > maxfeerate
+}
+
+// logExcluded logs a warning that n anomalous txs were excluded from a tx
+// source estimate.
+func logExcluded(logger *log.Logger, n int, maxfeerate sim.FeeRate) {
+	if logger == nil {
+		logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	logger.Printf("[WARNING] Excluded %d txs with fee rate > %d from TxSource.", n, maxfeerate)
 }
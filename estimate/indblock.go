@@ -3,6 +3,7 @@ package estimate
 import (
 	"errors"
 	"fmt"
+	"math"
 	"sort"
 
 	"github.com/bitcoinfees/feesim/sim"
@@ -25,103 +26,301 @@ func (err BlockCoverageError) Error() string {
 		covBlocks, window, minCovBlocks, window)
 }
 
+// TimeSpanError is returned if the (weighted) time span of the blocks in the
+// window is non-positive, e.g. if all the block times are equal due to bad
+// data, so that the block rate can't be estimated.
+type TimeSpanError struct {
+	span float64
+}
+
+func (err TimeSpanError) Error() string {
+	return fmt.Sprintf("Block window time span was %.0fs, should be positive; "+
+		"check the block stat times.", err.span)
+}
+
 type IndBlockSourceConfig struct {
 	Window        int64   `yaml:"window" json:"window"`
 	MinCov        float64 `yaml:"mincov" json:"mincov"`
 	GuardInterval int64   `yaml:"guardinterval" json:"guardinterval"`
 	TailPct       float64 `yaml:"tailpct" json:"tailpct"`
+
+	// Halflife (in blocks) of the exponential recency weighting of the blocks
+	// in the window. If <= 0, all blocks are weighted equally.
+	Halflife int64 `yaml:"halflife" json:"halflife"`
+
+	// Probability that a block is empty, e.g. due to SPV mining. Empty blocks
+	// are rarely captured by the tail stats, so this injects them into the
+	// estimated block source.
+	EmptyProb float64 `yaml:"emptyprob" json:"emptyprob"`
+
+	// If > 0, and the block coverage of the window is less than MinCov, the
+	// estimate is still made if the coverage of the most recent MinBlocks
+	// heights is at least MinCov (e.g. on a new instance), but the block
+	// source is flagged as low confidence (see
+	// sim.IndBlockSource.LowConfidence). As the blocks accumulate, the full
+	// window's coverage requirement takes over.
+	MinBlocks int64 `yaml:"minblocks" json:"minblocks"`
+
+	// See UniTxSourceConfig.WeightUnits; the max block sizes are in weight
+	// units if true.
+	WeightUnits bool `yaml:"-" json:"-"`
 }
 
-// Helper function
-func calcStats(height int64, c IndBlockSourceConfig, db BlockStatDB) ([]sim.FeeRate, []sim.TxSize, float64, error) {
+// Helper function. lowconf is whether the coverage requirement was only met by
+// the most recent c.MinBlocks heights.
+func calcStats(height int64, c IndBlockSourceConfig, db BlockStatDB) (
+	minfeerates []sim.FeeRate, maxblocksizes []sim.TxSize, blockrate float64, lowconf bool, err error) {
+
+	sizedata, sfrdata, blockrate, lowconf, err := windowStats(height, c, db)
+	if err != nil {
+		return nil, nil, 0, false, err
+	}
+	sort.Sort(sizedata)
+	sort.Sort(sfrdata)
+
+	// Take the tail which makes up TailPct of the total weight. With uniform
+	// weights this is int(TailPct*len(sfrdata)) + 1 blocks.
+	var totalweight float64
+	for _, sfr := range sfrdata {
+		totalweight += sfr.weight
+	}
+	thresh := c.TailPct * totalweight
+	var (
+		sizestailidx, sfrstailidx int
+		sizescum, sfrscum         float64
+	)
+	for ; sizestailidx < len(sizedata) && (sizestailidx == 0 || sizescum <= thresh); sizestailidx++ {
+		sizescum += sizedata[len(sizedata)-sizestailidx-1].weight
+	}
+	for ; sfrstailidx < len(sfrdata) && (sfrstailidx == 0 || sfrscum <= thresh); sfrstailidx++ {
+		sfrscum += sfrdata[sfrstailidx].weight
+	}
+	sizestail := sizedata[len(sizedata)-sizestailidx:]
+	sfrstail := sfrdata[:sfrstailidx]
+
+	maxblocksizes = make([]sim.TxSize, len(sizestail))
+	minfeerates = make([]sim.FeeRate, len(sfrstail))
+	sizesweights := make([]float64, len(sizestail))
+	sfrsweights := make([]float64, len(sfrstail))
+	for i, size := range sizestail {
+		maxblocksizes[i] = simSize(sim.TxSize(size.blockSize), c.WeightUnits)
+		sizesweights[i] = size.weight
+	}
+	for i, sfr := range sfrstail {
+		minfeerates[i] = sfr.sfr
+		sfrsweights[i] = sfr.weight
+	}
+	if c.Halflife > 0 {
+		// sim.IndBlockSource samples uniformly, so resample the tails
+		// according to their weights.
+		maxblocksizes = resampleSizes(maxblocksizes, sizesweights)
+		minfeerates = resampleFeeRates(minfeerates, sfrsweights)
+	}
+	return minfeerates, maxblocksizes, blockrate, lowconf, nil
+}
+
+// calcPolicies is calcStats for sim.PairedBlockSource: instead of independent
+// tails, it takes the blocks with the greatest mempool excess over the block
+// size (i.e. those under the most pressure to be full), and pairs each one's
+// size with its SFR. Under that pressure, a block's size and SFR both reflect
+// its miner's policy; e.g. a miner with a high min fee rate mines a small
+// block with a high SFR.
+func calcPolicies(height int64, c IndBlockSourceConfig, db BlockStatDB) (
+	policies []sim.BlockPolicy, blockrate float64, lowconf bool, err error) {
+
+	sizedata, _, blockrate, lowconf, err := windowStats(height, c, db)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	sort.Sort(sizedata)
+
+	// Take the tail which makes up TailPct of the total weight, as in
+	// calcStats.
+	var totalweight float64
+	for _, size := range sizedata {
+		totalweight += size.weight
+	}
+	thresh := c.TailPct * totalweight
+	var (
+		tailidx int
+		cum     float64
+	)
+	for ; tailidx < len(sizedata) && (tailidx == 0 || cum <= thresh); tailidx++ {
+		cum += sizedata[len(sizedata)-tailidx-1].weight
+	}
+	tail := sizedata[len(sizedata)-tailidx:]
+
+	policies = make([]sim.BlockPolicy, len(tail))
+	weights := make([]float64, len(tail))
+	for i, size := range tail {
+		policies[i] = sim.BlockPolicy{
+			MinFeeRate:   size.sfr,
+			MaxBlockSize: simSize(sim.TxSize(size.blockSize), c.WeightUnits),
+		}
+		weights[i] = size.weight
+	}
+	if c.Halflife > 0 {
+		r := make([]sim.BlockPolicy, len(policies))
+		for i, j := range resampleIndex(weights) {
+			r[i] = policies[j]
+		}
+		policies = r
+	}
+	return policies, blockrate, lowconf, nil
+}
+
+// windowStats returns the size and SFR data of the blocks in the window up to
+// height, and the estimated block rate. lowconf is as in calcStats.
+func windowStats(height int64, c IndBlockSourceConfig, db BlockStatDB) (
+	sizedata BlockSizeData, sfrdata BlockSFRData, blockrate float64, lowconf bool, err error) {
+
 	// Check block coverage
 	b, err := db.Get(height-c.Window+1, height)
 	if err != nil {
-		return nil, nil, 0, err
+		return nil, nil, 0, false, err
 	}
 	cov := float64(len(b)) / float64(c.Window)
 	if cov < c.MinCov {
-		return nil, nil, 0, BlockCoverageError{cov: cov, minCov: c.MinCov, window: c.Window}
+		if c.MinBlocks <= 0 || c.MinBlocks >= c.Window || recentCov(b, height, c.MinBlocks) < c.MinCov {
+			return nil, nil, 0, false, BlockCoverageError{cov: cov, minCov: c.MinCov, window: c.Window}
+		}
+		lowconf = true
+	}
+
+	// weight returns the recency weight of the block at height h.
+	weight := func(h int64) float64 {
+		if c.Halflife <= 0 {
+			return 1
+		}
+		return math.Pow(0.5, float64(height-h)/float64(c.Halflife))
 	}
 
 	totalhashes := float64(0)
+	totaltime := float64(0)
 	var prevBlock *BlockStat
-	sizedata := BlockSizeData{}
-	sfrdata := BlockSFRData{}
 	for _, block := range b {
-		totalhashes += block.NumHashes
+		w := weight(block.Height)
+		totalhashes += w * block.NumHashes
 		if prevBlock == nil {
 			prevBlock = block
 			continue
 		}
+		totaltime += w * float64(block.Time-prevBlock.Time)
 		if block.Height == prevBlock.Height+1 {
-			if block.Time-prevBlock.Time > c.GuardInterval {
+			if block.Time-prevBlock.Time > c.GuardInterval && !block.NoSFR && !prevBlock.NoSFR {
 				sizedata = append(sizedata, struct {
 					mempoolDiff int64
 					blockSize   int64
+					sfr         sim.FeeRate
+					weight      float64
 				}{
 					block.MempoolSize - prevBlock.MempoolSizeRemain,
 					block.Size,
+					block.SFRStat.SFR,
+					w,
 				})
 				sfrdata = append(sfrdata, struct {
 					mempoolSize int64
 					sfr         sim.FeeRate
+					weight      float64
 				}{
 					block.MempoolSize,
 					block.SFRStat.SFR,
+					w,
 				})
 			}
 		} else {
 			// Fill in the NumHashes of the missing blocks
 			for mh := prevBlock.Height + 1; mh < block.Height; mh++ {
 				if mh/diffAdjInterval == prevBlock.Height/diffAdjInterval {
-					totalhashes += prevBlock.NumHashes
+					totalhashes += weight(mh) * prevBlock.NumHashes
 				} else {
 					// Assumes that the height gap is <= 2016. If not, there are
 					// serious problems anyway.
 					// In any case, window should be <= 2016. Maybe we should
 					// enforce that.
-					totalhashes += block.NumHashes
+					totalhashes += weight(mh) * block.NumHashes
 				}
 			}
 		}
 		prevBlock = block
 	}
 
+	if len(b) > 1 && totaltime <= 0 {
+		return nil, nil, 0, false, TimeSpanError{span: totaltime}
+	}
 	if len(sfrdata) == 0 {
-		return nil, nil, 0, ErrInsufficientBlocks
+		return nil, nil, 0, false, ErrInsufficientBlocks
 	}
-	sort.Sort(sizedata)
-	sort.Sort(sfrdata)
-	tailidx := int(c.TailPct*float64(len(sfrdata))) + 1 // Min is 1
-	sizestail := sizedata[len(sizedata)-tailidx:]
-	sfrstail := sfrdata[:tailidx]
-	maxblocksizes := make([]sim.TxSize, len(sizestail))
-	minfeerates := make([]sim.FeeRate, len(sfrstail))
-	for i, size := range sizestail {
-		maxblocksizes[i] = sim.TxSize(size.blockSize)
+
+	// Estimate the blockrate
+	if b[len(b)-1].NumHashes <= 0 {
+		return nil, nil, 0, false, fmt.Errorf("block %d has non-positive NumHashes %v",
+			b[len(b)-1].Height, b[len(b)-1].NumHashes)
 	}
-	for i, sfr := range sfrstail {
-		minfeerates[i] = sfr.sfr
+	hashrate := totalhashes / totaltime
+	blockrate = hashrate / b[len(b)-1].NumHashes
+	return sizedata, sfrdata, blockrate, lowconf, nil
+}
+
+// recentCov returns the coverage of the n heights up to height by the
+// height-sorted blocks b.
+func recentCov(b []*BlockStat, height, n int64) float64 {
+	i := sort.Search(len(b), func(i int) bool { return b[i].Height > height-n })
+	return float64(len(b)-i) / float64(n)
+}
+
+// resampleIndex returns len(weights) indices into weights, chosen by
+// systematic resampling; i.e. each index i appears roughly
+// weights[i]/sum(weights)*len(weights) times. The result is deterministic.
+func resampleIndex(weights []float64) []int {
+	var total float64
+	for _, w := range weights {
+		total += w
 	}
+	n := len(weights)
+	idx := make([]int, n)
+	var (
+		j   int
+		cum = weights[0]
+	)
+	for i := range idx {
+		u := (float64(i) + 0.5) / float64(n) * total
+		for cum < u && j < n-1 {
+			j++
+			cum += weights[j]
+		}
+		idx[i] = j
+	}
+	return idx
+}
 
-	// Estimate the blockrate
-	winstart := b[0].Time
-	winend := b[len(b)-1].Time
-	hashrate := totalhashes / float64(winend-winstart)
-	blockrate := hashrate / b[len(b)-1].NumHashes
-	return minfeerates, maxblocksizes, blockrate, nil
+func resampleSizes(sizes []sim.TxSize, weights []float64) []sim.TxSize {
+	r := make([]sim.TxSize, len(sizes))
+	for i, j := range resampleIndex(weights) {
+		r[i] = sizes[j]
+	}
+	return r
+}
+
+func resampleFeeRates(feerates []sim.FeeRate, weights []float64) []sim.FeeRate {
+	r := make([]sim.FeeRate, len(feerates))
+	for i, j := range resampleIndex(weights) {
+		r[i] = feerates[j]
+	}
+	return r
 }
 
 // IndBlockSource returns an estimate of sim.IndBlockSource based on
 // BlockStats from heights [height-window+1, height].
 func IndBlockSource(height int64, c IndBlockSourceConfig, db BlockStatDB) (*sim.IndBlockSource, error) {
 
-	minfeerates, maxblocksizes, blockrate, err := calcStats(height, c, db)
+	minfeerates, maxblocksizes, blockrate, lowconf, err := calcStats(height, c, db)
 	if err != nil {
 		return nil, err
 	}
-	return sim.NewIndBlockSource(minfeerates, maxblocksizes, blockrate), nil
+	b := sim.NewIndBlockSource(minfeerates, maxblocksizes, blockrate).WithEmptyProb(c.EmptyProb)
+	return b.WithLowConfidence(lowconf), nil
 }
 
 // IndBlockSourceSMFR is IndBlockSource with a static minfeerate.
@@ -129,7 +328,7 @@ func IndBlockSource(height int64, c IndBlockSourceConfig, db BlockStatDB) (*sim.
 // Constantly full blocks causes minfeerate policy estimates to be inflated, which in turn inflates fee estimates.
 // To avoid this, we just assume that miner minfeerates are equal to the lowest observed sfr.
 func IndBlockSourceSMFR(height int64, c IndBlockSourceConfig, db BlockStatDB) (*sim.IndBlockSource, error) {
-	minfeerates, maxblocksizes, blockrate, err := calcStats(height, c, db)
+	minfeerates, maxblocksizes, blockrate, lowconf, err := calcStats(height, c, db)
 	if err != nil {
 		return nil, err
 	}
@@ -143,12 +342,25 @@ func IndBlockSourceSMFR(height int64, c IndBlockSourceConfig, db BlockStatDB) (*
 	for i := range minfeerates {
 		minfeerates[i] = l
 	}
-	return sim.NewIndBlockSource(minfeerates, maxblocksizes, blockrate), nil
+	b := sim.NewIndBlockSource(minfeerates, maxblocksizes, blockrate).WithEmptyProb(c.EmptyProb)
+	return b.WithLowConfidence(lowconf), nil
+}
+
+// PairedBlockSource returns an estimate of sim.PairedBlockSource based on
+// BlockStats from heights [height-window+1, height]. See calcPolicies.
+func PairedBlockSource(height int64, c IndBlockSourceConfig, db BlockStatDB) (*sim.PairedBlockSource, error) {
+	policies, blockrate, lowconf, err := calcPolicies(height, c, db)
+	if err != nil {
+		return nil, err
+	}
+	b := sim.NewPairedBlockSource(policies, blockrate).WithEmptyProb(c.EmptyProb)
+	return b.WithLowConfidence(lowconf), nil
 }
 
 type BlockSFRData []struct {
 	mempoolSize int64
 	sfr         sim.FeeRate
+	weight      float64
 }
 
 func (b BlockSFRData) Len() int {
@@ -166,6 +378,8 @@ func (b BlockSFRData) Swap(i, j int) {
 type BlockSizeData []struct {
 	mempoolDiff int64
 	blockSize   int64
+	sfr         sim.FeeRate
+	weight      float64
 }
 
 func (b BlockSizeData) Len() int {
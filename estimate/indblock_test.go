@@ -6,6 +6,7 @@ import (
 	"os"
 	"testing"
 
+	"github.com/bitcoinfees/feesim/sim"
 	"github.com/bitcoinfees/feesim/testutil"
 )
 
@@ -73,6 +74,42 @@ func TestIndBlockSource(t *testing.T) {
 	t.Log(err)
 }
 
+func TestIndBlockSourceEqualWeights(t *testing.T) {
+	// With a halflife far longer than the window, the block weights are all
+	// ~1, so the weighted quantiles must reproduce the TestIndBlockSource
+	// reference curve.
+	db := &BlockStatMemDB{}
+	db.init()
+	height := db.bestHeight()
+	c := IndBlockSourceConfig{
+		Window:        2016,
+		MinCov:        0.9,
+		GuardInterval: 300,
+		TailPct:       0.1,
+		Halflife:      1 << 40,
+	}
+	blksrc, err := IndBlockSource(height, c, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	capfn := blksrc.RateFn()
+	xref := []float64{
+		4999, 5000, 6413, 10000, 10009, 10021, 10395, 44405, 222222, math.MaxFloat64}
+	yref := []float64{
+		0, 942.646, 1027.22, 1135.98, 1220.58, 1305.17, 1389.77, 1474.36, 1486.45, 1486.45}
+	for i, x := range xref {
+		if err := testutil.CheckEqual(int(capfn.Eval(x)), int(yref[i])); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Equal weights resample to the identity.
+	idx := resampleIndex([]float64{1, 1, 1, 1, 1})
+	if err := testutil.CheckEqual(idx, []int{0, 1, 2, 3, 4}); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestIndBlockSourceSMFR(t *testing.T) {
 	db := &BlockStatMemDB{}
 	db.init()
@@ -106,3 +143,301 @@ func TestIndBlockSourceSMFR(t *testing.T) {
 	}
 	t.Log(err)
 }
+
+func TestIndBlockSourceHalflife(t *testing.T) {
+	// Regime change: the older half of the window has 1MB blocks, the recent
+	// half has 500kB blocks.
+	db := &BlockStatMemDB{}
+	for h := int64(1); h <= 200; h++ {
+		var size int64 = 1000000
+		if h > 100 {
+			size = 500000
+		}
+		db.b = append(db.b, &BlockStat{
+			Height:      h,
+			Size:        size,
+			SFRStat:     SFRStat{SFR: 1000},
+			MempoolSize: size,
+			Time:        600 * h,
+			NumHashes:   1,
+		})
+	}
+	height := db.bestHeight()
+	c := IndBlockSourceConfig{
+		Window:        200,
+		MinCov:        0.9,
+		GuardInterval: 300,
+		TailPct:       0.1,
+	}
+
+	blksrc, err := IndBlockSource(height, c, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uniformCap := blksrc.RateFn().Eval(math.MaxFloat64)
+	if err := testutil.CheckPctDiff(uniformCap, 1e6/600, 0.01); err != nil {
+		t.Error(err)
+	}
+
+	c.Halflife = 10
+	blksrc, err = IndBlockSource(height, c, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	weightedCap := blksrc.RateFn().Eval(math.MaxFloat64)
+	if err := testutil.CheckPctDiff(weightedCap, 5e5/600, 0.01); err != nil {
+		t.Error(err)
+	}
+
+	// Block rate is unaffected, since it's constant over the window.
+	if err := testutil.CheckPctDiff(blksrc.BlockRate(), 1./600, 0.01); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestIndBlockSourceNoSFR(t *testing.T) {
+	// The recent half of the window was rebuilt, so their SFR stats (zeroed)
+	// and sizes must not be used; but they still count for the block rate.
+	db := &BlockStatMemDB{}
+	for h := int64(1); h <= 200; h++ {
+		stat := &BlockStat{
+			Height:      h,
+			Size:        1000000,
+			SFRStat:     SFRStat{SFR: 1000},
+			MempoolSize: 1000000,
+			Time:        600 * h,
+			NumHashes:   1,
+		}
+		if h > 100 {
+			stat.Size = 2000000
+			stat.SFRStat = SFRStat{}
+			stat.NoSFR = true
+		}
+		db.b = append(db.b, stat)
+	}
+	c := IndBlockSourceConfig{
+		Window:        200,
+		MinCov:        0.9,
+		GuardInterval: 300,
+		TailPct:       0.1,
+	}
+	blksrc, err := IndBlockSource(db.bestHeight(), c, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	capfn := blksrc.RateFn()
+	if err := testutil.CheckEqual(capfn.Eval(999), 0.0); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckPctDiff(capfn.Eval(math.MaxFloat64), 1e6/600, 0.01); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckPctDiff(blksrc.BlockRate(), 1./600, 0.01); err != nil {
+		t.Error(err)
+	}
+
+	// If all are rebuilt, there's no SFR data at all.
+	for _, stat := range db.b {
+		stat.NoSFR = true
+	}
+	if _, err := IndBlockSource(db.bestHeight(), c, db); err != ErrInsufficientBlocks {
+		t.Error("ErrInsufficientBlocks should be returned, got", err)
+	}
+}
+
+func TestIndBlockSourceTimeSpan(t *testing.T) {
+	db := &BlockStatMemDB{}
+	for h := int64(1); h <= 100; h++ {
+		db.b = append(db.b, &BlockStat{
+			Height:      h,
+			Size:        1000000,
+			SFRStat:     SFRStat{SFR: 1000},
+			MempoolSize: 1000000,
+			Time:        1000,
+			NumHashes:   1,
+		})
+	}
+	c := IndBlockSourceConfig{
+		Window:        100,
+		MinCov:        0.9,
+		GuardInterval: -1,
+		TailPct:       0.1,
+	}
+
+	// All block times are equal. The negative GuardInterval means the blocks
+	// still make it into the SFR data.
+	for _, f := range []func(int64, IndBlockSourceConfig, BlockStatDB) (*sim.IndBlockSource, error){
+		IndBlockSource, IndBlockSourceSMFR,
+	} {
+		_, err := f(db.bestHeight(), c, db)
+		if _, ok := err.(TimeSpanError); !ok {
+			t.Fatal("TimeSpanError not returned, got", err)
+		}
+		t.Log(err)
+	}
+
+	// Non-positive NumHashes
+	for i, stat := range db.b {
+		stat.Time = 600 * int64(i)
+		stat.NumHashes = 0
+	}
+	if _, err := IndBlockSource(db.bestHeight(), c, db); err == nil {
+		t.Error("error should be returned for zero NumHashes")
+	} else {
+		t.Log(err)
+	}
+}
+
+func TestIndBlockSourceEmptyProb(t *testing.T) {
+	db := &BlockStatMemDB{}
+	db.init()
+	height := db.bestHeight()
+	c := IndBlockSourceConfig{
+		Window:        2016,
+		MinCov:        0.9,
+		GuardInterval: 300,
+		TailPct:       0.1,
+	}
+	ref, err := IndBlockSourceSMFR(height, c, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.EmptyProb = 0.1
+	blksrc, err := IndBlockSourceSMFR(height, c, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckPctDiff(
+		blksrc.RateFn().Eval(math.MaxFloat64), 0.9*ref.RateFn().Eval(math.MaxFloat64), 1e-9); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestIndBlockSourceMinBlocks(t *testing.T) {
+	// A new instance: only the most recent 150 blocks of the 2016 block
+	// window, with a few missing.
+	db := &BlockStatMemDB{}
+	for h := int64(1867); h <= 2016; h++ {
+		if h%50 == 0 {
+			continue
+		}
+		db.b = append(db.b, &BlockStat{
+			Height:      h,
+			Size:        1000000,
+			SFRStat:     SFRStat{SFR: 1000},
+			MempoolSize: 1000000,
+			Time:        600 * h,
+			NumHashes:   1,
+		})
+	}
+	c := IndBlockSourceConfig{
+		Window:        2016,
+		MinCov:        0.5,
+		GuardInterval: 300,
+		TailPct:       0.1,
+	}
+	if _, err := IndBlockSource(db.bestHeight(), c, db); err == nil {
+		t.Fatal("coverage error should be returned without MinBlocks")
+	}
+
+	c.MinBlocks = 144
+	blksrc, err := IndBlockSource(db.bestHeight(), c, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !blksrc.LowConfidence() {
+		t.Error("block source should be flagged as low confidence")
+	}
+	if err := testutil.CheckPctDiff(blksrc.BlockRate(), 1./600, 0.01); err != nil {
+		t.Error(err)
+	}
+	// The flag is kept by the derived sources.
+	if !blksrc.WithCapacityPct(0.5).LowConfidence() || !blksrc.Copy(1)[0].(*sim.IndBlockSource).LowConfidence() {
+		t.Error("derived block sources should be flagged as low confidence")
+	}
+	smfr, err := IndBlockSourceSMFR(db.bestHeight(), c, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !smfr.LowConfidence() {
+		t.Error("SMFR block source should be flagged as low confidence")
+	}
+
+	// Blocks which aren't recent don't count.
+	if _, err := IndBlockSource(db.bestHeight()+100, c, db); err == nil {
+		t.Error("coverage error should be returned if the recent blocks are missing")
+	}
+
+	// Once the full window's coverage is met, the flag is cleared.
+	c.Window = 200
+	if blksrc, err = IndBlockSource(db.bestHeight(), c, db); err != nil {
+		t.Fatal(err)
+	}
+	if blksrc.LowConfidence() {
+		t.Error("block source should not be flagged as low confidence")
+	}
+}
+
+func TestPairedBlockSource(t *testing.T) {
+	// Two miners: one mines 1MB blocks with min fee rate 1000, the other
+	// 500kB blocks with min fee rate 20000.
+	db := &BlockStatMemDB{}
+	for h := int64(1); h <= 200; h++ {
+		var (
+			size int64       = 1000000
+			sfr  sim.FeeRate = 1000
+		)
+		if h%2 == 0 {
+			size, sfr = 500000, 20000
+		}
+		db.b = append(db.b, &BlockStat{
+			Height:      h,
+			Size:        size,
+			SFRStat:     SFRStat{SFR: sfr},
+			MempoolSize: 2000000,
+			Time:        600 * h,
+			NumHashes:   1,
+		})
+	}
+	height := db.bestHeight()
+	c := IndBlockSourceConfig{
+		Window:        200,
+		MinCov:        0.9,
+		GuardInterval: 300,
+		TailPct:       1,
+	}
+	blksrc, err := PairedBlockSource(height, c, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The observed policies are sampled, never mixed.
+	b := blksrc.Copy(1)[0]
+	for i := 0; i < 1000; i++ {
+		_, p := b.Next()
+		if !(p == sim.BlockPolicy{MinFeeRate: 1000, MaxBlockSize: 1000000} ||
+			p == sim.BlockPolicy{MinFeeRate: 20000, MaxBlockSize: 500000}) {
+			t.Fatalf("policy %+v wasn't observed", p)
+		}
+	}
+
+	// Half of the blocks are 1MB at 1000, the rest add 500kB at 20000.
+	capfn := blksrc.RateFn()
+	if err := testutil.CheckEqual(capfn.Eval(999), float64(0)); err != nil {
+		t.Error(err)
+	}
+	xref := []float64{1000, 19999, 20000}
+	yref := []float64{833, 833, 1250}
+	for i, x := range xref {
+		if err := testutil.CheckPctDiff(capfn.Eval(x), yref[i], 0.01); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Test coverage error
+	c.MinCov = 1.1
+	_, err = PairedBlockSource(height, c, db)
+	if _, ok := err.(BlockCoverageError); !ok {
+		t.Fatal("Coverage error not returned.")
+	}
+}
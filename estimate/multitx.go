@@ -2,6 +2,7 @@ package estimate
 
 import (
 	"fmt"
+	"log"
 	"math"
 
 	"github.com/bitcoinfees/feesim/sim"
@@ -13,6 +14,20 @@ type MultiTxSourceConfig struct {
 	MaxWindow int64 `yaml:"maxwindow" json:"maxwindow"`
 	Halflife  int64 `yaml:"halflife" json:"halflife"`
 	MaxTxs    int   `yaml:"maxtxs" json:"maxtxs"`
+
+	// Min number of txs (after excluding the anomalous ones) required for
+	// estimation; with too few, the sample doesn't represent the fee rate
+	// distribution well. If 0, there's no minimum.
+	MinTxs int `yaml:"mintxs" json:"mintxs"`
+
+	// See UniTxSourceConfig.MaxFeeRates / MaxFeeRate
+	MaxFeeRates int         `yaml:"maxfeerates" json:"maxfeerates"`
+	MaxFeeRate  sim.FeeRate `yaml:"maxfeerate" json:"maxfeerate"`
+
+	// See UniTxSourceConfig.WeightUnits
+	WeightUnits bool `yaml:"-" json:"-"`
+
+	Logger *log.Logger `yaml:"-" json:"-"`
 }
 
 func MultiTxSource(t int64, c *MultiTxSourceConfig, db TxDB) (*sim.MultiTxSource, error) {
@@ -30,6 +45,23 @@ func MultiTxSource(t int64, c *MultiTxSourceConfig, db TxDB) (*sim.MultiTxSource
 		return nil, TxWindowError{Window: window, MinWindow: c.MinWindow}
 	}
 
+	// Exclude anomalous txs
+	if c.MaxFeeRate > 0 {
+		var filtered []Tx
+		for _, tx := range txs {
+			if !excludeTx(tx, c.MaxFeeRate) {
+				filtered = append(filtered, tx)
+			}
+		}
+		if n := len(txs) - len(filtered); n > 0 {
+			logExcluded(c.Logger, n, c.MaxFeeRate)
+		}
+		txs = filtered
+	}
+	if len(txs) < c.MinTxs {
+		return nil, TxSampleError{NumTxs: len(txs), MinTxs: c.MinTxs}
+	}
+
 	// Estimate tx rate
 	a := math.Pow(0.5, 1/float64(c.Halflife))
 	weights := make([]float64, len(txs))
@@ -51,7 +83,10 @@ func MultiTxSource(t int64, c *MultiTxSourceConfig, db TxDB) (*sim.MultiTxSource
 	sizes := make([]sim.TxSize, len(txs))
 
 	for i, tx := range txs {
-		feerates[i], sizes[i] = tx.FeeRate, tx.Size
+		feerates[i], sizes[i] = tx.FeeRate, simSize(tx.Size, c.WeightUnits)
+	}
+	if distinct, ok := quantizeFeeRates(feerates, c.MaxFeeRates); ok {
+		logQuantize(c.Logger, distinct, c.MaxFeeRates)
 	}
 
 	return sim.NewMultiTxSource(feerates, sizes, weights, txrate), nil
@@ -65,3 +100,14 @@ func (err TxWindowError) Error() string {
 	return fmt.Sprintf("Tx estimation window size was %vs, should be at least %vs",
 		err.Window, err.MinWindow)
 }
+
+// TxSampleError is returned if there are too few txs in the window for
+// estimation.
+type TxSampleError struct {
+	NumTxs, MinTxs int
+}
+
+func (err TxSampleError) Error() string {
+	return fmt.Sprintf("Tx estimation sample had %d txs, should have at least %d",
+		err.NumTxs, err.MinTxs)
+}
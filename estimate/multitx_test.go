@@ -92,4 +92,51 @@ func TestMultiTxSource(t *testing.T) {
 	} else {
 		t.Log(werr)
 	}
+
+	// Test too few txs
+	c = &MultiTxSourceConfig{
+		MinWindow: 600,
+		MaxWindow: window,
+		Halflife:  3600,
+		MaxTxs:    10000,
+		MinTxs:    100000,
+	}
+	_, err = MultiTxSource(tm, c, db)
+	if serr, ok := err.(TxSampleError); !ok {
+		t.Fatal("Should have TxSampleError, got", err)
+	} else if serr.NumTxs >= c.MinTxs || serr.MinTxs != c.MinTxs {
+		t.Error("Wrong TxSampleError:", serr)
+	}
+}
+
+func TestMultiTxSourceSparse(t *testing.T) {
+	// Enough window, but only a handful of txs
+	db := &TxMemDB{txs: []Tx{
+		{FeeRate: 10000, Size: 250, Time: 1000},
+		{FeeRate: 20000, Size: 500, Time: 1500},
+		{FeeRate: 5000, Size: 300, Time: 2000},
+	}}
+	c := &MultiTxSourceConfig{
+		MinWindow: 600,
+		MaxWindow: 3600,
+		Halflife:  3600,
+		MaxTxs:    10000,
+		MinTxs:    10,
+	}
+	_, err := MultiTxSource(2000, c, db)
+	if err := testutil.CheckEqual(err, TxSampleError{NumTxs: 3, MinTxs: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Anomalous txs don't count
+	c.MinTxs, c.MaxFeeRate = 3, 15000
+	_, err = MultiTxSource(2000, c, db)
+	if err := testutil.CheckEqual(err, TxSampleError{NumTxs: 2, MinTxs: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	c.MinTxs = 2
+	if _, err := MultiTxSource(2000, c, db); err != nil {
+		t.Fatal(err)
+	}
 }
@@ -22,6 +22,25 @@ func (s SFRStat) String() string {
 		s.SFR, s.AK, s.AN, s.BK, s.BN)
 }
 
+// Check returns an error if the stat is internally inconsistent, i.e. the
+// in-block counts exceed the tx counts, or the SFR is out of the fee rate
+// range.
+func (s SFRStat) Check() error {
+	if s.AK < 0 || s.AN < 0 || s.BK < 0 || s.BN < 0 {
+		return fmt.Errorf("negative count: %s", s)
+	}
+	if s.AK > s.AN {
+		return fmt.Errorf("AK > AN: %s", s)
+	}
+	if s.BK > s.BN {
+		return fmt.Errorf("BK > BN: %s", s)
+	}
+	if s.SFR <= 0 || s.SFR > sim.MaxFeeRate {
+		return fmt.Errorf("SFR out of range: %s", s)
+	}
+	return nil
+}
+
 type SFRTx struct {
 	FeeRate sim.FeeRate
 	InBlock bool
@@ -194,3 +194,56 @@ func replicateTxs(txs SFRTxSlice, r int) (result SFRTxSlice) {
 	}
 	return
 }
+
+func TestBlockStatCheck(t *testing.T) {
+	db := &BlockStatMemDB{}
+	db.init()
+	for _, b := range db.b {
+		if err := b.Check(); err != nil {
+			t.Fatalf("block %d: %v", b.Height, err)
+		}
+	}
+
+	// A computed SFR stat is consistent
+	txs := SFRTxSlice{
+		{FeeRate: 11000, InBlock: true},
+		{FeeRate: 10000, InBlock: false},
+		{FeeRate: 9000, InBlock: true},
+		{FeeRate: 5000, InBlock: false},
+	}
+	if err := txs.StrandingFeeRate(minrelaytxfee).Check(); err != nil {
+		t.Error(err)
+	}
+
+	ref := *db.b[0]
+	ref.SFRStat = SFRStat{SFR: 10000, AK: 2, AN: 3, BK: 1, BN: 2}
+	corrupt := []func(b *BlockStat){
+		func(b *BlockStat) { b.SFRStat.AK = 4 },
+		func(b *BlockStat) { b.SFRStat.BK = 3 },
+		func(b *BlockStat) { b.SFRStat.BN = -1 },
+		func(b *BlockStat) { b.SFRStat.SFR = 0 },
+		func(b *BlockStat) { b.SFRStat.SFR = -1 },
+		func(b *BlockStat) { b.MempoolSizeRemain = b.MempoolSize + 1 },
+		func(b *BlockStat) { b.MempoolSizeRemain = -1 },
+		func(b *BlockStat) { b.Size = 0 },
+		func(b *BlockStat) { b.NumHashes = 0 },
+		func(b *BlockStat) { b.NoSFR = true }, // SFR stat should be zeroed
+	}
+	if err := ref.Check(); err != nil {
+		t.Fatal(err)
+	}
+	for i, f := range corrupt {
+		b := ref
+		f(&b)
+		if err := b.Check(); err == nil {
+			t.Errorf("%d: corrupt stat %+v should fail the check", i, b)
+		} else {
+			t.Log(err)
+		}
+	}
+	b := ref
+	b.NoSFR, b.SFRStat = true, SFRStat{}
+	if err := b.Check(); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,8 +1,11 @@
 package estimate
 
 import (
+	"log"
 	"math"
 	"math/rand"
+	"os"
+	"sync"
 
 	"github.com/bitcoinfees/feesim/sim"
 )
@@ -11,6 +14,29 @@ type UniTxSourceConfig struct {
 	MinWindow int64 `yaml:"minwindow" json:"minwindow"`
 	MaxWindow int64 `yaml:"maxwindow" json:"maxwindow"`
 	Halflife  int64 `yaml:"halflife" json:"halflife"`
+
+	// If there are more than MaxFeeRates distinct tx fee rates, they are
+	// quantized, to bound the cost of the rate function calculations.
+	// 0 means no bound.
+	MaxFeeRates int `yaml:"maxfeerates" json:"maxfeerates"`
+
+	// Txs with fee rate above MaxFeeRate are considered anomalous and excluded
+	// from the estimate. They would otherwise blow up the search range of the
+	// sim stable fee. 0 means no filter.
+	MaxFeeRate sim.FeeRate `yaml:"maxfeerate" json:"maxfeerate"`
+
+	// If > 0, the reservoir is discarded and the tx source fully re-estimated
+	// from the last MaxWindow of txs, on the first Estimate after each
+	// multiple of RefreshPeriod seconds (since the Unix epoch, so that e.g.
+	// 86400 refreshes at midnight UTC). This avoids drift from the
+	// incremental decay.
+	RefreshPeriod int64 `yaml:"refreshperiod" json:"refreshperiod"`
+
+	// If true, the estimated tx sizes are in weight units (see
+	// sim.WitnessScaleFactor). It's set by the app's weightunits setting.
+	WeightUnits bool `yaml:"-" json:"-"`
+
+	Logger *log.Logger `yaml:"-" json:"-"`
 }
 
 type UniTxSource struct {
@@ -20,9 +46,25 @@ type UniTxSource struct {
 	a        float64
 	r        float64
 
+	// The time of the last full estimation
+	refreshTime int64
+
 	db  TxDB
 	cfg UniTxSourceConfig
 	rng *rand.Rand
+	mux sync.Mutex
+}
+
+// UniTxSourceState is a snapshot of the estimator's internal state, for
+// debugging the tx rate estimate.
+type UniTxSourceState struct {
+	Window    int64   `json:"window"`    // Accumulated window in seconds
+	MinWindow int64   `json:"minwindow"` // Estimate fails if Window < MinWindow
+	NumTxs    int     `json:"numtxs"`    // Number of txs in the reservoir
+	R         float64 `json:"r"`         // Exponentially decayed tx count
+	Decay     float64 `json:"decay"`     // Decay factor per second
+	TxRate    float64 `json:"txrate"`    // Estimated txs per second
+	PrevTime  int64   `json:"prevtime"`  // Time of the last tx added
 }
 
 func NewUniTxSource(db TxDB, cfg UniTxSourceConfig, rng *rand.Rand) *UniTxSource {
@@ -36,13 +78,24 @@ func NewUniTxSource(db TxDB, cfg UniTxSourceConfig, rng *rand.Rand) *UniTxSource
 }
 
 func (s *UniTxSource) Estimate(currTime int64) (*sim.UniTxSource, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
 
 	var (
 		txs []Tx
 		err error
 	)
+	if p := s.cfg.RefreshPeriod; p > 0 && s.prevTime != 0 && currTime/p > s.refreshTime/p {
+		s.reset()
+		logger := s.cfg.Logger
+		if logger == nil {
+			logger = log.New(os.Stderr, "", log.LstdFlags)
+		}
+		logger.Println("TxSource scheduled refresh: fully re-estimating.")
+	}
 	if s.prevTime == 0 {
-		// This is the first call to Estimate
+		// This is the first call to Estimate, or the first after a reset
+		s.refreshTime = currTime
 		if txs, err = s.db.Get(currTime-s.cfg.MaxWindow, currTime); err != nil {
 			return nil, err
 		}
@@ -55,8 +108,14 @@ func (s *UniTxSource) Estimate(currTime int64) (*sim.UniTxSource, error) {
 		return nil, err
 	}
 
+	var numExcluded int
 	for _, tx := range txs {
-		s.addTx(tx)
+		if !s.addTx(tx) {
+			numExcluded++
+		}
+	}
+	if numExcluded > 0 {
+		logExcluded(s.cfg.Logger, numExcluded, s.cfg.MaxFeeRate)
 	}
 
 	if s.window < s.cfg.MinWindow {
@@ -67,24 +126,67 @@ func (s *UniTxSource) Estimate(currTime int64) (*sim.UniTxSource, error) {
 	feerates := make([]sim.FeeRate, len(s.txs))
 	sizes := make([]sim.TxSize, len(s.txs))
 	for i, tx := range s.txs {
-		feerates[i], sizes[i] = tx.FeeRate, tx.Size
+		feerates[i], sizes[i] = tx.FeeRate, simSize(tx.Size, s.cfg.WeightUnits)
+	}
+	if distinct, ok := quantizeFeeRates(feerates, s.cfg.MaxFeeRates); ok {
+		logQuantize(s.cfg.Logger, distinct, s.cfg.MaxFeeRates)
+	}
+	return sim.NewUniTxSource(feerates, sizes, s.txRate()), nil
+}
+
+// State returns a snapshot of the estimator's state. It's safe to call
+// concurrently with Estimate.
+func (s *UniTxSource) State() UniTxSourceState {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return UniTxSourceState{
+		Window:    s.window,
+		MinWindow: s.cfg.MinWindow,
+		NumTxs:    len(s.txs),
+		R:         s.r,
+		Decay:     s.a,
+		TxRate:    s.txRate(),
+		PrevTime:  s.prevTime,
 	}
-	txrate := s.r * math.Log(s.a) / (math.Pow(s.a, float64(s.window)) - 1)
-	return sim.NewUniTxSource(feerates, sizes, txrate), nil
 }
 
-func (s *UniTxSource) addTx(tx Tx) {
+// txRate returns the tx rate (per second) implied by the decayed tx count
+// over the window, or 0 if the window is empty.
+func (s *UniTxSource) txRate() float64 {
+	if s.window <= 0 {
+		return 0
+	}
+	return s.r * math.Log(s.a) / (math.Pow(s.a, float64(s.window)) - 1)
+}
+
+// reset discards the reservoir, so that the next Estimate is a full
+// estimation.
+func (s *UniTxSource) reset() {
+	s.txs = nil
+	s.prevTime = 0
+	s.window = 0
+	s.r = 0
+}
+
+// addTx adds tx to the reservoir, and returns whether it was added, or
+// excluded due to cfg.MaxFeeRate. Excluded txs still advance the time.
+func (s *UniTxSource) addTx(tx Tx) bool {
 	defer func() { s.prevTime = tx.Time }()
 	deltaTime := tx.Time - s.prevTime
 	s.window += deltaTime
 	p := math.Pow(s.a, float64(deltaTime))
-	s.r = s.r*p + 1
+	s.r = s.r * p
 
 	numDiscard := roundRandom((1-p)*float64(len(s.txs)), s.rng)
 	for i := 0; i < numDiscard; i++ {
 		s.txs = popRandom(s.txs, s.rng)
 	}
+	if excludeTx(tx, s.cfg.MaxFeeRate) {
+		return false
+	}
+	s.r++
 	s.txs = append(s.txs, tx)
+	return true
 }
 
 // popRandom pops and discards a tx chosen uniformly at random, and returns
@@ -5,6 +5,7 @@ import (
 	"math/rand"
 	"testing"
 
+	"github.com/bitcoinfees/feesim/sim"
 	"github.com/bitcoinfees/feesim/testutil"
 )
 
@@ -57,6 +58,116 @@ func TestUniTxSource(t *testing.T) {
 	}
 }
 
+func TestUniTxSourceRefresh(t *testing.T) {
+	db := &TxMemDB{}
+	db.init()
+	gets := &getCountDB{TxMemDB: db}
+	c := UniTxSourceConfig{
+		MinWindow:     600,
+		MaxWindow:     window,
+		Halflife:      600,
+		RefreshPeriod: 1000,
+	}
+	e := NewUniTxSource(gets, c, rand.New(rand.NewSource(0)))
+
+	middle := db.txs[len(db.txs)/2].Time
+	latest := db.txs[len(db.txs)-1].Time
+	var numRefresh int64
+	for tm := middle; tm <= latest; tm += 60 {
+		full := gets.full
+		if _, err := e.Estimate(tm); err != nil {
+			t.Fatal(err)
+		}
+		// A full estimation happens on the first Estimate, and then on the
+		// first after each multiple of RefreshPeriod.
+		wantFull := tm == middle || tm/1000 > (tm-60)/1000
+		if err := testutil.CheckEqual(gets.full > full, wantFull); err != nil {
+			t.Errorf("time %d: %v", tm, err)
+		}
+		if wantFull {
+			numRefresh++
+			// The window spans all the txs up to MaxWindow; they start at
+			// time 0.
+			if full := int64(math.Min(float64(tm), window)); e.window < full-60 {
+				t.Errorf("time %d: window %d should span MaxWindow", tm, e.window)
+			}
+		}
+	}
+	if err := testutil.CheckEqual(gets.full, numRefresh); err != nil {
+		t.Error(err)
+	}
+	if numRefresh < 3 {
+		t.Error("too few refreshes to test:", numRefresh)
+	}
+
+	// No refresh if RefreshPeriod is 0
+	c.RefreshPeriod = 0
+	gets.full = 0
+	e = NewUniTxSource(gets, c, rand.New(rand.NewSource(0)))
+	for tm := middle; tm <= latest; tm += 60 {
+		if _, err := e.Estimate(tm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := testutil.CheckEqual(gets.full, int64(1)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUniTxSourceState(t *testing.T) {
+	db := &TxMemDB{txs: []Tx{
+		{FeeRate: 10000, Size: 250, Time: 1000},
+		{FeeRate: 10000, Size: 250, Time: 1000},
+		{FeeRate: 20000, Size: 250, Time: 1100},
+		{FeeRate: 20000, Size: 250, Time: 1100},
+	}}
+	c := UniTxSourceConfig{
+		MinWindow: 600,
+		MaxWindow: 1000,
+		Halflife:  100,
+	}
+	e := NewUniTxSource(db, c, rand.New(rand.NewSource(0)))
+	if err := testutil.CheckEqual(e.State(), UniTxSourceState{
+		MinWindow: 600, Decay: math.Pow(0.5, 0.01)}); err != nil {
+		t.Error(err)
+	}
+
+	// The window is too small, but the state is updated. At 1100, the two
+	// txs decay by half, so exactly one is discarded.
+	if _, err := e.Estimate(1200); err == nil {
+		t.Fatal("should have TxWindowError")
+	}
+	state := e.State()
+	if err := testutil.CheckEqual(state.Window, int64(100)); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(state.NumTxs, 3); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckPctDiff(state.R, 3, 1e-9); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(state.PrevTime, int64(1100)); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckPctDiff(state.TxRate, 3*math.Ln2/50, 1e-9); err != nil {
+		t.Error(err)
+	}
+}
+
+// getCountDB counts the full (i.e. from MaxWindow before end) Gets.
+type getCountDB struct {
+	*TxMemDB
+	full int64
+}
+
+func (d *getCountDB) Get(start, end int64) ([]Tx, error) {
+	if end-start == window {
+		d.full++
+	}
+	return d.TxMemDB.Get(start, end)
+}
+
 func TestRoundRandom(t *testing.T) {
 	const (
 		f = 9.99
@@ -72,3 +183,120 @@ func TestRoundRandom(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestQuantizeFeeRates(t *testing.T) {
+	const (
+		numTxs = 20000
+		n      = 200
+	)
+	rng := rand.New(rand.NewSource(0))
+	feerates := make([]sim.FeeRate, numTxs)
+	sizes := make([]sim.TxSize, numTxs)
+	for i := range feerates {
+		feerates[i] = sim.FeeRate(1000 + rng.Intn(100000))
+		sizes[i] = sim.TxSize(200 + rng.Intn(1000))
+	}
+	feerates[0] = 0 // Non-positive fee rates are left as is
+	exact := sim.NewUniTxSource(append([]sim.FeeRate(nil), feerates...), sizes, 1).RateFn()
+
+	distinct, ok := quantizeFeeRates(feerates, n)
+	if !ok {
+		t.Fatal("fee rates should have been quantized")
+	}
+	t.Log("distinct fee rates:", distinct)
+	set := make(map[sim.FeeRate]struct{})
+	for _, f := range feerates {
+		set[f] = struct{}{}
+	}
+	if len(set) > n+1 {
+		t.Errorf("%d distinct fee rates after quantization", len(set))
+	}
+	if err := testutil.CheckEqual(feerates[0], sim.FeeRate(0)); err != nil {
+		t.Error(err)
+	}
+
+	quantized := sim.NewUniTxSource(feerates, sizes, 1).RateFn()
+	// Fee rates move by at most half a grid step (~1.2%), so the rate
+	// function is approximated to within a small fraction of the total rate.
+	tol := 0.01 * exact.Eval(0)
+	for _, x := range []float64{0, 1000, 2000, 5000, 10000, 30000, 50000, 80000, 100000} {
+		if d := math.Abs(quantized.Eval(x) - exact.Eval(x)); d > tol {
+			t.Errorf("x=%v: quantized %v, exact %v", x, quantized.Eval(x), exact.Eval(x))
+		}
+	}
+
+	// No quantization if within the bound
+	if _, ok := quantizeFeeRates([]sim.FeeRate{1000, 2000, 3000}, 3); ok {
+		t.Error("fee rates should not have been quantized")
+	}
+	if _, ok := quantizeFeeRates(feerates, 0); ok {
+		t.Error("fee rates should not have been quantized")
+	}
+	// A single grid point
+	f := []sim.FeeRate{1000, 4000, 2000}
+	quantizeFeeRates(f, 1)
+	if err := testutil.CheckEqual(f, []sim.FeeRate{2000, 2000, 2000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTxSourceMaxFeeRate(t *testing.T) {
+	const maxfeerate = 1000000
+	db := &TxMemDB{}
+	db.init()
+	// An anomalous tx, at the latest time
+	latest := db.txs[len(db.txs)-1].Time
+	db.txs = append(db.txs, Tx{FeeRate: 1e15, Size: 250, Time: latest})
+
+	// Without the filter, the outlier sets the stable fee search range.
+	c := UniTxSourceConfig{
+		MinWindow: 600,
+		MaxWindow: window,
+		Halflife:  600,
+	}
+	e := NewUniTxSource(db, c, rand.New(rand.NewSource(0)))
+	txsrc, err := e.Estimate(latest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckPctDiff(txsrc.RateFn().Inverse(0), 1e15, 1e-9); err != nil {
+		t.Error(err)
+	}
+
+	c.MaxFeeRate = maxfeerate
+	e = NewUniTxSource(db, c, rand.New(rand.NewSource(0)))
+	txsrc, err = e.Estimate(latest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if highfee := txsrc.RateFn().Inverse(0); highfee > maxfeerate {
+		t.Errorf("highfee %v exceeds maxfeerate", highfee)
+	}
+	for _, tx := range e.txs {
+		if tx.FeeRate > maxfeerate {
+			t.Fatal("anomalous tx was not excluded")
+		}
+	}
+	// The tx rate estimate is unaffected
+	if err := testutil.CheckPctDiff(txsrc.RateFn().Eval(0), 712.5, 0.06); err != nil {
+		t.Error(err)
+	}
+
+	mc := &MultiTxSourceConfig{
+		MinWindow:  600,
+		MaxWindow:  window,
+		Halflife:   3600,
+		MaxTxs:     10000,
+		MaxFeeRate: maxfeerate,
+	}
+	mtxsrc, err := MultiTxSource(latest, mc, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if highfee := mtxsrc.RateFn().Inverse(0); highfee > maxfeerate {
+		t.Errorf("highfee %v exceeds maxfeerate", highfee)
+	}
+	if err := testutil.CheckPctDiff(mtxsrc.RateFn().Eval(0), 712.5, 0.02); err != nil {
+		t.Error(err)
+	}
+}
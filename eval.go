@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	est "github.com/bitcoinfees/feesim/estimate"
+	"github.com/bitcoinfees/feesim/predict"
+	"github.com/bitcoinfees/feesim/sim"
+)
+
+// evalConfig configures evaluate.
+type evalConfig struct {
+	// The outcomes of the txs confirmed in blocks From to To are evaluated.
+	From, To int64
+
+	// The fee rate (satoshis/kB) paid by the fixed fee policy
+	FixedFeeRate sim.FeeRate
+
+	// The Core-like policy pays, for target n, the lowest fee rate which
+	// would have confirmed within n blocks in SuccessPct of the n block
+	// windows in the Window blocks before the tx, judging by the blocks'
+	// SFRs. This roughly follows Bitcoin Core's estimatesmartfee, which
+	// requires a success threshold of the fee rate buckets it tracks.
+	Window     int64
+	SuccessPct float64
+
+	Predict predict.Config
+}
+
+// evalResult is the evaluation of the predicts of a window of blocks.
+type evalResult struct {
+	From        int64        `json:"from"`
+	To          int64        `json:"to"`
+	NumOutcomes int          `json:"numoutcomes"`
+	Targets     []evalTarget `json:"targets"`
+
+	// The fees of the fee policies, for the outcomes with a fee rate and the
+	// SFRs of the blocks up to their targets. The first policy is feesim's,
+	// i.e. the txs' own fee rates.
+	NumCompared int          `json:"numcompared"`
+	Policies    []evalPolicy `json:"policies"`
+}
+
+// evalTarget is the calibration of the predicts of a target, i.e. the number
+// (or size, if predict.weightbysize) of those which attained and exceeded it.
+type evalTarget struct {
+	ConfirmIn int64   `json:"confirmin"`
+	Attained  float64 `json:"attained"`
+	Exceeded  float64 `json:"exceeded"`
+}
+
+// evalPolicy is the total fees (satoshis) a fee policy pays for the compared
+// txs, and the number of them which would have confirmed by their target.
+// For the baseline policies, Saved and Overpaid are the totals of the txs'
+// fees which feesim's fee rate saved, or overpaid, relative to the policy.
+type evalPolicy struct {
+	Name     string `json:"name"`
+	Fees     int64  `json:"fees"`
+	Attained int    `json:"attained"`
+	Saved    int64  `json:"saved"`
+	Overpaid int64  `json:"overpaid"`
+}
+
+// add adds the fee of a tx to the policy, and returns it.
+func (p *evalPolicy) add(feeRate sim.FeeRate, size int64, attained bool) int64 {
+	fee := int64(feeRate) * size / 1000
+	p.Fees += fee
+	if attained {
+		p.Attained++
+	}
+	return fee
+}
+
+// addBaseline is like add, for a baseline policy; feesimFee is the tx's fee
+// under feesim's policy.
+func (p *evalPolicy) addBaseline(feeRate sim.FeeRate, size int64, attained bool, feesimFee int64) {
+	if d := p.add(feeRate, size, attained) - feesimFee; d > 0 {
+		p.Saved += d
+	} else {
+		p.Overpaid -= d
+	}
+}
+
+// evaluate evaluates the predict outcomes of the txs confirmed in blocks
+// cfg.From to cfg.To, with the block stats from height evalStatsStart.
+//
+// The policies' fees are for the predicted target; feesim's is the tx's own fee
+// rate, so the outcomes stored without one (by earlier versions) aren't
+// compared. The policies are deemed to attain the target if one of the blocks
+// up to it has an SFR at most their fee rate.
+func evaluate(outcomes []predict.Outcome, stats []*est.BlockStat, cfg evalConfig) evalResult {
+	r := evalResult{From: cfg.From, To: cfg.To}
+	var window []predict.Outcome
+	for _, outcome := range outcomes {
+		if outcome.Height >= cfg.From && outcome.Height <= cfg.To {
+			window = append(window, outcome)
+		}
+	}
+	attained, exceeded, n := predict.Calibration(window, cfg.Predict)
+	r.NumOutcomes = n
+	for i := range attained {
+		r.Targets = append(r.Targets, evalTarget{
+			ConfirmIn: int64(i + 1),
+			Attained:  attained[i],
+			Exceeded:  exceeded[i],
+		})
+	}
+
+	sfrs := make(map[int64]sim.FeeRate)
+	for _, stat := range stats {
+		if !stat.NoSFR {
+			sfrs[stat.Height] = stat.SFRStat.SFR
+		}
+	}
+	core := &coreEstimator{
+		sfrs:       sfrs,
+		window:     cfg.Window,
+		successPct: cfg.SuccessPct,
+		cache:      make(map[[2]int64]coreEstimate),
+	}
+	feesimPolicy := evalPolicy{Name: "feesim"}
+	fixedPolicy := evalPolicy{Name: "fixed"}
+	corePolicy := evalPolicy{Name: "corelike"}
+	for _, outcome := range window {
+		if outcome.Size <= 0 || outcome.FeeRate <= 0 || outcome.ConfirmIn < 1 ||
+			outcome.ConfirmIn > int64(cfg.Predict.MaxBlockConfirms) {
+			continue
+		}
+		// The height of the chain tip when the tx was predicted
+		height := outcome.ConfirmBy - outcome.ConfirmIn
+		minSFR, ok := windowMinSFR(sfrs, height, outcome.ConfirmIn)
+		if !ok {
+			continue
+		}
+		coreFeeRate, ok := core.feeRate(height, outcome.ConfirmIn)
+		if !ok {
+			continue
+		}
+		r.NumCompared++
+		feeRate := sim.FeeRate(outcome.FeeRate)
+		feesimFee := feesimPolicy.add(feeRate, outcome.Size, feeRate >= minSFR)
+		fixedPolicy.addBaseline(cfg.FixedFeeRate, outcome.Size, cfg.FixedFeeRate >= minSFR, feesimFee)
+		corePolicy.addBaseline(coreFeeRate, outcome.Size, coreFeeRate >= minSFR, feesimFee)
+	}
+	r.Policies = []evalPolicy{feesimPolicy, fixedPolicy, corePolicy}
+	return r
+}
+
+// evalStatsStart returns the lowest height of the block stats needed by
+// evaluate: those of the cfg.Window blocks before the earliest predict of the
+// outcomes evaluated. An exceeded outcome's predict can be any number of blocks
+// before cfg.From.
+func evalStatsStart(outcomes []predict.Outcome, cfg evalConfig) int64 {
+	start := cfg.From
+	for _, outcome := range outcomes {
+		if outcome.Height < cfg.From || outcome.Height > cfg.To {
+			continue
+		}
+		if h := outcome.ConfirmBy - outcome.ConfirmIn; h < start {
+			start = h
+		}
+	}
+	start -= cfg.Window
+	if start < 0 {
+		return 0
+	}
+	return start
+}
+
+// windowMinSFR returns the min SFR of blocks height+1 to height+n, and false
+// if any of their SFRs is unknown.
+func windowMinSFR(sfrs map[int64]sim.FeeRate, height, n int64) (sim.FeeRate, bool) {
+	minSFR := sim.MaxFeeRate
+	for h := height + 1; h <= height+n; h++ {
+		sfr, ok := sfrs[h]
+		if !ok {
+			return 0, false
+		}
+		if sfr < minSFR {
+			minSFR = sfr
+		}
+	}
+	return minSFR, true
+}
+
+type coreEstimate struct {
+	feeRate sim.FeeRate
+	ok      bool
+}
+
+// coreEstimator is the Core-like policy of evalConfig. The estimates are
+// cached, since many txs share a height and target.
+type coreEstimator struct {
+	sfrs       map[int64]sim.FeeRate
+	window     int64
+	successPct float64
+	cache      map[[2]int64]coreEstimate
+}
+
+// feeRate returns the estimate for target n at the given height, or false if
+// none of the windows before it have known SFRs.
+func (e *coreEstimator) feeRate(height, n int64) (sim.FeeRate, bool) {
+	key := [2]int64{height, n}
+	if c, ok := e.cache[key]; ok {
+		return c.feeRate, c.ok
+	}
+	var mins []sim.FeeRate
+	for h := height - e.window; h <= height-n; h++ {
+		if minSFR, ok := windowMinSFR(e.sfrs, h, n); ok {
+			mins = append(mins, minSFR)
+		}
+	}
+	var c coreEstimate
+	if len(mins) > 0 {
+		sort.Slice(mins, func(i, j int) bool { return mins[i] < mins[j] })
+		i := int(math.Ceil(e.successPct*float64(len(mins)))) - 1
+		if i < 0 {
+			i = 0
+		}
+		c = coreEstimate{feeRate: mins[i], ok: true}
+	}
+	e.cache[key] = c
+	return c.feeRate, c.ok
+}
+
+// writeEval writes the evaluation r, done with cfg, as tables of the
+// calibration and of the fee policies.
+func writeEval(w io.Writer, r evalResult, cfg evalConfig) {
+	if r.NumOutcomes == 0 {
+		fmt.Fprintf(w, "No outcomes of txs confirmed in blocks %d to %d.\n", r.From, r.To)
+		return
+	}
+	fmt.Fprintf(w, "Evaluated %d outcomes of txs confirmed in blocks %d to %d.\n\n",
+		r.NumOutcomes, r.From, r.To)
+	fmt.Fprintf(w, "Calibration:\n%6s %10s %9s\n", "Target", "Predicts", "Attained")
+	var attained, total float64
+	for _, target := range r.Targets {
+		n := target.Attained + target.Exceeded
+		fmt.Fprintf(w, "%6d %10.0f %9s\n", target.ConfirmIn, n, formatEvalPct(target.Attained, n))
+		attained += target.Attained
+		total += n
+	}
+	fmt.Fprintf(w, "%6s %10.0f %9s\n", "All", total, formatEvalPct(attained, total))
+
+	if r.NumCompared == 0 {
+		fmt.Fprintf(w, "\nNo outcomes with block stats to compare the fees.\n")
+		return
+	}
+	fmt.Fprintf(w, "\nFees of %d txs, at each policy's fee rate for the predicted target, and those\n"+
+		"feesim saved and overpaid relative to the policy:\n", r.NumCompared)
+	fmt.Fprintf(w, "%-24s %12s %9s %12s %12s\n", "Policy", "Fees (sat)", "Attained", "Saved", "Overpaid")
+	for _, p := range r.Policies {
+		name := p.Name
+		saved, overpaid := fmt.Sprint(p.Saved), fmt.Sprint(p.Overpaid)
+		switch p.Name {
+		case "feesim":
+			name = "Feesim"
+			saved, overpaid = "-", "-"
+		case "fixed":
+			name = fmt.Sprintf("Fixed %d sat/kB", cfg.FixedFeeRate)
+		case "corelike":
+			name = fmt.Sprintf("Core-like (%g%%, %d)", cfg.SuccessPct*100, cfg.Window)
+		}
+		fmt.Fprintf(w, "%-24s %12d %9s %12s %12s\n", name, p.Fees,
+			formatEvalPct(float64(p.Attained), float64(r.NumCompared)), saved, overpaid)
+	}
+}
+
+// formatEvalPct formats x / total as a percentage, or "-" if total is 0.
+func formatEvalPct(x, total float64) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", x/total*100)
+}
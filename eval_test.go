@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	est "github.com/bitcoinfees/feesim/estimate"
+	"github.com/bitcoinfees/feesim/predict"
+	"github.com/bitcoinfees/feesim/testutil"
+)
+
+// evalFixture returns block stats of heights 0 to 29, with SFRs alternating
+// between 20000 and 8000 (except block 25, which has none), and outcomes
+// around blocks 20 to 24.
+func evalFixture() ([]predict.Outcome, []*est.BlockStat) {
+	var stats []*est.BlockStat
+	for h := int64(0); h < 30; h++ {
+		stat := &est.BlockStat{Height: h, Size: 1000000, Time: h * 600, NumHashes: 1}
+		stat.SFRStat.SFR = 8000
+		if h%2 == 0 {
+			stat.SFRStat.SFR = 20000
+		}
+		if h == 25 {
+			stat.NoSFR = true
+			stat.SFRStat.SFR = 0
+		}
+		stats = append(stats, stat)
+	}
+	outcomes := []predict.Outcome{
+		{ConfirmIn: 1, ConfirmBy: 20, Height: 20, Size: 1000, FeeRate: 15000},
+		{ConfirmIn: 2, ConfirmBy: 22, Height: 23, Size: 500, FeeRate: 9000},
+		{ConfirmIn: 1, ConfirmBy: 24, Height: 24, Size: 2000, FeeRate: 25000},
+		{ConfirmIn: 1, ConfirmBy: 22, Height: 22, Size: 300},                 // No fee rate
+		{ConfirmIn: 2, ConfirmBy: 25, Height: 24, Size: 400, FeeRate: 10000}, // Block 25 has no SFR
+		{ConfirmIn: 3, ConfirmBy: 24, Height: 21, Size: 400, FeeRate: 10000}, // Out of range
+		{ConfirmIn: 1, ConfirmBy: 30, Height: 30, Size: 400, FeeRate: 10000}, // Out of the window
+	}
+	return outcomes, stats
+}
+
+func TestEvaluate(t *testing.T) {
+	outcomes, stats := evalFixture()
+	cfg := evalConfig{
+		From:         20,
+		To:           24,
+		FixedFeeRate: 10000,
+		Window:       6,
+		SuccessPct:   0.9,
+		Predict:      predict.Config{MaxBlockConfirms: 2},
+	}
+	r := evaluate(outcomes, stats, cfg)
+
+	// Only the outcomes with a fee rate and the SFRs of their blocks are
+	// compared. The Core-like policy pays 20000 for target 1 at heights 19 and
+	// 23, since 8000 is only enough in half of the windows, and 8000 for
+	// target 2 at height 20. Feesim pays the txs' fee rates, saving or
+	// overpaying tx by tx relative to the baselines.
+	ref := evalResult{
+		From:        20,
+		To:          24,
+		NumOutcomes: 5,
+		Targets: []evalTarget{
+			{ConfirmIn: 1, Attained: 3, Exceeded: 0},
+			{ConfirmIn: 2, Attained: 1, Exceeded: 1},
+		},
+		NumCompared: 3,
+		Policies: []evalPolicy{
+			{Name: "feesim", Fees: 15000 + 4500 + 50000, Attained: 2},
+			{Name: "fixed", Fees: 10000 + 5000 + 20000, Attained: 1,
+				Saved: 500, Overpaid: 5000 + 30000},
+			{Name: "corelike", Fees: 20000 + 4000 + 40000, Attained: 3,
+				Saved: 5000, Overpaid: 500 + 10000},
+		},
+	}
+	if err := testutil.CheckEqual(r, ref); err != nil {
+		t.Error(err)
+	}
+
+	// Without enough history, the Core-like policy can't estimate; no
+	// outcomes are compared.
+	r = evaluate(outcomes, stats[24:], cfg)
+	if err := testutil.CheckEqual(r.NumCompared, 0); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(r.Policies[0], evalPolicy{Name: "feesim"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEvalStatsStart(t *testing.T) {
+	outcomes, _ := evalFixture()
+	cfg := evalConfig{From: 20, To: 24, Window: 6}
+	// The earliest predict is at height 19.
+	if err := testutil.CheckEqual(evalStatsStart(outcomes, cfg), int64(13)); err != nil {
+		t.Error(err)
+	}
+
+	// An exceeded outcome predicted long before cfg.From
+	outcomes = append(outcomes, predict.Outcome{ConfirmIn: 1, ConfirmBy: 11, Height: 20, Size: 400})
+	if err := testutil.CheckEqual(evalStatsStart(outcomes, cfg), int64(4)); err != nil {
+		t.Error(err)
+	}
+	cfg.Window = 20
+	if err := testutil.CheckEqual(evalStatsStart(outcomes, cfg), int64(0)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWriteEval(t *testing.T) {
+	outcomes, stats := evalFixture()
+	cfg := evalConfig{
+		From:         20,
+		To:           24,
+		FixedFeeRate: 10000,
+		Window:       6,
+		SuccessPct:   0.9,
+		Predict:      predict.Config{MaxBlockConfirms: 2},
+	}
+	var b bytes.Buffer
+	writeEval(&b, evaluate(outcomes, stats, cfg), cfg)
+	ref := `Evaluated 5 outcomes of txs confirmed in blocks 20 to 24.
+
+Calibration:
+Target   Predicts  Attained
+     1          3    100.0%
+     2          2     50.0%
+   All          5     80.0%
+
+Fees of 3 txs, at each policy's fee rate for the predicted target, and those
+feesim saved and overpaid relative to the policy:
+Policy                     Fees (sat)  Attained        Saved     Overpaid
+Feesim                          69500     66.7%            -            -
+Fixed 10000 sat/kB              35000     33.3%          500        35000
+Core-like (90%, 6)              64000    100.0%         5000        10500
+`
+	if err := testutil.CheckEqual(b.String(), ref); err != nil {
+		t.Error(err)
+	}
+
+	b.Reset()
+	cfg.From, cfg.To = 100, 200
+	writeEval(&b, evaluate(outcomes, stats, cfg), cfg)
+	ref = "No outcomes of txs confirmed in blocks 100 to 200.\n"
+	if err := testutil.CheckEqual(b.String(), ref); err != nil {
+		t.Error(err)
+	}
+}
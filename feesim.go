@@ -1,11 +1,15 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"math"
+	"runtime"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rcrowley/go-metrics"
@@ -19,10 +23,13 @@ import (
 var errPause = errors.New("sim is paused")
 var errInProgress = errors.New("sim is in progress")
 var errShutdown = errors.New("sim is shutting down")
+var errOnDemandBusy = errors.New("an on-demand sim is already running; try again later")
+var errCanceled = errors.New("on-demand sim canceled")
 
 type TxDB interface {
 	est.TxDB
 	col.TxDB
+	Count(start, end int64) (int, error)
 	Delete(start, end int64) error
 	Close() error
 }
@@ -30,14 +37,56 @@ type TxDB interface {
 type BlockStatDB interface {
 	est.BlockStatDB
 	col.BlockStatDB
+	Count(start, end int64) (int, error)
 	Delete(start, end int64) error
 	Close() error
 }
 
+// RateHistoryDB stores snapshots of the tx and capacity byte rate functions,
+// keyed by time.
+type RateHistoryDB interface {
+	Get(start, end int64) ([]est.RateSnapshot, error)
+	Put([]est.RateSnapshot) error
+	Delete(start, end int64) error
+	Close() error
+}
+
+// Compacter is implemented by the tx / block stat DBs which can shrink their
+// files after a large delete.
+type Compacter interface {
+	Compact() error
+}
+
+// A Filer is a DB which may share its file with other DBs (see bolt.LoadDB).
+// DBs with the same File are compacted once.
+type Filer interface {
+	File() string
+}
+
+// Trim compacts a DB if at least trimCompactMin of its records were deleted.
+const trimCompactMin = 10000
+
+// Number of points of the rate functions in a rate history snapshot
+const rateHistoryPoints = 20
+
 type FeeSim struct {
-	result      []sim.FeeRate
-	txsource    sim.TxSource
-	blocksource sim.BlockSource
+	result        []sim.FeeRate
+	resultTime    int64
+	lastResult    []sim.FeeRate // The last result set without error
+	variates      []sim.TransientVariate
+	nextblock     *sim.NextBlockProb
+	conftime      *sim.ConfTimeDist
+	successCounts *sim.SuccessCounts
+	bounds        *sim.TransientResult
+	floors        *SimFloors
+	collectErrs   []col.CollectorError
+	alert         bool
+	nearCapacity  bool
+	capacityRatio float64
+	clockSkewed   bool
+	clockSkew     int64
+	txsource      sim.TxSource
+	blocksource   sim.BlockSource
 
 	err            error
 	errTxSource    error
@@ -49,11 +98,17 @@ type FeeSim struct {
 	blkdb     BlockStatDB
 	predictdb predict.DB
 	cfg       FeeSimConfig
+	tunables  tunableConfig
+
+	pause   chan bool
+	done    chan struct{}
+	wg      sync.WaitGroup
+	mux     sync.RWMutex
+	trimMux sync.Mutex
 
-	pause chan bool
-	done  chan struct{}
-	wg    sync.WaitGroup
-	mux   sync.RWMutex
+	// onDemand is 1 while an on-demand sim (see estimateWith and
+	// TuneNumIters) is running; only one may run at a time.
+	onDemand int32
 }
 
 type FeeSimConfig struct {
@@ -64,16 +119,105 @@ type FeeSimConfig struct {
 	TxMaxAge  int64               `yaml:"txmaxage" json:"txmaxage"`
 	TxGapTol  int64               `yaml:"txgaptol" json:"txgaptol"`
 
-	estTxSource    est.TxSourceEstimator    `yaml:"-" json:"-"`
-	estBlockSource est.BlockSourceEstimator `yaml:"-" json:"-"`
-	logger         *log.Logger              `yaml:"-" json:"-"`
+	// When rebooting, the stored txs are shifted forward in time to close
+	// the gap since the last one, unless the gap exceeds TxShiftTol times
+	// their mean inter-arrival time, in which case they're discarded. If 0,
+	// only TxGapTol applies.
+	TxShiftTol float64 `yaml:"txshifttol" json:"txshifttol"`
+
+	// If the mempool has more than SizeFnSample entries, the mempool size
+	// function is computed from a size-weighted sample of SizeFnSample
+	// entries. If 0, it's always computed exactly.
+	SizeFnSample int `yaml:"sizefnsample" json:"sizefnsample"`
+
+	// Coarse memory budget in MB for the transient sim. If the estimated
+	// footprint exceeds it, the sim is scaled down (see fitMemoryBudget). If
+	// 0, there's no budget.
+	MemoryBudget int `yaml:"memorybudget" json:"memorybudget"`
+
+	// If > 0, tx arrivals in the sim which aren't confirmed within
+	// MempoolExpiry hours are dropped, as with Bitcoin Core's
+	// -mempoolexpiry (see sim.Sim.SetExpiry).
+	MempoolExpiry int `yaml:"mempoolexpiry" json:"mempoolexpiry"`
+
+	// If > 0, the sim's tx arrival rate is increased with the congestion, by
+	// a factor of 1 + BumpElasticity*congestion, to approximate fee bumping
+	// (see sim.BumpTxSource and simCongestion).
+	BumpElasticity float64 `yaml:"bumpelasticity" json:"bumpelasticity"`
+
+	// If RBF.Enabled, the sim's tx arrivals are replaced by fee bumped
+	// ones according to RBF (see sim.RBFTxSource).
+	RBF sim.RBFConfig `yaml:"rbf" json:"rbf"`
+
+	// If true, the sim's tx and block sizes are in weight units instead of
+	// virtual bytes (see sim.WitnessScaleFactor), so that the mempool txs'
+	// weights aren't rounded up. The tx and capacity byte rates are then in
+	// weight units per second.
+	WeightUnits bool `yaml:"weightunits" json:"weightunits"`
+
+	// Number of most recent collector errors to keep.
+	CollectErrors int `yaml:"collecterrors" json:"collecterrors"`
+
+	// The fee spike alert, configured as estimate.alert (see EstimateConfig).
+	Alert AlertConfig `yaml:"-" json:"-"`
+
+	// If > 0, warn when the tx byte rate exceeds CapacityWarn times the
+	// capacity byte rate (see checkCapacity).
+	CapacityWarn float64 `yaml:"capacitywarn" json:"capacitywarn"`
+
+	// If > 0, warn when the local clock differs from the node's by more than
+	// ClockSkewWarn seconds, as measured against the node's tip time at
+	// startup and every clockSkewPeriod seconds (see checkClockSkew).
+	ClockSkewWarn int64 `yaml:"clockskewwarn" json:"clockskewwarn"`
+
+	// If true, when the sim is paused or in progress, the fee estimate RPCs
+	// return the last result, flagged as stale, instead of an error.
+	StaleResults bool `yaml:"staleresults" json:"staleresults"`
+
+	// Capacity percentiles of the estimate modes (see EstimateMode).
+	CapacityPct CapacityPctConfig `yaml:"capacitypct" json:"capacitypct"`
+
+	// Save the timer metrics to disk every MetricsSavePeriod seconds (and on
+	// shutdown), so that they persist across restarts. If 0, they're not
+	// saved.
+	MetricsSavePeriod int `yaml:"metricssaveperiod" json:"metricssaveperiod"`
+
+	// If > 0, failed TxDB / BlockStatDB / predict DB writes are queued in a
+	// dead letter file, and retried at startup and every DeadLetterRetry
+	// seconds (see col.DeadLetter). If 0, they're dropped.
+	DeadLetterRetry int `yaml:"deadletterretry" json:"deadletterretry"`
+
+	// If true, the fee rate of a mempool tx in the sim is the max of its own
+	// and its ancestor (package) fee rate, if the node reports it (see
+	// col.SimifyMempool). Otherwise it's the tx's own fee rate.
+	AncestorFeeRate bool `yaml:"ancestorfeerate" json:"ancestorfeerate"`
+
+	// If > 0, the tx and capacity byte rate functions are snapshotted every
+	// SimPeriod seconds into the rate history, and kept for
+	// RateHistoryRetention hours. If 0, there's no rate history. The rate
+	// history is always in its own bolt file (see loadRateHistoryDB).
+	RateHistoryRetention int `yaml:"ratehistoryretention" json:"ratehistoryretention"`
+
+	estTxSource    est.TxSourceEstimator       `yaml:"-" json:"-"`
+	estBlockSource est.BlockSourceEstimator    `yaml:"-" json:"-"`
+	txSourceState  func() est.UniTxSourceState `yaml:"-" json:"-"`
+	nodeTime       col.NodeTimeGetter          `yaml:"-" json:"-"`
+	logger         *log.Logger                 `yaml:"-" json:"-"`
+	metrics        *metricsStore               `yaml:"-" json:"-"`
+	deadLetter     *col.DeadLetter             `yaml:"-" json:"-"`
+	rateHistory    RateHistoryDB               `yaml:"-" json:"-"`
+
+	// The block source estimation window, in blocks; see Trim.
+	blockStatWindow int64 `yaml:"-" json:"-"`
 }
 
 func NewFeeSim(txdb TxDB, blkdb BlockStatDB, predictdb predict.DB, cfg FeeSimConfig) (*FeeSim, error) {
 	cfg.Collect.Logger = cfg.logger
+	cfg.Collect.DeadLetter = cfg.deadLetter
 	collect := col.NewCollector(txdb, blkdb, cfg.Collect)
 
 	cfg.Predict.Logger = cfg.logger
+	cfg.Predict.DeadLetter = cfg.deadLetter
 	predictor, err := predict.NewPredictor(predictdb, cfg.Predict)
 	if err != nil {
 		return nil, err
@@ -89,18 +233,33 @@ func NewFeeSim(txdb TxDB, blkdb BlockStatDB, predictdb predict.DB, cfg FeeSimCon
 		pause:     make(chan bool),
 		done:      make(chan struct{}),
 	}
+	feesim.tunables.simPeriod = cfg.SimPeriod
+	feesim.tunables.transient = cfg.Transient
 	return feesim, nil
 }
 
 func (s *FeeSim) Run() error {
 	logger := s.cfg.logger
+	// Register with wg under mux, so that a concurrent Stop either waits for
+	// Run or happens before it, in which case Run doesn't start at all.
+	s.mux.Lock()
+	select {
+	case <-s.done:
+		s.mux.Unlock()
+		return errShutdown
+	default:
+	}
 	s.wg.Add(1)
+	s.mux.Unlock()
 	defer logger.Println("Feesim all stopped.")
 	defer s.wg.Wait()
 	defer s.wg.Done()
 	defer s.predictdb.Close()
 	defer s.blkdb.Close()
 	defer s.txdb.Close()
+	if s.cfg.rateHistory != nil {
+		defer s.cfg.rateHistory.Close()
+	}
 
 	logger.Printf("Feesim v%s starting up..", version)
 	state, err := s.cfg.Collect.GetState()
@@ -110,6 +269,12 @@ func (s *FeeSim) Run() error {
 	timeNow := state.Time
 	heightNow := state.Height
 
+	// Retry the failed writes from before the restart first, so that the
+	// txs are normalized, and the confirmed predicts cleaned up, with the
+	// rest.
+	if s.cfg.deadLetter != nil {
+		s.retryDeadLetter()
+	}
 	if err := s.normalizeTxDB(timeNow); err != nil {
 		return err
 	}
@@ -132,7 +297,7 @@ func (s *FeeSim) Run() error {
 	s.SetResult(nil, errInProgress)
 
 	s.wg.Add(1)
-	go s.loopSim(s.cfg.SimPeriod)
+	go s.loopSim()
 
 	sc := make(chan *col.MempoolState, 10)
 	bc := make(chan []col.Block, 10)
@@ -147,6 +312,27 @@ func (s *FeeSim) Run() error {
 	s.wg.Add(1)
 	go s.estBlockSourceWorker(hc)
 
+	if s.cfg.metrics != nil && s.cfg.MetricsSavePeriod > 0 {
+		s.wg.Add(1)
+		go s.saveMetricsWorker(s.cfg.MetricsSavePeriod)
+	}
+
+	if s.cfg.deadLetter != nil && s.cfg.DeadLetterRetry > 0 {
+		s.wg.Add(1)
+		go s.deadLetterWorker(s.cfg.DeadLetterRetry)
+	}
+
+	if s.cfg.rateHistory != nil {
+		s.wg.Add(1)
+		go s.rateHistoryWorker()
+	}
+
+	if s.clockSkewEnabled() {
+		s.checkClockSkew(timeNow)
+		s.wg.Add(1)
+		go s.clockSkewWorker(clockSkewPeriod)
+	}
+
 	logger.Println("Feesim startup complete.")
 	for {
 		select {
@@ -179,6 +365,7 @@ func (s *FeeSim) Run() error {
 		case err := <-s.collect.E:
 			// Error in collector
 			logger.Println("[ERROR] Collector:", err)
+			s.addCollectorError(err)
 		case <-s.done:
 			// Terminate
 			return nil
@@ -213,11 +400,27 @@ func (s *FeeSim) Status() map[string]string {
 		status["mempool"] = "OK"
 	}
 
+	s.healthStatus(status)
+
+	if s.cfg.Alert.FeeRate > 0 {
+		if s.Alerting() {
+			status["alert"] = fmt.Sprintf("Estimate for %d blocks exceeds %d satoshis/kB.",
+				s.cfg.Alert.Target, s.cfg.Alert.FeeRate)
+		} else {
+			status["alert"] = "OK"
+		}
+	}
+
 	return status
 }
 
 func (s *FeeSim) Pause(p bool) {
-	s.pause <- p
+	select {
+	case s.pause <- p:
+	case <-s.done:
+		// The sim loop has stopped; don't block forever.
+		return
+	}
 	if p {
 		s.cfg.logger.Println("Sim paused.")
 	} else {
@@ -225,6 +428,13 @@ func (s *FeeSim) Pause(p bool) {
 	}
 }
 
+// Done returns a channel which is closed when the sim is stopped.
+func (s *FeeSim) Done() <-chan struct{} {
+	return s.done
+}
+
+// Stop terminates Run and blocks until all its goroutines have exited. It's
+// safe to call Stop multiple times, from multiple goroutines.
 func (s *FeeSim) Stop() {
 	s.closeDone()
 	s.wg.Wait()
@@ -307,6 +517,234 @@ func (s *FeeSim) estTxSourceWorker(tc <-chan int64) {
 	}
 }
 
+// saveMetricsWorker saves the metrics every period seconds, and once more on
+// shutdown.
+func (s *FeeSim) saveMetricsWorker(period int) {
+	logger := s.cfg.logger
+	defer s.wg.Done()
+	ticker := time.NewTicker(time.Duration(period) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			if err := s.cfg.metrics.save(); err != nil {
+				logger.Println("[ERROR] Saving metrics:", err)
+			}
+			return
+		}
+		if err := s.cfg.metrics.save(); err != nil {
+			logger.Println("[ERROR] Saving metrics:", err)
+		}
+	}
+}
+
+func (s *FeeSim) deadLetterWorker(period int) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(time.Duration(period) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.retryDeadLetter()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// rateHistoryWorker snapshots the rate functions into the rate history every
+// SimPeriod seconds, picking up a reloaded SimPeriod on the next tick.
+func (s *FeeSim) rateHistoryWorker() {
+	logger := s.cfg.logger
+	period := s.SimPeriod()
+	defer s.wg.Done()
+	defer logger.Println("Rate history worker stopped.")
+	ticker := time.NewTicker(time.Duration(period) * time.Second)
+	defer func() { ticker.Stop() }()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.snapshotRates(time.Now().Unix()); err != nil {
+				logger.Println("[ERROR] Rate history:", err)
+			}
+			if p := s.SimPeriod(); p != period {
+				period = p
+				ticker.Stop()
+				ticker = time.NewTicker(time.Duration(period) * time.Second)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// snapshotRates puts a snapshot of the current tx and capacity byte rate
+// functions, at time timeNow, into the rate history, and deletes the
+// snapshots older than the retention. No snapshot is taken if either source
+// isn't available.
+func (s *FeeSim) snapshotRates(timeNow int64) error {
+	txsource, err := s.TxSource()
+	if err != nil || txsource == nil {
+		return nil
+	}
+	blocksource, err := s.BlockSource()
+	if err != nil || blocksource == nil {
+		return nil
+	}
+	snapshot := est.RateSnapshot{Time: timeNow}
+	if snapshot.TxRate, err = ratePoints(txsource.RateFn().Approx(rateHistoryPoints)); err != nil {
+		return err
+	}
+	if snapshot.CapRate, err = ratePoints(blocksource.RateFn().Approx(rateHistoryPoints)); err != nil {
+		return err
+	}
+	if err := s.cfg.rateHistory.Put([]est.RateSnapshot{snapshot}); err != nil {
+		return err
+	}
+	cutoff := timeNow - int64(s.cfg.RateHistoryRetention)*3600
+	if cutoff <= 0 {
+		return nil
+	}
+	return s.cfg.rateHistory.Delete(0, cutoff-1)
+}
+
+// ratePoints returns the points of fn, as given by its JSON encoding.
+func ratePoints(fn sim.MonotonicFn) (est.RatePoints, error) {
+	var p est.RatePoints
+	b, err := json.Marshal(fn)
+	if err != nil {
+		return p, err
+	}
+	err = json.Unmarshal(b, &p)
+	return p, err
+}
+
+// RateHistory returns the rate history snapshots with time in between start
+// and end.
+func (s *FeeSim) RateHistory(start, end int64) ([]est.RateSnapshot, error) {
+	if s.cfg.rateHistory == nil {
+		return nil, errors.New("rate history is disabled; set ratehistoryretention in the config")
+	}
+	return s.cfg.rateHistory.Get(start, end)
+}
+
+// TrimResult is the number of records removed by FeeSim.Trim.
+type TrimResult struct {
+	BlockStats int  `json:"blockstats"`
+	Txs        int  `json:"txs"`
+	Compacted  bool `json:"compacted"` // Whether a DB file was compacted
+}
+
+// Trim deletes the block stats of heights before blockStatsBefore, and the txs
+// with times before txsBefore; either is skipped if 0. Unless force, it refuses
+// to delete block stats within the block source estimation window
+// (indblock.window) of the current height. A DB from which at least
+// trimCompactMin records were deleted is compacted after the deletes, if it's
+// a Compacter; a file shared by both DBs is compacted once.
+func (s *FeeSim) Trim(blockStatsBefore, txsBefore int64, force bool) (TrimResult, error) {
+	// Concurrent trims would compact the same DB twice.
+	s.trimMux.Lock()
+	defer s.trimMux.Unlock()
+
+	var result TrimResult
+	if blockStatsBefore > 0 && !force {
+		state := s.State()
+		if state == nil {
+			return result, errors.New("current height is not yet known; use force to trim anyway")
+		}
+		if window := s.cfg.blockStatWindow; blockStatsBefore > state.Height-window {
+			return result, fmt.Errorf("height %d is within the block stat window (%d blocks) of the current height %d; use force to trim anyway",
+				blockStatsBefore, window, state.Height)
+		}
+	}
+
+	if blockStatsBefore > 0 {
+		n, err := s.blkdb.Count(0, blockStatsBefore-1)
+		if err != nil {
+			return result, err
+		}
+		if err := s.blkdb.Delete(0, blockStatsBefore-1); err != nil {
+			return result, err
+		}
+		result.BlockStats = n
+	}
+	if txsBefore > 0 {
+		n, err := s.txdb.Count(0, txsBefore-1)
+		if err != nil {
+			return result, err
+		}
+		if err := s.txdb.Delete(0, txsBefore-1); err != nil {
+			return result, err
+		}
+		result.Txs = n
+	}
+
+	compacted := make(map[string]bool)
+	for _, db := range []struct {
+		name    string
+		db      interface{}
+		deleted int
+	}{
+		{"BlockStatDB", s.blkdb, result.BlockStats},
+		{"TxDB", s.txdb, result.Txs},
+	} {
+		c, ok := db.db.(Compacter)
+		if !ok || db.deleted < trimCompactMin {
+			continue
+		}
+		if f, ok := db.db.(Filer); ok {
+			if compacted[f.File()] {
+				continue
+			}
+			compacted[f.File()] = true
+		}
+		if err := c.Compact(); err != nil {
+			return result, fmt.Errorf("%s compact: %v", db.name, err)
+		}
+		result.Compacted = true
+	}
+	s.cfg.logger.Printf("Trimmed %d block stats and %d txs.", result.BlockStats, result.Txs)
+	return result, nil
+}
+
+// retryDeadLetter retries the failed DB writes queued in the dead letter.
+func (s *FeeSim) retryDeadLetter() {
+	logger := s.cfg.logger
+	n, err := s.cfg.deadLetter.Retry(map[string]func(json.RawMessage) error{
+		col.DeadLetterTxs: func(data json.RawMessage) error {
+			var txs []est.Tx
+			if err := json.Unmarshal(data, &txs); err != nil {
+				return err
+			}
+			return s.txdb.Put(txs)
+		},
+		col.DeadLetterBlockStats: func(data json.RawMessage) error {
+			var stats []*est.BlockStat
+			if err := json.Unmarshal(data, &stats); err != nil {
+				return err
+			}
+			return s.blkdb.Put(stats)
+		},
+		predict.DeadLetterTxs: func(data json.RawMessage) error {
+			var txs map[string]predict.Tx
+			if err := json.Unmarshal(data, &txs); err != nil {
+				return err
+			}
+			return s.predictdb.PutTxs(txs)
+		},
+	})
+	if err != nil {
+		logger.Println("[ERROR] Dead letter retry:", err)
+	}
+	if n > 0 {
+		logger.Printf("Dead letter: %d failed writes retried successfully.", n)
+	}
+	if remain, err := s.cfg.deadLetter.Len(); err == nil && remain > 0 {
+		logger.Printf("[WARNING] Dead letter: %d failed writes still queued.", remain)
+	}
+}
+
 func (s *FeeSim) estBlockSourceWorker(hc <-chan int64) {
 	logger := s.cfg.logger
 	defer s.wg.Done()
@@ -325,14 +763,19 @@ func (s *FeeSim) estBlockSourceWorker(hc <-chan int64) {
 		if _, isCovErr := err.(est.BlockCoverageError); err != nil && !isCovErr {
 			logger.Println("[ERROR] estBlockSourceWorker:", err)
 		}
+		if err == nil && isLowConfidence(blocksource) {
+			logger.Printf("[WARNING] Block %d: BlockSource estimated from the most recent blocks only "+
+				"(low confidence).", height)
+		}
 
 		logger.Printf("[DEBUG] Block %d: BlockSource estimate updated.", height)
 		s.SetBlockSource(blocksource, err)
 	}
 }
 
-func (s *FeeSim) loopSim(period int) {
+func (s *FeeSim) loopSim() {
 	logger := s.cfg.logger
+	period := s.SimPeriod()
 	defer s.wg.Done()
 	defer logger.Println("Sim loop stopped.")
 	ticker := time.NewTicker(time.Duration(period) * time.Second)
@@ -343,9 +786,7 @@ func (s *FeeSim) loopSim(period int) {
 	sizes := []int{1, 60, 1440}
 	simTimers := make([]metrics.Timer, 3)
 	for i, size := range sizes {
-		h := metrics.NewHistogram(metrics.NewSimpleExpDecaySample(size))
-		simTimers[i] = metrics.NewCustomTimer(h, metrics.NewMeter())
-		metrics.Register(names[i], simTimers[i])
+		simTimers[i] = s.cfg.metrics.timer(names[i], size)
 	}
 
 	for {
@@ -358,7 +799,7 @@ func (s *FeeSim) loopSim(period int) {
 			}
 			logger.Println("[DEBUG] Transient sim started.")
 			startTime := time.Now()
-			r := ts.Run()
+			r := ts.RunWithBounds()
 
 		ResultLoop:
 			select {
@@ -367,7 +808,13 @@ func (s *FeeSim) loopSim(period int) {
 				for _, m := range simTimers {
 					m.UpdateSince(startTime)
 				}
-				s.SetResult(result, nil)
+				s.SetResult(result.FeeRates, nil)
+				s.setBounds(result)
+				s.setVariates(ts.Variates())
+				s.setNextBlockProb(ts.NextBlockProb())
+				s.setConfTimeDist(ts.ConfTimeDist())
+				s.setSuccessCounts(ts.SuccessCounts())
+				s.checkAlert(result.FeeRates)
 			case p := <-s.pause:
 				if !p {
 					goto ResultLoop // No change
@@ -382,6 +829,14 @@ func (s *FeeSim) loopSim(period int) {
 			}
 		}
 
+		// Pick up a SimPeriod change, unless paused (in which case the ticker
+		// is restarted with the new period on resume).
+		if p := s.SimPeriod(); p != period && !s.IsPaused() {
+			period = p
+			ticker.Stop()
+			ticker = time.NewTicker(time.Duration(period) * time.Second)
+		}
+
 	WaitLoop:
 		select {
 		case <-ticker.C:
@@ -396,6 +851,7 @@ func (s *FeeSim) loopSim(period int) {
 				goto WaitLoop
 			}
 			// Is paused, so restart the ticker and resume
+			period = s.SimPeriod()
 			ticker = time.NewTicker(time.Duration(period) * time.Second)
 			s.SetResult(nil, errInProgress)
 		case <-s.done:
@@ -406,12 +862,164 @@ func (s *FeeSim) loopSim(period int) {
 }
 
 func (s *FeeSim) setupSim() (*sim.TransientSim, error) {
-	logger := s.cfg.logger
+	txsource, err := s.TxSource()
+	if err != nil {
+		return nil, err
+	}
+	blocksource, err := s.BlockSource()
+	if err != nil {
+		return nil, err
+	}
+	s.checkCapacity(txsource, blocksource)
+	ns, transientCfg, err := s.newSim(txsource, blocksource)
+	if err != nil {
+		return nil, err
+	}
+	s.setSimFloors(ns.StableFee(), transientCfg.LowestFeeRate)
+	return sim.NewTransientSim(ns, transientCfg), nil
+}
+
+// SimFloors are the fee rate floors (satoshis/kB) of the last sim setup, below
+// which no estimate is returned.
+type SimFloors struct {
+	// Arrivals with fee rate below StableFee are discarded by the sim, since
+	// their rate exceeds the spare capacity, i.e. they'd never clear.
+	StableFee sim.FeeRate `json:"stablefee"`
+
+	// The mempool trimming cutoff: lower fee rate txs are left out, since
+	// they don't affect confirmation within MaxBlockConfirms.
+	LowestFeeRate sim.FeeRate `json:"lowestfeerate"`
 
+	// The effective floor, i.e. the max of the two.
+	Floor sim.FeeRate `json:"floor"`
+}
+
+// SimFloors returns the fee rate floors of the last sim setup.
+func (s *FeeSim) SimFloors() (SimFloors, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	if s.floors == nil {
+		return SimFloors{}, errors.New("sim floors not available")
+	}
+	return *s.floors, nil
+}
+
+// StableFee returns the stable fee rate (satoshis/kB) of the current tx and
+// block sources, i.e. the sim's analytic discard threshold: arrivals with
+// lower fee rate exceed the spare capacity, so they'd never clear. It depends
+// only on the sources, not the mempool.
+func (s *FeeSim) StableFee() (sim.FeeRate, error) {
+	txsource, err := s.TxSource()
+	if err != nil {
+		return 0, err
+	}
+	blocksource, err := s.BlockSource()
+	if err != nil {
+		return 0, err
+	}
+	return sim.NewSim(txsource, blocksource, nil).StableFee(), nil
+}
+
+func (s *FeeSim) setSimFloors(stableFee, lowestFeeRate sim.FeeRate) {
+	floors := &SimFloors{StableFee: stableFee, LowestFeeRate: lowestFeeRate, Floor: lowestFeeRate}
+	if stableFee > lowestFeeRate {
+		floors.Floor = stableFee
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.floors = floors
+}
+
+// latestBlockStatWindow is the number of blocks (up to the current height)
+// searched by LatestBlockStat, i.e. about two weeks' worth.
+const latestBlockStatWindow = 2016
+
+// LatestBlockStat returns the stat of the most recent block in the
+// BlockStatDB, at or below the current mempool height.
+func (s *FeeSim) LatestBlockStat() (*est.BlockStat, error) {
 	state := s.collect.State()
 	if state == nil {
 		return nil, errors.New("mempool state not available")
 	}
+	start := state.Height - latestBlockStatWindow + 1
+	if start < 0 {
+		start = 0
+	}
+	stats, err := s.blkdb.Get(start, state.Height)
+	if err != nil {
+		return nil, err
+	}
+	if len(stats) == 0 {
+		return nil, fmt.Errorf("no block stats in the last %d blocks", latestBlockStatWindow)
+	}
+	return stats[len(stats)-1], nil
+}
+
+// CapacityPctConfig sets the max block size quantiles (of the block source's
+// max block sizes) assumed by the estimate modes other than the default.
+type CapacityPctConfig struct {
+	Economical   float64 `yaml:"economical" json:"economical"`
+	Conservative float64 `yaml:"conservative" json:"conservative"`
+}
+
+// Estimate modes
+const (
+	modeEconomical   = "economical"
+	modeDefault      = "default"
+	modeConservative = "conservative"
+)
+
+// EstimateMode returns the fee estimate of the mode. The default mode is the
+// periodic result. The economical and conservative modes assume an optimistic
+// or pessimistic max block size respectively (see CapacityPctConfig); they
+// run a transient sim on demand, blocking until it's done or cancel is
+// closed. Only one on-demand sim runs at a time; if one is already running,
+// an error is returned.
+func (s *FeeSim) EstimateMode(mode string, cancel <-chan struct{}) ([]sim.FeeRate, error) {
+	var pct float64
+	switch mode {
+	case modeDefault, "":
+		return s.Result()
+	case modeEconomical:
+		pct = s.cfg.CapacityPct.Economical
+	case modeConservative:
+		pct = s.cfg.CapacityPct.Conservative
+	default:
+		return nil, fmt.Errorf("invalid mode '%s'; must be one of %s, %s, %s",
+			mode, modeEconomical, modeDefault, modeConservative)
+	}
+	return s.estimateWith(func(b *sim.IndBlockSource) *sim.IndBlockSource {
+		return b.WithCapacityPct(pct)
+	}, cancel)
+}
+
+// EstimateScenario runs a transient sim on demand (see EstimateMode) with the
+// block source's max block size overridden with maxBlockSize, e.g. to model a
+// block size limit change. The estimated block rate and min fee rate
+// distribution are kept. maxBlockSize is in vbytes, even with
+// WeightUnits.
+func (s *FeeSim) EstimateScenario(maxBlockSize sim.TxSize, cancel <-chan struct{}) ([]sim.FeeRate, error) {
+	if maxBlockSize <= 0 {
+		return nil, errors.New("max block size must be > 0")
+	}
+	if s.cfg.WeightUnits {
+		maxBlockSize *= sim.WitnessScaleFactor
+	}
+	return s.estimateWith(func(b *sim.IndBlockSource) *sim.IndBlockSource {
+		return b.WithMaxBlockSize(maxBlockSize)
+	}, cancel)
+}
+
+// estimateWith runs a transient sim on demand (see EstimateMode) with the
+// block source modified by modify.
+func (s *FeeSim) estimateWith(modify func(*sim.IndBlockSource) *sim.IndBlockSource,
+	cancel <-chan struct{}) ([]sim.FeeRate, error) {
+
+	if !s.acquireOnDemand() {
+		return nil, errOnDemandBusy
+	}
+	defer s.releaseOnDemand()
+
 	txsource, err := s.TxSource()
 	if err != nil {
 		return nil, err
@@ -420,15 +1028,140 @@ func (s *FeeSim) setupSim() (*sim.TransientSim, error) {
 	if err != nil {
 		return nil, err
 	}
+	indblocksource, ok := blocksource.(*sim.IndBlockSource)
+	if !ok {
+		return nil, errors.New("block source does not support scenarios")
+	}
+	// Sources are not concurrent-safe, and the sim loop might be using them.
+	ts, err := s.setupSimWith(txsource.Copy(1)[0], modify(indblocksource))
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case result := <-ts.Run():
+		return result, nil
+	case <-cancel:
+		ts.Stop()
+		return nil, errCanceled
+	case <-s.done:
+		ts.Stop()
+		return nil, errShutdown
+	}
+}
+
+func (s *FeeSim) acquireOnDemand() bool {
+	return atomic.CompareAndSwapInt32(&s.onDemand, 0, 1)
+}
+
+func (s *FeeSim) releaseOnDemand() {
+	atomic.StoreInt32(&s.onDemand, 0)
+}
+
+// TuneNumIters runs tune on the current mempool and sources, with NumIters
+// doubling from 250 up to maxIters (4x the current NumIters if <= 0), and
+// returns the stability of each NumIters run, and the recommended one (see
+// sim.TuneNumIters). It blocks until done, which may take a while, or until
+// cancel is closed. It's an on-demand sim, so it doesn't run alongside
+// another (see EstimateMode).
+func (s *FeeSim) TuneNumIters(maxIters, runs int, tol float64, cancel <-chan struct{}) ([]sim.TuneLevel, int, error) {
+	if !s.acquireOnDemand() {
+		return nil, 0, errOnDemandBusy
+	}
+	defer s.releaseOnDemand()
+
+	if maxIters <= 0 {
+		maxIters = 4 * s.NumIters()
+	}
+	var numIters []int
+	for n := 250; n < maxIters; n *= 2 {
+		numIters = append(numIters, n)
+	}
+	numIters = append(numIters, maxIters)
+
+	txsource, err := s.TxSource()
+	if err != nil {
+		return nil, 0, err
+	}
+	blocksource, err := s.BlockSource()
+	if err != nil {
+		return nil, 0, err
+	}
+	// Sources are not concurrent-safe, and the sim loop might be using them.
+	ns, transientCfg, err := s.newSim(txsource.Copy(1)[0], blocksource.Copy(1)[0])
+	if err != nil {
+		return nil, 0, err
+	}
+	done := make(chan struct{})
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-s.done:
+		case <-cancel:
+		case <-stop:
+			return
+		}
+		close(done)
+	}()
+	levels, n, err := sim.TuneNumIters(ns, transientCfg, numIters, runs, tol, done)
+	if err != nil {
+		select {
+		case <-s.done:
+			return nil, 0, errShutdown
+		case <-cancel:
+			return nil, 0, errCanceled
+		default:
+		}
+	}
+	return levels, n, err
+}
+
+func (s *FeeSim) setupSimWith(txsource sim.TxSource, blocksource sim.BlockSource) (*sim.TransientSim, error) {
+	ns, transientCfg, err := s.newSim(txsource, blocksource)
+	if err != nil {
+		return nil, err
+	}
+	return sim.NewTransientSim(ns, transientCfg), nil
+}
+
+// newSim returns the sim of the current mempool state with the sources, and
+// the transient sim config to run it with.
+func (s *FeeSim) newSim(txsource sim.TxSource, blocksource sim.BlockSource) (*sim.Sim, sim.TransientConfig, error) {
+	logger := s.cfg.logger
+	transientCfg := s.Transient()
+
+	state := s.collect.State()
+	if state == nil {
+		return nil, sim.TransientConfig{}, errors.New("mempool state not available")
+	}
 
 	// Trim the mempool to optimize sim time. The idea is that since we're only
 	// simulating up to a certain MaxBlockConfirms, we can safely ignore many
 	// low fee transactions.
-	maxBlockConfirms := s.cfg.Transient.MaxBlockConfirms
-	txratefn, capratefn, sizefn := txsource.RateFn(), blocksource.RateFn(), state.SizeFn()
+	maxBlockConfirms := transientCfg.MaxBlockConfirms
+	txratefn, capratefn, sizefn := txsource.RateFn(), blocksource.RateFn(), s.SizeFn(state)
+	if s.cfg.WeightUnits {
+		// The mempool size fn is in vbytes, like the other reports.
+		sizefn = sim.ScaledFn(sizefn, float64(sim.WitnessScaleFactor))
+	}
 
 	maxcap := capratefn.Eval(math.MaxFloat64) // Maximum capacity byte rate
 
+	bumpMult := 1.
+	if s.cfg.BumpElasticity > 0 {
+		congestion := simCongestion(sizefn, capratefn, blocksource.BlockRate())
+		bumpMult = sim.BumpMult(s.cfg.BumpElasticity, congestion)
+		logger.Printf("[DEBUG] Congestion %.2f blocks; tx rate multiplier %.2f.", congestion, bumpMult)
+		// The source itself is wrapped after fitting the memory budget, which
+		// may downsample it.
+		bumped, err := sim.NewBumpTxSource(txsource, bumpMult)
+		if err != nil {
+			logger.Println("[ERROR] NewBumpTxSource:", err)
+			return nil, sim.TransientConfig{}, err
+		}
+		txratefn = bumped.RateFn()
+	}
+
 	highfee := sizefn.Inverse(0)
 	var n int
 	if highfee > float64(math.MaxInt32) {
@@ -443,10 +1176,10 @@ func (s *FeeSim) setupSim() (*sim.TransientSim, error) {
 		return d < buffer*float64(maxBlockConfirms) && d >= 0
 	}))
 
-	initmempool, err := col.SimifyMempool(state.Entries)
+	initmempool, err := col.SimifyMempool(state.Entries, s.cfg.AncestorFeeRate, s.cfg.WeightUnits)
 	if err != nil {
 		logger.Println("[ERROR] SimifyMempool:", err)
-		return nil, err
+		return nil, sim.TransientConfig{}, err
 	}
 
 	// Remove all transactions with fee rate less than cutoff. We remove all the
@@ -462,13 +1195,86 @@ func (s *FeeSim) setupSim() (*sim.TransientSim, error) {
 		}
 	}
 
+	if s.cfg.MemoryBudget > 0 {
+		txsource, initmempoolTrimmed, cutoff = s.fitMemoryBudget(
+			&transientCfg, txsource, initmempoolTrimmed, cutoff)
+	}
+
+	if bumpMult > 1 {
+		bumped, err := sim.NewBumpTxSource(txsource, bumpMult)
+		if err != nil {
+			logger.Println("[ERROR] NewBumpTxSource:", err)
+			return nil, sim.TransientConfig{}, err
+		}
+		txsource = bumped
+	}
+	if s.cfg.RBF.Enabled {
+		txsource = sim.NewRBFTxSource(txsource, s.cfg.RBF)
+	}
 	ns := sim.NewSim(txsource, blocksource, initmempoolTrimmed)
-	transientCfg := s.cfg.Transient
+	if s.cfg.MempoolExpiry > 0 {
+		ns.SetExpiry(time.Duration(s.cfg.MempoolExpiry) * time.Hour)
+	}
 	transientCfg.LowestFeeRate = cutoff
 	logger.Println("[DEBUG] Transient sim stablefeerate:", ns.StableFee())
 	logger.Println("[DEBUG] Transient sim lowfee:", transientCfg.LowestFeeRate)
 
-	return sim.NewTransientSim(ns, transientCfg), nil
+	return ns, transientCfg, nil
+}
+
+// simCongestion returns the mempool backlog in excess of one block, in units
+// of max capacity blocks. Only the txs that some miners would include count,
+// i.e. those with fee rate at least the lowest min fee rate of the block
+// source.
+func simCongestion(sizefn, capratefn sim.MonotonicFn, blockRate float64) float64 {
+	maxBlockSize := capratefn.Eval(math.MaxFloat64) / blockRate
+	if maxBlockSize <= 0 {
+		return 0
+	}
+	minfee := capratefn.Inverse(1)
+	backlog := sizefn.Eval(minfee) / maxBlockSize
+	return math.Max(backlog-1, 0)
+}
+
+// fitMemoryBudget adapts the transient sim config, tx source and initial
+// mempool to cfg.MemoryBudget; see fitMemoryBudget.
+func (s *FeeSim) fitMemoryBudget(transientCfg *sim.TransientConfig, txsource sim.TxSource,
+	initmempool []*sim.Tx, cutoff sim.FeeRate) (sim.TxSource, []*sim.Tx, sim.FeeRate) {
+
+	numprocs := transientCfg.NumProcs
+	if numprocs <= 0 {
+		numprocs = runtime.GOMAXPROCS(0)
+	}
+	sampled, ok := txsource.(sim.SampledTxSource)
+	var sampleSize int
+	if ok {
+		sampleSize = sampled.SampleSize()
+	}
+	plan := memoryPlan{NumProcs: numprocs, SampleSize: sampleSize, MempoolSize: len(initmempool)}
+	plan, adapted := fitMemoryBudget(plan, int64(s.cfg.MemoryBudget)<<20)
+	for _, a := range adapted {
+		s.cfg.logger.Printf("[WARNING] Memory budget of %dMB exceeded: %s.", s.cfg.MemoryBudget, a)
+	}
+
+	transientCfg.NumProcs = plan.NumProcs
+	if plan.SampleSize < sampleSize {
+		txsource = sampled.Downsample(plan.SampleSize)
+	}
+	if plan.MempoolSize < len(initmempool) {
+		var trimCutoff sim.FeeRate
+		initmempool, trimCutoff = trimMempool(initmempool, plan.MempoolSize)
+		if trimCutoff > cutoff {
+			cutoff = trimCutoff
+		}
+	}
+	return txsource, initmempool, cutoff
+}
+
+// SizeFn returns the mempool size function of state, which is sampled if
+// the mempool is larger than cfg.SizeFnSample. The sample is drawn with the
+// sim's RandSource (see sim.SetRandSource).
+func (s *FeeSim) SizeFn(state *col.MempoolState) sim.MonotonicFn {
+	return state.SizeFnSample(s.cfg.SizeFnSample, sim.NewRand())
 }
 
 func (s *FeeSim) IsPaused() bool {
@@ -489,24 +1295,221 @@ func (s *FeeSim) SetResult(result []sim.FeeRate, err error) {
 	s.mux.Lock()
 	defer s.mux.Unlock()
 	s.result, s.err = result, err
+	if err == nil {
+		s.resultTime = time.Now().Unix()
+		s.lastResult = result
+	}
+}
+
+// EstimateResult is like Result, except that if cfg.StaleResults is set and
+// the sim is paused or in progress, the last result is returned instead of
+// the error, with stale set.
+func (s *FeeSim) EstimateResult() (result []sim.FeeRate, stale bool, err error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	if s.err == nil {
+		return s.result, false, nil
+	}
+	if s.cfg.StaleResults && s.lastResult != nil && (s.err == errPause || s.err == errInProgress) {
+		return s.lastResult, true, nil
+	}
+	return nil, false, s.err
+}
+
+// ResultTime returns the Unix time at which the last result was set, or 0 if
+// there hasn't been one.
+func (s *FeeSim) ResultTime() int64 {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.resultTime
+}
+
+// Variates returns the raw conf time variates of the last transient sim run.
+// They're only kept if Transient.KeepVariates is set.
+func (s *FeeSim) Variates() ([]sim.TransientVariate, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	if !s.Transient().KeepVariates {
+		return nil, errors.New("variates not kept; set transient.keepvariates")
+	}
+	if s.variates == nil {
+		return nil, errors.New("variates not available")
+	}
+	return s.variates, nil
+}
+
+func (s *FeeSim) setVariates(v []sim.TransientVariate) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.variates = v
+}
+
+// NextBlockProb returns the estimated probability of confirmation in the next
+// block as a function of fee rate, from the last transient sim run.
+func (s *FeeSim) NextBlockProb() (*sim.NextBlockProb, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	if s.nextblock == nil {
+		return nil, errors.New("next block probability not available")
+	}
+	return s.nextblock, nil
+}
+
+func (s *FeeSim) setNextBlockProb(p *sim.NextBlockProb) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.nextblock = p
+}
+
+// EstimateBounds returns the last transient sim result along with its 95%
+// confidence bounds. They're only computed if Transient.WithConfidence is set.
+func (s *FeeSim) EstimateBounds() (sim.TransientResult, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	if s.err != nil {
+		return sim.TransientResult{}, s.err
+	}
+	if s.bounds == nil {
+		return sim.TransientResult{}, errors.New("confidence bounds not available; set transient.withconfidence")
+	}
+	return *s.bounds, nil
+}
+
+// setBounds records the bounds of result, if it has them.
+func (s *FeeSim) setBounds(result sim.TransientResult) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if result.Lower == nil {
+		s.bounds = nil
+	} else {
+		s.bounds = &result
+	}
+}
+
+// ConfTimeDist returns the estimated conf time distribution (in blocks) as a
+// function of fee rate, from the last transient sim run.
+func (s *FeeSim) ConfTimeDist() (*sim.ConfTimeDist, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	if s.conftime == nil {
+		return nil, errors.New("conf time distribution not available")
+	}
+	return s.conftime, nil
+}
+
+func (s *FeeSim) setConfTimeDist(d *sim.ConfTimeDist) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.conftime = d
+}
+
+// EstimatePercentiles returns result[k], the last transient sim result as if
+// it were run with Transient.MinSuccessPct pcts[k], which must be in (0, 1].
+// It shows the spread of the estimates, i.e. how much more it costs to be
+// surer of confirmation.
+func (s *FeeSim) EstimatePercentiles(pcts []float64) ([][]sim.FeeRate, error) {
+	for _, pct := range pcts {
+		if pct <= 0 || pct > 1 {
+			return nil, fmt.Errorf("percentile %v must be in (0, 1]", pct)
+		}
+	}
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	if s.successCounts == nil {
+		return nil, errors.New("percentiles not available")
+	}
+	result := make([][]sim.FeeRate, len(pcts))
+	for k, pct := range pcts {
+		result[k] = s.successCounts.FeeRates(pct)
+	}
+	return result, nil
+}
+
+func (s *FeeSim) setSuccessCounts(c *sim.SuccessCounts) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.successCounts = c
+}
+
+// CollectorErrors returns the most recent collector errors, oldest first.
+func (s *FeeSim) CollectorErrors() []col.CollectorError {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	errs := make([]col.CollectorError, len(s.collectErrs))
+	copy(errs, s.collectErrs)
+	return errs
+}
+
+// addCollectorError records err, keeping only the last cfg.CollectErrors.
+func (s *FeeSim) addCollectorError(err error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	n := s.cfg.CollectErrors
+	if n <= 0 {
+		return
+	}
+	s.collectErrs = append(s.collectErrs, col.CollectorError{
+		Time:  time.Now().Unix(),
+		Error: err.Error(),
+	})
+	if d := len(s.collectErrs) - n; d > 0 {
+		s.collectErrs = append(s.collectErrs[:0], s.collectErrs[d:]...)
+	}
 }
 
 func (s *FeeSim) PredictScores() (attained, exceeded []float64, err error) {
 	return s.predictor.GetScores()
 }
 
+// PredictScoresByFeeRate returns the prediction scores by confirmation time
+// and fee rate bucket (see predict.FeeRateBuckets).
+func (s *FeeSim) PredictScoresByFeeRate() (attained, exceeded [][]float64, err error) {
+	return s.predictor.GetFeeScores()
+}
+
 func (s *FeeSim) BlockSource() (sim.BlockSource, error) {
 	s.mux.RLock()
 	defer s.mux.RUnlock()
 	return s.blocksource, s.errBlockSource
 }
 
+// BlockSourceLowConfidence returns whether the block source estimate is
+// flagged as low confidence (see est.IndBlockSourceConfig.MinBlocks).
+func (s *FeeSim) BlockSourceLowConfidence() bool {
+	b, err := s.BlockSource()
+	return err == nil && isLowConfidence(b)
+}
+
+func isLowConfidence(b sim.BlockSource) bool {
+	lc, ok := b.(interface {
+		LowConfidence() bool
+	})
+	return ok && lc.LowConfidence()
+}
+
 func (s *FeeSim) SetBlockSource(b sim.BlockSource, err error) {
 	s.mux.Lock()
 	defer s.mux.Unlock()
 	s.blocksource, s.errBlockSource = b, err
 }
 
+// TxSourceState returns the tx source estimator's internal state.
+func (s *FeeSim) TxSourceState() (est.UniTxSourceState, error) {
+	if s.cfg.txSourceState == nil {
+		return est.UniTxSourceState{}, errors.New("tx source estimator state not available")
+	}
+	return s.cfg.txSourceState(), nil
+}
+
 func (s *FeeSim) TxSource() (sim.TxSource, error) {
 	s.mux.RLock()
 	defer s.mux.RUnlock()
@@ -531,8 +1534,16 @@ func (s *FeeSim) normalizeTxDB(timeNow int64) error {
 		s.cfg.logger.Println("TxDB outdated / empty; starting from scratch.")
 		return nil
 	}
-	s.cfg.logger.Println("Normalizing TxDB.")
 	d := timeNow - txs[len(txs)-1].Time
+	if tol := s.cfg.TxShiftTol; tol > 0 && len(txs) > 1 {
+		interArrival := float64(txs[len(txs)-1].Time-txs[0].Time) / float64(len(txs)-1)
+		if float64(d) > tol*interArrival {
+			s.cfg.logger.Printf("TxDB gap of %ds is more than %g mean inter-arrival times (%.2fs); "+
+				"starting from scratch.", d, tol, interArrival)
+			return nil
+		}
+	}
+	s.cfg.logger.Println("Normalizing TxDB.")
 	for i := range txs {
 		txs[i].Time += d
 	}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+
+	col "github.com/bitcoinfees/feesim/collect"
+	"github.com/bitcoinfees/feesim/db/bolt"
+	est "github.com/bitcoinfees/feesim/estimate"
+	"github.com/bitcoinfees/feesim/predict"
+	"github.com/bitcoinfees/feesim/sim"
+	"github.com/bitcoinfees/feesim/testutil"
+)
+
+func TestFeeSimStop(t *testing.T) {
+	// The metrics meter arbiter goroutine is process-wide and persistent, so
+	// start it before taking the goroutine count.
+	metrics.NewMeter()
+	numGoroutines := runtime.NumGoroutine()
+
+	s, cleanup := newTestFeeSim(t, testGetState)
+	defer cleanup()
+
+	runErr := make(chan error)
+	go func() { runErr <- s.Run() }()
+	// Let the workers start up
+	time.Sleep(1500 * time.Millisecond)
+
+	// Concurrent repeated Stop calls should all return, once all the
+	// workers have stopped.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Stop()
+		}()
+	}
+	wg.Wait()
+	if err := <-runErr; err != nil {
+		t.Fatal(err)
+	}
+	s.Stop()
+	// Pause shouldn't block after Stop
+	s.Pause(true)
+
+	checkGoroutines(t, numGoroutines)
+
+	// Stop before Run; Run should not start.
+	s, cleanup = newTestFeeSim(t, testGetState)
+	defer cleanup()
+	s.Stop()
+	if err := s.Run(); err != errShutdown {
+		t.Errorf("Run after Stop returned %v", err)
+	}
+	checkGoroutines(t, numGoroutines)
+}
+
+func TestSimFloors(t *testing.T) {
+	s, cleanup := newTestFeeSim(t, testGetState)
+	defer cleanup()
+	if _, err := s.SimFloors(); err == nil {
+		t.Error("sim floors should not be available before the sim")
+	}
+
+	// The tx byte rate (300 B/s) exceeds the capacity (250 B/s), but not
+	// without the lowest fee rate txs, which therefore can't be cleared.
+	txsource := sim.NewUniTxSource([]sim.FeeRate{2000, 10000, 50000}, []sim.TxSize{250, 250, 250}, 1.2)
+	blocksource := sim.NewIndBlockSource([]sim.FeeRate{1000}, []sim.TxSize{150000}, 1./600)
+	s.cfg.estTxSource = func(int64) (sim.TxSource, error) { return txsource, nil }
+	s.cfg.estBlockSource = func(int64) (sim.BlockSource, error) { return blocksource, nil }
+	s.tunables.transient = sim.TransientConfig{MaxBlockConfirms: 4, MinSuccessPct: 0.9, NumProcs: 1, NumIters: 100}
+
+	runErr := make(chan error)
+	go func() { runErr <- s.Run() }()
+	var (
+		result []sim.FeeRate
+		err    error
+	)
+	for i := 0; i < 100; i++ {
+		if result, err = s.Result(); err == nil && result != nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	s.Stop()
+	if err := <-runErr; err != nil {
+		t.Fatal(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	floors, err := s.SimFloors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("%+v %v", floors, result)
+	stableFee := sim.NewSim(txsource, blocksource, nil).StableFee()
+	if err := testutil.CheckEqual(floors.StableFee, stableFee); err != nil {
+		t.Error(err)
+	}
+	if stableFee <= 2000 {
+		t.Error("the lowest fee rate txs should be below the stable fee, which was", stableFee)
+	}
+	floor := floors.LowestFeeRate
+	if stableFee > floor {
+		floor = stableFee
+	}
+	if err := testutil.CheckEqual(floors.Floor, floor); err != nil {
+		t.Error(err)
+	}
+	for _, r := range result {
+		if r != -1 && r < floors.Floor {
+			t.Errorf("estimate %d is below the floor %d", r, floors.Floor)
+		}
+	}
+}
+
+// checkGoroutines checks that the goroutine count returns to n.
+func checkGoroutines(t *testing.T, n int) {
+	// Goroutines which have signalled completion might not have exited yet.
+	for i := 0; i < 50; i++ {
+		if runtime.NumGoroutine() <= n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	buf := make([]byte, 1<<16)
+	buf = buf[:runtime.Stack(buf, true)]
+	t.Errorf("%d goroutines leaked:\n%s", runtime.NumGoroutine()-n, buf)
+}
+
+func TestSimCongestion(t *testing.T) {
+	blocksource := sim.NewIndBlockSource([]sim.FeeRate{1000, 5000}, []sim.TxSize{1000000, 1000000}, 1./600)
+	capratefn := blocksource.RateFn()
+
+	// Txs below the lowest min fee rate (1000) don't count.
+	sizefn := sim.NewTxRateFn([]float64{500, 1000, 10000}, []float64{5e6, 3e6, 1e6})
+	if err := testutil.CheckPctDiff(simCongestion(sizefn, capratefn, blocksource.BlockRate()), 2, 1e-9); err != nil {
+		t.Error(err)
+	}
+	// Less than a block's backlog is no congestion.
+	sizefn = sim.NewTxRateFn([]float64{500, 1000}, []float64{5e6, 5e5})
+	if err := testutil.CheckEqual(simCongestion(sizefn, capratefn, blocksource.BlockRate()), 0.); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectorErrors(t *testing.T) {
+	var (
+		n   int
+		mux sync.Mutex
+	)
+	// Fail after the initial GetStates of FeeSim and the collector
+	getState := func() (*col.MempoolState, error) {
+		mux.Lock()
+		defer mux.Unlock()
+		n++
+		if n > 2 {
+			return nil, fmt.Errorf("node down %d", n)
+		}
+		return testGetState()
+	}
+	s, cleanup := newTestFeeSim(t, getState)
+	defer cleanup()
+	s.cfg.CollectErrors = 2
+
+	runErr := make(chan error)
+	go func() { runErr <- s.Run() }()
+	time.Sleep(3500 * time.Millisecond)
+	s.Stop()
+	if err := <-runErr; err != nil {
+		t.Fatal(err)
+	}
+
+	errs := s.CollectorErrors()
+	if err := testutil.CheckEqual(len(errs), 2); err != nil {
+		t.Fatal(err)
+	}
+	for i, e := range errs {
+		ref := fmt.Sprintf("GetState: node down %d", i+4)
+		if err := testutil.CheckEqual(e.Error, ref); err != nil {
+			t.Error(err)
+		}
+		if d := time.Now().Unix() - e.Time; d < 0 || d > 5 {
+			t.Errorf("Invalid error time %d", e.Time)
+		}
+	}
+
+	// Disabled
+	s.cfg.CollectErrors = 0
+	s.collectErrs = nil
+	s.addCollectorError(errors.New("error"))
+	if err := testutil.CheckEqual(len(s.CollectorErrors()), 0); err != nil {
+		t.Error(err)
+	}
+}
+
+func testGetState() (*col.MempoolState, error) {
+	return &col.MempoolState{
+		Height:  1,
+		Entries: make(map[string]col.MempoolEntry),
+		Time:    time.Now().Unix(),
+	}, nil
+}
+
+func newTestFeeSim(t *testing.T, getState col.MempoolStateGetter) (*FeeSim, func()) {
+	dir, err := ioutil.TempDir("", "feesim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var closers []io.Closer
+	cleanup := func() {
+		for _, c := range closers {
+			c.Close()
+		}
+		os.RemoveAll(dir)
+	}
+
+	txdb, err := bolt.LoadTxDB(filepath.Join(dir, "tx.db"))
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	closers = append(closers, txdb)
+	blkdb, err := bolt.LoadBlockStatDB(filepath.Join(dir, "blockstat.db"))
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	closers = append(closers, blkdb)
+	predictdb, err := bolt.LoadPredictDB(filepath.Join(dir, "predict.db"))
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	closers = append(closers, predictdb)
+
+	errSource := errors.New("not available")
+	cfg := FeeSimConfig{
+		Collect: col.Config{
+			PollPeriod: 1,
+			GetState:   getState,
+		},
+		Predict:   predict.Config{MaxBlockConfirms: 2, Halflife: 8},
+		SimPeriod: 1,
+		estTxSource: func(int64) (sim.TxSource, error) {
+			return nil, errSource
+		},
+		estBlockSource: func(int64) (sim.BlockSource, error) {
+			return nil, errSource
+		},
+		logger: log.New(ioutil.Discard, "", 0),
+	}
+	s, err := NewFeeSim(txdb, blkdb, predictdb, cfg)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return s, cleanup
+}
+
+func TestSnapshotRates(t *testing.T) {
+	s, cleanup := newTestFeeSim(t, testGetState)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "feesim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Disabled
+	if _, err := s.RateHistory(0, math.MaxInt64); err == nil {
+		t.Error("RateHistory should return an error if disabled")
+	}
+
+	rateHistory, err := bolt.LoadRateHistoryDB(filepath.Join(dir, "ratehistory.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rateHistory.Close()
+	s.cfg.rateHistory = rateHistory
+	s.cfg.RateHistoryRetention = 1
+
+	// No snapshot without the sources
+	if err := s.snapshotRates(10000); err != nil {
+		t.Fatal(err)
+	}
+	s.SetTxSource(sim.NewUniTxSource([]sim.FeeRate{10000, 20000}, []sim.TxSize{250, 500}, 1), nil)
+	s.SetBlockSource(sim.NewIndBlockSource([]sim.FeeRate{1000}, []sim.TxSize{1000000}, 1./600), nil)
+	for _, tm := range []int64{10001, 12000, 13602} {
+		if err := s.snapshotRates(tm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first snapshot is past the 1 hour retention
+	snapshots, err := s.RateHistory(0, math.MaxInt64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(len(snapshots), 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(snapshots[0].Time, int64(12000)); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(snapshots[0].TxRate, est.RatePoints{
+		X: []float64{10000, 20000},
+		Y: []float64{375, 250},
+	}); err != nil {
+		t.Error(err)
+	}
+	capRate := snapshots[1].CapRate.Y
+	if err := testutil.CheckPctDiff(capRate[len(capRate)-1], 1000000./600, 1e-9); err != nil {
+		t.Error(err)
+	}
+
+	// Via the service
+	var reply []RateHistory
+	service := &Service{FeeSim: s}
+	if err := service.TxRateHistory(nil, &RateHistoryArgs{Start: 13000}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(reply, []RateHistory{{Time: 13602, X: snapshots[1].TxRate.X, Y: snapshots[1].TxRate.Y}}); err != nil {
+		t.Error(err)
+	}
+	if err := service.CapRateHistory(nil, &RateHistoryArgs{Start: 0, End: 12000}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(reply, []RateHistory{{Time: 12000, X: snapshots[0].CapRate.X, Y: snapshots[0].CapRate.Y}}); err != nil {
+		t.Error(err)
+	}
+	if err := service.TxRateHistory(nil, &RateHistoryArgs{Start: 2, End: 1}, &reply); err == nil {
+		t.Error("an invalid time range should return an error")
+	}
+}
+
+func TestNormalizeTxDB(t *testing.T) {
+	// 1000 txs, one every 2s, ending at time t0.
+	const t0 = 1500000000
+	var txs []est.Tx
+	for tm := int64(t0 - 1998); tm <= t0; tm += 2 {
+		txs = append(txs, est.Tx{FeeRate: 10000, Size: 250, Time: tm})
+	}
+	// txRate normalizes the tx db with the gap, and returns the estimated tx
+	// rate (txs/s) at the end of the gap, or 0 if there's no estimate.
+	txRate := func(gap int64, tol float64) float64 {
+		s, cleanup := newTestFeeSim(t, testGetState)
+		defer cleanup()
+		s.cfg.TxMaxAge, s.cfg.TxGapTol, s.cfg.TxShiftTol = 10000, 3600, tol
+		if err := s.txdb.Put(txs); err != nil {
+			t.Fatal(err)
+		}
+		timeNow := t0 + gap
+		if err := s.normalizeTxDB(timeNow); err != nil {
+			t.Fatal(err)
+		}
+		c := est.UniTxSourceConfig{MinWindow: 600, MaxWindow: 10000, Halflife: 3600}
+		txsource, err := est.NewUniTxSource(s.txdb, c, rand.New(rand.NewSource(0))).Estimate(timeNow)
+		if err != nil {
+			t.Logf("gap %d, tol %g: %v", gap, tol, err)
+			return 0
+		}
+		// The rate fn is a byte rate
+		return txsource.RateFn().Eval(0) / 250
+	}
+
+	// A small gap (a few inter-arrival times) is shifted, whether or not
+	// there's a tolerance, and the rate is unbiased.
+	for _, tol := range []float64{0, 20} {
+		if err := testutil.CheckPctDiff(txRate(10, tol), 0.5, 0.01); err != nil {
+			t.Errorf("small gap, tol %g: %v", tol, err)
+		}
+	}
+	// A moderate gap is shifted without a tolerance, but discarded with one.
+	if err := testutil.CheckPctDiff(txRate(600, 0), 0.5, 0.01); err != nil {
+		t.Error(err)
+	}
+	if r := txRate(600, 20); r != 0 {
+		t.Error("moderate gap should be discarded with a tolerance, but got tx rate", r)
+	}
+	// A gap beyond TxGapTol is always discarded.
+	if r := txRate(4000, 0); r != 0 {
+		t.Error("gap > TxGapTol should be discarded, but got tx rate", r)
+	}
+}
+
+func TestAlert(t *testing.T) {
+	alerts := make(chan Alert, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a Alert
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			t.Error(err)
+		}
+		alerts <- a
+	}))
+	defer srv.Close()
+
+	s := &FeeSim{
+		collect: col.NewCollector(nil, nil, col.Config{}),
+		cfg: FeeSimConfig{
+			Alert:  AlertConfig{FeeRate: 20000, Target: 2, Webhook: srv.URL},
+			logger: log.New(ioutil.Discard, "", 0),
+		},
+	}
+	checkAlert := func(result []sim.FeeRate, active bool, post bool) {
+		s.checkAlert(result)
+		s.wg.Wait()
+		if err := testutil.CheckEqual(s.Alerting(), active); err != nil {
+			t.Fatal(err)
+		}
+		status := s.Status()["alert"]
+		if active == (status == "OK") {
+			t.Errorf("status is '%s' with alert %v", status, active)
+		}
+		select {
+		case a := <-alerts:
+			if !post {
+				t.Fatal("unexpected alert post:", a)
+			}
+			if err := testutil.CheckEqual(a.Active, active); err != nil {
+				t.Error(err)
+			}
+			if err := testutil.CheckEqual(a.FeeRate, toBTC(result)[1]); err != nil {
+				t.Error(err)
+			}
+			if err := testutil.CheckEqual(a.Threshold, 0.0002); err != nil {
+				t.Error(err)
+			}
+		default:
+			if post {
+				t.Fatal("alert was not posted")
+			}
+		}
+	}
+
+	checkAlert([]sim.FeeRate{50000, 20000, 10000}, false, false) // At the threshold
+	checkAlert([]sim.FeeRate{50000, 20001, 10000}, true, true)   // Fires
+	checkAlert([]sim.FeeRate{50000, 30000, 10000}, true, false)  // Still active
+	checkAlert([]sim.FeeRate{50000, 10000, 10000}, false, true)  // Clears
+	checkAlert([]sim.FeeRate{-1, -1, 10000}, true, true)         // No estimate
+	checkAlert([]sim.FeeRate{50000}, true, false)                // Target out of range
+
+	// Disabled
+	s = &FeeSim{
+		collect: col.NewCollector(nil, nil, col.Config{}),
+		cfg:     FeeSimConfig{logger: log.New(ioutil.Discard, "", 0)},
+	}
+	s.checkAlert([]sim.FeeRate{-1, -1})
+	if s.Alerting() {
+		t.Error("disabled alert should not fire")
+	}
+	if _, ok := s.Status()["alert"]; ok {
+		t.Error("disabled alert should not be in status")
+	}
+}
+
+// compactCountTxDB and compactCountBlockStatDB count the Compact calls of the
+// bolt DBs which they wrap.
+type compactCountTxDB struct {
+	TxDB
+	n *int
+}
+
+func (d compactCountTxDB) Compact() error {
+	*d.n++
+	return d.TxDB.(Compacter).Compact()
+}
+
+func (d compactCountTxDB) File() string {
+	return d.TxDB.(Filer).File()
+}
+
+type compactCountBlockStatDB struct {
+	BlockStatDB
+	n *int
+}
+
+func (d compactCountBlockStatDB) Compact() error {
+	*d.n++
+	return d.BlockStatDB.(Compacter).Compact()
+}
+
+func (d compactCountBlockStatDB) File() string {
+	return d.BlockStatDB.(Filer).File()
+}
+
+func TestTrimSharedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "feesim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := bolt.LoadDB(filepath.Join(dir, "feesim.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.TxDB().Close()
+	defer d.BlockStatDB().Close()
+	defer d.PredictDB().Close()
+
+	var stats []*est.BlockStat
+	for h := int64(0); h < trimCompactMin; h++ {
+		stats = append(stats, &est.BlockStat{Height: h, Size: 1000})
+	}
+	if err := d.BlockStatDB().Put(stats); err != nil {
+		t.Fatal(err)
+	}
+	var txs []est.Tx
+	for tm := int64(0); tm < trimCompactMin; tm++ {
+		txs = append(txs, est.Tx{FeeRate: 10000, Size: 250, Time: tm})
+	}
+	if err := d.TxDB().Put(txs); err != nil {
+		t.Fatal(err)
+	}
+
+	var compacts int
+	s := &FeeSim{
+		txdb:  compactCountTxDB{TxDB: d.TxDB(), n: &compacts},
+		blkdb: compactCountBlockStatDB{BlockStatDB: d.BlockStatDB(), n: &compacts},
+		cfg:   FeeSimConfig{logger: log.New(ioutil.Discard, "", 0)},
+	}
+	result, err := s.Trim(trimCompactMin, trimCompactMin, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(result, TrimResult{BlockStats: trimCompactMin, Txs: trimCompactMin, Compacted: true}); err != nil {
+		t.Error(err)
+	}
+	// The shared file is compacted once.
+	if err := testutil.CheckEqual(compacts, 1); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOnDemandBusy(t *testing.T) {
+	s := &FeeSim{}
+	s.SetTxSource(nil, errors.New("txsource not available"))
+
+	// Only one on-demand sim runs at a time
+	if !s.acquireOnDemand() {
+		t.Fatal("should acquire")
+	}
+	if _, err := s.EstimateScenario(1000000, nil); err != errOnDemandBusy {
+		t.Error("busy error should be returned, got", err)
+	}
+	if _, _, err := s.TuneNumIters(1000, 3, 0.05, nil); err != errOnDemandBusy {
+		t.Error("busy error should be returned, got", err)
+	}
+	s.releaseOnDemand()
+
+	// Released on return, even with an error
+	for i := 0; i < 2; i++ {
+		if _, err := s.EstimateScenario(1000000, nil); err == nil || err.Error() != "txsource not available" {
+			t.Error("txsource error should be returned, got", err)
+		}
+		if _, _, err := s.TuneNumIters(1000, 3, 0.05, nil); err == nil || err.Error() != "txsource not available" {
+			t.Error("txsource error should be returned, got", err)
+		}
+	}
+}
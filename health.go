@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/bitcoinfees/feesim/sim"
+)
+
+// checkCapacity updates the near-capacity flag with the sources' ratio of the
+// tx byte rate (of txs which some miners would include) to the capacity byte
+// rate, logging if it changed. As the ratio approaches 1, the sim becomes
+// unstable and the estimates balloon.
+func (s *FeeSim) checkCapacity(txsource sim.TxSource, blocksource sim.BlockSource) {
+	thresh := s.cfg.CapacityWarn
+	if thresh <= 0 {
+		return
+	}
+	capratefn := blocksource.RateFn()
+	maxcap := capratefn.Eval(math.MaxFloat64)
+	if maxcap <= 0 {
+		return
+	}
+	minfee := capratefn.Inverse(1)
+	ratio := txsource.RateFn().Eval(minfee) / maxcap
+	near := ratio > thresh
+
+	s.mux.Lock()
+	changed := near != s.nearCapacity
+	s.nearCapacity, s.capacityRatio = near, ratio
+	s.mux.Unlock()
+	if !changed {
+		return
+	}
+	if near {
+		s.cfg.logger.Printf("[WARNING] Near capacity: the tx byte rate is %.0f%% of the capacity byte rate, "+
+			"above %.0f%%; the estimates may be unstable.", 100*ratio, 100*thresh)
+	} else {
+		s.cfg.logger.Printf("Near capacity cleared: the tx byte rate is %.0f%% of the capacity byte rate.",
+			100*ratio)
+	}
+}
+
+// NearCapacity returns whether the tx byte rate is near capacity (see
+// checkCapacity), and the last ratio of the two.
+func (s *FeeSim) NearCapacity() (bool, float64) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.nearCapacity, s.capacityRatio
+}
+
+// healthStatus adds the health warnings which are active to status: the
+// "capacity" key if near capacity, and the "clockskew" key if the clock is
+// skewed. Unlike the other keys, they're absent when all is well.
+func (s *FeeSim) healthStatus(status map[string]string) {
+	if near, ratio := s.NearCapacity(); near && s.cfg.CapacityWarn > 0 {
+		status["capacity"] = fmt.Sprintf("Near capacity: tx byte rate is %.0f%% of capacity.", 100*ratio)
+	}
+	if skewed, skew := s.ClockSkew(); skewed && s.clockSkewEnabled() {
+		status["clockskew"] = clockSkewString(skew)
+	}
+}
+
+// Period in seconds of the clock skew check, after the one at startup.
+const clockSkewPeriod = 600
+
+func (s *FeeSim) clockSkewEnabled() bool {
+	return s.cfg.ClockSkewWarn > 0 && s.cfg.nodeTime != nil
+}
+
+// checkClockSkew compares the local time now with the node's tip block time
+// (or if the node doesn't report it, the tip's median time past), and warns
+// if they differ by more than cfg.ClockSkewWarn seconds. The local time is
+// that of the mempool states, and so of the txs' arrivals, whereas the node's
+// clock is that of the mempool entries; a skew between them corrupts the tx
+// windowing. The tip time lags the node's clock by the time since the block
+// was found, and may lead it by up to 2 hours (as allowed by consensus), so
+// the measure is coarse, and ClockSkewWarn should be at least an hour or so.
+func (s *FeeSim) checkClockSkew(now int64) {
+	nt, err := s.cfg.nodeTime()
+	if err != nil {
+		s.cfg.logger.Println("[ERROR] Clock skew check:", err)
+		return
+	}
+	tipTime := nt.Time
+	if tipTime == 0 {
+		tipTime = nt.MedianTime
+	}
+	skew := now - tipTime
+	skewed := skew > s.cfg.ClockSkewWarn || -skew > s.cfg.ClockSkewWarn
+
+	s.mux.Lock()
+	changed := skewed != s.clockSkewed
+	s.clockSkewed, s.clockSkew = skewed, skew
+	s.mux.Unlock()
+	if !changed {
+		return
+	}
+	if skewed {
+		s.cfg.logger.Printf("[WARNING] Clock skew: %s; check the local and node "+
+			"clocks (or whether the node is synced).", clockSkewString(skew))
+	} else {
+		s.cfg.logger.Printf("Clock skew cleared: local time is within %ds of the node's tip time.",
+			s.cfg.ClockSkewWarn)
+	}
+}
+
+func clockSkewString(skew int64) string {
+	if skew < 0 {
+		return fmt.Sprintf("local time is %s behind the node's tip time", time.Duration(-skew)*time.Second)
+	}
+	return fmt.Sprintf("local time is %s ahead of the node's tip time", time.Duration(skew)*time.Second)
+}
+
+// ClockSkew returns whether the local clock is skewed from the node's (see
+// checkClockSkew), and the last skew measured in seconds (positive if the
+// local clock is ahead).
+func (s *FeeSim) ClockSkew() (bool, int64) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.clockSkewed, s.clockSkew
+}
+
+// clockSkewWorker checks the clock skew every period seconds.
+func (s *FeeSim) clockSkewWorker(period int) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(time.Duration(period) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.checkClockSkew(time.Now().Unix())
+		case <-s.done:
+			return
+		}
+	}
+}
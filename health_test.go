@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+
+	col "github.com/bitcoinfees/feesim/collect"
+	"github.com/bitcoinfees/feesim/sim"
+	"github.com/bitcoinfees/feesim/testutil"
+)
+
+func TestCheckCapacity(t *testing.T) {
+	var logs bytes.Buffer
+	s := &FeeSim{
+		collect: col.NewCollector(nil, nil, col.Config{}),
+		cfg: FeeSimConfig{
+			CapacityWarn: 0.9,
+			logger:       log.New(&logs, "", 0),
+		},
+	}
+	// Capacity of 1e6 bytes per 600s; min fee rate 1000.
+	blocksource := sim.NewIndBlockSource([]sim.FeeRate{1000}, []sim.TxSize{1000000}, 1./600)
+	maxcap := 1e6 / 600
+	checkCapacity := func(txrate float64, near bool) {
+		// Half the txs are below the min fee rate, and don't count.
+		txsource := sim.NewUniTxSource([]sim.FeeRate{500, 2000}, []sim.TxSize{250, 250}, txrate)
+		s.checkCapacity(txsource, blocksource)
+		if isNear, ratio := s.NearCapacity(); isNear != near {
+			t.Fatalf("near capacity %v at ratio %.2f, want %v", isNear, ratio, near)
+		}
+		// The status is only shown while near capacity.
+		status, ok := s.Status()["capacity"]
+		if ok != near || near && status == "" {
+			t.Errorf("status is '%s' with near capacity %v", status, near)
+		}
+	}
+
+	checkCapacity(0.8*maxcap/125, false)
+	if logs.Len() > 0 {
+		t.Error("nothing should be logged below the threshold:", logs.String())
+	}
+	checkCapacity(0.95*maxcap/125, true)
+	if !strings.Contains(logs.String(), "[WARNING] Near capacity") {
+		t.Error("near capacity warning not logged:", logs.String())
+	}
+	_, ratio := s.NearCapacity()
+	if err := testutil.CheckPctDiff(ratio, 0.95, 1e-9); err != nil {
+		t.Error(err)
+	}
+	// Logged only on change
+	logs.Reset()
+	checkCapacity(1.5*maxcap/125, true)
+	if logs.Len() > 0 {
+		t.Error("warning should only be logged on change:", logs.String())
+	}
+	checkCapacity(0.5*maxcap/125, false)
+	if !strings.Contains(logs.String(), "cleared") {
+		t.Error("near capacity clearing not logged:", logs.String())
+	}
+
+	// Disabled
+	s.cfg.CapacityWarn = 0
+	if _, ok := s.Status()["capacity"]; ok {
+		t.Error("capacity status should not be shown if disabled")
+	}
+}
+
+func TestCheckClockSkew(t *testing.T) {
+	var logs bytes.Buffer
+	nodeTime := col.NodeTime{Time: 1000000, MedianTime: 1000000 - 3600}
+	var nodeErr error
+	s := &FeeSim{
+		collect: col.NewCollector(nil, nil, col.Config{}),
+		cfg: FeeSimConfig{
+			ClockSkewWarn: 7200,
+			nodeTime:      func() (col.NodeTime, error) { return nodeTime, nodeErr },
+			logger:        log.New(&logs, "", 0),
+		},
+	}
+	checkClockSkew := func(now int64, skewed bool) {
+		t.Helper()
+		s.checkClockSkew(now)
+		isSkewed, skew := s.ClockSkew()
+		if isSkewed != skewed {
+			t.Fatalf("skewed %v at skew %d, want %v", isSkewed, skew, skewed)
+		}
+		// The status is only shown while skewed.
+		status, ok := s.Status()["clockskew"]
+		if ok != skewed || skewed && status == "" {
+			t.Errorf("status is '%s' with skewed %v", status, skewed)
+		}
+	}
+
+	checkClockSkew(nodeTime.Time+600, false)
+	checkClockSkew(nodeTime.Time-7200, false)
+	if logs.Len() > 0 {
+		t.Error("nothing should be logged within the threshold:", logs.String())
+	}
+	// The local clock is a day behind.
+	checkClockSkew(nodeTime.Time-86400, true)
+	if !strings.Contains(logs.String(), "[WARNING] Clock skew: local time is 24h0m0s behind") {
+		t.Error("clock skew warning not logged:", logs.String())
+	}
+	if _, skew := s.ClockSkew(); skew != -86400 {
+		t.Errorf("skew should be -86400, got %d", skew)
+	}
+	// Logged only on change
+	logs.Reset()
+	checkClockSkew(nodeTime.Time+7201, true)
+	if logs.Len() > 0 {
+		t.Error("warning should only be logged on change:", logs.String())
+	}
+	if status := s.Status()["clockskew"]; !strings.Contains(status, "2h0m1s ahead") {
+		t.Error("status should show the skew, got", status)
+	}
+	checkClockSkew(nodeTime.Time, false)
+	if !strings.Contains(logs.String(), "cleared") {
+		t.Error("clock skew clearing not logged:", logs.String())
+	}
+
+	// Errors are logged, leaving the state as is.
+	logs.Reset()
+	nodeErr = errors.New("node down")
+	checkClockSkew(nodeTime.Time+86400, false)
+	if !strings.Contains(logs.String(), "node down") {
+		t.Error("error not logged:", logs.String())
+	}
+	nodeErr = nil
+
+	// The median time past is used if the tip time isn't reported.
+	nodeTime.Time = 0
+	checkClockSkew(nodeTime.MedianTime+7201, true)
+
+	// Disabled
+	s.cfg.ClockSkewWarn = 0
+	if _, ok := s.Status()["clockskew"]; ok {
+		t.Error("clock skew status should not be shown if disabled")
+	}
+}
@@ -44,17 +44,32 @@ func (l *DebugLog) Debug() bool {
 
 func (l *DebugLog) Close() {
 	l.r.Close()
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if c, ok := l.out.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+// SetOutput replaces the log output, closing the previous one if it's an
+// io.Closer. It's used to reopen the log file after it's been rotated.
+func (l *DebugLog) SetOutput(out io.Writer) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
 	if c, ok := l.out.(io.Closer); ok {
 		c.Close()
 	}
+	l.out = out
 }
 
 func (l *DebugLog) filter(debugPrefix string) {
 	s := bufio.NewScanner(l.r)
 	for s.Scan() {
 		m := s.Text()
-		if l.Debug() || !strings.Contains(m, debugPrefix) {
+		l.mux.Lock()
+		if l.debug || !strings.Contains(m, debugPrefix) {
 			fmt.Fprintln(l.out, m)
 		}
+		l.mux.Unlock()
 	}
 }
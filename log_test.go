@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSIGHUPReopensLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "feesim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logfile := filepath.Join(dir, "feesim.log")
+
+	f, err := openLogFile(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dLog := NewDebugLog(f, "", 0)
+	defer dLog.Close()
+	reopenLog := func() error {
+		f, err := openLogFile(logfile)
+		if err != nil {
+			return err
+		}
+		dLog.SetOutput(f)
+		return nil
+	}
+
+	sigc := make(chan os.Signal, 3)
+	signal.Notify(sigc, syscall.SIGHUP, syscall.SIGTERM)
+	defer signal.Stop(sigc)
+	stopped := make(chan struct{})
+	done := make(chan struct{})
+	reloads := make(chan struct{}, 1)
+	reloadConfig := func() error {
+		reloads <- struct{}{}
+		return nil
+	}
+	go func() {
+		handleSignals(sigc, func() { close(stopped) }, reopenLog, reloadConfig, dLog.Logger)
+		close(done)
+	}()
+
+	dLog.Logger.Println("before")
+	waitForLog(t, logfile, "before")
+
+	// Rotate, as logrotate would, then SIGHUP.
+	rotated := logfile + ".1"
+	if err := os.Rename(logfile, rotated); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	waitForLog(t, logfile, "Log file reopened.")
+	waitForLog(t, logfile, "Config reloaded.")
+	select {
+	case <-reloads:
+	default:
+		t.Error("SIGHUP should reload the config")
+	}
+	dLog.Logger.Println("after")
+	waitForLog(t, logfile, "after")
+	if b, _ := ioutil.ReadFile(rotated); strings.Contains(string(b), "after") {
+		t.Error("rotated log should not be written to after SIGHUP")
+	}
+	select {
+	case <-stopped:
+		t.Fatal("SIGHUP should not stop")
+	default:
+	}
+
+	// SIGTERM stops
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handleSignals should return after SIGTERM")
+	}
+	select {
+	case <-stopped:
+	default:
+		t.Error("SIGTERM should stop")
+	}
+}
+
+// waitForLog waits for the file to contain s.
+func waitForLog(t *testing.T, name, s string) {
+	for i := 0; i < 200; i++ {
+		if b, err := ioutil.ReadFile(name); err == nil && strings.Contains(string(b), s) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s should contain %q", name, s)
+}
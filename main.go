@@ -1,8 +1,10 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"os"
@@ -18,13 +20,14 @@ import (
 	col "github.com/bitcoinfees/feesim/collect"
 	"github.com/bitcoinfees/feesim/collect/corerpc"
 	"github.com/bitcoinfees/feesim/db/bolt"
+	"github.com/bitcoinfees/feesim/db/sqlite"
 	est "github.com/bitcoinfees/feesim/estimate"
 	"github.com/bitcoinfees/feesim/predict"
 	"github.com/bitcoinfees/feesim/sim"
 )
 
 const usage = `
-feesim [-c CONFIGFILE] [-d DATADIR] COMMAND [-h | -help] [args...]
+feesim [-c CONFIGFILE] [-d DATADIR] [-profile PROFILE] [-json] COMMAND [-h | -help] [args...]
 
 Commands:
 	start       (start the sim app)
@@ -36,22 +39,63 @@ Commands:
 	txrate      (show tx byterate)
 	caprate     (show capacity byterate)
 	mempoolsize (show mempool size)
+	mempool     (show a summary of the current mempool state)
 	pause       (pause the sim)
 	unpause     (resume the sim after pausing)
 	setdebug    (turn on/off debug-level logging)
 	metrics     (show app metrics)
 	config      (show app config settings.)
+	summary     (show a summary of the fee market)
+	nextblockprob (probability of confirmation in the next block at a fee rate)
+	conftime    (estimated time to confirmation at a fee rate)
+	utilization (show the ratio of tx byterate to capacity byterate)
+	collectorerrors (show the most recent collector errors)
+	export      (export caprate / txrate / mempoolsize, or the block stats, as CSV)
+	blockrate   (show the estimated block rate (blocks/hour))
+	estimatefeescenario (estimatefee with an overridden max block size)
+	configdiff  (show effective differences between two config files)
+	validate    (check the config, and that bitcoind and the datadir are usable)
+	rebuild-blockstats (recompute block sizes / hashes in the block stats DB)
+	recomputescores (recompute the prediction scores from retained outcomes)
+	verify-sfr  (check the stored block stats for consistency)
+	txsourcedebug (show the tx source estimator's internal state)
+	tune        (recommend a transient.numiters setting)
+	trim        (delete old block stats / txs, and compact the DBs)
+	help-rpc    (list / describe the RPC methods)
+	simfloors   (show the fee rate floors of the last sim)
+	stablefee   (stable fee rate (BTC/kB), below which txs never clear)
+	latestblockstat (show the stats of the latest block)
+	export-state (export the estimator state to a file)
+	import-state (import the estimator state from a file)
+	eval        (evaluate the predicts and their fees over a window of blocks)
 
 `
 
 const (
 	coin    = 100000000
 	version = "0.3.2"
+
+	// The client timeout (in seconds) of the commands which run a sim on
+	// demand, which takes longer than the other RPCs.
+	onDemandTimeout = 600
 )
 
+// jsonCommands are the commands which support -json. The results of metrics,
+// config, summary, utilization and latestblockstat are always JSON.
+var jsonCommands = map[string]bool{
+	"status": true, "estimatefee": true, "scores": true, "txrate": true,
+	"caprate": true, "mempoolsize": true, "mempool": true, "metrics": true,
+	"config": true, "summary": true, "nextblockprob": true, "conftime": true,
+	"utilization": true, "collectorerrors": true, "blockrate": true,
+	"estimatefeescenario": true, "txsourcedebug": true, "tune": true,
+	"help-rpc": true, "simfloors": true, "stablefee": true,
+	"latestblockstat": true, "eval": true,
+}
+
 func main() {
 	var (
-		configFile, dataDir string
+		configFile, dataDir, profile string
+		jsonOut                      bool
 	)
 	flag.CommandLine.Usage = func() {
 		fmt.Fprintf(os.Stderr, usage)
@@ -62,6 +106,11 @@ func main() {
 		fmt.Sprintf("Path to config file (alternatively, use %s env var).", configFileEnv))
 	flag.StringVar(&dataDir, "d", "",
 		fmt.Sprintf("Path to data directory (alternatively, use %s env var).", dataDirEnv))
+	flag.StringVar(&profile, "profile", "",
+		fmt.Sprintf("Config profile to use (alternatively, use %s env var).", profileEnv))
+	flag.BoolVar(&jsonOut, "json", false,
+		"Show the result of a read command (e.g. status, estimatefee or conftime) as JSON "+
+			"(the API response as is).")
 	flag.Parse()
 
 	args := flag.Args()
@@ -69,8 +118,11 @@ func main() {
 		flag.CommandLine.Usage()
 		os.Exit(1)
 	}
+	if jsonOut && !jsonCommands[args[0]] {
+		log.Fatalf("-json is not supported by '%s'", args[0])
+	}
 
-	cfg, err := loadConfig(configFile, dataDir)
+	cfg, err := loadConfig(configFile, dataDir, profile)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -80,26 +132,35 @@ func main() {
 		Port:    cfg.AppRPC.Port,
 		Timeout: 15,
 	})
+	simclient := api.NewClient(api.Config{
+		Host:    cfg.AppRPC.Host,
+		Port:    cfg.AppRPC.Port,
+		Timeout: onDemandTimeout,
+	})
 
 	switch args[0] {
 	case "start":
-		runFeeSim(args, cfg)
+		runFeeSim(args, cfg, func() (config, error) {
+			return loadConfig(configFile, dataDir, profile)
+		})
 	case "version":
 		fmt.Println(version)
 	case "stop":
 		stop(args, apiclient)
 	case "status":
-		status(args, apiclient)
+		status(args, apiclient, jsonOut)
 	case "estimatefee":
-		estimateFee(args, apiclient)
+		estimateFee(args, apiclient, simclient, cfg.Estimate.DefaultTarget, jsonOut)
 	case "scores":
-		scores(args, apiclient)
+		scores(args, apiclient, jsonOut)
 	case "txrate":
-		txRate(args, apiclient)
+		txRate(args, apiclient, jsonOut)
 	case "caprate":
-		capRate(args, apiclient)
+		capRate(args, apiclient, jsonOut)
 	case "mempoolsize":
-		mempoolSize(args, apiclient)
+		mempoolSize(args, apiclient, jsonOut)
+	case "mempool":
+		mempool(args, apiclient, jsonOut)
 	case "pause":
 		pause(args, apiclient)
 	case "unpause":
@@ -110,12 +171,64 @@ func main() {
 		appMetrics(args, apiclient)
 	case "config":
 		appConfig(args, apiclient)
+	case "summary":
+		summary(args, apiclient)
+	case "nextblockprob":
+		nextBlockProb(args, apiclient, jsonOut)
+	case "conftime":
+		confTime(args, apiclient, jsonOut)
+	case "utilization":
+		utilization(args, apiclient)
+	case "collectorerrors":
+		collectorErrors(args, apiclient, jsonOut)
+	case "export":
+		if len(args) > 1 && args[1] == "blockstats" {
+			exportBlockStats(args[1:], cfg)
+		} else {
+			export(args, apiclient)
+		}
+	case "blockrate":
+		blockRate(args, apiclient, jsonOut)
+	case "estimatefeescenario":
+		estimateFeeScenario(args, simclient, jsonOut)
+	case "configdiff":
+		configDiff(args)
+	case "validate":
+		validate(args, cfg)
+	case "rebuild-blockstats":
+		rebuildBlockStats(args, cfg)
+	case "recomputescores":
+		recomputeScores(args, cfg)
+	case "verify-sfr":
+		verifySFR(args, cfg)
+	case "txsourcedebug":
+		txSourceDebug(args, apiclient, jsonOut)
+	case "tune":
+		tune(args, cfg, jsonOut)
+	case "trim":
+		trim(args, cfg)
+	case "help-rpc":
+		helpRPC(args, apiclient, jsonOut)
+	case "simfloors":
+		simFloors(args, apiclient, jsonOut)
+	case "stablefee":
+		stableFee(args, apiclient, jsonOut)
+	case "latestblockstat":
+		latestBlockStat(args, apiclient)
+	case "export-state":
+		exportState(args, cfg)
+	case "import-state":
+		importState(args, cfg)
+	case "eval":
+		eval(args, cfg, jsonOut)
 	default:
 		log.Fatalf("Invalid command '%s'", args[0])
 	}
 }
 
-func runFeeSim(args []string, cfg config) {
+// runFeeSim starts Feesim with cfg. On SIGHUP, the config is reloaded with
+// reload, and its hot-reloadable subset applied (see FeeSim.Reconfigure).
+func runFeeSim(args []string, cfg config, reload func() (config, error)) {
 	const usage = `
 feesim start
 
@@ -135,22 +248,31 @@ to pause the sim (while still collecting data).
 	if err := f.Parse(args[1:]); err != nil {
 		log.Fatal(err)
 	}
-	txdb, err := loadTxDB(cfg)
-	if err != nil {
-		log.Fatal(fmt.Errorf("loadTxDB: %v", err))
+	if errs := cfg.Validate(); len(errs) > 0 {
+		for _, err := range errs {
+			log.Println(err)
+		}
+		log.Fatal("invalid config; see feesim validate")
 	}
-
-	blkdb, err := loadBlockStatDB(cfg)
+	if err := checkDataDir(cfg.DataDir); err != nil {
+		log.Fatal(err)
+	}
+	txdb, blkdb, predictdb, err := loadDBs(cfg)
 	if err != nil {
-		log.Fatal(fmt.Errorf("loadBlockStatDB: %v", err))
+		log.Fatal(fmt.Errorf("loadDBs: %v", err))
 	}
 
-	predictdb, err := loadPredictDB(cfg)
-	if err != nil {
-		log.Fatal(fmt.Errorf("loadPredictDB: %v", err))
+	// Setup the logger
+	var dLog *DebugLog
+	if f, err := openLogFile(cfg.LogFile); err != nil {
+		log.Fatal(fmt.Errorf("opening logfile: %v", err))
+	} else {
+		dLog = NewDebugLog(f, "", log.LstdFlags)
 	}
 
-	estTx, err := loadTxSourceEstimator(txdb, cfg)
+	cfg.UniTx.Logger = dLog.Logger
+	cfg.MultiTx.Logger = dLog.Logger
+	estTx, txSourceState, err := loadTxSourceEstimator(txdb, cfg)
 	if err != nil {
 		log.Fatal(fmt.Errorf("loadTxSourceEstimator: %v", err))
 	}
@@ -160,30 +282,66 @@ to pause the sim (while still collecting data).
 		log.Fatal(fmt.Errorf("loadBlockSourceEstimator: %v", err))
 	}
 
-	collectConfig, err := loadCollectorConfig(cfg)
-	if err != nil {
-		log.Fatal(fmt.Errorf("loadCollectorConfig: %v", err))
+	var store *metricsStore
+	if cfg.MetricsSavePeriod > 0 {
+		store, err = loadMetricsStore(filepath.Join(cfg.DataDir, "metrics.json"), metrics.DefaultRegistry)
+		if err != nil {
+			log.Fatal(fmt.Errorf("loadMetricsStore: %v", err))
+		}
 	}
 
-	// Setup the logger
-	var dLog *DebugLog
-	logFileMode := os.O_WRONLY | os.O_CREATE | os.O_APPEND
-	if f, err := os.OpenFile(cfg.LogFile, logFileMode, 0666); err != nil {
-		log.Fatal(fmt.Errorf("opening logfile: %v", err))
-	} else {
-		dLog = NewDebugLog(f, "", log.LstdFlags)
+	var deadLetter *col.DeadLetter
+	if cfg.DeadLetterRetry > 0 {
+		deadLetter = col.NewDeadLetter(filepath.Join(cfg.DataDir, "deadletter.jsonl"))
+	}
+
+	var rateHistory RateHistoryDB
+	if cfg.RateHistoryRetention > 0 {
+		if rateHistory, err = loadRateHistoryDB(cfg); err != nil {
+			log.Fatal(fmt.Errorf("loadRateHistoryDB: %v", err))
+		}
+	}
+
+	collectConfig, err := loadCollectorConfig(cfg, store)
+	if err != nil {
+		log.Fatal(fmt.Errorf("loadCollectorConfig: %v", err))
 	}
 
 	feesimConfig := FeeSimConfig{
 		estTxSource:    estTx,
 		estBlockSource: estBlk,
+		txSourceState:  txSourceState,
+		nodeTime:       corerpc.NodeTimeGetter(cfg.BitcoinRPC),
 		Collect:        collectConfig,
 		Transient:      cfg.Transient,
 		Predict:        cfg.Predict,
 		SimPeriod:      cfg.SimPeriod,
 		TxMaxAge:       cfg.TxMaxAge,
 		TxGapTol:       cfg.TxGapTol,
-		logger:         dLog.Logger,
+		TxShiftTol:     cfg.TxShiftTol,
+		SizeFnSample:   cfg.SizeFnSample,
+		CollectErrors:  cfg.CollectErrors,
+		Alert:          cfg.Estimate.Alert,
+		CapacityWarn:   cfg.CapacityWarn,
+		ClockSkewWarn:  cfg.ClockSkewWarn,
+		CapacityPct:    cfg.CapacityPct,
+		StaleResults:   cfg.StaleResults,
+		MemoryBudget:   cfg.MemoryBudget,
+		MempoolExpiry:  cfg.MempoolExpiry,
+		BumpElasticity: cfg.BumpElasticity,
+		RBF:            cfg.RBF,
+		WeightUnits:    cfg.WeightUnits,
+
+		MetricsSavePeriod: cfg.MetricsSavePeriod,
+		DeadLetterRetry:   cfg.DeadLetterRetry,
+		AncestorFeeRate:   cfg.AncestorFeeRate,
+		logger:            dLog.Logger,
+		metrics:           store,
+		deadLetter:        deadLetter,
+		rateHistory:       rateHistory,
+		blockStatWindow:   cfg.IndBlock.Window,
+
+		RateHistoryRetention: cfg.RateHistoryRetention,
 	}
 	feesim, err := NewFeeSim(txdb, blkdb, predictdb, feesimConfig)
 	if err != nil {
@@ -199,13 +357,35 @@ to pause the sim (while still collecting data).
 	go func() { errc <- feesim.Run() }()
 	go func() { errc <- service.ListenAndServe() }()
 
-	// Signal handling
+	// Signal handling. SIGHUP reopens the log file (e.g. for logrotate) and
+	// reloads the config; SIGINT / SIGTERM shut down.
 	sigc := make(chan os.Signal, 3)
 	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
-	go func() {
-		<-sigc
-		feesim.Stop()
-	}()
+	reopenLog := func() error {
+		f, err := openLogFile(cfg.LogFile)
+		if err != nil {
+			return err
+		}
+		dLog.SetOutput(f)
+		return nil
+	}
+	reloadConfig := func() error {
+		newCfg, err := reload()
+		if err != nil {
+			return err
+		}
+		if errs := newCfg.Validate(); len(errs) > 0 {
+			for _, err := range errs {
+				dLog.Logger.Println("[ERROR] Config reload:", err)
+			}
+			return errors.New("invalid config, not applied; see feesim validate")
+		}
+		for _, d := range ignoredConfigChanges(cfg, newCfg) {
+			dLog.Logger.Printf("[WARNING] Config reload: ignored %s; restart to apply it.", d)
+		}
+		return feesim.Reconfigure(newCfg.FeeSimConfig)
+	}
+	go handleSignals(sigc, feesim.Stop, reopenLog, reloadConfig, dLog.Logger)
 
 	err = <-errc
 	// Blocks until it is safely shutdown. It is idempotent, so no harm if
@@ -216,65 +396,283 @@ to pause the sim (while still collecting data).
 	}
 }
 
-func loadTxSourceEstimator(db est.TxDB, cfg config) (est.TxSourceEstimator, error) {
-	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
-	estimator := est.NewUniTxSource(db, cfg.UniTx, rng)
-	estTx := func(t int64) (sim.TxSource, error) {
-		return estimator.Estimate(t)
+// handleSignals calls reopenLog and then reloadConfig on each SIGHUP, and stop
+// on any other signal, after which it returns.
+func handleSignals(sigc <-chan os.Signal, stop func(), reopenLog, reloadConfig func() error, logger *log.Logger) {
+	for sig := range sigc {
+		if sig != syscall.SIGHUP {
+			stop()
+			return
+		}
+		if err := reopenLog(); err != nil {
+			logger.Println("[ERROR] Reopening log file:", err)
+		} else {
+			logger.Println("Log file reopened.")
+		}
+		if err := reloadConfig(); err != nil {
+			logger.Println("[ERROR] Reloading config:", err)
+		} else {
+			logger.Println("Config reloaded.")
+		}
+	}
+}
+
+func openLogFile(name string) (*os.File, error) {
+	return os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+}
+
+// Tx source models (see config.TxSourceModel)
+const (
+	txSourceModelUni   = "uni"
+	txSourceModelMulti = "multi"
+)
+
+// loadTxSourceEstimator loads the estimator of the configured tx source
+// model. It also returns a func for getting the estimator's internal state,
+// which is nil if the model has none.
+func loadTxSourceEstimator(db est.TxDB, cfg config) (est.TxSourceEstimator, func() est.UniTxSourceState, error) {
+	cfg.UniTx.WeightUnits = cfg.WeightUnits
+	cfg.MultiTx.WeightUnits = cfg.WeightUnits
+	switch cfg.TxSourceModel {
+	case txSourceModelUni, "":
+		rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+		estimator := est.NewUniTxSource(db, cfg.UniTx, rng)
+		estTx := func(t int64) (sim.TxSource, error) {
+			return estimator.Estimate(t)
+		}
+		return estTx, estimator.State, nil
+	case txSourceModelMulti:
+		multiCfg := cfg.MultiTx
+		estTx := func(t int64) (sim.TxSource, error) {
+			return est.MultiTxSource(t, &multiCfg, db)
+		}
+		return estTx, nil, nil
+	default:
+		return nil, nil, fmt.Errorf("invalid txsourcemodel '%s'; must be %s or %s",
+			cfg.TxSourceModel, txSourceModelUni, txSourceModelMulti)
 	}
-	return estTx, nil
 }
 
+// Block source models (see config.BlockSourceModel)
+const (
+	blockSourceModelInd    = "ind"
+	blockSourceModelSMFR   = "smfr"
+	blockSourceModelPaired = "paired"
+)
+
+// loadBlockSourceEstimator loads the estimator of the configured block source
+// model.
 func loadBlockSourceEstimator(db est.BlockStatDB, cfg config) (est.BlockSourceEstimator, error) {
+	cfg.IndBlock.WeightUnits = cfg.WeightUnits
+	var estimate func(int64, est.IndBlockSourceConfig, est.BlockStatDB) (*sim.IndBlockSource, error)
+	switch cfg.BlockSourceModel {
+	case blockSourceModelSMFR, "":
+		estimate = est.IndBlockSourceSMFR
+	case blockSourceModelInd:
+		estimate = est.IndBlockSource
+	case blockSourceModelPaired:
+		estBlk := func(h int64) (sim.BlockSource, error) {
+			return est.PairedBlockSource(h, cfg.IndBlock, db)
+		}
+		return estBlk, nil
+	default:
+		return nil, fmt.Errorf("invalid blocksourcemodel '%s'; must be %s (miner min fee "+
+			"rates estimated from the block SFRs), %s (a static min fee rate, the lowest "+
+			"estimated one, which avoids inflated estimates when blocks are constantly full) "+
+			"or %s (min fee rates and max block sizes estimated together, as miner policies)",
+			cfg.BlockSourceModel, blockSourceModelInd, blockSourceModelSMFR, blockSourceModelPaired)
+	}
 	estBlk := func(h int64) (sim.BlockSource, error) {
-		return est.IndBlockSourceSMFR(h, cfg.IndBlock, db)
+		return estimate(h, cfg.IndBlock, db)
 	}
 	return estBlk, nil
 }
 
+// checkDataDir checks that files can be written in dir, so that a read-only or
+// full filesystem is reported clearly, instead of failing deep in DB loading.
+func checkDataDir(dir string) error {
+	f, err := ioutil.TempFile(dir, ".writeprobe")
+	if err == nil {
+		_, err = f.Write([]byte{0})
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		os.Remove(f.Name())
+	}
+	if err == nil {
+		return nil
+	}
+	if col.IsDiskFull(err) {
+		return fmt.Errorf("datadir %s is on a full filesystem (%v); free up space, "+
+			"or use another datadir (-d)", dir, err)
+	}
+	return fmt.Errorf("datadir %s is not writable (%v); check its permissions, and that "+
+		"its filesystem isn't mounted read-only, or use another datadir (-d)", dir, err)
+}
+
+// DB backends (see config.DBBackend)
+const (
+	dbBackendBolt   = "bolt"
+	dbBackendSQLite = "sqlite"
+)
+
+// The bolt DB file shared by the tx, block stat and predict DBs (see
+// bolt.LoadDB)
+const boltDBFileName = "feesim.db"
+
+// dbFile returns the path of the DB file with the given base name in the data
+// dir; the extension depends on the DB backend, so that switching the backend
+// doesn't clobber the other's files. With the bolt backend, the DBs share
+// boltDBFileName, unless the data dir has the separate files of earlier
+// versions (e.g. tx.db), which are kept. It returns an error if the backend is
+// invalid.
+func dbFile(cfg config, name string) (string, error) {
+	switch cfg.DBBackend {
+	case dbBackendBolt, "":
+		if _, err := os.Stat(filepath.Join(cfg.DataDir, "tx.db")); err == nil {
+			return filepath.Join(cfg.DataDir, name+".db"), nil
+		}
+		return filepath.Join(cfg.DataDir, boltDBFileName), nil
+	case dbBackendSQLite:
+		return filepath.Join(cfg.DataDir, name+".sqlite"), nil
+	default:
+		return "", fmt.Errorf("invalid dbbackend '%s'; must be %s or %s",
+			cfg.DBBackend, dbBackendBolt, dbBackendSQLite)
+	}
+}
+
+// loadDBs loads the tx, block stat and predict DBs; unlike loading them one
+// by one, this works when they share a file (see dbFile).
+func loadDBs(cfg config) (TxDB, BlockStatDB, predict.DB, error) {
+	dbfile, err := dbFile(cfg, "tx")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if cfg.DBBackend != dbBackendSQLite && filepath.Base(dbfile) == boltDBFileName {
+		d, err := bolt.LoadDB(dbfile)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("bolt.LoadDB: %v", err)
+		}
+		return d.TxDB(), d.BlockStatDB(), d.PredictDB(), nil
+	}
+
+	txdb, err := loadTxDB(cfg)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("loadTxDB: %v", err)
+	}
+	blkdb, err := loadBlockStatDB(cfg)
+	if err != nil {
+		txdb.Close()
+		return nil, nil, nil, fmt.Errorf("loadBlockStatDB: %v", err)
+	}
+	predictdb, err := loadPredictDB(cfg)
+	if err != nil {
+		txdb.Close()
+		blkdb.Close()
+		return nil, nil, nil, fmt.Errorf("loadPredictDB: %v", err)
+	}
+	return txdb, blkdb, predictdb, nil
+}
+
 func loadTxDB(cfg config) (TxDB, error) {
-	const dbFileName = "tx.db"
-	dbfile := filepath.Join(cfg.DataDir, dbFileName)
+	dbfile, err := dbFile(cfg, "tx")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.DBBackend == dbBackendSQLite {
+		return sqlite.LoadTxDB(dbfile)
+	}
 	return bolt.LoadTxDB(dbfile)
 }
 
 func loadBlockStatDB(cfg config) (BlockStatDB, error) {
-	const dbFileName = "blockstat.db"
-	dbfile := filepath.Join(cfg.DataDir, dbFileName)
+	dbfile, err := dbFile(cfg, "blockstat")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.DBBackend == dbBackendSQLite {
+		return sqlite.LoadBlockStatDB(dbfile)
+	}
 	return bolt.LoadBlockStatDB(dbfile)
 }
 
-func loadPredictDB(cfg config) (predict.DB, error) {
-	const dbFileName = "predict.db"
+// loadBlockStatDBReadOnly loads the block stat DB for reading only. It fails
+// if the app is running.
+func loadBlockStatDBReadOnly(cfg config) (BlockStatDB, error) {
+	dbfile, err := dbFile(cfg, "blockstat")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.DBBackend == dbBackendSQLite {
+		return sqlite.LoadBlockStatDBReadOnly(dbfile)
+	}
+	return bolt.LoadBlockStatDBReadOnly(dbfile)
+}
+
+// loadRateHistoryDB loads the rate history DB. Unlike the DBs of dbFile, it's
+// always a bolt DB in its own file, whatever the backend; there's no sqlite
+// rate history DB yet.
+func loadRateHistoryDB(cfg config) (RateHistoryDB, error) {
+	const dbFileName = "ratehistory.db"
 	dbfile := filepath.Join(cfg.DataDir, dbFileName)
+	return bolt.LoadRateHistoryDB(dbfile)
+}
+
+func loadPredictDB(cfg config) (predict.DB, error) {
+	dbfile, err := dbFile(cfg, "predict")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.DBBackend == dbBackendSQLite {
+		return sqlite.LoadPredictDB(dbfile)
+	}
 	return bolt.LoadPredictDB(dbfile)
 }
 
-func loadCollectorConfig(cfg config) (col.Config, error) {
+func loadGetters(timeNow corerpc.UnixNow, cfg config) (col.MempoolStateGetter, col.BlockGetter, error) {
+	if cfg.BitcoinRPC.REST {
+		return corerpc.RESTGetters(timeNow, cfg.BitcoinRPC)
+	}
+	return corerpc.Getters(timeNow, cfg.BitcoinRPC)
+}
+
+func loadCollectorConfig(cfg config, store *metricsStore) (col.Config, error) {
 	timeNow := func() int64 {
 		return time.Now().Unix()
 	}
-	getState, getBlock, err := corerpc.Getters(timeNow, cfg.BitcoinRPC)
-	if err != nil {
+	var (
+		getState col.MempoolStateGetter
+		getBlock col.BlockGetter
+		trigger  <-chan struct{}
+		err      error
+	)
+	if len(cfg.BitcoinRPC.ZMQ.Endpoints) > 0 && !cfg.BitcoinRPC.REST {
+		// The subscriptions last as long as the process.
+		z, err := corerpc.NewZMQGetters(timeNow, cfg.BitcoinRPC)
+		if err != nil {
+			return col.Config{}, err
+		}
+		getState, getBlock, trigger = z.GetState, z.GetBlock, z.Trigger
+	} else if getState, getBlock, err = loadGetters(timeNow, cfg); err != nil {
 		return col.Config{}, err
 	}
 
 	// Wrap getState with a timer
 	reservoirSize := 60 / cfg.Collect.PollPeriod * 60 * 24 // About one day's worth
-	getStateTimer := metrics.NewCustomTimer(metrics.NewHistogram(
-		metrics.NewSimpleExpDecaySample(reservoirSize)), metrics.NewMeter())
+	name := "getstate" + strconv.Itoa(reservoirSize)
+	getStateTimer := store.timer(name, reservoirSize)
 	timedGetState := func() (*col.MempoolState, error) {
 		start := time.Now()
 		defer getStateTimer.UpdateSince(start)
 		return getState()
 	}
-	name := "getstate" + strconv.Itoa(reservoirSize)
-	metrics.Register(name, getStateTimer)
 
 	c := col.Config{
-		GetState:   timedGetState,
-		GetBlock:   getBlock,
-		PollPeriod: cfg.Collect.PollPeriod,
+		GetState:      timedGetState,
+		GetBlock:      getBlock,
+		Trigger:       trigger,
+		PollPeriod:    cfg.Collect.PollPeriod,
+		BlockFetchers: cfg.Collect.BlockFetchers,
 	}
 	return c, nil
 }
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bitcoinfees/feesim/db/bolt"
+	est "github.com/bitcoinfees/feesim/estimate"
+	"github.com/bitcoinfees/feesim/sim"
+	"github.com/bitcoinfees/feesim/testutil"
+)
+
+func TestCheckDataDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "feesim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := checkDataDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	// The probe file should be cleaned up
+	if files, err := ioutil.ReadDir(dir); err != nil {
+		t.Fatal(err)
+	} else if len(files) > 0 {
+		t.Errorf("probe left %d files in datadir", len(files))
+	}
+
+	// A datadir "under" a regular file can't be written to, even as root
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkDataDir(filepath.Join(file, "datadir")); err == nil {
+		t.Error("datadir under a file should not be writable")
+	} else {
+		t.Log(err)
+	}
+
+	// Read-only datadir
+	if os.Geteuid() == 0 {
+		t.Skip("root ignores dir permissions")
+	}
+	rodir := filepath.Join(dir, "readonly")
+	if err := os.Mkdir(rodir, 0500); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(rodir, 0700)
+	if err := checkDataDir(rodir); err == nil {
+		t.Error("read-only datadir should not be writable")
+	} else {
+		t.Log(err)
+	}
+}
+
+// sliceTxDB is an est.TxDB of a tx slice sorted by time.
+type sliceTxDB []est.Tx
+
+func (d sliceTxDB) Get(start, end int64) ([]est.Tx, error) {
+	var txs []est.Tx
+	for _, tx := range d {
+		if tx.Time >= start && tx.Time <= end {
+			txs = append(txs, tx)
+		}
+	}
+	return txs, nil
+}
+
+func TestLoadTxSourceEstimator(t *testing.T) {
+	var db sliceTxDB
+	for i := int64(0); i < 1000; i++ {
+		db = append(db, est.Tx{FeeRate: sim.FeeRate(10000 + i), Size: 250, Time: 1000 + i})
+	}
+	cfg := defaultConfig
+	cfg.UniTx.Logger = log.New(ioutil.Discard, "", 0)
+	cfg.MultiTx.Logger = cfg.UniTx.Logger
+
+	// Default model
+	estTx, state, err := loadTxSourceEstimator(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state == nil {
+		t.Error("uni model should have a state func")
+	}
+	if txsource, err := estTx(1999); err != nil {
+		t.Fatal(err)
+	} else if _, ok := txsource.(*sim.UniTxSource); !ok {
+		t.Errorf("uni model should return a *sim.UniTxSource, got %T", txsource)
+	}
+
+	cfg.TxSourceModel = "multi"
+	estTx, state, err = loadTxSourceEstimator(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != nil {
+		t.Error("multi model should have no state func")
+	}
+	if txsource, err := estTx(1999); err != nil {
+		t.Fatal(err)
+	} else if _, ok := txsource.(*sim.MultiTxSource); !ok {
+		t.Errorf("multi model should return a *sim.MultiTxSource, got %T", txsource)
+	}
+	// The multi model config applies
+	cfg.MultiTx.MinWindow = 2000
+	if estTx, _, err = loadTxSourceEstimator(db, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := estTx(1999); err == nil {
+		t.Error("window shorter than multitx.minwindow should return an error")
+	}
+
+	cfg.TxSourceModel = "bogus"
+	if _, _, err := loadTxSourceEstimator(db, cfg); err == nil {
+		t.Error("unknown model should return an error")
+	} else {
+		t.Log(err)
+	}
+}
+
+func TestLoadBlockSourceEstimator(t *testing.T) {
+	f, err := os.Open("estimate/testdata/blockstats.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	db := &rangeBlockStatDB{}
+	if err := json.NewDecoder(f).Decode(&db.stats); err != nil {
+		t.Fatal(err)
+	}
+	height := db.stats[len(db.stats)-1].Height
+	cfg := defaultConfig
+	cfg.IndBlock.MinCov = 0.9
+
+	for model, ref := range map[string]func(int64, est.IndBlockSourceConfig, est.BlockStatDB) (*sim.IndBlockSource, error){
+		"":     est.IndBlockSourceSMFR, // Default
+		"smfr": est.IndBlockSourceSMFR,
+		"ind":  est.IndBlockSource,
+	} {
+		cfg.BlockSourceModel = model
+		estBlk, err := loadBlockSourceEstimator(db, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocksource, err := estBlk(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		refsource, err := ref(height, cfg.IndBlock, db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The models differ in the capacity at intermediate fee rates.
+		x := 10000.0
+		if err := testutil.CheckEqual(blocksource.RateFn().Eval(x), refsource.RateFn().Eval(x)); err != nil {
+			t.Errorf("%s: %v", model, err)
+		}
+	}
+
+	cfg.BlockSourceModel = "bogus"
+	if _, err := loadBlockSourceEstimator(db, cfg); err == nil {
+		t.Error("unknown model should return an error")
+	} else {
+		t.Log(err)
+	}
+}
+
+func TestLoadDBBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "feesim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := defaultConfig
+	cfg.DataDir = dir
+
+	dbFiles := map[string][]string{
+		"":       {"feesim.db"},
+		"bolt":   {"feesim.db"},
+		"sqlite": {"tx.sqlite", "blockstat.sqlite", "predict.sqlite"},
+	}
+	for backend, files := range dbFiles {
+		cfg.DBBackend = backend
+		txdb, blkdb, predictdb, err := loadDBs(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := txdb.Put([]est.Tx{{FeeRate: 10000, Size: 250, Time: 1}}); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range files {
+			if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+				t.Errorf("%s: %v", backend, err)
+			}
+		}
+		txdb.Close()
+		blkdb.Close()
+		predictdb.Close()
+	}
+
+	// The shared bolt file can also be loaded one DB at a time.
+	cfg.DBBackend = "bolt"
+	blkdb, err := loadBlockStatDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blkdb.Close()
+
+	// A data dir with the separate bolt files of earlier versions keeps them.
+	legacyDir, err := ioutil.TempDir("", "feesim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(legacyDir)
+	legacyCfg := cfg
+	legacyCfg.DataDir = legacyDir
+	legacyTxDB, err := bolt.LoadTxDB(filepath.Join(legacyDir, "tx.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyTxDB.Close()
+	txdb, blkdb, predictdb, err := loadDBs(legacyCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txdb.Close()
+	blkdb.Close()
+	predictdb.Close()
+	for _, name := range []string{"tx.db", "blockstat.db", "predict.db"} {
+		if _, err := os.Stat(filepath.Join(legacyDir, name)); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(legacyDir, "feesim.db")); !os.IsNotExist(err) {
+		t.Error("feesim.db shouldn't be created in a data dir with tx.db")
+	}
+
+	// The sqlite tx DB is separate from the bolt one
+	cfg.DBBackend = "sqlite"
+	sqliteTxDB, err := loadTxDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txs, err := sqliteTxDB.Get(0, 2)
+	sqliteTxDB.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(len(txs), 1); err != nil {
+		t.Error(err)
+	}
+
+	cfg.DBBackend = "bogus"
+	if _, err := loadTxDB(cfg); err == nil {
+		t.Error("unknown backend should return an error")
+	} else {
+		t.Log(err)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// metricsStore persists timer totals across restarts. For each timer, the
+// all-time count is kept in a companion counter (named <timer>-total), which
+// is saved and restored. The timer itself starts afresh, since the sample
+// reservoirs can't be reseeded exactly, and the meter rates are time-based.
+//
+// A nil *metricsStore is valid, and creates non-persisted timers.
+type metricsStore struct {
+	file     string
+	registry metrics.Registry
+	saved    map[string]savedTimer
+
+	mux    sync.Mutex
+	timers map[string]*totalTimer
+}
+
+type savedTimer struct {
+	Total int64 `json:"total"`
+}
+
+// totalTimer is a Timer which also increments a counter of all-time updates.
+type totalTimer struct {
+	metrics.Timer
+	total metrics.Counter
+}
+
+func (t *totalTimer) Update(d time.Duration) {
+	t.Timer.Update(d)
+	t.total.Inc(1)
+}
+
+func (t *totalTimer) UpdateSince(ts time.Time) {
+	t.Update(time.Since(ts))
+}
+
+func (t *totalTimer) Time(f func()) {
+	ts := time.Now()
+	f()
+	t.UpdateSince(ts)
+}
+
+// loadMetricsStore loads the saved metrics from file, if it exists. Metrics
+// are registered with r.
+func loadMetricsStore(file string, r metrics.Registry) (*metricsStore, error) {
+	m := &metricsStore{
+		file:     file,
+		registry: r,
+		saved:    make(map[string]savedTimer),
+		timers:   make(map[string]*totalTimer),
+	}
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &m.saved); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// timer creates and registers a timer with an exp decay sample reservoir of
+// the specified size, restoring its saved total if any.
+func (m *metricsStore) timer(name string, size int) metrics.Timer {
+	timer := metrics.NewCustomTimer(metrics.NewHistogram(
+		metrics.NewSimpleExpDecaySample(size)), metrics.NewMeter())
+	if m == nil {
+		metrics.Register(name, timer)
+		return timer
+	}
+
+	t := &totalTimer{Timer: timer, total: metrics.NewCounter()}
+	t.total.Inc(m.saved[name].Total)
+	m.registry.Register(name, t)
+	m.registry.Register(name+"-total", t.total)
+
+	m.mux.Lock()
+	m.timers[name] = t
+	m.mux.Unlock()
+	return t
+}
+
+// save writes the timer metrics to file. The file is replaced atomically, so
+// that a crash mid-save doesn't lose the previous snapshot.
+func (m *metricsStore) save() error {
+	m.mux.Lock()
+	saved := make(map[string]savedTimer)
+	// Keep saved timers which weren't created this run
+	for name, t := range m.saved {
+		saved[name] = t
+	}
+	for name, t := range m.timers {
+		saved[name] = savedTimer{Total: t.total.Count()}
+	}
+	m.mux.Unlock()
+
+	b, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	tmp := m.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.file)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+
+	"github.com/bitcoinfees/feesim/testutil"
+)
+
+func TestMetricsStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "feesim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "metrics.json")
+
+	r := metrics.NewRegistry()
+	m, err := loadMetricsStore(file, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timer := m.timer("sim", 3)
+	for i := 1; i <= 5; i++ {
+		timer.Update(time.Duration(i))
+	}
+	if err := testutil.CheckEqual(r.Get("sim-total").(metrics.Counter).Count(), int64(5)); err != nil {
+		t.Fatal(err)
+	}
+	// Not created this run, but should be kept
+	m.saved["other"] = savedTimer{Total: 2}
+	if err := m.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// "Restart"
+	r = metrics.NewRegistry()
+	if m, err = loadMetricsStore(file, r); err != nil {
+		t.Fatal(err)
+	}
+	timer = m.timer("sim", 3)
+	if err := testutil.CheckEqual(r.Get("sim").(metrics.Timer), timer); err != nil {
+		t.Error(err)
+	}
+	total := r.Get("sim-total").(metrics.Counter)
+	if err := testutil.CheckEqual(total.Count(), int64(5)); err != nil {
+		t.Error(err)
+	}
+	timer.UpdateSince(time.Now())
+	if err := testutil.CheckEqual(total.Count(), int64(6)); err != nil {
+		t.Error(err)
+	}
+	if err := m.save(); err != nil {
+		t.Fatal(err)
+	}
+	if m, err = loadMetricsStore(file, metrics.NewRegistry()); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(m.saved["sim"].Total, int64(6)); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(m.saved["other"].Total, int64(2)); err != nil {
+		t.Error(err)
+	}
+
+	// A nil store makes plain timers
+	var nilStore *metricsStore
+	if _, ok := nilStore.timer("nilstore", 3).(*metrics.StandardTimer); !ok {
+		t.Error("nil store should make a StandardTimer")
+	}
+	metrics.Unregister("nilstore")
+}
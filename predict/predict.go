@@ -4,10 +4,12 @@
 package predict
 
 import (
+	"fmt"
 	"log"
 	"math"
 	"os"
 	"sort"
+	"sync"
 
 	col "github.com/bitcoinfees/feesim/collect"
 	"github.com/bitcoinfees/feesim/sim"
@@ -16,6 +18,51 @@ import (
 type Tx struct {
 	ConfirmIn int64
 	ConfirmBy int64
+	Size      int64 // Tx virtual size, used if Config.WeightBySize is set
+	FeeRate   int64 // Tx fee rate (satoshis/kB), or 0 if stored by an earlier version
+}
+
+// Outcome is a resolved prediction: a tx predicted to confirm in ConfirmIn
+// blocks (i.e. by block ConfirmBy) was confirmed in block Height.
+type Outcome struct {
+	ConfirmIn int64
+	ConfirmBy int64
+	Height    int64
+	Size      int64
+	FeeRate   int64
+}
+
+// FeeRateBuckets are the lower bounds (satoshis/kB) of the fee rate buckets
+// of the fee rate scores (see FeeScoreDB). The last bucket is unbounded.
+var FeeRateBuckets = []int64{0, 5000, 10000, 20000, 50000, 100000, 200000, 500000}
+
+// FeeScoreDB is implemented by DBs which can store the scores by fee rate
+// bucket as well as by confirmation time. If the DB implements it,
+// ProcessBlock tallies those scores too.
+type FeeScoreDB interface {
+	// The scores are indexed by [ConfirmIn-1][fee rate bucket].
+	GetFeeScores() (attained, exceeded [][]float64, err error)
+	PutFeeScores(attained, exceeded [][]float64) error
+}
+
+// OutcomeDB is implemented by DBs which can retain prediction outcomes. It's
+// required if Config.RetainOutcomes > 0.
+type OutcomeDB interface {
+	// PutOutcomes appends the outcomes, and then removes the oldest ones so
+	// that at most limit are retained.
+	PutOutcomes(outcomes []Outcome, limit int) error
+
+	// GetOutcomes returns the retained outcomes, in the order they were put.
+	GetOutcomes() ([]Outcome, error)
+}
+
+// LastBlockDB is implemented by DBs which can store the last processed
+// block. If the DB implements it, ProcessBlock's guard against processing a
+// block twice holds across restarts.
+type LastBlockDB interface {
+	// GetLastBlock returns height -1 if no block has been stored.
+	GetLastBlock() (height int64, hash string, err error)
+	PutLastBlock(height int64, hash string) error
 }
 
 type DB interface {
@@ -35,42 +82,73 @@ type Config struct {
 	MaxBlockConfirms int `yaml:"maxblockconfirms" json:"maxblockconfirms"`
 	Halflife         int `yaml:"halflife" json:"halflife"` // In number of blocks
 
+	// Weight the tally by tx size instead of counting each tx once. Predicts
+	// stored without a size (i.e. by an earlier version) have zero weight.
+	WeightBySize bool `yaml:"weightbysize" json:"weightbysize"`
+
+	// Number of most recent prediction outcomes to retain, so that the
+	// scores can be recomputed (see Predictor.RecomputeScores). If 0, they
+	// are not retained.
+	RetainOutcomes int `yaml:"retainoutcomes" json:"retainoutcomes"`
+
+	// If not nil, failed PutTxs writes in AddPredicts are queued in
+	// DeadLetter (with kind DeadLetterTxs), to be retried later.
+	DeadLetter *col.DeadLetter `yaml:"-" json:"-"`
+
 	Logger *log.Logger `yaml:"-" json:"-"`
 }
 
+// DeadLetterTxs is the dead letter kind of failed PutTxs writes.
+const DeadLetterTxs = "predicttxs"
+
 // TODO: Consider tallying predicts once the block heights exceeds confirmBy
 type Predictor struct {
 	db    DB
 	cfg   Config
 	a     float64
 	state *col.MempoolState
+
+	// The height and hash of the last processed block. lastHeight is -1 if
+	// none has been processed yet, and lastHash is empty if unknown.
+	lastHeight int64
+	lastHash   string
+
+	mux sync.RWMutex // Guards cfg.Halflife, a, lastHeight and lastHash
 }
 
 func NewPredictor(db DB, cfg Config) (*Predictor, error) {
-	// Resize the Scores
+	if cfg.MaxBlockConfirms < 0 {
+		return nil, fmt.Errorf("MaxBlockConfirms must be >= 0, was %d", cfg.MaxBlockConfirms)
+	}
+	if _, ok := db.(OutcomeDB); cfg.RetainOutcomes > 0 && !ok {
+		return nil, fmt.Errorf("RetainOutcomes is set, but the DB can't retain outcomes")
+	}
+	// Resize the Scores. The stored scores might be of any length (including
+	// mismatched), e.g. if MaxBlockConfirms was changed.
 	attained, exceeded, err := db.GetScores()
 	if err != nil {
 		return nil, err
 	}
-	if d := cfg.MaxBlockConfirms - len(attained); d > 0 {
-		attained = append(attained, make([]float64, d)...)
-	} else {
-		attained = attained[:cfg.MaxBlockConfirms]
-	}
-	if d := cfg.MaxBlockConfirms - len(exceeded); d > 0 {
-		exceeded = append(exceeded, make([]float64, d)...)
-	} else {
-		exceeded = exceeded[:cfg.MaxBlockConfirms]
-	}
+	attained = resizeScores(attained, cfg.MaxBlockConfirms)
+	exceeded = resizeScores(exceeded, cfg.MaxBlockConfirms)
 	if err := db.PutScores(attained, exceeded); err != nil {
 		return nil, err
 	}
 
+	lastHeight, lastHash := int64(-1), ""
+	if ldb, ok := db.(LastBlockDB); ok {
+		if lastHeight, lastHash, err = ldb.GetLastBlock(); err != nil {
+			return nil, err
+		}
+	}
+
 	a := math.Pow(0.5, 1/float64(cfg.Halflife))
 	p := &Predictor{
-		db:  db,
-		cfg: cfg,
-		a:   a,
+		db:         db,
+		cfg:        cfg,
+		a:          a,
+		lastHeight: lastHeight,
+		lastHash:   lastHash,
 	}
 	return p, nil
 }
@@ -81,21 +159,63 @@ func (p *Predictor) ProcessBlock(b col.Block) error {
 		logger = log.New(os.Stderr, "", log.LstdFlags)
 	}
 
+	// A block may be delivered more than once, e.g. if the collector
+	// restarts; it should only be scored once. A block at the last height
+	// with a different hash is a reorg's replacement block, and is scored.
+	height := b.Height()
+	var hash string
+	if h, ok := b.(col.Hasher); ok {
+		hash = h.Hash()
+	}
+	p.mux.RLock()
+	lastHeight, lastHash := p.lastHeight, p.lastHash
+	p.mux.RUnlock()
+	if height < lastHeight || height == lastHeight && (hash == "" || hash == lastHash) {
+		logger.Printf("[DEBUG] Predictor: block %d already processed; skipped.", height)
+		return nil
+	}
+
 	attained := make([]float64, p.cfg.MaxBlockConfirms)
 	exceeded := make([]float64, p.cfg.MaxBlockConfirms)
-	height, txids := b.Height(), b.Txids()
+	feeAttained := resizeFeeScores(nil, p.cfg.MaxBlockConfirms)
+	feeExceeded := resizeFeeScores(nil, p.cfg.MaxBlockConfirms)
+	txids := b.Txids()
 	predictTxs, err := p.db.GetTxs(txids)
 	if err != nil {
 		return err
 	}
+	var (
+		numStale int
+		outcomes []Outcome
+	)
 	for _, tx := range predictTxs {
-		if height <= tx.ConfirmBy {
-			attained[tx.ConfirmIn-1]++
-		} else {
-			exceeded[tx.ConfirmIn-1]++
+		if tx.ConfirmIn < 1 || tx.ConfirmIn > int64(p.cfg.MaxBlockConfirms) {
+			// Stale prediction, e.g. if MaxBlockConfirms was reduced across
+			// a restart. Ignore it; since the tx is now confirmed, it will
+			// be removed from the DB on the next Cleanup.
+			numStale++
+			continue
+		}
+		outcome := Outcome{
+			ConfirmIn: tx.ConfirmIn,
+			ConfirmBy: tx.ConfirmBy,
+			Height:    height,
+			Size:      tx.Size,
+			FeeRate:   tx.FeeRate,
+		}
+		tally(attained, exceeded, outcome, p.cfg.WeightBySize)
+		tallyFee(feeAttained, feeExceeded, outcome, p.cfg.WeightBySize)
+		outcomes = append(outcomes, outcome)
+	}
+	if p.cfg.RetainOutcomes > 0 && len(outcomes) > 0 {
+		if err := p.db.(OutcomeDB).PutOutcomes(outcomes, p.cfg.RetainOutcomes); err != nil {
+			return err
 		}
 	}
-	logger.Printf("[DEBUG] Predictor: %d predicts tallied.", len(predictTxs))
+	if numStale > 0 {
+		logger.Printf("[WARNING] Predictor: %d out-of-range predicts ignored.", numStale)
+	}
+	logger.Printf("[DEBUG] Predictor: %d predicts tallied.", len(predictTxs)-numStale)
 
 	attainedTotal, exceededTotal, err := p.db.GetScores()
 	if err != nil {
@@ -103,11 +223,182 @@ func (p *Predictor) ProcessBlock(b col.Block) error {
 	}
 
 	// Exponential decay
+	a := p.decay()
 	for i := range attained {
-		attainedTotal[i] = p.a*attainedTotal[i] + attained[i]
-		exceededTotal[i] = p.a*exceededTotal[i] + exceeded[i]
+		attainedTotal[i] = a*attainedTotal[i] + attained[i]
+		exceededTotal[i] = a*exceededTotal[i] + exceeded[i]
+	}
+	if err := p.db.PutScores(attainedTotal, exceededTotal); err != nil {
+		return err
+	}
+	if fdb, ok := p.db.(FeeScoreDB); ok {
+		feeAttainedTotal, feeExceededTotal, err := fdb.GetFeeScores()
+		if err != nil {
+			return err
+		}
+		feeAttainedTotal = resizeFeeScores(feeAttainedTotal, p.cfg.MaxBlockConfirms)
+		feeExceededTotal = resizeFeeScores(feeExceededTotal, p.cfg.MaxBlockConfirms)
+		for i := range feeAttained {
+			for j := range feeAttained[i] {
+				feeAttainedTotal[i][j] = a*feeAttainedTotal[i][j] + feeAttained[i][j]
+				feeExceededTotal[i][j] = a*feeExceededTotal[i][j] + feeExceeded[i][j]
+			}
+		}
+		if err := fdb.PutFeeScores(feeAttainedTotal, feeExceededTotal); err != nil {
+			return err
+		}
+	}
+
+	if ldb, ok := p.db.(LastBlockDB); ok {
+		if err := ldb.PutLastBlock(height, hash); err != nil {
+			return err
+		}
 	}
-	return p.db.PutScores(attainedTotal, exceededTotal)
+	p.mux.Lock()
+	p.lastHeight, p.lastHash = height, hash
+	p.mux.Unlock()
+	return nil
+}
+
+// Halflife returns the current halflife (in blocks) of the score decay.
+func (p *Predictor) Halflife() int {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+	return p.cfg.Halflife
+}
+
+// SetHalflife sets the halflife (in blocks) of the score decay. It applies
+// from the next ProcessBlock; the existing scores are unchanged (see
+// RecomputeScores).
+func (p *Predictor) SetHalflife(halflife int) error {
+	if halflife <= 0 {
+		return fmt.Errorf("halflife must be > 0, was %d", halflife)
+	}
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.cfg.Halflife = halflife
+	p.a = math.Pow(0.5, 1/float64(halflife))
+	return nil
+}
+
+// decay returns the per block score decay factor.
+func (p *Predictor) decay() float64 {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+	return p.a
+}
+
+// RecomputeScores recomputes the scores from the retained outcomes, with the
+// current config (e.g. a different Halflife), and replaces the stored scores.
+// The decay is as of the block of the last outcome. It returns the number of
+// outcomes used.
+func (p *Predictor) RecomputeScores() (int, error) {
+	odb, ok := p.db.(OutcomeDB)
+	if !ok {
+		return 0, fmt.Errorf("the DB can't retain outcomes")
+	}
+	outcomes, err := odb.GetOutcomes()
+	if err != nil {
+		return 0, err
+	}
+	p.mux.RLock()
+	cfg, a := p.cfg, p.a
+	p.mux.RUnlock()
+	attained, exceeded, feeAttained, feeExceeded, n := recomputeScores(outcomes, cfg, a)
+	if err := p.db.PutScores(attained, exceeded); err != nil {
+		return 0, err
+	}
+	if fdb, ok := p.db.(FeeScoreDB); ok {
+		if err := fdb.PutFeeScores(feeAttained, feeExceeded); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// Calibration returns the undecayed scores of the outcomes, i.e. the number
+// (or size, if cfg.WeightBySize) of the predicts by ConfirmIn which attained
+// and exceeded their targets, e.g. for evaluating the predicts over a window
+// of blocks. It also returns the number of outcomes used.
+func Calibration(outcomes []Outcome, cfg Config) (attained, exceeded []float64, n int) {
+	attained, exceeded, _, _, n = recomputeScores(outcomes, cfg, 1)
+	return attained, exceeded, n
+}
+
+// recomputeScores replays the outcomes in block order, decaying the scores by
+// a per block, as ProcessBlock does. Outcomes out of range of
+// cfg.MaxBlockConfirms are skipped. It returns the scores, the fee rate
+// scores, and the number of outcomes used.
+func recomputeScores(outcomes []Outcome, cfg Config, a float64) (attained, exceeded []float64, feeAttained, feeExceeded [][]float64, n int) {
+	outcomes = append([]Outcome(nil), outcomes...)
+	sort.SliceStable(outcomes, func(i, j int) bool { return outcomes[i].Height < outcomes[j].Height })
+
+	attained = make([]float64, cfg.MaxBlockConfirms)
+	exceeded = make([]float64, cfg.MaxBlockConfirms)
+	feeAttained = resizeFeeScores(nil, cfg.MaxBlockConfirms)
+	feeExceeded = resizeFeeScores(nil, cfg.MaxBlockConfirms)
+	for i, outcome := range outcomes {
+		if i > 0 && outcome.Height > outcomes[i-1].Height {
+			decay := math.Pow(a, float64(outcome.Height-outcomes[i-1].Height))
+			for j := range attained {
+				attained[j] *= decay
+				exceeded[j] *= decay
+				for k := range feeAttained[j] {
+					feeAttained[j][k] *= decay
+					feeExceeded[j][k] *= decay
+				}
+			}
+		}
+		if outcome.ConfirmIn < 1 || outcome.ConfirmIn > int64(cfg.MaxBlockConfirms) {
+			continue
+		}
+		tally(attained, exceeded, outcome, cfg.WeightBySize)
+		tallyFee(feeAttained, feeExceeded, outcome, cfg.WeightBySize)
+		n++
+	}
+	return attained, exceeded, feeAttained, feeExceeded, n
+}
+
+// tally adds the outcome to the block's score tally.
+func tally(attained, exceeded []float64, outcome Outcome, weightBySize bool) {
+	w := 1.0
+	if weightBySize {
+		w = float64(outcome.Size)
+	}
+	if outcome.Height <= outcome.ConfirmBy {
+		attained[outcome.ConfirmIn-1] += w
+	} else {
+		exceeded[outcome.ConfirmIn-1] += w
+	}
+}
+
+// tallyFee adds the outcome to the block's fee rate score tally. Outcomes
+// without a fee rate aren't tallied.
+func tallyFee(attained, exceeded [][]float64, outcome Outcome, weightBySize bool) {
+	bucket := feeRateBucket(outcome.FeeRate)
+	if bucket < 0 {
+		return
+	}
+	w := 1.0
+	if weightBySize {
+		w = float64(outcome.Size)
+	}
+	if outcome.Height <= outcome.ConfirmBy {
+		attained[outcome.ConfirmIn-1][bucket] += w
+	} else {
+		exceeded[outcome.ConfirmIn-1][bucket] += w
+	}
+}
+
+// feeRateBucket returns the index of the FeeRateBuckets bucket of feerate, or
+// -1 if feerate is 0 (i.e. unknown).
+func feeRateBucket(feerate int64) int {
+	if feerate <= 0 {
+		return -1
+	}
+	return sort.Search(len(FeeRateBuckets), func(i int) bool {
+		return FeeRateBuckets[i] > feerate
+	}) - 1
 }
 
 func (p *Predictor) AddPredicts(s *col.MempoolState, simResult []sim.FeeRate) error {
@@ -135,10 +426,25 @@ func (p *Predictor) AddPredicts(s *col.MempoolState, simResult []sim.FeeRate) er
 			continue
 		}
 		confirmBy := s.Height + int64(confirmIn)
-		predictTxs[txid] = Tx{ConfirmIn: int64(confirmIn), ConfirmBy: confirmBy}
+		predictTxs[txid] = Tx{
+			ConfirmIn: int64(confirmIn),
+			ConfirmBy: confirmBy,
+			Size:      int64(entry.Size()),
+			FeeRate:   int64(entry.FeeRate()),
+		}
 	}
 	logger.Printf("[DEBUG] Predictor: %d predicts added.", len(predictTxs))
-	return p.db.PutTxs(predictTxs)
+	if err := p.db.PutTxs(predictTxs); err != nil {
+		if p.cfg.DeadLetter != nil {
+			if dlErr := p.cfg.DeadLetter.Add(DeadLetterTxs, predictTxs); dlErr != nil {
+				logger.Printf("[ERROR] Dead letter: queueing failed %s write: %v", DeadLetterTxs, dlErr)
+			} else {
+				logger.Printf("[WARNING] Failed %s write queued in the dead letter for retry.", DeadLetterTxs)
+			}
+		}
+		return err
+	}
+	return nil
 }
 
 func (p *Predictor) Cleanup(s *col.MempoolState) error {
@@ -153,6 +459,21 @@ func (p *Predictor) GetScores() (attained []float64, exceeded []float64, err err
 	return p.db.GetScores()
 }
 
+// GetFeeScores returns the scores by confirmation time and fee rate bucket
+// (see FeeScoreDB and FeeRateBuckets).
+func (p *Predictor) GetFeeScores() (attained, exceeded [][]float64, err error) {
+	fdb, ok := p.db.(FeeScoreDB)
+	if !ok {
+		return nil, nil, fmt.Errorf("the DB can't store fee rate scores")
+	}
+	if attained, exceeded, err = fdb.GetFeeScores(); err != nil {
+		return nil, nil, err
+	}
+	// The stored scores are resized on the next ProcessBlock, e.g. if
+	// MaxBlockConfirms was changed.
+	return resizeFeeScores(attained, p.cfg.MaxBlockConfirms), resizeFeeScores(exceeded, p.cfg.MaxBlockConfirms), nil
+}
+
 // searchResult returns the smallest i such that x >= result[i]
 func searchResult(result []sim.FeeRate, x sim.FeeRate) int {
 	return sort.Search(len(result), func(i int) bool {
@@ -162,3 +483,24 @@ func searchResult(result []sim.FeeRate, x sim.FeeRate) int {
 		return false
 	})
 }
+
+// resizeScores returns a copy of scores with length n, truncated or padded
+// with zeros as necessary.
+func resizeScores(scores []float64, n int) []float64 {
+	r := make([]float64, n)
+	copy(r, scores)
+	return r
+}
+
+// resizeFeeScores resizes the fee rate scores to n rows of
+// len(FeeRateBuckets).
+func resizeFeeScores(scores [][]float64, n int) [][]float64 {
+	r := make([][]float64, n)
+	for i := range r {
+		r[i] = make([]float64, len(FeeRateBuckets))
+		if i < len(scores) {
+			copy(r[i], scores[i])
+		}
+	}
+	return r
+}
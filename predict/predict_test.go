@@ -1,7 +1,11 @@
 package predict
 
 import (
+	"encoding/json"
 	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	col "github.com/bitcoinfees/feesim/collect"
@@ -10,8 +14,24 @@ import (
 )
 
 type MockPredictDB struct {
-	txs                map[string]Tx
-	attained, exceeded []float64
+	txs                      map[string]Tx
+	attained, exceeded       []float64
+	feeAttained, feeExceeded [][]float64
+	outcomes                 []Outcome
+	lastHeight               int64
+	lastHash                 string
+}
+
+func (d *MockPredictDB) PutOutcomes(outcomes []Outcome, limit int) error {
+	d.outcomes = append(d.outcomes, outcomes...)
+	if len(d.outcomes) > limit {
+		d.outcomes = d.outcomes[len(d.outcomes)-limit:]
+	}
+	return nil
+}
+
+func (d *MockPredictDB) GetOutcomes() ([]Outcome, error) {
+	return d.outcomes, nil
 }
 
 func (d *MockPredictDB) GetTxs(txids []string) (map[string]Tx, error) {
@@ -34,6 +54,9 @@ func (d *MockPredictDB) PutTxs(txs map[string]Tx) error {
 			if err := testutil.CheckEqual(tx.ConfirmBy, int64(4)); err != nil {
 				return err
 			}
+			if err := testutil.CheckEqual(tx.Size, int64(1000)); err != nil {
+				return err
+			}
 		case "1":
 			if err := testutil.CheckEqual(tx.ConfirmIn, int64(1)); err != nil {
 				return err
@@ -72,6 +95,25 @@ func (d *MockPredictDB) PutScores(attained []float64, exceeded []float64) error
 	return nil
 }
 
+func (d *MockPredictDB) GetFeeScores() ([][]float64, [][]float64, error) {
+	return d.feeAttained, d.feeExceeded, nil
+}
+
+func (d *MockPredictDB) PutFeeScores(attained [][]float64, exceeded [][]float64) error {
+	d.feeAttained = attained
+	d.feeExceeded = exceeded
+	return nil
+}
+
+func (d *MockPredictDB) GetLastBlock() (int64, string, error) {
+	return d.lastHeight, d.lastHash, nil
+}
+
+func (d *MockPredictDB) PutLastBlock(height int64, hash string) error {
+	d.lastHeight, d.lastHash = height, hash
+	return nil
+}
+
 func (d *MockPredictDB) Reconcile(txids []string) error {
 	return testutil.CheckEqual(txids, []string{"4"})
 }
@@ -81,7 +123,7 @@ func (d *MockPredictDB) Close() error {
 }
 
 func NewMockPredictDB() *MockPredictDB {
-	return &MockPredictDB{txs: make(map[string]Tx)}
+	return &MockPredictDB{txs: make(map[string]Tx), lastHeight: -1}
 }
 
 func TestPredict(t *testing.T) {
@@ -157,9 +199,9 @@ func TestPredict(t *testing.T) {
 		t.Error(err)
 	}
 
-	// Test the decay
+	// Test the decay, with the following (empty) blocks
 	for i := 0; i < cfg.Halflife; i++ {
-		if err := p.ProcessBlock(b); err != nil {
+		if err := p.ProcessBlock(&heightBlock{height: 5 + int64(i)}); err != nil {
 			t.Fatal(err)
 		}
 	}
@@ -196,6 +238,452 @@ func TestPredict(t *testing.T) {
 	}
 }
 
+func TestPredictDuplicateBlock(t *testing.T) {
+	cfg := Config{MaxBlockConfirms: 2, Halflife: 8}
+	db := NewMockPredictDB()
+	db.txs["0"] = Tx{ConfirmIn: 1, ConfirmBy: 10}
+	p, err := NewPredictor(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &heightBlock{height: 4, hash: "a", txids: []string{"0"}}
+	for i := 0; i < 2; i++ {
+		if err := p.ProcessBlock(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Also after a restart
+	if p, err = NewPredictor(db, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.ProcessBlock(b); err != nil {
+		t.Fatal(err)
+	}
+	attained, exceeded, err := p.GetScores()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(attained, []float64{1, 0}); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(exceeded, []float64{0, 0}); err != nil {
+		t.Error(err)
+	}
+
+	// Earlier blocks are also skipped
+	if err := p.ProcessBlock(&heightBlock{height: 3, txids: []string{"0"}}); err != nil {
+		t.Fatal(err)
+	}
+	if attained, _, err = p.GetScores(); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(attained, []float64{1, 0}); err != nil {
+		t.Error(err)
+	}
+
+	// A reorg's replacement block, at the same height, is scored
+	if err := p.ProcessBlock(&heightBlock{height: 4, hash: "b", txids: []string{"0"}}); err != nil {
+		t.Fatal(err)
+	}
+	if attained, _, err = p.GetScores(); err != nil {
+		t.Fatal(err)
+	}
+	a := p.decay()
+	if err := testutil.CheckPctDiff(attained[0], 1+a, 1e-9); err != nil {
+		t.Error(err)
+	}
+
+	// The next block is scored
+	if err := p.ProcessBlock(&heightBlock{height: 5, hash: "c", txids: []string{"0"}}); err != nil {
+		t.Fatal(err)
+	}
+	if attained, _, err = p.GetScores(); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckPctDiff(attained[0], (1+a)*a+1, 1e-9); err != nil {
+		t.Error(err)
+	}
+}
+
+// failingPredictDB is a MockPredictDB whose PutTxs fails while err is set.
+type failingPredictDB struct {
+	*MockPredictDB
+	err error
+}
+
+func (d *failingPredictDB) PutTxs(txs map[string]Tx) error {
+	if d.err != nil {
+		return d.err
+	}
+	return d.MockPredictDB.PutTxs(txs)
+}
+
+func TestPredictDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "feesim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d := col.NewDeadLetter(filepath.Join(dir, "deadletter.jsonl"))
+
+	db := &failingPredictDB{NewMockPredictDB(), errors.New("transient error")}
+	cfg := Config{MaxBlockConfirms: 4, Halflife: 8, DeadLetter: d}
+	p, err := NewPredictor(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state0 := &col.MempoolState{Entries: map[string]col.MempoolEntry{}}
+	state1 := &col.MempoolState{
+		Entries: map[string]col.MempoolEntry{
+			"1": &testMempoolEntry{&testutil.MempoolEntry{
+				Fee:  0.0001,
+				Size: 1000,
+			}},
+		},
+		Height: 1,
+	}
+	result := []sim.FeeRate{10000, 5001, 5000}
+	if err := p.AddPredicts(state0, result); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AddPredicts(state1, result); err == nil {
+		t.Fatal("PutTxs error should be returned")
+	}
+	if n, err := d.Len(); err != nil {
+		t.Fatal(err)
+	} else if err := testutil.CheckEqual(n, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Retry once the DB has recovered
+	db.err = nil
+	n, err := d.Retry(map[string]func(json.RawMessage) error{
+		DeadLetterTxs: func(data json.RawMessage) error {
+			var txs map[string]Tx
+			if err := json.Unmarshal(data, &txs); err != nil {
+				return err
+			}
+			return db.PutTxs(txs)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(n, 1); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(db.txs, map[string]Tx{
+		"1": {ConfirmIn: 1, ConfirmBy: 2, Size: 1000, FeeRate: 10000},
+	}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPredictStale(t *testing.T) {
+	cfg := Config{MaxBlockConfirms: 4, Halflife: 8}
+	db := NewMockPredictDB()
+	// Stale predictions from a previous config with larger MaxBlockConfirms
+	db.txs["0"] = Tx{ConfirmIn: 10, ConfirmBy: 10}
+	db.txs["1"] = Tx{ConfirmIn: 0, ConfirmBy: 10}
+	db.txs["2"] = Tx{ConfirmIn: 2, ConfirmBy: 10}
+	p, err := NewPredictor(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.ProcessBlock(&testBlock{}); err != nil {
+		t.Fatal(err)
+	}
+	attained, exceeded, err := p.GetScores()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(attained, []float64{0, 1, 0, 0}); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(exceeded, []float64{0, 0, 0, 0}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPredictSetHalflife(t *testing.T) {
+	db := NewMockPredictDB()
+	db.attained, db.exceeded = []float64{4, 2}, []float64{2, 1}
+	p, err := NewPredictor(db, Config{MaxBlockConfirms: 2, Halflife: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetHalflife(0); err == nil {
+		t.Error("halflife 0 should be rejected")
+	}
+	if err := p.SetHalflife(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(p.Halflife(), 1); err != nil {
+		t.Error(err)
+	}
+
+	// With halflife 1, an empty block halves the scores.
+	if err := p.ProcessBlock(&testBlock{}); err != nil {
+		t.Fatal(err)
+	}
+	attained, exceeded, err := p.GetScores()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(attained, []float64{2, 1}); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(exceeded, []float64{1, 0.5}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPredictResizeScores(t *testing.T) {
+	cfg := Config{MaxBlockConfirms: 4, Halflife: 8}
+	for _, tc := range []struct {
+		attained, exceeded []float64
+		attainedRef        []float64
+		exceededRef        []float64
+	}{
+		// Shorter
+		{[]float64{1, 2}, []float64{3, 4}, []float64{1, 2, 0, 0}, []float64{3, 4, 0, 0}},
+		// Longer
+		{[]float64{1, 2, 3, 4, 5, 6}, []float64{6, 5, 4, 3, 2, 1},
+			[]float64{1, 2, 3, 4}, []float64{6, 5, 4, 3}},
+		// Mismatched
+		{[]float64{1, 2, 3, 4, 5}, []float64{1}, []float64{1, 2, 3, 4}, []float64{1, 0, 0, 0}},
+		{nil, []float64{1, 2, 3, 4, 5}, []float64{0, 0, 0, 0}, []float64{1, 2, 3, 4}},
+	} {
+		db := NewMockPredictDB()
+		db.attained, db.exceeded = tc.attained, tc.exceeded
+		p, err := NewPredictor(db, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		attained, exceeded, err := p.GetScores()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := testutil.CheckEqual(attained, tc.attainedRef); err != nil {
+			t.Error(err)
+		}
+		if err := testutil.CheckEqual(exceeded, tc.exceededRef); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Scores were stored for a larger MaxBlockConfirms
+	db := NewMockPredictDB()
+	db.attained = []float64{1, 2, 3, 4, 5, 6}
+	db.exceeded = []float64{1, 2, 3, 4, 5, 6}
+	if _, err := NewPredictor(db, Config{MaxBlockConfirms: 0, Halflife: 8}); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(len(db.attained), 0); err != nil {
+		t.Error(err)
+	}
+	if _, err := NewPredictor(db, Config{MaxBlockConfirms: -1, Halflife: 8}); err == nil {
+		t.Error("negative MaxBlockConfirms should return an error")
+	}
+}
+
+func TestPredictWeightBySize(t *testing.T) {
+	for _, tc := range []struct {
+		weightBySize             bool
+		attainedRef, exceededRef []float64
+	}{
+		{false, []float64{1, 1, 0, 0}, []float64{1, 0, 0, 0}},
+		{true, []float64{100, 250, 0, 0}, []float64{1000, 0, 0, 0}},
+	} {
+		cfg := Config{MaxBlockConfirms: 4, Halflife: 8, WeightBySize: tc.weightBySize}
+		db := NewMockPredictDB()
+		// The block height is 4
+		db.txs["0"] = Tx{ConfirmIn: 1, ConfirmBy: 10, Size: 100}
+		db.txs["1"] = Tx{ConfirmIn: 1, ConfirmBy: 2, Size: 1000}
+		db.txs["2"] = Tx{ConfirmIn: 2, ConfirmBy: 10, Size: 250}
+		p, err := NewPredictor(db, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.ProcessBlock(&testBlock{}); err != nil {
+			t.Fatal(err)
+		}
+		attained, exceeded, err := p.GetScores()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := testutil.CheckEqual(attained, tc.attainedRef); err != nil {
+			t.Error(err)
+		}
+		if err := testutil.CheckEqual(exceeded, tc.exceededRef); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestPredictFeeScores(t *testing.T) {
+	cfg := Config{MaxBlockConfirms: 2, Halflife: 1, RetainOutcomes: 100}
+	db := NewMockPredictDB()
+	p, err := NewPredictor(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.txs = map[string]Tx{
+		"0": {ConfirmIn: 1, ConfirmBy: 4, FeeRate: 12000},
+		"1": {ConfirmIn: 1, ConfirmBy: 3, FeeRate: 15000},
+		"2": {ConfirmIn: 2, ConfirmBy: 4, FeeRate: 1000000},
+		"3": {ConfirmIn: 2, ConfirmBy: 4}, // No fee rate
+	}
+	if err := p.ProcessBlock(&heightBlock{height: 4, txids: []string{"0", "1", "2", "3"}}); err != nil {
+		t.Fatal(err)
+	}
+	db.txs = map[string]Tx{"4": {ConfirmIn: 1, ConfirmBy: 5, FeeRate: 5000}}
+	if err := p.ProcessBlock(&heightBlock{height: 5, txids: []string{"4"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	attainedRef := [][]float64{{0, 1, 0.5, 0, 0, 0, 0, 0}, {0, 0, 0, 0, 0, 0, 0, 0.5}}
+	exceededRef := [][]float64{{0, 0, 0.5, 0, 0, 0, 0, 0}, {0, 0, 0, 0, 0, 0, 0, 0}}
+	attained, exceeded, err := p.GetFeeScores()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(attained, attainedRef); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(exceeded, exceededRef); err != nil {
+		t.Error(err)
+	}
+
+	// RecomputeScores recomputes the same fee rate scores from the outcomes
+	db.PutFeeScores(nil, nil)
+	if _, err := p.RecomputeScores(); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(db.feeAttained, attainedRef); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(db.feeExceeded, exceededRef); err != nil {
+		t.Error(err)
+	}
+
+	// The DB must implement FeeScoreDB
+	if p, err = NewPredictor(struct{ DB }{db}, Config{MaxBlockConfirms: 2, Halflife: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := p.GetFeeScores(); err == nil {
+		t.Error("GetFeeScores without a FeeScoreDB should return an error")
+	}
+}
+
+func TestPredictRecomputeScores(t *testing.T) {
+	cfg := Config{MaxBlockConfirms: 4, Halflife: 8, RetainOutcomes: 100}
+	db := NewMockPredictDB()
+	p, err := NewPredictor(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Process blocks at heights 4..9.
+	for h := int64(4); h < 10; h++ {
+		db.txs = map[string]Tx{
+			"0": {ConfirmIn: 1, ConfirmBy: h, Size: 100},
+			"1": {ConfirmIn: 2, ConfirmBy: h - 1, Size: 200},
+			"2": {ConfirmIn: 10, ConfirmBy: h, Size: 300}, // Stale
+		}
+		b := &heightBlock{height: h, txids: []string{"0", "1", "2"}}
+		// A block without predicts, which decays the scores.
+		if h == 8 {
+			b.txids = nil
+		}
+		if err := p.ProcessBlock(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := testutil.CheckEqual(len(db.outcomes), 10); err != nil {
+		t.Fatal(err)
+	}
+	attainedRef, exceededRef, _ := p.GetScores()
+
+	// Reset and recompute
+	db.PutScores(make([]float64, 4), make([]float64, 4))
+	n, err := p.RecomputeScores()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(n, 10); err != nil {
+		t.Error(err)
+	}
+	attained, exceeded, _ := p.GetScores()
+	for i := range attained {
+		if err := testutil.CheckPctDiff(attained[i], attainedRef[i], 1e-9); err != nil {
+			t.Error(err)
+		}
+		if err := testutil.CheckPctDiff(exceeded[i], exceededRef[i], 1e-9); err != nil {
+			t.Error(err)
+		}
+	}
+	t.Log(attained, exceeded)
+
+	// Calibration is undecayed
+	attained, exceeded, n = Calibration(db.outcomes, cfg)
+	if err := testutil.CheckEqual(n, 10); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(attained, []float64{5, 0, 0, 0}); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(exceeded, []float64{0, 5, 0, 0}); err != nil {
+		t.Error(err)
+	}
+
+	// With a different halflife, size weighting and MaxBlockConfirms
+	cfg = Config{MaxBlockConfirms: 1, Halflife: 1, WeightBySize: true, RetainOutcomes: 100}
+	if p, err = NewPredictor(db, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if n, err = p.RecomputeScores(); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(n, 5); err != nil {
+		t.Error(err)
+	}
+	attained, exceeded, _ = p.GetScores()
+	// Heights 4, 5, 6, 7, 9 each attained 100; decay by half per block.
+	if err := testutil.CheckPctDiff(attained[0], 100+100./4+100./8+100./16+100./32, 1e-9); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(exceeded, []float64{0}); err != nil {
+		t.Error(err)
+	}
+
+	// Retention needs an OutcomeDB
+	if _, err := NewPredictor(struct{ DB }{db}, cfg); err == nil {
+		t.Error("RetainOutcomes without an OutcomeDB should return an error")
+	}
+}
+
+// heightBlock is a block with the given height, hash and txids.
+type heightBlock struct {
+	testBlock
+	height int64
+	hash   string
+	txids  []string
+}
+
+func (b *heightBlock) Hash() string {
+	return b.hash
+}
+
+func (b *heightBlock) Height() int64 {
+	return b.height
+}
+
+func (b *heightBlock) Txids() []string {
+	return b.txids
+}
+
 type testBlock struct {
 	i int
 }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// Timer quantiles in the Prometheus summaries
+var prometheusQuantiles = []float64{0.5, 0.75, 0.95, 0.99}
+
+var prometheusInvalidChars = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+// prometheusName returns the Prometheus metric name of a go-metrics name.
+func prometheusName(name string) string {
+	return "feesim_" + prometheusInvalidChars.ReplaceAllString(name, "_")
+}
+
+// prometheusHandler serves the metrics in the Prometheus text exposition
+// format: the go-metrics of r, and the app gauges.
+func (s *Service) prometheusHandler(r metrics.Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writePrometheus(w, r)
+		s.writePrometheusGauges(w)
+	})
+}
+
+// writePrometheus writes the metrics of r in the Prometheus text exposition
+// format. Timers (in nanoseconds) are written as summaries in seconds.
+func writePrometheus(w io.Writer, r metrics.Registry) {
+	all := make(map[string]interface{})
+	r.Each(func(name string, m interface{}) {
+		all[name] = m
+	})
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		pname := prometheusName(name)
+		switch m := all[name].(type) {
+		case metrics.Counter:
+			fmt.Fprintf(w, "# TYPE %s counter\n", pname)
+			fmt.Fprintf(w, "%s %d\n", pname, m.Count())
+		case metrics.Gauge:
+			fmt.Fprintf(w, "# TYPE %s gauge\n", pname)
+			fmt.Fprintf(w, "%s %d\n", pname, m.Value())
+		case metrics.GaugeFloat64:
+			fmt.Fprintf(w, "# TYPE %s gauge\n", pname)
+			fmt.Fprintf(w, "%s %s\n", pname, formatPrometheus(m.Value()))
+		case metrics.Meter:
+			fmt.Fprintf(w, "# TYPE %s_total counter\n", pname)
+			fmt.Fprintf(w, "%s_total %d\n", pname, m.Count())
+		case metrics.Histogram:
+			h := m.Snapshot()
+			fmt.Fprintf(w, "# TYPE %s summary\n", pname)
+			for i, p := range h.Percentiles(prometheusQuantiles) {
+				fmt.Fprintf(w, "%s{quantile=\"%g\"} %s\n", pname, prometheusQuantiles[i], formatPrometheus(p))
+			}
+			fmt.Fprintf(w, "%s_sum %d\n", pname, h.Sum())
+			fmt.Fprintf(w, "%s_count %d\n", pname, h.Count())
+		case metrics.Timer:
+			t := m.Snapshot()
+			pname += "_seconds"
+			fmt.Fprintf(w, "# TYPE %s summary\n", pname)
+			for i, p := range t.Percentiles(prometheusQuantiles) {
+				fmt.Fprintf(w, "%s{quantile=\"%g\"} %s\n", pname, prometheusQuantiles[i], formatPrometheus(p/1e9))
+			}
+			fmt.Fprintf(w, "%s_sum %s\n", pname, formatPrometheus(float64(t.Sum())/1e9))
+			fmt.Fprintf(w, "%s_count %d\n", pname, t.Count())
+		}
+	}
+}
+
+// writePrometheusGauges writes the app gauges for alerting: the 1 block fee
+// estimate (BTC/kB) and the mempool tx count. They're omitted while not
+// available.
+func (s *Service) writePrometheusGauges(w io.Writer) {
+	if result, _, err := s.FeeSim.EstimateResult(); err == nil && len(result) > 0 && result[0] != -1 {
+		fmt.Fprintln(w, "# HELP feesim_estimatefee Fee rate estimate (BTC/kB) for confirmation in 1 block.")
+		fmt.Fprintln(w, "# TYPE feesim_estimatefee gauge")
+		fmt.Fprintf(w, "feesim_estimatefee{target=\"1\"} %s\n", formatPrometheus(toBTC(result)[0]))
+	}
+	if state := s.FeeSim.State(); state != nil {
+		fmt.Fprintln(w, "# HELP feesim_mempool_txs Number of txs in the mempool.")
+		fmt.Fprintln(w, "# TYPE feesim_mempool_txs gauge")
+		fmt.Fprintf(w, "feesim_mempool_txs %d\n", len(state.Entries))
+	}
+}
+
+func formatPrometheus(x float64) string {
+	return strconv.FormatFloat(x, 'g', -1, 64)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+
+	col "github.com/bitcoinfees/feesim/collect"
+	"github.com/bitcoinfees/feesim/sim"
+	"github.com/bitcoinfees/feesim/testutil"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	r := metrics.NewRegistry()
+	timer := metrics.NewTimer()
+	timer.Update(2 * time.Second)
+	timer.Update(4 * time.Second)
+	r.Register("sim1", timer)
+	counter := metrics.NewCounter()
+	counter.Inc(3)
+	r.Register("sim1-total", counter)
+	gauge := metrics.NewGauge()
+	gauge.Update(7)
+	r.Register("gauge", gauge)
+
+	var b bytes.Buffer
+	writePrometheus(&b, r)
+	ref := `# TYPE feesim_gauge gauge
+feesim_gauge 7
+# TYPE feesim_sim1_seconds summary
+feesim_sim1_seconds{quantile="0.5"} 3
+feesim_sim1_seconds{quantile="0.75"} 4
+feesim_sim1_seconds{quantile="0.95"} 4
+feesim_sim1_seconds{quantile="0.99"} 4
+feesim_sim1_seconds_sum 6
+feesim_sim1_seconds_count 2
+# TYPE feesim_sim1_total counter
+feesim_sim1_total 3
+`
+	if err := testutil.CheckEqual(b.String(), ref); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPrometheusHandler(t *testing.T) {
+	getState := func() (*col.MempoolState, error) {
+		return &col.MempoolState{Entries: map[string]col.MempoolEntry{"a": nil, "b": nil}}, nil
+	}
+	c := col.NewCollector(nil, nil, col.Config{PollPeriod: 3600, GetState: getState})
+	if err := c.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	s := &Service{FeeSim: &FeeSim{collect: c}}
+	s.FeeSim.SetResult([]sim.FeeRate{20000, 10000}, nil)
+
+	// Disabled by default
+	srv := httptest.NewServer(s.handler())
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	srv.Close()
+	if err := testutil.CheckEqual(resp.StatusCode, http.StatusNotFound); err != nil {
+		t.Error(err)
+	}
+
+	s.Cfg.AppRPC.MetricsPath = "/metrics"
+	srv = httptest.NewServer(s.handler())
+	defer srv.Close()
+	resp, err = http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(resp.StatusCode, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Error("Content-Type should be text/plain, was", ct)
+	}
+	for _, line := range []string{
+		"feesim_estimatefee{target=\"1\"} 0.0002\n",
+		"feesim_mempool_txs 2\n",
+	} {
+		if !strings.Contains(string(body), line) {
+			t.Errorf("metrics should contain %q, got:\n%s", line, body)
+		}
+	}
+}
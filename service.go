@@ -1,50 +1,152 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net"
 	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/rpc"
 	jsonrpc "github.com/gorilla/rpc/json"
 	"github.com/rcrowley/go-metrics"
 
 	col "github.com/bitcoinfees/feesim/collect"
+	est "github.com/bitcoinfees/feesim/estimate"
+	"github.com/bitcoinfees/feesim/predict"
 	"github.com/bitcoinfees/feesim/sim"
 )
 
+// How long to wait for active requests to complete when shutting down.
+const serviceShutdownTimeout = 5 * time.Second
+
 type Service struct {
 	FeeSim *FeeSim
 	DLog   *DebugLog
 	Cfg    config
+
+	server *http.Server
+	mux    sync.Mutex
 }
 
-func (s *Service) ListenAndServe() error {
-	var methods = map[string]string{
-		"stop":          "Service.Stop",
-		"status":        "Service.Status",
-		"estimatefee":   "Service.EstimateFee",
-		"predictscores": "Service.PredictScores",
-		"txrate":        "Service.TxRate",
-		"caprate":       "Service.CapRate",
-		"mempoolsize":   "Service.MempoolSize",
-		"pause":         "Service.Pause",
-		"unpause":       "Service.Unpause",
-		"setdebug":      "Service.SetDebug",
-		"config":        "Service.Config",
-		"metrics":       "Service.Metrics",
-		"blocksource":   "Service.BlockSource",
-		"txsource":      "Service.TxSource",
-		"mempoolstate":  "Service.MempoolState",
-	}
+// rpcMethod is a Service method, and its description (see Service.Methods).
+type rpcMethod struct {
+	name string
+	desc string
+}
+
+// rpcMethods maps the RPC method names to the Service methods.
+var rpcMethods = map[string]rpcMethod{
+	"stop":                {"Service.Stop", "Stop Feesim."},
+	"status":              {"Service.Status", "Show the app status."},
+	"estimatefee":         {"Service.EstimateFee", "Fee rate estimate (BTC/kB) for confirmation in N blocks (all if N is 0)."},
+	"predictscores":       {"Service.PredictScores", "Show the prediction scores."},
+	"predictscoresbyfee":  {"Service.PredictScoresByFeeRate", "Show the prediction scores by conf target and fee rate bucket."},
+	"txrate":              {"Service.TxRate", "Tx byterate as a function of fee rate, with at most args points (0 means all)."},
+	"txratehistory":       {"Service.TxRateHistory", "Snapshots of the tx byterate function within a time range."},
+	"capratehistory":      {"Service.CapRateHistory", "Snapshots of the capacity byterate function within a time range."},
+	"caprate":             {"Service.CapRate", "Capacity byterate as a function of fee rate, with at most args points (0 means all)."},
+	"mempoolsize":         {"Service.MempoolSize", "Mempool size as a function of fee rate, with at most args points (0 means all)."},
+	"pause":               {"Service.Pause", "Pause the sim."},
+	"unpause":             {"Service.Unpause", "Resume the sim after pausing."},
+	"setdebug":            {"Service.SetDebug", "Turn on/off debug-level logging."},
+	"config":              {"Service.Config", "Show the app config settings."},
+	"metrics":             {"Service.Metrics", "Show the app metrics."},
+	"blocksource":         {"Service.BlockSource", "Show the estimated block source."},
+	"txsource":            {"Service.TxSource", "Show the estimated tx source."},
+	"mempoolstate":        {"Service.MempoolState", "Show the current mempool state."},
+	"summary":             {"Service.Summary", "Show a summary of the fee market."},
+	"variates":            {"Service.Variates", "Show the conf time variates of the last sim run (requires keepvariates)."},
+	"nextblockprob":       {"Service.NextBlockProb", "Probability of confirmation in the next block at a fee rate."},
+	"utilization":         {"Service.Utilization", "Ratio of tx byterate to capacity byterate at the fee rates in args."},
+	"collectorerrors":     {"Service.CollectorErrors", "Show the most recent collector errors."},
+	"blockrate":           {"Service.BlockRate", "Show the estimated block rate (blocks/hour)."},
+	"estimatefeescenario": {"Service.EstimateFeeScenario", "Fee rate estimates with an overridden max block size."},
+	"estimatefeeinfo":     {"Service.EstimateFeeInfo", "Fee rate estimates, with the last and next update times."},
+	"conftimeseconds":     {"Service.ConfTimeSeconds", "Estimated time to confirmation in seconds at a fee rate."},
+	"estimatefeemode":     {"Service.EstimateFeeMode", "Fee rate estimates of an estimate mode."},
+	"estimatefeeclamped":  {"Service.EstimateFeeClamped", "Fee rate estimate for the target, clamped to the max available target."},
+	"estimatefeebounds":   {"Service.EstimateFeeBounds", "Fee rate estimates (BTC/kB) with their 95% confidence bounds (requires withconfidence)."},
+	"estimatefeedefault":  {"Service.EstimateFeeDefault", "Fee rate estimate for the default target (estimate.defaulttarget)."},
+	"estimatefeepcts":     {"Service.EstimateFeePercentiles", "Fee rate estimates (BTC/kB) at each of the given success percentiles."},
+	"txsourcedebug":       {"Service.TxSourceDebug", "Show the tx source estimator's internal state."},
+	"tune":                {"Service.Tune", "Recommend a transient.numiters setting."},
+	"trim":                {"Service.Trim", "Delete the block stats / txs before a height / time, compacting the DBs."},
+	"simfloors":           {"Service.SimFloors", "Show the fee rate floors of the last sim, below which there are no estimates."},
+	"stablefee":           {"Service.StableFee", "Stable fee rate (BTC/kB) of the tx and block sources, below which txs never clear."},
+	"latestblockstat":     {"Service.LatestBlockStat", "Show the stats (SFR, mempool sizes etc.) of the latest block."},
+	"methods":             {"Service.Methods", "List the RPC methods, with their descriptions and arg / reply shapes."},
+}
+
+// handler returns the HTTP handler of the RPC API, and the dashboard.
+func (s *Service) handler() http.Handler {
 	srv := rpc.NewServer()
 	srv.RegisterCodec(jsonrpc.NewCodec(), "application/json")
 	srv.RegisterService(s, "")
-	srv.RegisterCustomNames(methods)
-	http.Handle("/", srv)
+	names := make(map[string]string)
+	for method, m := range rpcMethods {
+		names[method] = m.name
+	}
+	srv.RegisterCustomNames(names)
+	mux := http.NewServeMux()
+	mux.Handle("/", withDashboard(srv))
+	if path := s.Cfg.AppRPC.MetricsPath; path != "" {
+		mux.Handle(path, s.prometheusHandler(metrics.DefaultRegistry))
+	}
+	return mux
+}
+
+func (s *Service) ListenAndServe() error {
 	addr := net.JoinHostPort(s.Cfg.AppRPC.Host, s.Cfg.AppRPC.Port)
-	s.DLog.Logger.Println("RPC server listening on", addr)
-	return http.ListenAndServe(addr, nil)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: s.handler()}
+	s.mux.Lock()
+	s.server = server
+	s.mux.Unlock()
+
+	// Shut down the server when the sim stops.
+	served := make(chan struct{})
+	defer close(served)
+	go func() {
+		select {
+		case <-s.FeeSim.Done():
+			ctx, cancel := context.WithTimeout(context.Background(), serviceShutdownTimeout)
+			defer cancel()
+			if err := s.Shutdown(ctx); err != nil {
+				s.DLog.Logger.Println("[ERROR] RPC server shutdown:", err)
+			}
+		case <-served:
+		}
+	}()
+
+	s.DLog.Logger.Println("RPC server listening on", ln.Addr())
+	if err := server.Serve(ln); err != http.ErrServerClosed {
+		return err
+	}
+	s.DLog.Logger.Println("RPC server stopped.")
+	return nil
+}
+
+// Shutdown gracefully shuts down the RPC server, causing ListenAndServe to
+// return. It's also done automatically when the sim stops.
+func (s *Service) Shutdown(ctx context.Context) error {
+	s.mux.Lock()
+	server := s.server
+	s.mux.Unlock()
+	if server == nil {
+		return nil
+	}
+	return server.Shutdown(ctx)
 }
 
 func (s *Service) Stop(r *http.Request, args *struct{}, reply *struct{}) error {
@@ -57,9 +159,24 @@ func (s *Service) Status(r *http.Request, args *struct{}, reply *map[string]stri
 	return nil
 }
 
+// TargetError is returned if the requested conf target exceeds the max
+// available target, i.e. transient.maxblockconfirms.
+type TargetError struct {
+	Target    int
+	MaxTarget int
+}
+
+func (err TargetError) Error() string {
+	return fmt.Sprintf("target %d exceeds the max available target %d "+
+		"(MaxBlockConfirms); use estimatefeeclamped for the best available result",
+		err.Target, err.MaxTarget)
+}
+
 // NOTE: There's no fail-safe max value, take care.
+// With StaleResults set, the result may be stale (see FeeSim.EstimateResult);
+// use EstimateFeeInfo to check.
 func (s *Service) EstimateFee(r *http.Request, args *int, reply *interface{}) error {
-	result, err := s.FeeSim.Result()
+	result, _, err := s.FeeSim.EstimateResult()
 	if err != nil {
 		return err
 	}
@@ -68,19 +185,10 @@ func (s *Service) EstimateFee(r *http.Request, args *int, reply *interface{}) er
 		return fmt.Errorf("argument must be >= 0")
 	}
 	if *args > len(result) {
-		return fmt.Errorf("MaxBlockConfirms=%d exceeded", len(result))
-	}
-
-	// Convert from satoshis to BTC, to conform to Bitcoin Core's estimatefee API
-	resultBTC := make([]float64, len(result))
-	for i, satoshis := range result {
-		if satoshis == -1 {
-			resultBTC[i] = -1
-		} else {
-			resultBTC[i] = float64(satoshis) / coin
-		}
+		return TargetError{Target: *args, MaxTarget: len(result)}
 	}
 
+	resultBTC := toBTC(result)
 	if *args == 0 {
 		*reply = resultBTC
 	} else {
@@ -89,6 +197,421 @@ func (s *Service) EstimateFee(r *http.Request, args *int, reply *interface{}) er
 	return nil
 }
 
+// ClampedEstimate is the reply of Service.EstimateFeeClamped.
+type ClampedEstimate struct {
+	FeeRate float64 `json:"feerate"` // BTC/kB
+	Target  int     `json:"target"`  // The target of FeeRate
+
+	// Whether the requested target exceeded the max available target, so
+	// that Target is the max available target instead.
+	Clamped bool `json:"clamped"`
+
+	// Whether this is the last result of a paused / in progress sim (see
+	// FeeSim.EstimateResult).
+	Stale bool `json:"stale"`
+}
+
+// EstimateFeeClamped is like EstimateFee with N == *args > 0, except that if
+// N exceeds the max available target, the estimate for the max available
+// target is returned, with Clamped set.
+func (s *Service) EstimateFeeClamped(r *http.Request, args *int, reply *ClampedEstimate) error {
+	result, stale, err := s.FeeSim.EstimateResult()
+	if err != nil {
+		return err
+	}
+	if *args < 1 {
+		return fmt.Errorf("argument must be >= 1")
+	}
+	if len(result) == 0 {
+		return errors.New("no targets available")
+	}
+	target, clamped := *args, false
+	if target > len(result) {
+		target, clamped = len(result), true
+	}
+	*reply = ClampedEstimate{
+		FeeRate: toBTC(result)[target-1],
+		Target:  target,
+		Clamped: clamped,
+		Stale:   stale,
+	}
+	return nil
+}
+
+// DefaultEstimate is the reply of Service.EstimateFeeDefault.
+type DefaultEstimate struct {
+	FeeRate float64 `json:"feerate"` // BTC/kB
+	Target  int     `json:"target"`  // The default target
+	Stale   bool    `json:"stale"`   // See EstimateFeeInfo
+}
+
+// EstimateFeeDefault is like EstimateFee, for the default target
+// (estimate.defaulttarget in the config). It returns an error if there's no
+// default target.
+func (s *Service) EstimateFeeDefault(r *http.Request, args *struct{}, reply *DefaultEstimate) error {
+	target := s.Cfg.Estimate.DefaultTarget
+	if target <= 0 {
+		return errors.New("no default target; set estimate.defaulttarget in the config")
+	}
+	result, stale, err := s.FeeSim.EstimateResult()
+	if err != nil {
+		return err
+	}
+	if target > len(result) {
+		return TargetError{Target: target, MaxTarget: len(result)}
+	}
+	*reply = DefaultEstimate{
+		FeeRate: toBTC(result)[target-1],
+		Target:  target,
+		Stale:   stale,
+	}
+	return nil
+}
+
+// EstimateFeeInfo is the reply of Service.EstimateFeeInfo.
+type EstimateFeeInfo struct {
+	FeeRates []float64 `json:"feerates"`
+	// Unix time of the last result
+	LastUpdate int64 `json:"lastupdate"`
+	// Seconds between sim runs (SimPeriod); the result doesn't change more
+	// often than this, so there's no point polling faster.
+	RefreshInterval int `json:"refreshinterval"`
+	// Estimated Unix time of the next result
+	NextUpdate int64 `json:"nextupdate"`
+	// Whether this is the last result of a paused / in progress sim (see
+	// FeeSim.EstimateResult).
+	Stale bool `json:"stale"`
+	// Whether the block source is estimated from too few blocks for the usual
+	// coverage requirement (see est.IndBlockSourceConfig.MinBlocks).
+	LowConfidence bool `json:"lowconfidence"`
+}
+
+// EstimateFeeInfo is like EstimateFee (with N == 0), but also reports when
+// the result was last updated, and how often it is refreshed.
+func (s *Service) EstimateFeeInfo(r *http.Request, args *struct{}, reply *EstimateFeeInfo) error {
+	result, stale, err := s.FeeSim.EstimateResult()
+	if err != nil {
+		return err
+	}
+	lastUpdate := s.FeeSim.ResultTime()
+	period := s.FeeSim.SimPeriod()
+	*reply = EstimateFeeInfo{
+		FeeRates:        toBTC(result),
+		LastUpdate:      lastUpdate,
+		RefreshInterval: period,
+		NextUpdate:      lastUpdate + int64(period),
+		Stale:           stale,
+		LowConfidence:   s.FeeSim.BlockSourceLowConfidence(),
+	}
+	return nil
+}
+
+// EstimateFeeBounds is the reply of Service.EstimateFeeBounds. All fee rates
+// are in BTC/kB; an Upper of -1 means that the bound is unbounded.
+type EstimateFeeBounds struct {
+	FeeRates []float64 `json:"feerates"`
+	Lower    []float64 `json:"lower"`
+	Upper    []float64 `json:"upper"`
+}
+
+// EstimateFeeBounds is like EstimateFee (with N == 0), but also returns the
+// 95% confidence bounds of each target's fee rate, if transient.withconfidence
+// is set.
+func (s *Service) EstimateFeeBounds(r *http.Request, args *struct{}, reply *EstimateFeeBounds) error {
+	result, err := s.FeeSim.EstimateBounds()
+	if err != nil {
+		return err
+	}
+	*reply = EstimateFeeBounds{
+		FeeRates: toBTC(result.FeeRates),
+		Lower:    toBTC(result.Lower),
+		Upper:    toBTC(result.Upper),
+	}
+	return nil
+}
+
+// EstimateFeePercentiles is the reply of Service.EstimateFeePercentiles.
+// FeeRates[k] are the fee rates (BTC/kB) at success pct Percentiles[k], for
+// all targets, or only for target N if N > 0.
+type EstimateFeePercentiles struct {
+	Percentiles []float64   `json:"percentiles"`
+	FeeRates    [][]float64 `json:"feerates"`
+}
+
+// EstimateFeePercentiles is like EstimateFee, but for each of the success pcts
+// args.Percentiles instead of transient.minsuccesspct (see
+// FeeSim.EstimatePercentiles).
+func (s *Service) EstimateFeePercentiles(r *http.Request, args *struct {
+	N           int
+	Percentiles []float64
+}, reply *EstimateFeePercentiles) error {
+	if args.N < 0 {
+		return fmt.Errorf("argument must be >= 0")
+	}
+	if len(args.Percentiles) == 0 {
+		return errors.New("no percentiles")
+	}
+	result, err := s.FeeSim.EstimatePercentiles(args.Percentiles)
+	if err != nil {
+		return err
+	}
+	feerates := make([][]float64, len(result))
+	for k, fk := range result {
+		if args.N > len(fk) {
+			return TargetError{Target: args.N, MaxTarget: len(fk)}
+		}
+		if args.N > 0 {
+			fk = fk[args.N-1 : args.N]
+		}
+		feerates[k] = toBTC(fk)
+	}
+	*reply = EstimateFeePercentiles{Percentiles: args.Percentiles, FeeRates: feerates}
+	return nil
+}
+
+// EstimateFeeScenario is like EstimateFee (with N == 0), but with the max
+// block size overridden with args.MaxBlockSize (bytes). It runs a sim on
+// demand, so it may take a while; it's stopped if the request is canceled.
+func (s *Service) EstimateFeeScenario(r *http.Request, args *struct{ MaxBlockSize int64 }, reply *[]float64) error {
+	result, err := s.FeeSim.EstimateScenario(sim.TxSize(args.MaxBlockSize), requestDone(r))
+	if err != nil {
+		return err
+	}
+	*reply = toBTC(result)
+	return nil
+}
+
+// EstimateFeeMode is like EstimateFee (with N == 0), for the estimate mode
+// args.Mode: "economical", "default" or "conservative". The non-default modes
+// run a sim on demand, so they may take a while; it's stopped if the request
+// is canceled.
+func (s *Service) EstimateFeeMode(r *http.Request, args *struct{ Mode string }, reply *[]float64) error {
+	result, err := s.FeeSim.EstimateMode(args.Mode, requestDone(r))
+	if err != nil {
+		return err
+	}
+	*reply = toBTC(result)
+	return nil
+}
+
+// TuneResult is the reply of Service.Tune.
+type TuneResult struct {
+	Levels      []sim.TuneLevel `json:"levels"`
+	Recommended int             `json:"recommended"` // 0 if none was stable enough
+	Current     int             `json:"current"`     // The configured NumIters
+}
+
+// Tune runs the transient sim repeatedly on the current mempool, with
+// increasing NumIters up to args.MaxIters, to recommend the smallest NumIters
+// whose estimates vary across args.Runs runs by at most args.Tol (relative
+// std dev). See FeeSim.TuneNumIters.
+func (s *Service) Tune(r *http.Request, args *struct {
+	MaxIters, Runs int
+	Tol            float64
+}, reply *TuneResult) error {
+	levels, n, err := s.FeeSim.TuneNumIters(args.MaxIters, args.Runs, args.Tol, requestDone(r))
+	if err != nil {
+		return err
+	}
+	*reply = TuneResult{Levels: levels, Recommended: n, Current: s.FeeSim.NumIters()}
+	return nil
+}
+
+// requestDone returns the channel closed when r is canceled, e.g. if the
+// client disconnects, or nil if r is nil.
+func requestDone(r *http.Request) <-chan struct{} {
+	if r == nil {
+		return nil
+	}
+	return r.Context().Done()
+}
+
+// Trim deletes the block stats of heights before args.BlockStatsBefore, and
+// the txs with times before args.TxsBefore (either is skipped if 0), and
+// replies with the number of records removed. See FeeSim.Trim.
+func (s *Service) Trim(r *http.Request, args *struct {
+	BlockStatsBefore, TxsBefore int64
+	Force                       bool
+}, reply *TrimResult) error {
+	result, err := s.FeeSim.Trim(args.BlockStatsBefore, args.TxsBefore, args.Force)
+	if err != nil {
+		return err
+	}
+	*reply = result
+	return nil
+}
+
+// Summary returns the most useful fee market signals in one call. Signals
+// which are not currently available are omitted; see the "status" field for
+// the reason.
+func (s *Service) Summary(r *http.Request, args *struct{}, reply *map[string]interface{}) error {
+	summary := make(map[string]interface{})
+	summary["status"] = s.FeeSim.Status()
+
+	if result, err := s.FeeSim.Result(); err == nil {
+		summary["estimatefee"] = toBTC(result)
+	}
+	if state := s.FeeSim.State(); state != nil {
+		summary["mempoolsize"] = s.FeeSim.SizeFn(state).Eval(0)
+		summary["minfeerate"] = state.MinFeeRate
+	}
+	if txsource, err := s.FeeSim.TxSource(); err == nil {
+		summary["txrate"] = txsource.RateFn().Eval(0)
+	}
+	if blocksource, err := s.FeeSim.BlockSource(); err == nil {
+		summary["caprate"] = blocksource.RateFn().Eval(math.MaxFloat64)
+	}
+	if stableFee, err := s.FeeSim.StableFee(); err == nil {
+		summary["stablefee"] = stableFee
+	}
+	if attained, exceeded, err := s.FeeSim.PredictScores(); err == nil {
+		summary["predictscores"] = map[string][]float64{
+			"attained": attained,
+			"exceeded": exceeded,
+		}
+	}
+
+	*reply = summary
+	return nil
+}
+
+// Variates returns the raw conf time variates of the last sim run, for
+// offline analysis. It's a debug feature, gated by transient.keepvariates.
+func (s *Service) Variates(r *http.Request, args *struct{}, reply *[]sim.TransientVariate) error {
+	v, err := s.FeeSim.Variates()
+	if err != nil {
+		return err
+	}
+	*reply = v
+	return nil
+}
+
+// NextBlockProb returns the estimated probability that a tx with fee rate
+// args.FeeRate (satoshis/kB) is confirmed in the next block.
+func (s *Service) NextBlockProb(r *http.Request, args *struct{ FeeRate int64 }, reply *float64) error {
+	p, err := s.FeeSim.NextBlockProb()
+	if err != nil {
+		return err
+	}
+	feerate := sim.FeeRate(args.FeeRate)
+	if feerate < p.Lowest() {
+		return fmt.Errorf("fee rate must be >= lowest simulated fee rate %d", p.Lowest())
+	}
+	*reply = p.Eval(feerate)
+	return nil
+}
+
+// ConfTimeSeconds is the reply of Service.ConfTimeSeconds. The times are -1 if
+// the probability of confirmation within transient.maxblockconfirms is too
+// low.
+type ConfTimeSeconds struct {
+	Median     float64 `json:"median"`
+	Percentile float64 `json:"percentile"` // At transient.minsuccesspct
+	SuccessPct float64 `json:"successpct"`
+}
+
+// ConfTimeSeconds returns the estimated time in seconds for a tx with fee rate
+// args.FeeRate (satoshis/kB) to be confirmed, combining the sim's conf time
+// distribution (in blocks) with the block source's block rate.
+func (s *Service) ConfTimeSeconds(r *http.Request, args *struct{ FeeRate int64 }, reply *ConfTimeSeconds) error {
+	d, err := s.FeeSim.ConfTimeDist()
+	if err != nil {
+		return err
+	}
+	blocksource, err := s.FeeSim.BlockSource()
+	if err != nil {
+		return err
+	}
+	feerate := sim.FeeRate(args.FeeRate)
+	if feerate < d.Lowest() {
+		return fmt.Errorf("fee rate must be >= lowest simulated fee rate %d", d.Lowest())
+	}
+	blockrate, pct := blocksource.BlockRate(), s.FeeSim.Transient().MinSuccessPct
+	*reply = ConfTimeSeconds{
+		Median:     d.TimePercentile(feerate, 0.5, blockrate),
+		Percentile: d.TimePercentile(feerate, pct, blockrate),
+		SuccessPct: pct,
+	}
+	return nil
+}
+
+type utilizationTier struct {
+	FeeRate     sim.FeeRate `json:"feerate"`
+	Utilization float64     `json:"utilization"`
+}
+
+// Utilization returns the ratio of the tx byterate to the capacity byterate at
+// the mempool min fee rate, and at each of the fee rates (satoshis/kB) in
+// args. A ratio approaching 1 means that fees are about to spike.
+func (s *Service) Utilization(r *http.Request, args *[]int64, reply *map[string]interface{}) error {
+	txsource, err := s.FeeSim.TxSource()
+	if err != nil {
+		return err
+	}
+	blocksource, err := s.FeeSim.BlockSource()
+	if err != nil {
+		return err
+	}
+	state := s.FeeSim.State()
+	if state == nil {
+		return fmt.Errorf("mempool not available")
+	}
+	txratefn, capratefn := txsource.RateFn(), blocksource.RateFn()
+
+	tiers := make([]utilizationTier, len(*args))
+	for i, feerate := range *args {
+		tiers[i] = utilizationTier{
+			FeeRate:     sim.FeeRate(feerate),
+			Utilization: calcUtilization(txratefn, capratefn, sim.FeeRate(feerate)),
+		}
+	}
+	*reply = map[string]interface{}{
+		"minfeerate":  state.MinFeeRate,
+		"utilization": calcUtilization(txratefn, capratefn, state.MinFeeRate),
+		"tiers":       tiers,
+	}
+	return nil
+}
+
+// calcUtilization returns the ratio of the byterate of txs with fee rate >=
+// feerate, to the capacity byterate available to them. Returns -1 if there is
+// no capacity at feerate.
+func calcUtilization(txratefn, capratefn sim.MonotonicFn, feerate sim.FeeRate) float64 {
+	capacity := capratefn.Eval(float64(feerate))
+	if capacity <= 0 {
+		return -1
+	}
+	return txratefn.Eval(float64(feerate)) / capacity
+}
+
+// CollectorErrors returns the most recent collector errors, e.g. for
+// diagnosing intermittent Bitcoin Core connectivity.
+func (s *Service) CollectorErrors(r *http.Request, args *struct{}, reply *[]col.CollectorError) error {
+	*reply = s.FeeSim.CollectorErrors()
+	return nil
+}
+
+// BlockRate returns the block source's estimated block rate, in blocks/hour.
+func (s *Service) BlockRate(r *http.Request, args *struct{}, reply *float64) error {
+	blocksource, err := s.FeeSim.BlockSource()
+	if err != nil {
+		return err
+	}
+	*reply = blocksource.BlockRate() * 3600
+	return nil
+}
+
+// TxSourceDebug returns the tx source estimator's internal state, e.g. to
+// diagnose a TxWindowError.
+func (s *Service) TxSourceDebug(r *http.Request, args *struct{}, reply *est.UniTxSourceState) error {
+	state, err := s.FeeSim.TxSourceState()
+	if err != nil {
+		return err
+	}
+	*reply = state
+	return nil
+}
+
 func (s *Service) PredictScores(r *http.Request, args *struct{}, reply *map[string][]float64) error {
 	attained, exceeded, err := s.FeeSim.PredictScores()
 	if err != nil {
@@ -101,10 +624,88 @@ func (s *Service) PredictScores(r *http.Request, args *struct{}, reply *map[stri
 	return nil
 }
 
+// FeeRateScores is the reply of Service.PredictScoresByFeeRate.
+type FeeRateScores struct {
+	FeeRates []int64     `json:"feerates"` // Bucket lower bounds (satoshis/kB)
+	Attained [][]float64 `json:"attained"` // Indexed by [target-1][bucket]
+	Exceeded [][]float64 `json:"exceeded"`
+}
+
+// PredictScoresByFeeRate returns the prediction scores broken down by fee
+// rate bucket as well as by the predicted confirmation time.
+func (s *Service) PredictScoresByFeeRate(r *http.Request, args *struct{}, reply *FeeRateScores) error {
+	attained, exceeded, err := s.FeeSim.PredictScoresByFeeRate()
+	if err != nil {
+		return err
+	}
+	*reply = FeeRateScores{
+		FeeRates: predict.FeeRateBuckets,
+		Attained: attained,
+		Exceeded: exceeded,
+	}
+	return nil
+}
+
+// RateHistoryArgs are the args of TxRateHistory and CapRateHistory: the Unix
+// time range [Start, End] of the snapshots. If End is 0, there's no upper
+// bound.
+type RateHistoryArgs struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// RateHistory is a rate history snapshot of a byte rate function (see
+// est.RatePoints).
+type RateHistory struct {
+	Time int64     `json:"time"`
+	X    []float64 `json:"x"`
+	Y    []float64 `json:"y"`
+}
+
+// TxRateHistory returns the snapshots of the tx byte rate function in the
+// time range.
+func (s *Service) TxRateHistory(r *http.Request, args *RateHistoryArgs, reply *[]RateHistory) error {
+	return s.rateHistory(args, reply, func(snapshot est.RateSnapshot) est.RatePoints {
+		return snapshot.TxRate
+	})
+}
+
+// CapRateHistory returns the snapshots of the capacity byte rate function in
+// the time range.
+func (s *Service) CapRateHistory(r *http.Request, args *RateHistoryArgs, reply *[]RateHistory) error {
+	return s.rateHistory(args, reply, func(snapshot est.RateSnapshot) est.RatePoints {
+		return snapshot.CapRate
+	})
+}
+
+func (s *Service) rateHistory(args *RateHistoryArgs, reply *[]RateHistory, fn func(est.RateSnapshot) est.RatePoints) error {
+	end := args.End
+	if end == 0 {
+		end = math.MaxInt64
+	}
+	if args.Start < 0 || end < args.Start {
+		return fmt.Errorf("invalid time range [%d, %d]", args.Start, args.End)
+	}
+	snapshots, err := s.FeeSim.RateHistory(args.Start, end)
+	if err != nil {
+		return err
+	}
+	history := make([]RateHistory, len(snapshots))
+	for i, snapshot := range snapshots {
+		p := fn(snapshot)
+		history[i] = RateHistory{Time: snapshot.Time, X: p.X, Y: p.Y}
+	}
+	*reply = history
+	return nil
+}
+
+// TxRate, CapRate and MempoolSize return an approximation of the respective
+// functions with at most args points. As with EstimateFee, 0 means all (the
+// distinct points), and a negative args is an error.
 func (s *Service) TxRate(r *http.Request, args *int, reply *sim.MonotonicFn) error {
 	n := *args
-	if n <= 0 {
-		n = 20
+	if n < 0 {
+		return fmt.Errorf("argument must be >= 0")
 	}
 	txsource, err := s.FeeSim.TxSource()
 	if err != nil {
@@ -116,8 +717,8 @@ func (s *Service) TxRate(r *http.Request, args *int, reply *sim.MonotonicFn) err
 
 func (s *Service) CapRate(r *http.Request, args *int, reply *sim.MonotonicFn) error {
 	n := *args
-	if n <= 0 {
-		n = 20
+	if n < 0 {
+		return fmt.Errorf("argument must be >= 0")
 	}
 	blocksource, err := s.FeeSim.BlockSource()
 	if err != nil {
@@ -129,14 +730,14 @@ func (s *Service) CapRate(r *http.Request, args *int, reply *sim.MonotonicFn) er
 
 func (s *Service) MempoolSize(r *http.Request, args *int, reply *sim.MonotonicFn) error {
 	n := *args
-	if n <= 0 {
-		n = 20
+	if n < 0 {
+		return fmt.Errorf("argument must be >= 0")
 	}
 	state := s.FeeSim.State()
 	if state == nil {
 		return fmt.Errorf("mempool not available")
 	}
-	*reply = state.SizeFn().Approx(n)
+	*reply = s.FeeSim.SizeFn(state).Approx(n)
 	return nil
 }
 
@@ -195,3 +796,139 @@ func (s *Service) MempoolState(r *http.Request, args *struct{}, reply **col.Memp
 	*reply = state
 	return nil
 }
+
+// SimFloors returns the fee rate floors (satoshis/kB) of the last sim, which
+// explain why no estimate below Floor is returned.
+func (s *Service) SimFloors(r *http.Request, args *struct{}, reply *SimFloors) error {
+	floors, err := s.FeeSim.SimFloors()
+	if err != nil {
+		return err
+	}
+	*reply = floors
+	return nil
+}
+
+// StableFee returns the stable fee rate (BTC/kB) of the current tx and block
+// sources, i.e. the "minimum fee to ever confirm": lower fee rate arrivals
+// exceed the spare capacity (see FeeSim.StableFee).
+func (s *Service) StableFee(r *http.Request, args *struct{}, reply *float64) error {
+	stableFee, err := s.FeeSim.StableFee()
+	if err != nil {
+		return err
+	}
+	*reply = satoshisToBTC(stableFee)
+	return nil
+}
+
+// LatestBlockStat returns the stat of the most recent block in the BlockStatDB,
+// as computed by the collector when the block was found.
+func (s *Service) LatestBlockStat(r *http.Request, args *struct{}, reply *est.BlockStat) error {
+	stat, err := s.FeeSim.LatestBlockStat()
+	if err != nil {
+		return err
+	}
+	*reply = *stat
+	return nil
+}
+
+// MethodInfo describes an RPC method; see Service.Methods.
+type MethodInfo struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Args        interface{} `json:"args"`
+	Reply       interface{} `json:"reply"`
+}
+
+// Methods lists the registered RPC methods, sorted by name, with their
+// descriptions and arg / reply shapes (see typeShape).
+func (s *Service) Methods(r *http.Request, args *struct{}, reply *[]MethodInfo) error {
+	t := reflect.TypeOf(s)
+	methods := make([]MethodInfo, 0, len(rpcMethods))
+	for name, m := range rpcMethods {
+		method, ok := t.MethodByName(strings.TrimPrefix(m.name, "Service."))
+		if !ok {
+			return fmt.Errorf("RPC method %s maps to nonexistent %s", name, m.name)
+		}
+		// Receiver, *http.Request, args, reply
+		methods = append(methods, MethodInfo{
+			Name:        name,
+			Description: m.desc,
+			Args:        typeShape(method.Type.In(2).Elem(), nil),
+			Reply:       typeShape(method.Type.In(3).Elem(), nil),
+		})
+	}
+	sort.Slice(methods, func(i, j int) bool { return methods[i].Name < methods[j].Name })
+	*reply = methods
+	return nil
+}
+
+var jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+
+// typeShape describes the JSON encoding of values of type t. Structs are
+// described by an object of their fields' shapes, slices and arrays by a
+// one-element array of the element shape, and maps by an object with the key
+// type as the only key. Other types are described by their name, e.g. "int";
+// interfaces are "any", since the shape depends on the dynamic type. Types
+// with custom JSON encodings, and recursive types, are described by their Go
+// type name. seen holds the struct types being described.
+func typeShape(t reflect.Type, seen map[reflect.Type]bool) interface{} {
+	if t.Implements(jsonMarshalerType) && t.Kind() != reflect.Interface {
+		return t.String()
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeShape(t.Elem(), seen)
+	case reflect.Interface:
+		return "any"
+	case reflect.Slice, reflect.Array:
+		return []interface{}{typeShape(t.Elem(), seen)}
+	case reflect.Map:
+		return map[string]interface{}{t.Key().String(): typeShape(t.Elem(), seen)}
+	case reflect.Struct:
+		if seen[t] {
+			return t.String()
+		}
+		if seen == nil {
+			seen = make(map[reflect.Type]bool)
+		}
+		seen[t] = true
+		defer delete(seen, t)
+		fields := make(map[string]interface{})
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue // Unexported
+			}
+			name := f.Name
+			if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+				continue
+			} else if tag != "" {
+				name = tag
+			}
+			fields[name] = typeShape(f.Type, seen)
+		}
+		return fields
+	default:
+		return t.String()
+	}
+}
+
+// toBTC converts a sim result from satoshis to BTC, to conform to Bitcoin
+// Core's estimatefee API.
+func toBTC(result []sim.FeeRate) []float64 {
+	resultBTC := make([]float64, len(result))
+	for i, satoshis := range result {
+		if satoshis == -1 {
+			resultBTC[i] = -1
+		} else {
+			resultBTC[i] = satoshisToBTC(satoshis)
+		}
+	}
+	return resultBTC
+}
+
+// satoshisToBTC converts satoshis to BTC. Since satoshis is an integer, the
+// result has satoshi precision, like Bitcoin Core's ValueFromAmount.
+func satoshisToBTC(satoshis sim.FeeRate) float64 {
+	return float64(satoshis) / coin
+}
@@ -0,0 +1,839 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitcoinfees/feesim/api"
+	col "github.com/bitcoinfees/feesim/collect"
+	est "github.com/bitcoinfees/feesim/estimate"
+	"github.com/bitcoinfees/feesim/predict"
+	"github.com/bitcoinfees/feesim/sim"
+	"github.com/bitcoinfees/feesim/testutil"
+)
+
+func TestToBTC(t *testing.T) {
+	result := []sim.FeeRate{4999, 1, 10000, 123456789, -1, 0, 5001, 2100000000000000}
+	ref := []string{"0.00004999", "0.00000001", "0.0001", "1.23456789", "-1", "0", "0.00005001", "21000000"}
+	resultBTC := toBTC(result)
+	for i, btc := range resultBTC {
+		if err := testutil.CheckEqual(strconv.FormatFloat(btc, 'f', -1, 64), ref[i]); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// The BTC values must convert back exactly to the input satoshis.
+	for satoshis := sim.FeeRate(0); satoshis < 100000; satoshis++ {
+		btc := toBTC([]sim.FeeRate{satoshis})[0]
+		if s := strconv.FormatFloat(btc, 'f', -1, 64); len(s) > len("0.00000000") {
+			t.Fatalf("%d: %s has more than 8 dp", satoshis, s)
+		}
+		if sim.FeeRate(math.Round(btc*coin)) != satoshis {
+			t.Fatalf("%d: %v does not convert back", satoshis, btc)
+		}
+	}
+}
+
+func TestCalcUtilization(t *testing.T) {
+	// Capacity: 833.33 bytes/s at >= 1000 sats/kB, 1666.67 bytes/s at >= 2000.
+	blocksource := sim.NewIndBlockSource([]sim.FeeRate{1000, 2000}, []sim.TxSize{1e6}, 1./600)
+	// Tx byterate: 250 bytes/s at each of 1500 and 3000 sats/kB.
+	txsource := sim.NewMultiTxSource(
+		[]sim.FeeRate{1500, 3000}, []sim.TxSize{500, 500}, []float64{1, 1}, 1)
+	txratefn, capratefn := txsource.RateFn(), blocksource.RateFn()
+
+	feerates := []sim.FeeRate{500, 1000, 1500, 2000, 3000, 3001}
+	ref := []float64{-1, 0.6, 0.6, 0.15, 0.15, 0}
+	for i, feerate := range feerates {
+		u := calcUtilization(txratefn, capratefn, feerate)
+		if err := testutil.CheckPctDiff(u, ref[i], 1e-9); err != nil {
+			t.Errorf("feerate %d: %v", feerate, err)
+		}
+	}
+}
+
+func TestServiceBlockRate(t *testing.T) {
+	s := &Service{FeeSim: &FeeSim{}}
+	var blockrate float64
+	s.FeeSim.SetBlockSource(nil, errors.New("not available"))
+	if err := s.BlockRate(nil, &struct{}{}, &blockrate); err == nil {
+		t.Error("error should be returned")
+	}
+
+	blocksource := sim.NewIndBlockSource([]sim.FeeRate{1000}, []sim.TxSize{1e6}, 1./540)
+	s.FeeSim.SetBlockSource(blocksource, nil)
+	if err := s.BlockRate(nil, &struct{}{}, &blockrate); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckPctDiff(blockrate, 3600./540, 1e-9); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServiceTxRate(t *testing.T) {
+	s := &Service{FeeSim: &FeeSim{}}
+	txsource := sim.NewUniTxSource([]sim.FeeRate{10000, 20000, 30000}, []sim.TxSize{250, 500, 1000}, 1)
+	s.FeeSim.SetTxSource(txsource, nil)
+	var reply sim.MonotonicFn
+	if err := s.TxRate(nil, new(int), &reply); err != nil {
+		t.Fatal(err)
+	}
+	// As with EstimateFee, 0 means all.
+	if err := testutil.CheckEqual(reply, txsource.RateFn()); err != nil {
+		t.Error(err)
+	}
+	n := -1
+	if err := s.TxRate(nil, &n, &reply); err == nil {
+		t.Error("negative args should be an error")
+	}
+}
+
+func TestServiceTxSourceDebug(t *testing.T) {
+	s := &Service{FeeSim: &FeeSim{}}
+	var state est.UniTxSourceState
+	if err := s.TxSourceDebug(nil, &struct{}{}, &state); err == nil {
+		t.Error("error should be returned")
+	}
+
+	ref := est.UniTxSourceState{Window: 300, MinWindow: 600, NumTxs: 5, R: 4.5, Decay: 0.99, TxRate: 0.01}
+	s.FeeSim.cfg.txSourceState = func() est.UniTxSourceState { return ref }
+	if err := s.TxSourceDebug(nil, &struct{}{}, &state); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(state, ref); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServiceMethods(t *testing.T) {
+	s := &Service{FeeSim: &FeeSim{}}
+	var methods []MethodInfo
+	if err := s.Methods(nil, &struct{}{}, &methods); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(len(methods), len(rpcMethods)); err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]MethodInfo)
+	for i, m := range methods {
+		if i > 0 && m.Name <= methods[i-1].Name {
+			t.Errorf("methods not sorted: %s after %s", m.Name, methods[i-1].Name)
+		}
+		if _, ok := rpcMethods[m.Name]; !ok {
+			t.Errorf("method %s is not registered", m.Name)
+		}
+		if m.Description == "" {
+			t.Errorf("method %s has no description", m.Name)
+		}
+		byName[m.Name] = m
+	}
+	for name := range rpcMethods {
+		if _, ok := byName[name]; !ok {
+			t.Errorf("registered method %s is not listed", name)
+		}
+	}
+
+	m := byName["estimatefeescenario"]
+	if err := testutil.CheckEqual(m.Args, map[string]interface{}{"MaxBlockSize": "int64"}); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(m.Reply, []interface{}{"float64"}); err != nil {
+		t.Error(err)
+	}
+	m = byName["collectorerrors"]
+	if err := testutil.CheckEqual(m.Args, map[string]interface{}{}); err != nil {
+		t.Error(err)
+	}
+	ref := []interface{}{map[string]interface{}{"time": "int64", "error": "string"}}
+	if err := testutil.CheckEqual(m.Reply, ref); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(byName["txrate"].Reply, "any"); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(byName["predictscores"].Reply,
+		map[string]interface{}{"string": []interface{}{"float64"}}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTypeShape(t *testing.T) {
+	type node struct {
+		Value    int     `json:"value"`
+		Hidden   string  `json:"-"`
+		Children []*node `json:"children,omitempty"`
+		private  int
+	}
+	ref := map[string]interface{}{
+		"value":    "int",
+		"children": []interface{}{"main.node"},
+	}
+	if err := testutil.CheckEqual(typeShape(reflect.TypeOf(node{}), nil), ref); err != nil {
+		t.Error(err)
+	}
+	// Custom JSON encoding
+	if err := testutil.CheckEqual(typeShape(reflect.TypeOf(sim.TxRateFn{}), nil), "sim.TxRateFn"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServiceLatestBlockStat(t *testing.T) {
+	getState := func() (*col.MempoolState, error) {
+		return &col.MempoolState{Height: 110, Entries: make(map[string]col.MempoolEntry)}, nil
+	}
+	f, cleanup := newTestFeeSim(t, getState)
+	defer cleanup()
+	defer f.blkdb.Close()
+	s := &Service{FeeSim: f}
+
+	var stat est.BlockStat
+	if err := s.LatestBlockStat(nil, &struct{}{}, &stat); err == nil {
+		t.Error("latest block stat should not be available without a mempool state")
+	}
+	if err := f.collect.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer f.collect.Stop()
+	if err := s.LatestBlockStat(nil, &struct{}{}, &stat); err == nil {
+		t.Error("latest block stat should not be available from an empty DB")
+	}
+
+	var stats []*est.BlockStat
+	for _, h := range []int64{100, 105, 111} {
+		stats = append(stats, &est.BlockStat{
+			Height:            h,
+			Size:              h * 1000,
+			SFRStat:           est.SFRStat{SFR: 20000, AK: 5, AN: 5, BK: 3, BN: 4},
+			MempoolSize:       500000,
+			MempoolSizeRemain: 400000,
+			Time:              1e9 + h*600,
+			NumHashes:         1e20,
+		})
+	}
+	if err := f.blkdb.Put(stats); err != nil {
+		t.Fatal(err)
+	}
+	// The latest block at or below the mempool height
+	if err := s.LatestBlockStat(nil, &struct{}{}, &stat); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(stat, *stats[1]); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServiceSimFloors(t *testing.T) {
+	s := &Service{FeeSim: &FeeSim{}}
+	var floors SimFloors
+	if err := s.SimFloors(nil, &struct{}{}, &floors); err == nil {
+		t.Error("sim floors should not be available")
+	}
+	s.FeeSim.setSimFloors(3000, 5000)
+	if err := s.SimFloors(nil, &struct{}{}, &floors); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(floors, SimFloors{StableFee: 3000, LowestFeeRate: 5000, Floor: 5000}); err != nil {
+		t.Error(err)
+	}
+	s.FeeSim.setSimFloors(6000, 5000)
+	if err := s.SimFloors(nil, &struct{}{}, &floors); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(floors.Floor, sim.FeeRate(6000)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServiceStableFee(t *testing.T) {
+	s := &Service{FeeSim: &FeeSim{}}
+	var stableFee float64
+	s.FeeSim.SetTxSource(nil, errors.New("not available"))
+	if err := s.StableFee(nil, &struct{}{}, &stableFee); err == nil {
+		t.Error("stable fee should not be available")
+	}
+
+	// 1250 bytes/s at 20000, 625 bytes/s at 10000; capacity 1667 bytes/s
+	txsource := sim.NewMultiTxSource([]sim.FeeRate{20000, 10000}, []sim.TxSize{250, 250}, []float64{2, 1}, 7.5)
+	blocksource := sim.NewIndBlockSource([]sim.FeeRate{1000}, []sim.TxSize{1000000}, 1./600)
+	s.FeeSim.SetTxSource(txsource, nil)
+	s.FeeSim.SetBlockSource(blocksource, nil)
+	if err := s.StableFee(nil, &struct{}{}, &stableFee); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(stableFee, 0.00010001); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServiceEstimateFeeBounds(t *testing.T) {
+	s := &Service{FeeSim: &FeeSim{}}
+	var bounds EstimateFeeBounds
+	s.FeeSim.SetResult([]sim.FeeRate{20000, 10000}, nil)
+	s.FeeSim.setBounds(sim.TransientResult{FeeRates: []sim.FeeRate{20000, 10000}})
+	if err := s.EstimateFeeBounds(nil, &struct{}{}, &bounds); err == nil {
+		t.Error("bounds should not be available without withconfidence")
+	}
+
+	s.FeeSim.setBounds(sim.TransientResult{
+		FeeRates: []sim.FeeRate{20000, 10000},
+		Lower:    []sim.FeeRate{15000, 8000},
+		Upper:    []sim.FeeRate{-1, 12000},
+	})
+	if err := s.EstimateFeeBounds(nil, &struct{}{}, &bounds); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(bounds, EstimateFeeBounds{
+		FeeRates: []float64{0.0002, 0.0001},
+		Lower:    []float64{0.00015, 0.00008},
+		Upper:    []float64{-1, 0.00012},
+	}); err != nil {
+		t.Error(err)
+	}
+
+	s.FeeSim.SetResult(nil, errInProgress)
+	if err := s.EstimateFeeBounds(nil, &struct{}{}, &bounds); err != errInProgress {
+		t.Error("errInProgress should be returned, got", err)
+	}
+}
+
+func TestServiceEstimateFeePercentiles(t *testing.T) {
+	s := &Service{FeeSim: &FeeSim{}}
+	var reply EstimateFeePercentiles
+	args := &struct {
+		N           int
+		Percentiles []float64
+	}{0, []float64{0.5, 0.9}}
+	if err := s.EstimateFeePercentiles(nil, args, &reply); err == nil {
+		t.Error("error should be returned before the sim has run")
+	}
+
+	blocksource := sim.NewIndBlockSource([]sim.FeeRate{1000}, []sim.TxSize{50000}, 1./600)
+	txsource := sim.NewMultiTxSource([]sim.FeeRate{2000, 20000}, []sim.TxSize{250, 250}, []float64{1, 1}, 0.5)
+	c := sim.TransientConfig{MaxBlockConfirms: 3, MinSuccessPct: 0.9, NumIters: 100, LowestFeeRate: 1000}
+	ts := sim.NewTransientSim(sim.NewSim(txsource, blocksource, nil), c)
+	result := <-ts.Run()
+	s.FeeSim.SetResult(result, nil)
+	s.FeeSim.setSuccessCounts(ts.SuccessCounts())
+
+	if err := s.EstimateFeePercentiles(nil, args, &reply); err != nil {
+		t.Fatal(err)
+	}
+	p := ts.PercentileFeeRates(args.Percentiles)
+	if err := testutil.CheckEqual(reply, EstimateFeePercentiles{
+		Percentiles: args.Percentiles,
+		FeeRates:    [][]float64{toBTC(p[0]), toBTC(p[1])},
+	}); err != nil {
+		t.Error(err)
+	}
+	// The MinSuccessPct row is the result.
+	if err := testutil.CheckEqual(p[1], result); err != nil {
+		t.Error(err)
+	}
+
+	args.N = 2
+	if err := s.EstimateFeePercentiles(nil, args, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(reply.FeeRates, [][]float64{toBTC(p[0])[1:2], toBTC(p[1])[1:2]}); err != nil {
+		t.Error(err)
+	}
+
+	args.N = 4
+	if err := s.EstimateFeePercentiles(nil, args, &reply); err == nil {
+		t.Error("error should be returned for target > max target")
+	}
+	args.N, args.Percentiles = 1, []float64{1.5}
+	if err := s.EstimateFeePercentiles(nil, args, &reply); err == nil {
+		t.Error("error should be returned for percentile > 1")
+	}
+	args.Percentiles = nil
+	if err := s.EstimateFeePercentiles(nil, args, &reply); err == nil {
+		t.Error("error should be returned without percentiles")
+	}
+}
+
+func TestServiceEstimateFeeInfo(t *testing.T) {
+	s := &Service{FeeSim: &FeeSim{}}
+	s.FeeSim.tunables.simPeriod = 60
+	var info EstimateFeeInfo
+	s.FeeSim.SetResult(nil, errInProgress)
+	if err := s.EstimateFeeInfo(nil, &struct{}{}, &info); err != errInProgress {
+		t.Error("errInProgress should be returned, got", err)
+	}
+
+	before := time.Now().Unix()
+	s.FeeSim.SetResult([]sim.FeeRate{20000, 10000}, nil)
+	after := time.Now().Unix()
+	if err := s.EstimateFeeInfo(nil, &struct{}{}, &info); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(info.FeeRates, []float64{0.0002, 0.0001}); err != nil {
+		t.Error(err)
+	}
+	if info.LastUpdate < before || info.LastUpdate > after {
+		t.Errorf("LastUpdate %d not in [%d, %d]", info.LastUpdate, before, after)
+	}
+	if err := testutil.CheckEqual(info.RefreshInterval, 60); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(info.NextUpdate, info.LastUpdate+60); err != nil {
+		t.Error(err)
+	}
+	if info.LowConfidence {
+		t.Error("LowConfidence should not be set without a block source")
+	}
+	blocksource := sim.NewIndBlockSource([]sim.FeeRate{1000}, []sim.TxSize{1000000}, 1./600)
+	s.FeeSim.SetBlockSource(blocksource.WithLowConfidence(true), nil)
+	if err := s.EstimateFeeInfo(nil, &struct{}{}, &info); err != nil {
+		t.Fatal(err)
+	}
+	if !info.LowConfidence {
+		t.Error("LowConfidence should be set")
+	}
+
+	// An error result doesn't change the last update time.
+	s.FeeSim.SetResult(nil, errPause)
+	if err := testutil.CheckEqual(s.FeeSim.ResultTime(), info.LastUpdate); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServiceEstimateFeeStale(t *testing.T) {
+	s := &Service{FeeSim: &FeeSim{}}
+	result := []sim.FeeRate{30000, 20000, 10000}
+	n := 2
+	var reply interface{}
+
+	// No last result yet
+	s.FeeSim.cfg.StaleResults = true
+	s.FeeSim.SetResult(nil, errInProgress)
+	if err := s.EstimateFee(nil, &n, &reply); err != errInProgress {
+		t.Error("errInProgress should be returned, got", err)
+	}
+
+	s.FeeSim.SetResult(result, nil)
+	for _, simErr := range []error{errPause, errInProgress} {
+		s.FeeSim.SetResult(nil, simErr)
+
+		// Strict
+		s.FeeSim.cfg.StaleResults = false
+		if err := s.EstimateFee(nil, &n, &reply); err != simErr {
+			t.Errorf("%v should be returned, got %v", simErr, err)
+		}
+
+		s.FeeSim.cfg.StaleResults = true
+		if err := s.EstimateFee(nil, &n, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if err := testutil.CheckEqual(reply, toBTC(result)[1]); err != nil {
+			t.Error(err)
+		}
+		var info EstimateFeeInfo
+		if err := s.EstimateFeeInfo(nil, &struct{}{}, &info); err != nil {
+			t.Fatal(err)
+		}
+		if !info.Stale {
+			t.Error("info should be flagged stale")
+		}
+		if err := testutil.CheckEqual(info.FeeRates, toBTC(result)); err != nil {
+			t.Error(err)
+		}
+		var clamped ClampedEstimate
+		if err := s.EstimateFeeClamped(nil, &n, &clamped); err != nil {
+			t.Fatal(err)
+		}
+		if !clamped.Stale {
+			t.Error("clamped estimate should be flagged stale")
+		}
+	}
+
+	// Other errors aren't masked
+	s.FeeSim.SetResult(nil, errShutdown)
+	if err := s.EstimateFee(nil, &n, &reply); err != errShutdown {
+		t.Error("errShutdown should be returned, got", err)
+	}
+
+	// A fresh result isn't stale
+	s.FeeSim.SetResult(result, nil)
+	var info EstimateFeeInfo
+	if err := s.EstimateFeeInfo(nil, &struct{}{}, &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Stale {
+		t.Error("info should not be flagged stale")
+	}
+}
+
+func TestServiceTune(t *testing.T) {
+	s := &Service{FeeSim: &FeeSim{}}
+	s.FeeSim.SetTxSource(nil, errors.New("txsource not available"))
+	args := struct {
+		MaxIters, Runs int
+		Tol            float64
+	}{1000, 3, 0.05}
+	var reply TuneResult
+	if err := s.Tune(nil, &args, &reply); err == nil || err.Error() != "txsource not available" {
+		t.Error("txsource error should be returned, got", err)
+	}
+}
+
+func TestServiceSummary(t *testing.T) {
+	getState := func() (*col.MempoolState, error) {
+		return &col.MempoolState{Height: 20000, Entries: make(map[string]col.MempoolEntry)}, nil
+	}
+	f, cleanup := newTestFeeSim(t, getState)
+	defer cleanup()
+	s := &Service{FeeSim: f}
+	f.SetTxSource(nil, errors.New("not available"))
+	f.SetBlockSource(nil, errors.New("not available"))
+	f.SetResult(nil, errInProgress)
+
+	// Without a sim result or sources, only the status and scores are given.
+	var reply map[string]interface{}
+	if err := s.Summary(nil, &struct{}{}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"estimatefee", "mempoolsize", "minfeerate", "txrate", "caprate", "stablefee"} {
+		if _, ok := reply[key]; ok {
+			t.Errorf("%s should be omitted", key)
+		}
+	}
+	if err := testutil.CheckEqual(reply["status"].(map[string]string)["txsource"], "not available"); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(reply["predictscores"], map[string][]float64{
+		"attained": {0, 0},
+		"exceeded": {0, 0},
+	}); err != nil {
+		t.Error(err)
+	}
+
+	// With a sim result and sources
+	f.SetResult([]sim.FeeRate{20000, 10000}, nil)
+	f.SetTxSource(sim.NewUniTxSource([]sim.FeeRate{10000, 20000}, []sim.TxSize{250, 500}, 1), nil)
+	f.SetBlockSource(sim.NewIndBlockSource([]sim.FeeRate{1000}, []sim.TxSize{1000000}, 1./600), nil)
+	if err := s.Summary(nil, &struct{}{}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(reply["estimatefee"], []float64{0.0002, 0.0001}); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckPctDiff(reply["txrate"].(float64), 375, 1e-9); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckPctDiff(reply["caprate"].(float64), 1000000./600, 1e-9); err != nil {
+		t.Error(err)
+	}
+	if _, ok := reply["stablefee"]; !ok {
+		t.Error("stablefee should be given")
+	}
+	if err := testutil.CheckEqual(reply["status"].(map[string]string)["txsource"], "OK"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServiceTrim(t *testing.T) {
+	getState := func() (*col.MempoolState, error) {
+		return &col.MempoolState{Height: 20000, Entries: make(map[string]col.MempoolEntry)}, nil
+	}
+	f, cleanup := newTestFeeSim(t, getState)
+	defer cleanup()
+	defer f.txdb.Close()
+	defer f.blkdb.Close()
+	f.cfg.blockStatWindow = 2016
+	s := &Service{FeeSim: f}
+
+	var stats []*est.BlockStat
+	for h := int64(0); h < 15000; h++ {
+		stats = append(stats, &est.BlockStat{Height: h, Size: 1000})
+	}
+	if err := f.blkdb.Put(stats); err != nil {
+		t.Fatal(err)
+	}
+	var txs []est.Tx
+	for tm := int64(0); tm < 10; tm++ {
+		txs = append(txs, est.Tx{FeeRate: 10000, Size: 250, Time: tm})
+	}
+	if err := f.txdb.Put(txs); err != nil {
+		t.Fatal(err)
+	}
+
+	type trimArgs = struct {
+		BlockStatsBefore, TxsBefore int64
+		Force                       bool
+	}
+	trim := func(args trimArgs) (TrimResult, error) {
+		var reply TrimResult
+		err := s.Trim(nil, &args, &reply)
+		return reply, err
+	}
+
+	// Without the current height, block stats are only trimmed with force
+	if _, err := trim(trimArgs{BlockStatsBefore: 100}); err == nil {
+		t.Error("trim should fail without a mempool state")
+	}
+	if err := f.collect.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer f.collect.Stop()
+
+	// Within the block stat window of the current height
+	if _, err := trim(trimArgs{BlockStatsBefore: 18000}); err == nil {
+		t.Error("trim within the block stat window should fail")
+	}
+
+	result, err := trim(trimArgs{BlockStatsBefore: 12000, TxsBefore: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(result, TrimResult{BlockStats: 12000, Txs: 5, Compacted: true}); err != nil {
+		t.Error(err)
+	}
+	remainingStats, err := f.blkdb.Get(0, math.MaxInt64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(remainingStats, stats[12000:]); err != nil {
+		t.Error(err)
+	}
+	remainingTxs, err := f.txdb.Get(0, math.MaxInt64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(remainingTxs, txs[5:]); err != nil {
+		t.Error(err)
+	}
+
+	// Forced, and not enough deleted to compact
+	if result, err = trim(trimArgs{BlockStatsBefore: 19000, Force: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(result, TrimResult{BlockStats: 3000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServiceEstimateFeeTarget(t *testing.T) {
+	s := &Service{FeeSim: &FeeSim{}}
+	s.FeeSim.SetResult([]sim.FeeRate{30000, 20000, 10000}, nil)
+
+	var reply interface{}
+	n := 5
+	err := s.EstimateFee(nil, &n, &reply)
+	if err := testutil.CheckEqual(err, TargetError{Target: 5, MaxTarget: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(err.Error(), "max available target 3") {
+		t.Error("error message should include the max target:", err)
+	}
+
+	var clamped ClampedEstimate
+	for n, ref := range map[int]ClampedEstimate{
+		1: {FeeRate: 0.0003, Target: 1},
+		3: {FeeRate: 0.0001, Target: 3},
+		5: {FeeRate: 0.0001, Target: 3, Clamped: true},
+	} {
+		if err := s.EstimateFeeClamped(nil, &n, &clamped); err != nil {
+			t.Fatal(err)
+		}
+		if err := testutil.CheckEqual(clamped, ref); err != nil {
+			t.Errorf("%d: %v", n, err)
+		}
+	}
+	n = 0
+	if err := s.EstimateFeeClamped(nil, &n, &clamped); err == nil {
+		t.Error("error should be returned for target 0")
+	}
+}
+
+func TestServicePredictScoresByFeeRate(t *testing.T) {
+	s, cleanup := newTestFeeSim(t, testGetState)
+	defer cleanup()
+	defer s.predictdb.Close()
+	attained := [][]float64{{1, 2, 3, 4, 5, 6, 7, 8}}
+	exceeded := [][]float64{{8, 7, 6, 5, 4, 3, 2, 1}}
+	if err := s.predictdb.(predict.FeeScoreDB).PutFeeScores(attained, exceeded); err != nil {
+		t.Fatal(err)
+	}
+
+	var reply FeeRateScores
+	if err := (&Service{FeeSim: s}).PredictScoresByFeeRate(nil, &struct{}{}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(reply.FeeRates, predict.FeeRateBuckets); err != nil {
+		t.Error(err)
+	}
+	// Resized to MaxBlockConfirms (2) rows
+	zeros := make([]float64, len(predict.FeeRateBuckets))
+	if err := testutil.CheckEqual(reply.Attained, append(attained, zeros)); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(reply.Exceeded, append(exceeded, zeros)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServiceEstimateFeeDefault(t *testing.T) {
+	s := &Service{FeeSim: &FeeSim{}}
+	s.FeeSim.SetResult([]sim.FeeRate{30000, 20000, 10000}, nil)
+
+	var reply DefaultEstimate
+	if err := s.EstimateFeeDefault(nil, &struct{}{}, &reply); err == nil {
+		t.Error("error should be returned if there's no default target")
+	}
+
+	s.Cfg.Estimate.DefaultTarget = 2
+	if err := s.EstimateFeeDefault(nil, &struct{}{}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(reply, DefaultEstimate{FeeRate: 0.0002, Target: 2}); err != nil {
+		t.Error(err)
+	}
+	// Same as EstimateFee with the target
+	var single interface{}
+	n := 2
+	if err := s.EstimateFee(nil, &n, &single); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(single, reply.FeeRate); err != nil {
+		t.Error(err)
+	}
+
+	s.Cfg.Estimate.DefaultTarget = 5
+	err := s.EstimateFeeDefault(nil, &struct{}{}, &reply)
+	if err := testutil.CheckEqual(err, TargetError{Target: 5, MaxTarget: 3}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServiceEstimateFeeMode(t *testing.T) {
+	s := &Service{FeeSim: &FeeSim{}}
+	s.FeeSim.SetResult([]sim.FeeRate{20000, 10000}, nil)
+	var result []float64
+	for _, mode := range []string{"", "default"} {
+		if err := s.EstimateFeeMode(nil, &struct{ Mode string }{mode}, &result); err != nil {
+			t.Fatal(err)
+		}
+		if err := testutil.CheckEqual(result, []float64{0.0002, 0.0001}); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := s.EstimateFeeMode(nil, &struct{ Mode string }{"cheap"}, &result); err == nil {
+		t.Error("error should be returned for an invalid mode")
+	}
+	// The non-default modes need the sources
+	s.FeeSim.SetBlockSource(nil, errors.New("not available"))
+	s.FeeSim.SetTxSource(nil, errors.New("not available"))
+	if err := s.EstimateFeeMode(nil, &struct{ Mode string }{"economical"}, &result); err == nil {
+		t.Error("error should be returned without sources")
+	}
+}
+
+func TestServiceConfTimeSeconds(t *testing.T) {
+	s := &Service{FeeSim: &FeeSim{}}
+	s.FeeSim.tunables.transient.MinSuccessPct = 0.9
+	var reply ConfTimeSeconds
+	if err := s.ConfTimeSeconds(nil, &struct{ FeeRate int64 }{1000}, &reply); err == nil {
+		t.Error("error should be returned before the sim has run")
+	}
+
+	// Blocks are never full, so txs >= 1000 are always confirmed in the next
+	// block, and the conf time is exponential with the block rate.
+	const blockrate = 1. / 600
+	blocksource := sim.NewIndBlockSource([]sim.FeeRate{1000}, []sim.TxSize{1e9}, blockrate)
+	txsource := sim.NewMultiTxSource([]sim.FeeRate{2000}, []sim.TxSize{250}, []float64{1}, 0.1)
+	c := sim.TransientConfig{MaxBlockConfirms: 3, MinSuccessPct: 0.9, NumIters: 100, LowestFeeRate: 1000}
+	ts := sim.NewTransientSim(sim.NewSim(txsource, blocksource, nil), c)
+	<-ts.Run()
+	s.FeeSim.setConfTimeDist(ts.ConfTimeDist())
+	s.FeeSim.SetBlockSource(blocksource, nil)
+
+	if err := s.ConfTimeSeconds(nil, &struct{ FeeRate int64 }{999}, &reply); err == nil {
+		t.Error("error should be returned below the lowest fee rate")
+	}
+	if err := s.ConfTimeSeconds(nil, &struct{ FeeRate int64 }{1000}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckPctDiff(reply.Median, math.Ln2*600, 1e-5); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckPctDiff(reply.Percentile, -math.Log(0.1)*600, 1e-5); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(reply.SuccessPct, 0.9); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServiceListenAndServe(t *testing.T) {
+	// Get a free port, which is reused by each server in turn.
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	ln.Close()
+
+	for i := 0; i < 3; i++ {
+		s := &Service{
+			FeeSim: &FeeSim{done: make(chan struct{})},
+			DLog:   NewDebugLog(ioutil.Discard, "", 0),
+		}
+		s.Cfg.AppRPC = AppRPCConfig{Host: "localhost", Port: port}
+		errc := make(chan error)
+		go func() { errc <- s.ListenAndServe() }()
+
+		c := api.NewClient(api.Config{Host: "localhost", Port: port, Timeout: 5})
+		var cfg map[string]interface{}
+		for j := 0; j < 50; j++ {
+			if cfg, err = c.Config(); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := cfg["apprpc"]; !ok {
+			t.Error("invalid config response")
+		}
+
+		// The sources are reconstructed as their concrete types.
+		s.FeeSim.SetTxSource(sim.NewUniTxSource([]sim.FeeRate{10000}, []sim.TxSize{250}, 1), nil)
+		s.FeeSim.SetBlockSource(sim.NewIndBlockSource([]sim.FeeRate{1000}, []sim.TxSize{1e6}, 1./600), nil)
+		if txsource, err := c.TxSource(); err != nil {
+			t.Error(err)
+		} else if _, ok := txsource.(*sim.UniTxSource); !ok {
+			t.Errorf("tx source should be a *sim.UniTxSource, got %T", txsource)
+		}
+		if blocksource, err := c.BlockSource(); err != nil {
+			t.Error(err)
+		} else if err := testutil.CheckEqual(blocksource.BlockRate(), 1./600); err != nil {
+			t.Error(err)
+		}
+
+		if i%2 == 0 {
+			// Stopping the sim stops the server
+			s.FeeSim.Stop()
+		} else if err := s.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-errc:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("server did not stop")
+		}
+		s.DLog.Close()
+	}
+}
@@ -0,0 +1,104 @@
+package sim
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// BumpTxSource approximates fee bumping (i.e. replace-by-fee) under
+// congestion: users whose txs are stuck rebroadcast them at higher fee rates,
+// competing with the other arrivals for the next blocks. This is modeled as
+// an increase in the arrival rate of the underlying source, by a constant
+// factor for the duration of the sim. The assumptions are that the
+// replacements follow the same fee rate / size distribution as the arrivals,
+// and that the replaced txs aren't removed from the mempool, so the model is
+// only a coarse one. Implements TxSource.
+type BumpTxSource struct {
+	src  TxSource
+	mult float64
+}
+
+// NewBumpTxSource returns src with its arrival rate multiplied by mult. It
+// returns an error if mult isn't at least 1.
+func NewBumpTxSource(src TxSource, mult float64) (*BumpTxSource, error) {
+	if !(mult >= 1) {
+		return nil, fmt.Errorf("mult must be >= 1, was %g", mult)
+	}
+	return &BumpTxSource{src: src, mult: mult}, nil
+}
+
+// BumpMult returns the arrival rate multiplier for the congestion (the
+// mempool backlog in excess of one block, in units of blocks) with the
+// elasticity, i.e. 1 + elasticity*congestion.
+func BumpMult(elasticity, congestion float64) float64 {
+	if elasticity <= 0 || congestion <= 0 {
+		return 1
+	}
+	return 1 + elasticity*congestion
+}
+
+// Generate generates the txs of the underlying source over an interval
+// stretched by the multiplier; since the arrivals are poisson, this is
+// equivalent to scaling the arrival rate.
+func (s *BumpTxSource) Generate(t time.Duration) []*Tx {
+	return s.src.Generate(time.Duration(float64(t) * s.mult))
+}
+
+func (s *BumpTxSource) Copy(n int) []TxSource {
+	ss := s.src.Copy(n)
+	for i := range ss {
+		ss[i] = &BumpTxSource{src: ss[i], mult: s.mult}
+	}
+	return ss
+}
+
+func (s *BumpTxSource) MinSize() TxSize {
+	return s.src.MinSize()
+}
+
+func (s *BumpTxSource) RateFn() MonotonicFn {
+	return scaledFn{fn: s.src.RateFn(), k: s.mult}
+}
+
+func (s *BumpTxSource) MarshalJSON() ([]byte, error) {
+	v := make(map[string]interface{})
+	v["source"] = s.src
+	v["mult"] = s.mult
+	v["type"] = "BumpTxSource"
+	return json.Marshal(v)
+}
+
+// ScaledFn returns fn with its values multiplied by k, which must be > 0; e.g.
+// to convert a size function to weight units.
+func ScaledFn(fn MonotonicFn, k float64) MonotonicFn {
+	if k <= 0 {
+		panic("k must be > 0")
+	}
+	return scaledFn{fn: fn, k: k}
+}
+
+// scaledFn is fn with its values multiplied by k > 0.
+type scaledFn struct {
+	fn MonotonicFn
+	k  float64
+}
+
+func (f scaledFn) Eval(x float64) float64 {
+	return f.k * f.fn.Eval(x)
+}
+
+func (f scaledFn) Inverse(y float64) float64 {
+	return f.fn.Inverse(y / f.k)
+}
+
+func (f scaledFn) Approx(n int) MonotonicFn {
+	return scaledFn{fn: f.fn.Approx(n), k: f.k}
+}
+
+func (f scaledFn) MarshalJSON() ([]byte, error) {
+	v := make(map[string]interface{})
+	v["fn"] = f.fn
+	v["scale"] = f.k
+	return json.Marshal(v)
+}
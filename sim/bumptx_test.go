@@ -0,0 +1,86 @@
+package sim
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bitcoinfees/feesim/testutil"
+)
+
+func TestBumpTxSource(t *testing.T) {
+	src := NewUniTxSource([]FeeRate{10000, 20000}, []TxSize{250, 500}, 2)
+	bump, err := NewBumpTxSource(src, 1.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var _ TxSource = bump
+	if _, err := NewBumpTxSource(src, 0.5); err == nil {
+		t.Error("mult < 1 should be an error")
+	}
+
+	// The rate fn is scaled by mult.
+	for _, x := range []float64{0, 10000, 15000, 20000, 30000} {
+		if err := testutil.CheckPctDiff(bump.RateFn().Eval(x), 1.5*src.RateFn().Eval(x), 1e-9); err != nil {
+			t.Error(x, err)
+		}
+	}
+	if err := testutil.CheckEqual(bump.RateFn().Inverse(bump.RateFn().Eval(20000)), float64(10001)); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(bump.MinSize(), TxSize(250)); err != nil {
+		t.Error(err)
+	}
+
+	// As is the arrival rate.
+	const T = time.Hour
+	var n int
+	for _, s := range bump.Copy(10) {
+		n += len(s.Generate(T))
+	}
+	if err := testutil.CheckPctDiff(float64(n), 10*1.5*2*T.Seconds(), 0.02); err != nil {
+		t.Error(err)
+	}
+
+	if err := testutil.CheckEqual(BumpMult(0.5, 4), 3.); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(BumpMult(0.5, -1), 1.); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(BumpMult(0, 4), 1.); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBumpTxSourceEstimates(t *testing.T) {
+	// Under congestion, more fee bumping (i.e. higher elasticity) should
+	// yield higher short target estimates.
+	txsrc := loadMultiTxSource()
+	blksrc := loadIndBlockSource()
+	c := TransientConfig{
+		MaxBlockConfirms: 6,
+		MinSuccessPct:    0.9,
+		NumIters:         200,
+		LowestFeeRate:    5000,
+	}
+	run := func(mult float64) []FeeRate {
+		txs, err := NewBumpTxSource(txsrc.Copy(1)[0], mult)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := NewSim(txs, blksrc, loadInitMempool("333931"))
+		return <-NewTransientSim(s, c).Run()
+	}
+	ref, bumped := run(1), run(1.5)
+	t.Log("ref:", ref)
+	t.Log("bumped:", bumped)
+	// -1 (no fee) counts as infinite.
+	for i := range ref {
+		if bumped[i] != -1 && (ref[i] == -1 || ref[i] > bumped[i]) {
+			t.Errorf("%d blocks: ref %d > bumped %d", i+1, ref[i], bumped[i])
+		}
+	}
+	if bumped[0] <= ref[0] {
+		t.Error("next block estimate should be higher with fee bumping")
+	}
+}
@@ -12,11 +12,24 @@ const (
 	MaxTxSize  TxSize  = math.MaxInt64
 )
 
+// FeeRate is in satoshis per kB, truncated to an integer, which is the same
+// representation as Bitcoin Core's CFeeRate. A finer representation wouldn't
+// help: the node's fee policies (min relay fee, mempool min fee) are in whole
+// satoshis per kB, and for txs of at most 1 kB, each 1 satoshi fee step is a
+// distinct FeeRate anyway, so no ties are introduced where they matter most
+// (e.g. for the SFR). Fee rates must be computed from integer satoshis though,
+// not from float BTC amounts (see collect/corerpc).
 type (
 	FeeRate int64 // satoshis per kB
 	TxSize  int64 // in bytes
 )
 
+// WitnessScaleFactor is the ratio of weight units to virtual bytes. The sizes
+// are in virtual bytes by default, but they can be in weight units instead,
+// as long as they are consistently so (the tx and block sources and the
+// mempool); the fee rates are per kvB either way.
+const WitnessScaleFactor TxSize = 4
+
 type Tx struct {
 	FeeRate FeeRate `json:"feerate"`
 	Size    TxSize  `json:"size"`
@@ -24,6 +37,13 @@ type Tx struct {
 
 	children       []*Tx
 	removedparents int
+	expires        time.Duration // Sim time of expiry, if > 0 (see Sim.SetExpiry)
+
+	// See RBFTxSource. A replaceable tx is unique to the sim, so it can be
+	// identified by pointer, and replaces is the tx that a replacement
+	// replaces.
+	replaceable bool
+	replaces    *Tx
 }
 
 // If a block won't include any txs regardless of fee, set
@@ -47,7 +67,8 @@ type txqueue []*Tx
 //
 // A null source is permitted (i.e. a source which always Generates length-zero
 // txs.
-// TODO: Add unmarshalers
+//
+// A source's MarshalJSON encoding can be decoded with UnmarshalTxSource.
 type TxSource interface {
 	Generate(t time.Duration) (txs []*Tx)
 
@@ -69,7 +90,20 @@ type TxSource interface {
 	MarshalJSON() ([]byte, error)
 }
 
-// A simulation block source.
+// SampledTxSource is a TxSource which generates txs by drawing from a tx
+// sample, so that its memory footprint is proportional to the sample size.
+type SampledTxSource interface {
+	TxSource
+
+	SampleSize() int
+
+	// Downsample returns a source with at most n of the sample txs, taken at
+	// regular intervals (so it's deterministic), with the same tx rate.
+	Downsample(n int) TxSource
+}
+
+// A simulation block source. Its MarshalJSON encoding can be decoded with
+// UnmarshalBlockSource.
 type BlockSource interface {
 	Next() (t time.Duration, b BlockPolicy)
 
@@ -93,7 +127,14 @@ type BlockSource interface {
 type MonotonicFn interface {
 	Eval(x float64) float64
 	Inverse(y float64) float64
+
+	// Approx returns an approximation of the function with at most n points,
+	// sampled at evenly spaced y values. Duplicate points are removed, so
+	// fewer than n points may be returned. If n <= 0, or if n is at least the
+	// number of distinct points of the function, all the distinct points are
+	// returned (i.e. the function is returned as is).
 	Approx(n int) MonotonicFn
+
 	MarshalJSON() ([]byte, error)
 }
 
@@ -137,6 +178,9 @@ func (f TxRateFn) Approx(n int) MonotonicFn {
 	if len(f.x) == 0 {
 		return NewTxRateFn(nil, nil)
 	}
+	if n <= 0 || n >= len(f.x) {
+		return f
+	}
 	max := f.Eval(0)
 	x := make([]float64, n)
 	for i := range x {
@@ -207,6 +251,9 @@ func (f CapRateFn) Inverse(y float64) (x float64) {
 }
 
 func (f CapRateFn) Approx(n int) MonotonicFn {
+	if n <= 0 || n >= len(f.x) {
+		return f
+	}
 	max := f.Eval(math.MaxFloat64) - 1
 	x := make([]float64, n)
 	for i := range x {
@@ -0,0 +1,88 @@
+package sim
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Implements BlockSource; blocks are found at a constant interval, and block i
+// has min fee rate minfeerates[i % len(minfeerates)] and max block size
+// maxblocksizes[i % len(maxblocksizes)]. It's for reproducing exact scenarios
+// and for deterministic tests. Not concurrent safe.
+type ConstBlockSource struct {
+	minfeerates   []FeeRate
+	maxblocksizes []TxSize
+	interval      time.Duration
+	i             int // index of the next block
+}
+
+func NewConstBlockSource(minfeerates []FeeRate, maxblocksizes []TxSize, interval time.Duration) *ConstBlockSource {
+	if interval <= 0 {
+		panic("interval must be > 0")
+	}
+	if len(minfeerates) == 0 || len(maxblocksizes) == 0 {
+		panic("minfeerates and maxblocksizes must have len > 0.")
+	}
+	return &ConstBlockSource{
+		minfeerates:   minfeerates,
+		maxblocksizes: maxblocksizes,
+		interval:      interval,
+	}
+}
+
+func (b *ConstBlockSource) Next() (t time.Duration, p BlockPolicy) {
+	t = b.interval
+	p.MinFeeRate = b.minfeerates[b.i%len(b.minfeerates)]
+	p.MaxBlockSize = b.maxblocksizes[b.i%len(b.maxblocksizes)]
+	b.i++
+	return
+}
+
+// Reset starts again from the first block policy, so that each sim run has
+// the same blocks (see Sim.Reset).
+func (b *ConstBlockSource) Reset() {
+	b.i = 0
+}
+
+func (b *ConstBlockSource) BlockRate() float64 {
+	return 1 / b.interval.Seconds()
+}
+
+// Copy returns n copies of b, each of which starts again from the first
+// block policy.
+func (b *ConstBlockSource) Copy(n int) []BlockSource {
+	bb := make([]BlockSource, n)
+	for i := range bb {
+		bb[i] = NewConstBlockSource(b.minfeerates, b.maxblocksizes, b.interval)
+	}
+	return bb
+}
+
+func (b *ConstBlockSource) RateFn() MonotonicFn {
+	return capRateFn(b.minfeerates, b.maxblocksizes, b.BlockRate(), 0)
+}
+
+func (b *ConstBlockSource) MarshalJSON() ([]byte, error) {
+	// Unlike IndBlockSource's, the order is kept, since it's the block order.
+	minfeerates := make([]float64, len(b.minfeerates))
+	for i, feerate := range b.minfeerates {
+		if feerate == MaxFeeRate {
+			minfeerates[i] = -1
+		} else {
+			minfeerates[i] = float64(feerate)
+		}
+	}
+
+	maxblocksizes := make([]float64, len(b.maxblocksizes))
+	for i, size := range b.maxblocksizes {
+		maxblocksizes[i] = float64(size)
+	}
+
+	v := make(map[string]interface{})
+	v["minfeerates"] = minfeerates
+	v["maxblocksizes"] = maxblocksizes
+	v["interval"] = b.interval.Seconds()
+	v["blockrate"] = b.BlockRate()
+	v["type"] = "ConstBlockSource"
+	return json.Marshal(v)
+}
@@ -0,0 +1,112 @@
+package sim
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/bitcoinfees/feesim/testutil"
+)
+
+func TestConstBlockSource(t *testing.T) {
+	minfeerates := []FeeRate{5000, 10000, MaxFeeRate}
+	maxblocksizes := []TxSize{1000000, 750000}
+	b := NewConstBlockSource(minfeerates, maxblocksizes, 600*time.Second)
+	if err := testutil.CheckEqual(b.BlockRate(), 1./600); err != nil {
+		t.Error(err)
+	}
+
+	policiesRef := []BlockPolicy{
+		{MinFeeRate: 5000, MaxBlockSize: 1000000},
+		{MinFeeRate: 10000, MaxBlockSize: 750000},
+		{MinFeeRate: MaxFeeRate, MaxBlockSize: 1000000},
+		{MinFeeRate: 5000, MaxBlockSize: 750000},
+		{MinFeeRate: 10000, MaxBlockSize: 1000000},
+		{MinFeeRate: MaxFeeRate, MaxBlockSize: 750000},
+		{MinFeeRate: 5000, MaxBlockSize: 1000000},
+	}
+	checkPolicies := func(b BlockSource) {
+		t.Helper()
+		policies := make([]BlockPolicy, len(policiesRef))
+		for i := range policies {
+			var tm time.Duration
+			tm, policies[i] = b.Next()
+			if err := testutil.CheckEqual(tm, 600*time.Second); err != nil {
+				t.Error(err)
+			}
+		}
+		if err := testutil.CheckEqual(policies, policiesRef); err != nil {
+			t.Error(err)
+		}
+	}
+	checkPolicies(b)
+
+	// Reset starts again from the first block, as does Sim.Reset.
+	b.Reset()
+	checkPolicies(b)
+	s := NewSim(NewMultiTxSource(nil, nil, nil, 0), b, nil)
+	s.Reset()
+	checkPolicies(b)
+
+	// The copies start from the first block, regardless of b's state.
+	for _, c := range b.Copy(2) {
+		checkPolicies(c)
+	}
+
+	// Test RateFn; the same as IndBlockSource's.
+	ratefn := b.RateFn()
+	ratefnRef := NewIndBlockSource(minfeerates, maxblocksizes, 1./600).RateFn()
+	for _, x := range []float64{-1, 4999, 5000, 5001, 9999, 10000, 10001, 1e7} {
+		if err := testutil.CheckEqual(ratefn.Eval(x), ratefnRef.Eval(x)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Test MarshalJSON
+	bJSON, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v map[string]interface{}
+	if err := json.Unmarshal(bJSON, &v); err != nil {
+		t.Fatal(err)
+	}
+	vRef := map[string]interface{}{
+		"minfeerates":   []interface{}{5000., 10000., -1.},
+		"maxblocksizes": []interface{}{1000000., 750000.},
+		"interval":      600.,
+		"blockrate":     1. / 600,
+		"type":          "ConstBlockSource",
+	}
+	if err := testutil.CheckEqual(v, vRef); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConstBlockSourceTransient(t *testing.T) {
+	// With no tx arrivals, the conf times are determined by the mempool, so
+	// that every iteration is the same.
+	txsource := NewMultiTxSource(nil, nil, nil, 0)
+	blocksource := NewConstBlockSource([]FeeRate{10000, 20000}, []TxSize{50000}, 600*time.Second)
+	cfg := TransientConfig{
+		MaxBlockConfirms: 6,
+		MinSuccessPct:    0.9,
+		NumIters:         20,
+		LowestFeeRate:    5000,
+		KeepVariates:     true,
+	}
+	ts := NewTransientSim(NewSim(txsource, blocksource, loadInitMempool("333931")), cfg)
+	feeref := []FeeRate{44248, 38611, 26738, 22728, 19194, 19194}
+	if err := testutil.CheckEqual(<-ts.Run(), feeref); err != nil {
+		t.Error(err)
+	}
+	v := ts.Variates()
+	if err := testutil.CheckEqual(len(v), cfg.NumIters); err != nil {
+		t.Fatal(err)
+	}
+	for _, vi := range v[1:] {
+		if err := testutil.CheckEqual(vi, v[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package sim
+
+import (
+	"testing"
+
+	"github.com/bitcoinfees/feesim/testutil"
+)
+
+// chainMempool returns numChains chains of depth txs each, in which the root
+// pays rootFeeRate, and the descendants pay more, the deeper they are.
+func chainMempool(numChains, depth int, rootFeeRate FeeRate) []*Tx {
+	var mempool []*Tx
+	for i := 0; i < numChains; i++ {
+		parent := &Tx{FeeRate: rootFeeRate, Size: 250}
+		mempool = append(mempool, parent)
+		for j := 1; j < depth; j++ {
+			child := &Tx{FeeRate: FeeRate(10000 * j), Size: 250, Parents: []*Tx{parent}}
+			mempool = append(mempool, child)
+			parent = child
+		}
+	}
+	return mempool
+}
+
+func simSFRs(s *Sim, n int) []FeeRate {
+	sfrs := make([]FeeRate, n)
+	for i := range sfrs {
+		sfrs[i], _ = s.NextBlock()
+	}
+	return sfrs
+}
+
+func TestSimModelCPFP(t *testing.T) {
+	// No arrivals, and 4 txs per block
+	txsource := NewMultiTxSource(nil, nil, nil, 0)
+	blocksource := NewIndBlockSource([]FeeRate{0}, []TxSize{1000}, 1./600)
+
+	// Without CPFP, the deps are ignored, so the high fee descendants go
+	// first.
+	s := NewSimWithConfig(txsource, blocksource, chainMempool(4, 5, 1000), SimConfig{})
+	sfrsRef := []FeeRate{40001, 30001, 20001, 10001, 0, 0}
+	if err := testutil.CheckEqual(simSFRs(s, 6), sfrsRef); err != nil {
+		t.Error(err)
+	}
+
+	// With CPFP, a child is only queued once its parent is confirmed (in
+	// the same block, if there's space), so the low fee roots go first, and
+	// the blocks are filled about a chain at a time.
+	s = NewSimWithConfig(txsource, blocksource, chainMempool(4, 5, 1000), SimConfig{ModelCPFP: true})
+	sfrsRef = []FeeRate{1001, 1001, 1001, 1001, 0, 0}
+	if err := testutil.CheckEqual(simSFRs(s, 6), sfrsRef); err != nil {
+		t.Error(err)
+	}
+
+	// The deps are kept across Reset and Copy.
+	s.Reset()
+	if err := testutil.CheckEqual(simSFRs(s, 6), sfrsRef); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(simSFRs(s.Copy(1)[0], 6), sfrsRef); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSimModelCPFPMempool(t *testing.T) {
+	const (
+		mfr FeeRate = 10000
+		mbs TxSize  = 50000
+		n           = 50
+	)
+	txsource := NewMultiTxSource(nil, nil, nil, 0)
+	blocksource := NewIndBlockSource([]FeeRate{mfr}, []TxSize{mbs}, 1./600)
+
+	// The zero config is NewSim.
+	sfrsRef := simSFRs(NewSim(txsource, blocksource, loadInitMempool("333931")), n)
+	sfrs := simSFRs(NewSimWithConfig(txsource, blocksource, loadInitMempool("333931"), SimConfig{}), n)
+	if err := testutil.CheckEqual(sfrs, sfrsRef); err != nil {
+		t.Error(err)
+	}
+
+	// With CPFP, the mempool's chains delay some of the txs, so that the
+	// SFRs are lower or equal in each block.
+	var numDeps int
+	mempool := loadInitMempool("333931")
+	for _, tx := range mempool {
+		numDeps += len(tx.Parents)
+	}
+	if numDeps == 0 {
+		t.Fatal("the test mempool should have deps")
+	}
+	sfrsCPFP := simSFRs(NewSimWithConfig(txsource, blocksource, mempool, SimConfig{ModelCPFP: true}), n)
+	var numDiff int
+	for i := range sfrsCPFP {
+		if sfrsCPFP[i] != sfrsRef[i] {
+			numDiff++
+		}
+	}
+	t.Logf("%d deps, %d of %d SFRs differ", numDeps, numDiff, n)
+	if numDiff == 0 {
+		t.Error("the SFRs should differ with CPFP")
+	}
+}
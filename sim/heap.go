@@ -14,6 +14,24 @@ func (q txqueue) init() {
 	}
 }
 
+// remove removes the txs in drop from q, by identity, setting drop[tx] to
+// true for each one found. The heap order isn't maintained, so q must be
+// re-initialized afterwards.
+func (q *txqueue) remove(drop map[*Tx]bool) {
+	q_ := (*q)[:0]
+	for _, tx := range *q {
+		if _, ok := drop[tx]; ok {
+			drop[tx] = true
+			continue
+		}
+		q_ = append(q_, tx)
+	}
+	for i := len(q_); i < len(*q); i++ {
+		(*q)[i] = nil
+	}
+	*q = q_
+}
+
 func (q *txqueue) push(tx *Tx) {
 	*q = append(*q, tx)
 	q.up(len(*q) - 1)
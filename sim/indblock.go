@@ -13,6 +13,8 @@ type IndBlockSource struct {
 	minfeerates   []FeeRate
 	maxblocksizes []TxSize
 	blockrate     float64 // blocks per second
+	emptyprob     float64 // probability that a block is empty
+	lowconf       bool    // estimated from less data than usually required
 	rand          *rand.Rand
 }
 
@@ -35,6 +37,9 @@ func (b *IndBlockSource) Next() (t time.Duration, p BlockPolicy) {
 	t = time.Duration(b.rand.ExpFloat64() / b.blockrate * float64(time.Second))
 	p.MinFeeRate = b.minfeerates[b.rand.Intn(len(b.minfeerates))]
 	p.MaxBlockSize = b.maxblocksizes[b.rand.Intn(len(b.maxblocksizes))]
+	if b.emptyprob > 0 && b.rand.Float64() < b.emptyprob {
+		p.MaxBlockSize = 0
+	}
 	return
 }
 
@@ -42,6 +47,59 @@ func (b *IndBlockSource) BlockRate() float64 {
 	return b.blockrate
 }
 
+// WithMaxBlockSize returns a copy of b with all blocks having max block size
+// size, but with the same min fee rate distribution and block rate. It's for
+// modeling a change of the block size limit.
+func (b *IndBlockSource) WithMaxBlockSize(size TxSize) *IndBlockSource {
+	c := NewIndBlockSource(b.minfeerates, []TxSize{size}, b.blockrate)
+	c.emptyprob = b.emptyprob
+	c.lowconf = b.lowconf
+	return c
+}
+
+// WithEmptyProb returns a copy of b in which each block is empty (i.e. has
+// max block size 0) with probability p, and otherwise follows b. It's for
+// modeling SPV mining, in which pools mine empty blocks right after a new tip
+// before validating it.
+func (b *IndBlockSource) WithEmptyProb(p float64) *IndBlockSource {
+	c := NewIndBlockSource(b.minfeerates, b.maxblocksizes, b.blockrate)
+	c.emptyprob = p
+	c.lowconf = b.lowconf
+	return c
+}
+
+// WithLowConfidence returns a copy of b, flagged as low confidence if lowconf,
+// i.e. as having been estimated from less block data than usually required.
+func (b *IndBlockSource) WithLowConfidence(lowconf bool) *IndBlockSource {
+	c := NewIndBlockSource(b.minfeerates, b.maxblocksizes, b.blockrate)
+	c.emptyprob = b.emptyprob
+	c.lowconf = lowconf
+	return c
+}
+
+// LowConfidence returns whether b is flagged as low confidence; see
+// WithLowConfidence.
+func (b *IndBlockSource) LowConfidence() bool {
+	return b.lowconf
+}
+
+// WithCapacityPct returns a copy of b with all blocks having max block size
+// equal to the pct quantile of b's max block sizes, but with the same min fee
+// rate distribution and block rate. A high pct is an optimistic capacity
+// assumption, which yields lower fee estimates.
+func (b *IndBlockSource) WithCapacityPct(pct float64) *IndBlockSource {
+	sizes := make([]TxSize, len(b.maxblocksizes))
+	copy(sizes, b.maxblocksizes)
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+	i := int(pct * float64(len(sizes)))
+	if i >= len(sizes) {
+		i = len(sizes) - 1
+	} else if i < 0 {
+		i = 0
+	}
+	return b.WithMaxBlockSize(sizes[i])
+}
+
 func (b *IndBlockSource) Copy(n int) []BlockSource {
 	bb := make([]BlockSource, n)
 	r := getrand(n + 1)
@@ -50,6 +108,8 @@ func (b *IndBlockSource) Copy(n int) []BlockSource {
 			minfeerates:   b.minfeerates,
 			maxblocksizes: b.maxblocksizes,
 			blockrate:     b.blockrate,
+			emptyprob:     b.emptyprob,
+			lowconf:       b.lowconf,
 			rand:          r[i+1],
 		}
 	}
@@ -57,17 +117,24 @@ func (b *IndBlockSource) Copy(n int) []BlockSource {
 }
 
 func (b *IndBlockSource) RateFn() MonotonicFn {
+	return capRateFn(b.minfeerates, b.maxblocksizes, b.blockrate, b.emptyprob)
+}
+
+// capRateFn returns the capacity rate fn of blocks found at blockrate, whose
+// min fee rates and max block sizes are distributed as minfeerates and
+// maxblocksizes, and which are empty with probability emptyprob.
+func capRateFn(minfeerates []FeeRate, maxblocksizes []TxSize, blockrate, emptyprob float64) MonotonicFn {
 	// Calculate the average max block size
 	sizesum := TxSize(0)
-	for _, s := range b.maxblocksizes {
+	for _, s := range maxblocksizes {
 		sizesum += s
 	}
-	avgmbs := float64(sizesum) / float64(len(b.maxblocksizes))
+	avgmbs := float64(sizesum) / float64(len(maxblocksizes)) * (1 - emptyprob)
 
 	m := make(map[float64]float64)
-	for _, f := range b.minfeerates {
+	for _, f := range minfeerates {
 		if f < MaxFeeRate {
-			m[float64(f)] += 1 / float64(len(b.minfeerates))
+			m[float64(f)] += 1 / float64(len(minfeerates))
 		}
 	}
 	x := make([]float64, len(m))
@@ -78,7 +145,7 @@ func (b *IndBlockSource) RateFn() MonotonicFn {
 	ratesum := float64(0)
 	y := make([]float64, len(x))
 	for i, f := range x {
-		ratesum += m[f] * avgmbs * b.blockrate
+		ratesum += m[f] * avgmbs * blockrate
 		y[i] = ratesum
 	}
 	return NewCapRateFn(x, y)
@@ -105,6 +172,8 @@ func (b *IndBlockSource) MarshalJSON() ([]byte, error) {
 	v["minfeerates"] = minfeerates
 	v["maxblocksizes"] = maxblocksizes
 	v["blockrate"] = b.blockrate
+	v["emptyprob"] = b.emptyprob
+	v["lowconfidence"] = b.lowconf
 	v["type"] = "IndBlockSource"
 	return json.Marshal(v)
 }
@@ -69,6 +69,16 @@ func TestIndBlockSource(t *testing.T) {
 	// Test RateFn approx
 	approx := ratefn.Approx(20)
 	t.Log("CapRateFn approx:", approx)
+	// n exceeds the number of distinct points, so all points are returned.
+	if err := testutil.CheckEqual(approx, ratefn); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(ratefn.Approx(0), ratefn); err != nil {
+		t.Error(err)
+	}
+	if n := len(ratefn.Approx(2).(CapRateFn).x); n > 2 {
+		t.Errorf("Approx(2) returned %d points", n)
+	}
 
 	// Test null source
 	b = NewIndBlockSource([]FeeRate{MaxFeeRate}, []TxSize{1e6}, blockrate)
@@ -88,3 +98,32 @@ func TestIndBlockSource(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestIndBlockSourceEmptyProb(t *testing.T) {
+	const N = 100000
+	blockrate := 1.0 / 600.0
+	ref := NewIndBlockSource([]FeeRate{5000, 10000}, []TxSize{1000000, 750000}, blockrate)
+	b := ref.WithEmptyProb(0.2).Copy(1)[0]
+	var empty int
+	for i := 0; i < N; i++ {
+		if _, p := b.Next(); p.MaxBlockSize == 0 {
+			empty++
+		}
+	}
+	if err := testutil.CheckPctDiff(float64(empty)/N, 0.2, 0.02); err != nil {
+		t.Error(err)
+	}
+
+	// Capacity is reduced accordingly, and the block rate is unchanged
+	b = ref.WithEmptyProb(0.2)
+	if err := testutil.CheckPctDiff(b.RateFn().Eval(10000), 0.8*ref.RateFn().Eval(10000), 1e-9); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(b.BlockRate(), blockrate); err != nil {
+		t.Error(err)
+	}
+	// Preserved by WithMaxBlockSize
+	if err := testutil.CheckEqual(ref.WithEmptyProb(0.2).WithMaxBlockSize(1e6).emptyprob, 0.2); err != nil {
+		t.Error(err)
+	}
+}
@@ -84,6 +84,24 @@ func (s *MultiTxSource) Copy(n int) []TxSource {
 	return ss
 }
 
+func (s *MultiTxSource) SampleSize() int {
+	return len(s.txs)
+}
+
+func (s *MultiTxSource) Downsample(n int) TxSource {
+	if n <= 0 || n >= len(s.txs) {
+		return s.Copy(1)[0]
+	}
+	feerates := make([]FeeRate, n)
+	sizes := make([]TxSize, n)
+	weights := make([]float64, n)
+	for i := range feerates {
+		j := i * len(s.txs) / n
+		feerates[i], sizes[i], weights[i] = s.txs[j].FeeRate, s.txs[j].Size, s.weights[j]
+	}
+	return NewMultiTxSource(feerates, sizes, weights, s.txrate)
+}
+
 func (s *MultiTxSource) MinSize() TxSize {
 	return s.minSize
 }
@@ -171,3 +171,28 @@ func moments(x []float64) (mean float64, variance float64) {
 	variance = s / (n - 1)
 	return
 }
+
+func TestMultiTxSourceDownsample(t *testing.T) {
+	f := []FeeRate{40000, 30000, 20000, 10000, 40000, 30000}
+	s := []TxSize{250, 250, 250, 250, 500, 500}
+	w := []float64{1, 1, 3, 1, 1, 1}
+	txsrc := NewMultiTxSource(f, s, w, 2)
+	var _ SampledTxSource = txsrc
+
+	d := txsrc.Downsample(3).(*MultiTxSource)
+	if err := testutil.CheckEqual(d.txs, []Tx{
+		{FeeRate: 40000, Size: 250}, {FeeRate: 20000, Size: 250}, {FeeRate: 40000, Size: 500},
+	}); err != nil {
+		t.Error(err)
+	}
+	// Relative weights are kept
+	if err := testutil.CheckEqual(d.weights, []float64{0.2, 0.6, 0.2}); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(d.txrate, txsrc.txrate); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(txsrc.Downsample(6).(*MultiTxSource).SampleSize(), 6); err != nil {
+		t.Error(err)
+	}
+}
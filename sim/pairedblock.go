@@ -0,0 +1,135 @@
+package sim
+
+import (
+	"encoding/json"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Implements BlockSource; samples the min fee rate and max block size of a
+// block together, as one of the observed block policies, so that their
+// correlation (a miner's policy pairs them) is preserved. Not concurrent safe.
+type PairedBlockSource struct {
+	policies  []BlockPolicy
+	blockrate float64 // blocks per second
+	emptyprob float64 // probability that a block is empty
+	lowconf   bool    // estimated from less data than usually required
+	rand      *rand.Rand
+}
+
+func NewPairedBlockSource(policies []BlockPolicy, blockrate float64) *PairedBlockSource {
+	if blockrate <= 0 {
+		panic("blockrate must be > 0")
+	}
+	if len(policies) == 0 {
+		panic("policies must have len > 0.")
+	}
+	return &PairedBlockSource{
+		policies:  policies,
+		blockrate: blockrate,
+		rand:      getrand(1)[0],
+	}
+}
+
+func (b *PairedBlockSource) Next() (t time.Duration, p BlockPolicy) {
+	t = time.Duration(b.rand.ExpFloat64() / b.blockrate * float64(time.Second))
+	p = b.policies[b.rand.Intn(len(b.policies))]
+	if b.emptyprob > 0 && b.rand.Float64() < b.emptyprob {
+		p.MaxBlockSize = 0
+	}
+	return
+}
+
+func (b *PairedBlockSource) BlockRate() float64 {
+	return b.blockrate
+}
+
+// WithEmptyProb returns a copy of b in which each block is empty with
+// probability p, as with IndBlockSource.WithEmptyProb.
+func (b *PairedBlockSource) WithEmptyProb(p float64) *PairedBlockSource {
+	c := NewPairedBlockSource(b.policies, b.blockrate)
+	c.emptyprob = p
+	c.lowconf = b.lowconf
+	return c
+}
+
+// WithLowConfidence returns a copy of b, flagged as low confidence if lowconf,
+// as with IndBlockSource.WithLowConfidence.
+func (b *PairedBlockSource) WithLowConfidence(lowconf bool) *PairedBlockSource {
+	c := NewPairedBlockSource(b.policies, b.blockrate)
+	c.emptyprob = b.emptyprob
+	c.lowconf = lowconf
+	return c
+}
+
+// LowConfidence returns whether b is flagged as low confidence; see
+// WithLowConfidence.
+func (b *PairedBlockSource) LowConfidence() bool {
+	return b.lowconf
+}
+
+func (b *PairedBlockSource) Copy(n int) []BlockSource {
+	bb := make([]BlockSource, n)
+	r := getrand(n + 1)
+	for i := range bb {
+		bb[i] = &PairedBlockSource{
+			policies:  b.policies,
+			blockrate: b.blockrate,
+			emptyprob: b.emptyprob,
+			lowconf:   b.lowconf,
+			rand:      r[i+1],
+		}
+	}
+	return bb
+}
+
+// RateFn returns the capacity byte rate at fee rate x: the max block size
+// averaged over the policies, counting those with min fee rate > x as 0, times
+// the block rate. Unlike IndBlockSource, the max block sizes at each fee rate
+// are those of the policies with that min fee rate.
+func (b *PairedBlockSource) RateFn() MonotonicFn {
+	m := make(map[float64]float64)
+	for _, p := range b.policies {
+		if p.MinFeeRate < MaxFeeRate {
+			m[float64(p.MinFeeRate)] += float64(p.MaxBlockSize) / float64(len(b.policies))
+		}
+	}
+	x := make([]float64, 0, len(m))
+	for k := range m {
+		x = append(x, k)
+	}
+	sort.Float64s(x)
+	ratesum := float64(0)
+	y := make([]float64, len(x))
+	for i, f := range x {
+		ratesum += m[f] * (1 - b.emptyprob) * b.blockrate
+		y[i] = ratesum
+	}
+	return NewCapRateFn(x, y)
+}
+
+func (b *PairedBlockSource) MarshalJSON() ([]byte, error) {
+	policies := make([][2]float64, len(b.policies))
+	for i, p := range b.policies {
+		policies[i][0] = float64(p.MinFeeRate)
+		if p.MinFeeRate == MaxFeeRate {
+			policies[i][0] = -1
+		}
+		policies[i][1] = float64(p.MaxBlockSize)
+	}
+	sort.Slice(policies, func(i, j int) bool {
+		if policies[i][0] != policies[j][0] {
+			return policies[i][0] < policies[j][0]
+		}
+		return policies[i][1] < policies[j][1]
+	})
+
+	v := make(map[string]interface{})
+	v["policies"] = policies // [minfeerate, maxblocksize] pairs
+	v["blockrate"] = b.blockrate
+	v["emptyprob"] = b.emptyprob
+	v["lowconfidence"] = b.lowconf
+	v["type"] = "PairedBlockSource"
+	return json.Marshal(v)
+}
@@ -0,0 +1,62 @@
+package sim
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/bitcoinfees/feesim/testutil"
+)
+
+func TestPairedBlockSource(t *testing.T) {
+	const N = 10000
+	policies := []BlockPolicy{
+		{MinFeeRate: 5000, MaxBlockSize: 2000000},
+		{MinFeeRate: 20000, MaxBlockSize: 500000},
+	}
+	blockrate := 1.0 / 600.0
+	b := NewPairedBlockSource(policies, blockrate).Copy(1)[0]
+	T := time.Duration(0)
+	var numLow int
+	for i := 0; i < N; i++ {
+		tm, p := b.Next()
+		T += tm
+		// The policies are sampled whole; never mixed.
+		if p != policies[0] && p != policies[1] {
+			t.Fatalf("policy %+v was not one of the observed", p)
+		}
+		if p == policies[0] {
+			numLow++
+		}
+	}
+	if err := testutil.CheckPctDiff(float64(numLow)/N, 0.5, 0.03); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckPctDiff(float64(N)/T.Seconds(), blockrate, 0.02); err != nil {
+		t.Error(err)
+	}
+
+	// Test MarshalJSON
+	bJSON, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(string(bJSON))
+
+	// Test RateFn; policies which never include txs don't add capacity.
+	policies = append(policies, BlockPolicy{MinFeeRate: MaxFeeRate, MaxBlockSize: 1000000})
+	ratefn := NewPairedBlockSource(policies, blockrate).RateFn()
+	xref := []float64{4999, 5000, 19999, 20000, float64(MaxFeeRate)}
+	yref := []float64{0, 1111, 1111, 1388, 1388}
+	for i, x := range xref {
+		if err := testutil.CheckEqual(int(ratefn.Eval(x)), int(yref[i])); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Capacity is reduced by the empty block probability
+	ratefn = NewPairedBlockSource(policies, blockrate).WithEmptyProb(0.5).RateFn()
+	if err := testutil.CheckEqual(int(ratefn.Eval(20000)), 694); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,124 @@
+package sim
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RBFConfig configures RBFTxSource.
+type RBFConfig struct {
+	// If false, the tx source isn't wrapped, i.e. there's no replacement.
+	Enabled bool `yaml:"enabled" json:"enabled"`
+
+	// Probability that a generated tx is replaceable, i.e. is replaced at the
+	// next Generate call if it's still unconfirmed.
+	ReplaceProb float64 `yaml:"replaceprob" json:"replaceprob"`
+
+	// Mean of the fee rate bump of the replacements, as a fraction of the
+	// original fee rate. The bumps are exponentially distributed.
+	MeanBump float64 `yaml:"meanbump" json:"meanbump"`
+}
+
+// RBFTxSource models replace-by-fee: each tx of the underlying source is
+// replaceable with probability ReplaceProb, in which case the next Generate
+// call also returns a replacement of it, with the same size and a bumped fee
+// rate. Sim drops the original from its queue when the replacement arrives, or
+// if the original was already confirmed, drops the replacement instead.
+// Unlike BumpTxSource, the replaced txs are removed, but each tx is replaced
+// at most once. Implements TxSource; not concurrent safe.
+type RBFTxSource struct {
+	src     TxSource
+	cfg     RBFConfig
+	pending []*Tx // The replaceable txs of the last Generate call
+	rand    *rand.Rand
+}
+
+// NewRBFTxSource returns src with replacements according to cfg. cfg.Enabled
+// isn't checked; it's for the caller to decide whether to wrap src.
+func NewRBFTxSource(src TxSource, cfg RBFConfig) *RBFTxSource {
+	if cfg.ReplaceProb < 0 || cfg.ReplaceProb > 1 {
+		panic("replaceprob must be in [0, 1]")
+	}
+	if cfg.MeanBump <= 0 {
+		panic("meanbump must be > 0")
+	}
+	return &RBFTxSource{src: src, cfg: cfg, rand: getrand(1)[0]}
+}
+
+// Generate returns the replacements of the replaceable txs of the last call,
+// followed by the txs of the underlying source. The replaceable ones are
+// copies, since the sim identifies them by pointer, and the generated txs may
+// be shared.
+func (s *RBFTxSource) Generate(t time.Duration) []*Tx {
+	txs := s.src.Generate(t)
+	out := make([]*Tx, 0, len(s.pending)+len(txs))
+	for _, orig := range s.pending {
+		out = append(out, &Tx{
+			FeeRate:  bumpFeeRate(orig.FeeRate, s.cfg.MeanBump*s.rand.ExpFloat64()),
+			Size:     orig.Size,
+			replaces: orig,
+		})
+	}
+	s.pending = s.pending[:0]
+	for _, tx := range txs {
+		if s.rand.Float64() < s.cfg.ReplaceProb {
+			tx = &Tx{FeeRate: tx.FeeRate, Size: tx.Size, replaceable: true}
+			s.pending = append(s.pending, tx)
+		}
+		out = append(out, tx)
+	}
+	return out
+}
+
+// bumpFeeRate returns f increased by the fraction bump, and by at least 1 (as
+// required of replacements), capped at MaxFeeRate.
+func bumpFeeRate(f FeeRate, bump float64) FeeRate {
+	if f == MaxFeeRate {
+		return f
+	}
+	b := float64(f) * (1 + bump)
+	if b >= float64(MaxFeeRate) {
+		return MaxFeeRate
+	}
+	if bumped := FeeRate(math.Floor(b)); bumped > f {
+		return bumped
+	}
+	return f + 1
+}
+
+// Reset forgets the replaceable txs, whose replacements would otherwise arrive
+// in the next sim run (see Sim.Reset).
+func (s *RBFTxSource) Reset() {
+	s.pending = nil
+}
+
+func (s *RBFTxSource) Copy(n int) []TxSource {
+	ss := s.src.Copy(n)
+	r := getrand(n + 1)
+	for i := range ss {
+		ss[i] = &RBFTxSource{src: ss[i], cfg: s.cfg, rand: r[i+1]}
+	}
+	return ss
+}
+
+func (s *RBFTxSource) MinSize() TxSize {
+	return s.src.MinSize()
+}
+
+// RateFn returns the rate fn of the underlying source. The replacements don't
+// add to the byte rate, since they displace the originals, but they shift it
+// to higher fee rates, which isn't accounted for; so this is a lower bound.
+func (s *RBFTxSource) RateFn() MonotonicFn {
+	return s.src.RateFn()
+}
+
+func (s *RBFTxSource) MarshalJSON() ([]byte, error) {
+	v := make(map[string]interface{})
+	v["source"] = s.src
+	v["replaceprob"] = s.cfg.ReplaceProb
+	v["meanbump"] = s.cfg.MeanBump
+	v["type"] = "RBFTxSource"
+	return json.Marshal(v)
+}
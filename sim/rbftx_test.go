@@ -0,0 +1,125 @@
+package sim
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bitcoinfees/feesim/testutil"
+)
+
+func TestRBFTxSource(t *testing.T) {
+	src := NewUniTxSource([]FeeRate{10000, 20000}, []TxSize{250, 500}, 2)
+	cfg := RBFConfig{Enabled: true, ReplaceProb: 0.2, MeanBump: 0.5}
+	rbf := NewRBFTxSource(src, cfg).Copy(1)[0]
+
+	var (
+		numTxs, numReplaceable, numReplacements int
+		bumpSum                                 float64
+	)
+	for i := 0; i < 100; i++ {
+		for _, tx := range rbf.Generate(10 * time.Minute) {
+			if tx.replaces != nil {
+				numReplacements++
+				if tx.Size != tx.replaces.Size {
+					t.Fatal("replacement size differs from the original")
+				}
+				if tx.FeeRate <= tx.replaces.FeeRate {
+					t.Fatal("replacement fee rate must be higher than the original")
+				}
+				bumpSum += float64(tx.FeeRate)/float64(tx.replaces.FeeRate) - 1
+				continue
+			}
+			numTxs++
+			if tx.replaceable {
+				numReplaceable++
+			}
+		}
+	}
+	t.Logf("%d txs, %d replaceable, %d replacements", numTxs, numReplaceable, numReplacements)
+	if err := testutil.CheckPctDiff(float64(numReplaceable)/float64(numTxs), cfg.ReplaceProb, 0.03); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckPctDiff(bumpSum/float64(numReplacements), cfg.MeanBump, 0.03); err != nil {
+		t.Error(err)
+	}
+	// All but the last call's replaceable txs have been replaced.
+	pending := len(rbf.(*RBFTxSource).pending)
+	if err := testutil.CheckEqual(numReplacements, numReplaceable-pending); err != nil {
+		t.Error(err)
+	}
+
+	// The replacements are forgotten on Reset.
+	rbf.(*RBFTxSource).Reset()
+	for _, tx := range rbf.Generate(0) {
+		t.Errorf("tx %+v generated after reset", tx)
+	}
+
+	if err := testutil.CheckEqual(bumpFeeRate(10, 0.01), FeeRate(11)); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(bumpFeeRate(MaxFeeRate-1, 1), MaxFeeRate); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSimRBF(t *testing.T) {
+	// With a backlog of a few blocks at 15000, the replaceable txs at 10000
+	// get stuck and replaced.
+	src := NewUniTxSource([]FeeRate{10000, 20000}, []TxSize{250, 500}, 2)
+	rbf := NewRBFTxSource(src, RBFConfig{Enabled: true, ReplaceProb: 0.5, MeanBump: 0.5})
+	blk := NewIndBlockSource([]FeeRate{5000}, []TxSize{500000}, 1.0/600)
+	var mempool []*Tx
+	for i := 0; i < 8000; i++ {
+		mempool = append(mempool, &Tx{FeeRate: 15000, Size: 250})
+	}
+	s := NewSim(rbf, blk, mempool)
+	s.SetExpiry(time.Hour)
+	for i := 0; i < 3; i++ {
+		s.NextBlock()
+	}
+	// A replaced tx isn't left in the queue.
+	queued := make(map[*Tx]bool)
+	var numReplacements int
+	for _, tx := range s.queue {
+		queued[tx] = true
+	}
+	for _, tx := range s.queue {
+		if tx.replaces != nil {
+			numReplacements++
+			if queued[tx.replaces] {
+				t.Fatalf("tx %+v queued along with its original", tx)
+			}
+		}
+	}
+	if numReplacements == 0 {
+		t.Error("no replacements were queued")
+	}
+}
+
+func TestSimReplace(t *testing.T) {
+	a := &Tx{FeeRate: 3000, Size: 250, replaceable: true}
+	b := &Tx{FeeRate: 2000, Size: 250, replaceable: true}
+	c := &Tx{FeeRate: 1000, Size: 250}
+	confirmed := &Tx{FeeRate: 1000, Size: 250, replaceable: true}
+	s := &Sim{queue: txqueue{a, b, c}}
+
+	// Without replacements, the queue is untouched.
+	if replaced := s.replace([]*Tx{{FeeRate: 1000, Size: 250}}); replaced != nil {
+		t.Error("nothing should be replaced")
+	}
+	if err := testutil.CheckEqual(len(s.queue), 3); err != nil {
+		t.Error(err)
+	}
+
+	newtxs := []*Tx{
+		{FeeRate: 2500, Size: 250, replaces: b},
+		{FeeRate: 1500, Size: 250, replaces: confirmed},
+	}
+	replaced := s.replace(newtxs)
+	if err := testutil.CheckEqual(replaced, map[*Tx]bool{b: true, confirmed: false}); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(s.queue, txqueue{a, c}); err != nil {
+		t.Error(err)
+	}
+}
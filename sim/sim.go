@@ -28,6 +28,7 @@ package sim
 import (
 	"math"
 	"sort"
+	"time"
 )
 
 type Sim struct {
@@ -38,22 +39,46 @@ type Sim struct {
 	queue       txqueue
 	stablefee   FeeRate
 	minTxSize   TxSize
+
+	// If expiry > 0, txs which have been in the queue for longer than expiry
+	// are dropped (see SetExpiry). elapsed is the sim time since Reset.
+	expiry  time.Duration
+	elapsed time.Duration
+}
+
+// SimConfig configures a Sim (see NewSimWithConfig). The zero value is the
+// configuration of NewSim.
+type SimConfig struct {
+	// If true, the mempool dependencies of the initial mempool txs (their
+	// Parents) are kept, so that a tx only enters the queue once all its
+	// parents are confirmed. Each tx is still included on its own fee rate;
+	// i.e. a child doesn't pay for its parents. initmempool must then be
+	// closed; i.e. the Parents of its txs must be contained in it. If false,
+	// the parents are assumed to be in-chain (see NewSimWithConfig).
+	ModelCPFP bool
 }
 
 // NewSim ... initmempool must be closed; i.e. SimMempoolTx Children must be
 // contained in initmempool.
 func NewSim(txsource TxSource, blocksource BlockSource, initmempool []*Tx) *Sim {
+	return NewSimWithConfig(txsource, blocksource, initmempool, SimConfig{})
+}
+
+// NewSimWithConfig is like NewSim, with the options in cfg.
+func NewSimWithConfig(txsource TxSource, blocksource BlockSource, initmempool []*Tx, cfg SimConfig) *Sim {
 	// Starting with v0.2.0, we pretend that all initial mempool transactions
 	// have no mempool dependencies (i.e. all its txins are already in-chain). This
 	// is due to Bitcoin Core's addition of child-pays-for-parent (CPFP) in v0.13.0;
 	// ideally we would want to model CPFP here as well, but I think the added model
 	// fidelity is not worth the extra computation cost - the mempool dependencies
 	// of tx arrivals aren't modeled anyway.
-	// Eventually we'll want to clean up the code to remove all the now-obsolete
-	// pre-CPFP logic, but we're leaving it in for now because we might change our
-	// minds about modeling CPFP, which would necessitate a large overhaul.
-	for _, tx := range initmempool {
-		tx.Parents = tx.Parents[:0]
+	// The pre-CPFP logic is still available with cfg.ModelCPFP, which keeps the
+	// dependencies, e.g. for analysis of long chains of unconfirmed txs in
+	// high congestion.
+	if !cfg.ModelCPFP {
+		for _, tx := range initmempool {
+			tx.Parents = tx.Parents[:0]
+		}
 	}
 
 	// Calculate the stable fee rate. All tx arrivals with fee rate less than
@@ -118,8 +143,29 @@ func (s *Sim) NextBlock() (sfr FeeRate, blocksize TxSize) {
 	t, b := s.blocksource.Next()
 	// TODO: Consider passing stablefee to Generate instead of filtering here
 	newtxs := s.txsource.Generate(t)
+	if s.expiry > 0 {
+		s.elapsed += t
+		s.expire()
+	}
+	replaced := s.replace(newtxs)
 	for _, tx := range newtxs {
+		if tx.replaces != nil && !replaced[tx.replaces] {
+			// The original was already confirmed (or dropped), so it's not
+			// replaced after all.
+			continue
+		}
 		if tx.FeeRate >= s.stablefee {
+			if s.expiry > 0 {
+				if tx.replaceable || tx.replaces != nil {
+					// Not shared (see RBFTxSource), and the replaceable
+					// ones must stay identifiable.
+					tx.expires = s.elapsed + s.expiry
+				} else {
+					// The generated txs may be shared, so copy them to
+					// record the expiry time.
+					tx = &Tx{FeeRate: tx.FeeRate, Size: tx.Size, expires: s.elapsed + s.expiry}
+				}
+			}
 			s.queue = append(s.queue, tx)
 		}
 	}
@@ -177,13 +223,71 @@ func (s *Sim) NextBlock() (sfr FeeRate, blocksize TxSize) {
 	return sfr, blocksize
 }
 
-// Reset the mempool to initial state
+// replace removes the txs replaced by newtxs from the queue (see
+// RBFTxSource), which then needs to be re-heapified. It returns the replaced
+// txs, mapped to whether they were found in the queue, i.e. were unconfirmed.
+func (s *Sim) replace(newtxs []*Tx) map[*Tx]bool {
+	var replaced map[*Tx]bool
+	for _, tx := range newtxs {
+		if tx.replaces != nil {
+			if replaced == nil {
+				replaced = make(map[*Tx]bool)
+			}
+			replaced[tx.replaces] = false
+		}
+	}
+	if replaced != nil {
+		s.queue.remove(replaced)
+	}
+	return replaced
+}
+
+// SetExpiry sets the tx expiry, i.e. the sim time after which a tx arrival
+// which hasn't been confirmed is dropped from the queue, as with Bitcoin
+// Core's -mempoolexpiry. The arrivals of each block are taken to arrive at the
+// time of the block. The initial mempool txs don't expire, since their ages
+// are unknown (and the expired ones were already evicted by Bitcoin Core). If
+// d <= 0, txs don't expire (the default). It also resets the sim.
+func (s *Sim) SetExpiry(d time.Duration) {
+	s.expiry = d
+	s.Reset()
+}
+
+// expire drops the expired txs from the queue, which then needs to be
+// re-heapified.
+func (s *Sim) expire() {
+	q := s.queue[:0]
+	for _, tx := range s.queue {
+		if tx.expires == 0 || tx.expires >= s.elapsed {
+			q = append(q, tx)
+		}
+	}
+	for i := len(q); i < len(s.queue); i++ {
+		s.queue[i] = nil
+	}
+	s.queue = q
+}
+
+// Reset the mempool to initial state. The tx and block sources are reset too,
+// if they have state across Generate / Next calls (e.g. RBFTxSource,
+// ConstBlockSource).
 func (s *Sim) Reset() {
+	if r, ok := s.txsource.(interface {
+		Reset()
+	}); ok {
+		r.Reset()
+	}
+	if r, ok := s.blocksource.(interface {
+		Reset()
+	}); ok {
+		r.Reset()
+	}
 	for _, tx := range s.initmempool {
 		tx.removedparents = 0
 	}
 	s.queue = make(txqueue, len(s.initqueue))
 	copy(s.queue, s.initqueue)
+	s.elapsed = 0
 }
 
 // Check if children of tx have satisfied all deps, i.e. all parents have
@@ -248,6 +352,7 @@ func (s *Sim) Copy(n int) []*Sim {
 			stablefee:   s.stablefee,
 			initqueue:   q,
 			minTxSize:   s.minTxSize,
+			expiry:      s.expiry,
 		}
 		ss[i].Reset()
 	}
@@ -5,6 +5,7 @@ import (
 	"os"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/bitcoinfees/feesim/testutil"
 )
@@ -12,15 +13,15 @@ import (
 func TestMain(m *testing.M) {
 	testutil.LoadData("../testutil/testdata")
 
-	// Replace main's getrand; seed value can be anything as long as
-	// it's constant
-	getrand = func(n int) []*rand.Rand {
+	// Deterministic seeding; seed value can be anything as long as it's
+	// constant
+	SetRandSource(func(n int) []*rand.Rand {
 		r := make([]*rand.Rand, n)
 		for i := range r {
 			r[i] = rand.New(rand.NewSource(int64(i + 1)))
 		}
 		return r
-	}
+	})
 
 	os.Exit(m.Run())
 }
@@ -223,6 +224,65 @@ func TestSimSFR(t *testing.T) {
 	}
 }
 
+func TestSimExpiry(t *testing.T) {
+	// A 10 block backlog of high fee txs, while low fee txs arrive at just
+	// below capacity. Without expiry, the low fee arrivals pile up behind the
+	// backlog, and are confirmed once it clears. With expiry, most of them
+	// expire first.
+	newSim := func(expiry time.Duration) *Sim {
+		var initmempool []*Tx
+		for i := 0; i < 4000; i++ {
+			initmempool = append(initmempool, &Tx{FeeRate: 20000, Size: 250})
+		}
+		blocksource := NewIndBlockSource([]FeeRate{1000}, []TxSize{100000}, 1./600)
+		txsource := NewMultiTxSource([]FeeRate{6000}, []TxSize{250}, []float64{1}, 0.6)
+		s := NewSim(txsource, blocksource, initmempool)
+		s.SetExpiry(expiry)
+		return s
+	}
+	const numBlocks = 16
+	sfrs := func(s *Sim) []FeeRate {
+		r := make([]FeeRate, numBlocks)
+		for i := range r {
+			r[i], _ = s.NextBlock()
+		}
+		return r
+	}
+
+	ref := sfrs(newSim(0))
+	s := newSim(10 * time.Minute)
+	expiring := sfrs(s)
+	t.Log(ref)
+	t.Log(expiring)
+	var numLower int
+	for i := range ref {
+		if expiring[i] > ref[i] {
+			t.Errorf("block %d: SFR %d with expiry exceeds %d without", i+1, expiring[i], ref[i])
+		}
+		if expiring[i] < ref[i] {
+			numLower++
+		}
+	}
+	if numLower == 0 {
+		t.Error("expiry should lower some SFRs")
+	}
+	// The initial mempool doesn't expire, so the backlog itself is the same.
+	for i := 0; i < 9; i++ {
+		if err := testutil.CheckEqual(expiring[i], FeeRate(20001)); err != nil {
+			t.Error(i, err)
+		}
+	}
+
+	// Reset restarts the sim clock, and copies keep the expiry.
+	s.Reset()
+	if err := testutil.CheckEqual(s.elapsed, time.Duration(0)); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(s.Copy(1)[0].expiry, 10*time.Minute); err != nil {
+		t.Error(err)
+	}
+}
+
 func loadInitMempool(height string) []*Tx {
 	txids := []string{}
 	m := make(map[string]*Tx)
@@ -0,0 +1,66 @@
+package sim
+
+import "math"
+
+const (
+	// The queue length is taken to have stabilized when running another
+	// window of blocks changes the running mean queue length by at most
+	// steadyStateTol (relative). The queue length itself is too noisy to
+	// compare window to window.
+	steadyStateTol = 0.05
+
+	// The max number of windows run per iteration before giving up on
+	// stabilization and sampling anyway.
+	maxSteadyStateWindows = 100
+)
+
+// SteadyStateSFR runs the queue of s to equilibrium and returns the median
+// SFR at equilibrium, i.e. a "minimum fee to ever confirm" indicator.
+//
+// In each of iters iterations, s is reset and run in windows of numblocks
+// blocks, until the running mean queue length (number of txs) stabilizes to
+// within steadyStateTol; the SFRs of the next window are then sampled. The
+// median over all samples is returned.
+//
+// This differs from StableFee, which is the analytic threshold below which
+// arrivals are discarded because their byterate exceeds the capacity; it's a
+// lower bound of the SFR, whereas SteadyStateSFR accounts for the queueing at
+// fee rates above it. s is reset afterwards, and must not be in use
+// elsewhere. If numblocks or iters is <= 0, StableFee is returned.
+func SteadyStateSFR(s *Sim, numblocks, iters int) FeeRate {
+	if numblocks <= 0 || iters <= 0 {
+		return s.StableFee()
+	}
+	defer s.Reset()
+
+	sfrs := make([]FeeRate, 0, numblocks*iters)
+	for i := 0; i < iters; i++ {
+		s.Reset()
+		total := s.runWindow(numblocks, nil)
+		for n := 2; n <= maxSteadyStateWindows; n++ {
+			prev := total / float64(n-1)
+			total += s.runWindow(numblocks, nil)
+			curr := total / float64(n)
+			if curr == prev || (prev > 0 && math.Abs(curr-prev)/prev <= steadyStateTol) {
+				break
+			}
+		}
+		s.runWindow(numblocks, func(sfr FeeRate) { sfrs = append(sfrs, sfr) })
+	}
+	feeRateSlice(sfrs).Sort()
+	return sfrs[len(sfrs)/2]
+}
+
+// runWindow runs numblocks blocks of s, calling sample (if not nil) with each
+// SFR, and returns the mean queue length after each block.
+func (s *Sim) runWindow(numblocks int, sample func(FeeRate)) float64 {
+	var total int
+	for i := 0; i < numblocks; i++ {
+		sfr, _ := s.NextBlock()
+		if sample != nil {
+			sample(sfr)
+		}
+		total += len(s.queue)
+	}
+	return float64(total) / float64(numblocks)
+}
@@ -0,0 +1,49 @@
+package sim
+
+import (
+	"testing"
+
+	"github.com/bitcoinfees/feesim/testutil"
+)
+
+func TestSteadyStateSFR(t *testing.T) {
+	// Capacity of 1e6 bytes per 600s, i.e. 1667 bytes/s, at fee rates >=
+	// 1000. The tx byterate is 625 bytes/s at each of the 4 fee rates, so
+	// the arrivals at 5000 and below exceed the spare capacity and are
+	// discarded, i.e. the stable fee is 5001.
+	blocksource := NewIndBlockSource([]FeeRate{1000}, []TxSize{1000000}, 1./600)
+	feerates := []FeeRate{20000, 10000, 5000, 2000}
+	sizes := []TxSize{250, 250, 250, 250}
+	weights := []float64{1, 1, 1, 1}
+	txsource := NewMultiTxSource(feerates, sizes, weights, 10)
+	s := NewSim(txsource, blocksource, nil)
+	if err := testutil.CheckEqual(s.StableFee(), FeeRate(5001)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Utilization above the stable fee is 75%, but since the block intervals
+	// are exponential, about half the blocks are full, so the median SFR
+	// exceeds the stable fee.
+	if err := testutil.CheckEqual(SteadyStateSFR(s, 50, 3), FeeRate(10001)); err != nil {
+		t.Error(err)
+	}
+
+	// With 6 tx/s, all the arrivals fit within the capacity, so the stable
+	// fee is the min fee rate of 1000, whereas at equilibrium (90%
+	// utilization) the queue is seldom cleared, so that the SFR is higher.
+	txsource = NewMultiTxSource(feerates, sizes, weights, 6)
+	s = NewSim(txsource, blocksource, nil)
+	if err := testutil.CheckEqual(s.StableFee(), FeeRate(1000)); err != nil {
+		t.Fatal(err)
+	}
+	sfr := SteadyStateSFR(s, 50, 3)
+	if sfr <= s.StableFee() {
+		t.Errorf("steady state SFR %d should exceed the stable fee %d", sfr, s.StableFee())
+	}
+	t.Log("steady state SFR:", sfr)
+
+	// Non-positive args
+	if err := testutil.CheckEqual(SteadyStateSFR(s, 0, 10), s.StableFee()); err != nil {
+		t.Error(err)
+	}
+}
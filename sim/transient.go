@@ -1,6 +1,7 @@
 package sim
 
 import (
+	"math"
 	"runtime"
 	"sort"
 	"sync"
@@ -11,14 +12,53 @@ type TransientConfig struct {
 	MinSuccessPct    float64 `yaml:"minsuccesspct" json:"minsuccesspct"` // should be in [0, 1)
 	NumIters         int     `yaml:"numiters" json:"numiters"`
 
+	// Debug option: keep the raw conf time variates of the last run, so that
+	// they can be retrieved with TransientSim.Variates. There are NumIters of
+	// them, so take care.
+	KeepVariates bool `yaml:"keepvariates" json:"keepvariates"`
+
+	// Number of sim copies to run concurrently. If <= 0, GOMAXPROCS is used.
+	NumProcs int `yaml:"numprocs" json:"numprocs"`
+
+	// If > 0, and the variates have more than MaxFeeRates distinct fee
+	// rates, the result is computed over a geometric grid of MaxFeeRates fee
+	// rates spanning their range, instead of all of them. This bounds the
+	// aggregation cost; each estimate is then at most one grid step higher
+	// than the exact one.
+	MaxFeeRates int `yaml:"maxfeerates" json:"maxfeerates"`
+
+	// Compute 95% confidence bounds on each target's fee rate, which are
+	// returned by RunWithBounds (see TransientResult).
+	WithConfidence bool `yaml:"withconfidence" json:"withconfidence"`
+
 	LowestFeeRate FeeRate `yaml:"-" json:"-"`
 }
 
+// TransientResult is the result of a transient sim run. FeeRates[i] is the
+// lowest fee rate to confirm in i+1 blocks, or -1 if there is no such fee
+// rate. If TransientConfig.WithConfidence is set, Lower[i] and Upper[i] are
+// the bounds of a 95% confidence interval of FeeRates[i] (an Upper[i] of -1
+// means that it's unbounded); otherwise they're nil.
+type TransientResult struct {
+	FeeRates []FeeRate `json:"feerates"`
+	Lower    []FeeRate `json:"lower,omitempty"`
+	Upper    []FeeRate `json:"upper,omitempty"`
+}
+
 type transientVar struct {
 	feeRates  []FeeRate
 	confTimes []int
 }
 
+// TransientVariate is the result of a single transient sim iteration:
+// a transaction with fee rate >= FeeRates[i] was confirmed in ConfTimes[i]
+// blocks. ConfTimes[i] == MaxBlockConfirms+1 means that it was not confirmed
+// within MaxBlockConfirms blocks.
+type TransientVariate struct {
+	FeeRates  []FeeRate `json:"feerates"`
+	ConfTimes []int     `json:"conftimes"`
+}
+
 type TransientSim struct {
 	sim *Sim
 
@@ -28,6 +68,18 @@ type TransientSim struct {
 	// It's max(sim.StableFee(), cfg.LowestFeeRate)
 	lowestfee FeeRate
 
+	// The raw variates of the run, if cfg.KeepVariates.
+	variates []transientVar
+
+	// The next block conf probability function of the run.
+	nextBlockProb *NextBlockProb
+
+	// The conf time distribution of the run.
+	confTimeDist *ConfTimeDist
+
+	// The conf time counts of the run, by fee rate.
+	successCounts *SuccessCounts
+
 	// Used to stop the sim, ans also to signify that Run has been called, since
 	// the channel is made in Run.
 	done chan struct{}
@@ -66,28 +118,120 @@ func (ts *TransientSim) closeDone() {
 	}
 }
 
+// Variates returns the raw conf time variates of the run, if
+// cfg.KeepVariates was set. Returns nil if the run is not yet complete.
+func (ts *TransientSim) Variates() []TransientVariate {
+	ts.mux.RLock()
+	defer ts.mux.RUnlock()
+	if ts.variates == nil {
+		return nil
+	}
+	v := make([]TransientVariate, len(ts.variates))
+	for i, tvar := range ts.variates {
+		v[i] = TransientVariate{FeeRates: tvar.feeRates, ConfTimes: tvar.confTimes}
+	}
+	return v
+}
+
+// AggregateVariates computes the transient sim result from the raw conf time
+// variates, with respect to cfg.MinSuccessPct and cfg.MaxBlockConfirms.
+// result[i] is the lowest fee to confirm in i+1 blocks, or -1 if there is
+// no such fee.
+func AggregateVariates(v []TransientVariate, cfg TransientConfig) []FeeRate {
+	tvars := make([]transientVar, len(v))
+	for i, vi := range v {
+		tvars[i] = transientVar{feeRates: vi.FeeRates, confTimes: vi.ConfTimes}
+	}
+	return aggregate(tvars, cfg)
+}
+
+// NextBlockProb returns the estimated probability, as a function of fee rate,
+// of confirmation in the next block. Returns nil if the run is not yet
+// complete.
+func (ts *TransientSim) NextBlockProb() *NextBlockProb {
+	ts.mux.RLock()
+	defer ts.mux.RUnlock()
+	return ts.nextBlockProb
+}
+
+// ConfTimeDist returns the distribution of the conf time (in blocks) as a
+// function of fee rate. Returns nil if the run is not yet complete.
+func (ts *TransientSim) ConfTimeDist() *ConfTimeDist {
+	ts.mux.RLock()
+	defer ts.mux.RUnlock()
+	return ts.confTimeDist
+}
+
+// SuccessCounts returns the conf time counts of the run, by fee rate, from
+// which the result for any success pct can be computed. Returns nil if the
+// run is not yet complete.
+func (ts *TransientSim) SuccessCounts() *SuccessCounts {
+	ts.mux.RLock()
+	defer ts.mux.RUnlock()
+	return ts.successCounts
+}
+
+// PercentileFeeRates returns result[k], the result of the run with
+// MinSuccessPct pcts[k] (see SuccessCounts.FeeRates). Returns nil if the run
+// is not yet complete.
+func (ts *TransientSim) PercentileFeeRates(pcts []float64) [][]FeeRate {
+	c := ts.SuccessCounts()
+	if c == nil {
+		return nil
+	}
+	result := make([][]FeeRate, len(pcts))
+	for k, pct := range pcts {
+		result[k] = c.FeeRates(pct)
+	}
+	return result
+}
+
 func (ts *TransientSim) Run() <-chan []FeeRate {
 	r := make(chan []FeeRate)
 	ts.wg.Add(1)
-	go ts.run(r)
+	go func() {
+		defer close(r)
+		ts.run(func(result TransientResult) {
+			select {
+			case r <- result.FeeRates:
+			case <-ts.done:
+			}
+		})
+	}()
+	return r
+}
+
+// RunWithBounds is like Run, except that the result includes the confidence
+// bounds if cfg.WithConfidence is set.
+func (ts *TransientSim) RunWithBounds() <-chan TransientResult {
+	r := make(chan TransientResult)
+	ts.wg.Add(1)
+	go func() {
+		defer close(r)
+		ts.run(func(result TransientResult) {
+			select {
+			case r <- result:
+			case <-ts.done:
+			}
+		})
+	}()
 	return r
 }
 
-func (ts *TransientSim) run(r chan<- []FeeRate) {
-	var result []FeeRate
+// run runs the sim, and calls send with the result (which is empty if the
+// sim was stopped).
+func (ts *TransientSim) run(send func(TransientResult)) {
+	var result TransientResult
 
-	defer close(r)
 	defer ts.closeDone()
-	defer func() {
-		select {
-		case r <- result:
-		case <-ts.done:
-		}
-	}()
+	defer func() { send(result) }()
 	defer ts.wg.Wait()
 	defer ts.wg.Done()
 
-	numprocs := runtime.GOMAXPROCS(0)
+	numprocs := ts.cfg.NumProcs
+	if numprocs <= 0 {
+		numprocs = runtime.GOMAXPROCS(0)
+	}
 
 	ts.sim.Reset()
 	ss := ts.sim.Copy(numprocs - 1)
@@ -111,30 +255,226 @@ func (ts *TransientSim) run(r chan<- []FeeRate) {
 	}
 
 	tvars := make([]transientVar, ts.cfg.NumIters)
-	fset := make(map[FeeRate]struct{}) // A set of all tvar feerates
 	for i := range tvars {
 		select {
 		case tvars[i] = <-vc:
-			for _, feeRate := range tvars[i].feeRates {
-				fset[feeRate] = struct{}{}
-			}
 		case <-ts.done:
 			return
 		}
 	}
 
-	// Form a reverse sorted array from fset
-	f := make([]FeeRate, len(fset))
-	i := 0
-	for feeRate := range fset {
-		f[i] = feeRate
-		i++
+	ts.mux.Lock()
+	if ts.cfg.KeepVariates {
+		ts.variates = tvars
 	}
-	feeRateSlice(f).ReverseSort()
+	ts.nextBlockProb = newNextBlockProb(tvars, ts.lowestfee)
+	ts.confTimeDist = newConfTimeDist(tvars, ts.lowestfee, ts.cfg.MaxBlockConfirms)
+	ts.successCounts = newSuccessCounts(tvars, ts.cfg)
+	ts.mux.Unlock()
+	if ts.cfg.WithConfidence {
+		result = ts.successCounts.withBounds(ts.cfg.MinSuccessPct)
+	} else {
+		result = TransientResult{FeeRates: ts.successCounts.FeeRates(ts.cfg.MinSuccessPct)}
+	}
+}
+
+// NextBlockProb is the fraction of transient sim iterations in which a
+// transaction of a given fee rate was confirmed in the next block.
+type NextBlockProb struct {
+	// Sorted fee rates required for confirmation in the next block, one for
+	// each iteration in which the next block could be attained at all.
+	feeRates []FeeRate
+	numIters int
+	lowest   FeeRate
+}
+
+func newNextBlockProb(tvars []transientVar, lowest FeeRate) *NextBlockProb {
+	var f []FeeRate
+	for _, v := range tvars {
+		if v.confTimes[0] == 1 {
+			f = append(f, v.feeRates[0])
+		}
+	}
+	feeRateSlice(f).Sort()
+	return &NextBlockProb{feeRates: f, numIters: len(tvars), lowest: lowest}
+}
+
+// Eval returns the probability that a transaction with fee rate feeRate is
+// confirmed in the next block. Fee rates below the sim's lowest fee rate
+// (see Lowest) are not simulated, so the result is 0 for them.
+func (p *NextBlockProb) Eval(feeRate FeeRate) float64 {
+	if p.numIters == 0 || feeRate < p.lowest {
+		return 0
+	}
+	k := sort.Search(len(p.feeRates), func(i int) bool {
+		return p.feeRates[i] > feeRate
+	})
+	return float64(k) / float64(p.numIters)
+}
+
+// Lowest returns the lowest fee rate for which the probability was estimated.
+func (p *NextBlockProb) Lowest() FeeRate {
+	return p.lowest
+}
+
+// ConfTimeDist is the distribution, over the transient sim iterations, of the
+// number of blocks for a transaction of a given fee rate to be confirmed.
+type ConfTimeDist struct {
+	// feeRates[k] are the sorted fee rates required for confirmation within
+	// k+1 blocks, one for each iteration in which it could be attained at
+	// all.
+	feeRates [][]FeeRate
+	numIters int
+	lowest   FeeRate
+}
 
-	b := make([][]int, len(f))
+func newConfTimeDist(tvars []transientVar, lowest FeeRate, maxblocks int) *ConfTimeDist {
+	f := make([][]FeeRate, maxblocks)
+	for _, v := range tvars {
+		// v.feeRates is decreasing, so the fee rate required for confirmation
+		// within k+1 blocks is that of the last variate with conf time <= k+1.
+		j := 0
+		for k := range f {
+			for ; j < len(v.confTimes) && v.confTimes[j] <= k+1; j++ {
+			}
+			if j > 0 {
+				f[k] = append(f[k], v.feeRates[j-1])
+			}
+		}
+	}
+	for _, fk := range f {
+		feeRateSlice(fk).Sort()
+	}
+	return &ConfTimeDist{feeRates: f, numIters: len(tvars), lowest: lowest}
+}
+
+// Eval returns the conf time cumulative distribution of a transaction with
+// fee rate feeRate: p[k] is the probability that it's confirmed within k+1
+// blocks. As with NextBlockProb, it's all 0 for fee rates below Lowest.
+func (d *ConfTimeDist) Eval(feeRate FeeRate) []float64 {
+	p := make([]float64, len(d.feeRates))
+	if d.numIters == 0 || feeRate < d.lowest {
+		return p
+	}
+	for k, f := range d.feeRates {
+		n := sort.Search(len(f), func(i int) bool {
+			return f[i] > feeRate
+		})
+		p[k] = float64(n) / float64(d.numIters)
+	}
+	return p
+}
+
+// Lowest returns the lowest fee rate for which the distribution was estimated.
+func (d *ConfTimeDist) Lowest() FeeRate {
+	return d.lowest
+}
+
+// TimePercentile returns the time in seconds within which a transaction with
+// fee rate feeRate is confirmed with probability pct, given the block rate
+// (in blocks per second). The time to the nth block is Erlang distributed, and
+// is taken to be independent of the number of blocks to confirmation. Returns
+// -1 if the probability of confirmation within the max number of blocks
+// doesn't exceed pct.
+func (d *ConfTimeDist) TimePercentile(feeRate FeeRate, pct, blockRate float64) float64 {
+	cdf := d.Eval(feeRate)
+	// The percentile is only attained in finite time if pct is strictly
+	// less than the probability of confirmation within the max blocks.
+	if len(cdf) == 0 || cdf[len(cdf)-1] <= pct || pct <= 0 || blockRate <= 0 {
+		return -1
+	}
+	// The conf time CDF at t is the sum over k of P(conf in k+1 blocks) *
+	// P(k+1 blocks are found within t).
+	timeCDF := func(t float64) float64 {
+		x := blockRate * t
+		var (
+			c, prev float64
+			term    = math.Exp(-x) // x^i e^-x / i!
+			tail    = 1.0          // P(Poisson(x) >= i+1)
+		)
+		for k, p := range cdf {
+			tail -= term
+			term *= x / float64(k+1)
+			c += (p - prev) * tail
+			prev = p
+		}
+		return c
+	}
+
+	// Bisect for the percentile.
+	lo, hi := 0.0, 1/blockRate
+	for i := 0; timeCDF(hi) < pct; i++ {
+		if i == 64 {
+			return -1 // Too close to call
+		}
+		lo, hi = hi, 2*hi
+	}
+	for i := 0; i < 100 && hi-lo > 1e-6*hi; i++ {
+		mid := (lo + hi) / 2
+		if timeCDF(mid) < pct {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return hi
+}
+
+// z-score of the two-sided 95% confidence bounds
+const confidenceZ = 1.96
+
+// aggregate computes the transient sim result from the conf time variates.
+func aggregate(tvars []transientVar, cfg TransientConfig) []FeeRate {
+	return newSuccessCounts(tvars, cfg).FeeRates(cfg.MinSuccessPct)
+}
+
+// SuccessCounts are the conf time counts of a transient sim run, for each of
+// the fee rates over which the result is computed (see aggregateCounts).
+type SuccessCounts struct {
+	feeRates  []FeeRate
+	counts    [][]int
+	numIters  int
+	maxblocks int
+}
+
+func newSuccessCounts(tvars []transientVar, cfg TransientConfig) *SuccessCounts {
+	f, b := aggregateCounts(tvars, cfg)
+	return &SuccessCounts{feeRates: f, counts: b, numIters: len(tvars), maxblocks: cfg.MaxBlockConfirms}
+}
+
+// FeeRates returns result[i], the lowest fee rate to confirm in i+1 blocks in
+// at least pct of the iterations, or -1 if there is no such fee rate. With
+// pct == MinSuccessPct, it's the result of the run.
+func (c *SuccessCounts) FeeRates(pct float64) []FeeRate {
+	T := int(pct * float64(c.numIters))
+	return percentileFeeRates(c.feeRates, c.counts, T, c.maxblocks)
+}
+
+// withBounds returns FeeRates(p) along with its confidence bounds. The number
+// of iterations in which a fee rate attains a target is binomial, so the
+// bounds are the fee rates at which the success count reaches the bounds of a
+// (normal approximation) binomial confidence interval of p, instead of p
+// itself.
+func (c *SuccessCounts) withBounds(p float64) TransientResult {
+	n := float64(c.numIters)
+	margin := confidenceZ * math.Sqrt(p*(1-p)*n)
+	return TransientResult{
+		FeeRates: percentileFeeRates(c.feeRates, c.counts, int(p*n), c.maxblocks),
+		Lower:    percentileFeeRates(c.feeRates, c.counts, int(math.Floor(p*n-margin)), c.maxblocks),
+		Upper:    percentileFeeRates(c.feeRates, c.counts, int(math.Ceil(p*n+margin)), c.maxblocks),
+	}
+}
+
+// aggregateCounts returns the decreasing fee rates over which the result is
+// computed (see aggregateFeeRates), and b[i][j], the number of variates in
+// which fee rate f[i] was confirmed in j+1 blocks (j == MaxBlockConfirms
+// meaning not confirmed).
+func aggregateCounts(tvars []transientVar, cfg TransientConfig) (f []FeeRate, b [][]int) {
+	f = aggregateFeeRates(tvars, cfg.MaxFeeRates)
+
+	b = make([][]int, len(f))
 	for i := range b {
-		b[i] = make([]int, ts.cfg.MaxBlockConfirms+1)
+		b[i] = make([]int, cfg.MaxBlockConfirms+1)
 	}
 	// Get the blockconf variates for each fee rate
 	for _, v := range tvars {
@@ -149,10 +489,30 @@ func (ts *TransientSim) run(r chan<- []FeeRate) {
 			panic("Some feerates were skipped.")
 		}
 	}
+	return f, b
+}
 
-	// Now get the blockconf MinSuccessPct percentile for each fee rate
+// percentileFeeRates returns result[i], the lowest fee rate in f which is
+// confirmed within i+1 blocks in at least T variates, or -1 if there is no
+// such fee rate; f and b are as returned by aggregateCounts.
+func percentileFeeRates(f []FeeRate, b [][]int, T int, maxblocks int) []FeeRate {
+	result := make([]FeeRate, maxblocks)
+	if len(b) > 0 {
+		var n int
+		for _, count := range b[0] {
+			n += count
+		}
+		if T > n {
+			// Not attained even when not confirmed at all
+			for i := range result {
+				result[i] = -1
+			}
+			return result
+		}
+	}
+
+	// Get the blockconf T-th order statistic for each fee rate
 	p := make([]int, len(f))
-	T := int(ts.cfg.MinSuccessPct * float64(len(tvars)))
 	for i, _b := range b {
 		sum := 0
 		for j, count := range _b {
@@ -169,8 +529,6 @@ func (ts *TransientSim) run(r chan<- []FeeRate) {
 		panic("p should be sorted.")
 	}
 
-	// result[i] is the lowest fee to confirm in i+1 blocks
-	result = make([]FeeRate, ts.cfg.MaxBlockConfirms)
 	// Get the lowest fee rate for each conf time
 	for i := range result {
 		idx := sort.SearchInts(p, i+2)
@@ -180,6 +538,61 @@ func (ts *TransientSim) run(r chan<- []FeeRate) {
 			result[i] = -1
 		}
 	}
+	return result
+}
+
+// aggregateFeeRates returns, in decreasing order, the fee rates over which
+// aggregate computes the result: all the distinct variate fee rates, or if
+// there are more than n > 0 of them, a geometric grid of n fee rates spanning
+// their range. The grid includes the min fee rate, so that every variate
+// still maps to some grid point.
+func aggregateFeeRates(tvars []transientVar, n int) []FeeRate {
+	fset := make(map[FeeRate]struct{}) // A set of all tvar feerates
+	min, max := MaxFeeRate, FeeRate(0)
+	for _, v := range tvars {
+		for _, feeRate := range v.feeRates {
+			fset[feeRate] = struct{}{}
+			if feeRate < min {
+				min = feeRate
+			}
+			if feeRate > max {
+				max = feeRate
+			}
+		}
+	}
+	if n > 0 && len(fset) > n && min >= 0 {
+		return feeRateGrid(min, max, n)
+	}
+
+	// Form a reverse sorted array from fset
+	f := make([]FeeRate, len(fset))
+	i := 0
+	for feeRate := range fset {
+		f[i] = feeRate
+		i++
+	}
+	feeRateSlice(f).ReverseSort()
+	return f
+}
+
+// feeRateGrid returns a geometric grid of at most n >= 2 distinct fee rates
+// from max down to min (with 0 <= min < max); points which coincide after
+// rounding are merged.
+func feeRateGrid(min, max FeeRate, n int) []FeeRate {
+	if n < 2 {
+		n = 2
+	}
+	logmin := math.Log(math.Max(float64(min), 1))
+	step := (math.Log(float64(max)) - logmin) / float64(n-1)
+	f := make([]FeeRate, 0, n)
+	f = append(f, max)
+	for k := n - 2; k > 0; k-- {
+		g := FeeRate(math.Ceil(math.Exp(logmin + float64(k)*step)))
+		if g < f[len(f)-1] && g > min {
+			f = append(f, g)
+		}
+	}
+	return append(f, min)
 }
 
 // transientGen ... maxblocks is MAX_BLOCK_CONFIRMS, n is numiters.
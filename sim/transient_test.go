@@ -2,6 +2,7 @@ package sim
 
 import (
 	"encoding/json"
+	"fmt"
 	"math"
 	"os"
 	"runtime"
@@ -48,13 +49,30 @@ func TestTransient(t *testing.T) {
 	if r != nil {
 		t.Error("r should be nil, was", r)
 	}
+	// Variates not kept by default
+	if v := ts.Variates(); v != nil {
+		t.Error("variates should be nil, was", v)
+	}
+
+	// Test that the variates re-aggregate to the result
+	_c := c
+	_c.KeepVariates = true
+	ts = NewTransientSim(s, _c)
+	r = <-ts.Run()
+	v := ts.Variates()
+	if err := testutil.CheckEqual(len(v), _c.NumIters); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(AggregateVariates(v, _c), r); err != nil {
+		t.Error(err)
+	}
 
 	// TODO: Test TransientConfig boundary values.
 
 	// Test with absurdly high txrate
 	txsrc.txrate = 100
 	s = NewSim(txsrc, blksrc, initmempool)
-	_c := c
+	_c = c
 	_c.NumIters = 5
 	ts = NewTransientSim(s, _c)
 	r = <-ts.Run()
@@ -92,6 +110,250 @@ func TestTransient(t *testing.T) {
 	ts.Stop() // Cancel should be idempotent; should not panic here.
 }
 
+func TestNextBlockProb(t *testing.T) {
+	// Blocks are never full, and there's always a tx at each block min fee
+	// rate, so the next block's SFR is its min fee rate.
+	feerates := []FeeRate{1000, 2000, 3000, 4000}
+	var initmempool []*Tx
+	for _, f := range feerates {
+		initmempool = append(initmempool, &Tx{FeeRate: f, Size: 250})
+	}
+	sizes := []TxSize{250, 250, 250, 250}
+	txsrc := NewMultiTxSource(feerates, sizes, []float64{1, 1, 1, 1}, 0.1)
+	blksrc := NewIndBlockSource(feerates, []TxSize{1e9}, 1./600)
+	s := NewSim(txsrc, blksrc, initmempool)
+
+	c := TransientConfig{
+		MaxBlockConfirms: 5,
+		MinSuccessPct:    0.9,
+		NumIters:         4000,
+		LowestFeeRate:    1000,
+	}
+	ts := NewTransientSim(s, c)
+	if p := ts.NextBlockProb(); p != nil {
+		t.Error("NextBlockProb should be nil before the run is complete.")
+	}
+	<-ts.Run()
+	p := ts.NextBlockProb()
+	if err := testutil.CheckEqual(p.Lowest(), FeeRate(1000)); err != nil {
+		t.Error(err)
+	}
+
+	for _, f := range []FeeRate{0, 999} {
+		if err := testutil.CheckEqual(p.Eval(f), 0.0); err != nil {
+			t.Error(err)
+		}
+	}
+	// The conf time distribution agrees with NextBlockProb.
+	d := ts.ConfTimeDist()
+	for _, f := range []FeeRate{999, 1000, 2500, 4000} {
+		if err := testutil.CheckEqual(d.Eval(f)[0], p.Eval(f)); err != nil {
+			t.Error(err)
+		}
+	}
+	fref := []FeeRate{1000, 1999, 2000, 3500, 4000, MaxFeeRate}
+	pref := []float64{0.25, 0.25, 0.5, 0.75, 1, 1}
+	for i, f := range fref {
+		t.Logf("%d: %.4f", f, p.Eval(f))
+		if err := testutil.CheckPctDiff(p.Eval(f), pref[i], 0.05); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestConfTimeDist(t *testing.T) {
+	tvars := []transientVar{
+		{feeRates: []FeeRate{1000}, confTimes: []int{1}},
+		{feeRates: []FeeRate{2000, 1000}, confTimes: []int{1, 2}},
+		{feeRates: []FeeRate{2000, 1000}, confTimes: []int{2, 3}}, // 1000 not confirmed
+		{feeRates: []FeeRate{3000, 1000}, confTimes: []int{1, 2}},
+	}
+	d := newConfTimeDist(tvars, 1000, 2)
+	cdfref := map[FeeRate][]float64{
+		999:  {0, 0},
+		1000: {0.25, 0.75},
+		2000: {0.5, 1},
+		3000: {0.75, 1},
+	}
+	for f, ref := range cdfref {
+		if err := testutil.CheckEqual(d.Eval(f), ref); err != nil {
+			t.Errorf("%d: %v", f, err)
+		}
+	}
+
+	// With a block rate of one per 10 minutes
+	const blockRate = 1. / 600
+	// 3000 is confirmed in the next block with probability 0.75, else the
+	// one after, so the time CDF is 1 - e^-x - x e^-x / 4, x = blockRate * t.
+	for _, pct := range []float64{0.1, 0.5, 0.9} {
+		tm := d.TimePercentile(3000, pct, blockRate)
+		x := blockRate * tm
+		if err := testutil.CheckPctDiff(1-math.Exp(-x)-x*math.Exp(-x)/4, pct, 1e-5); err != nil {
+			t.Errorf("%.1f: %v", pct, err)
+		}
+	}
+	// If always confirmed in the next block, the time is exponential.
+	d = newConfTimeDist(tvars[:1], 1000, 2)
+	if err := testutil.CheckPctDiff(d.TimePercentile(1000, 0.5, blockRate), math.Ln2/blockRate, 1e-5); err != nil {
+		t.Error(err)
+	}
+	// Percentiles not attained within the max blocks
+	d = newConfTimeDist(tvars, 1000, 2)
+	for _, f := range []FeeRate{999, 1000} {
+		if tm := d.TimePercentile(f, 0.9, blockRate); tm != -1 {
+			t.Errorf("%d: time should be -1, was %f", f, tm)
+		}
+	}
+}
+
+func TestTransientMaxBlockSize(t *testing.T) {
+	txsrc := loadMultiTxSource()
+	blksrc := loadIndBlockSource()
+	c := TransientConfig{
+		MaxBlockConfirms: 12,
+		MinSuccessPct:    0.9,
+		NumIters:         200,
+		LowestFeeRate:    5000,
+	}
+
+	// The overridden source keeps the block rate and min fee rates.
+	small, large := blksrc.WithMaxBlockSize(500000), blksrc.WithMaxBlockSize(2000000)
+	if err := testutil.CheckEqual(large.BlockRate(), blksrc.BlockRate()); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckPctDiff(
+		large.RateFn().Eval(20000), 4*small.RateFn().Eval(20000), 1e-9); err != nil {
+		t.Error(err)
+	}
+
+	run := func(b BlockSource) []FeeRate {
+		s := NewSim(txsrc.Copy(1)[0], b, loadInitMempool("333931"))
+		return <-NewTransientSim(s, c).Run()
+	}
+	rsmall, rlarge := run(small), run(large)
+	t.Log("small:", rsmall)
+	t.Log("large:", rlarge)
+	// Larger blocks yield lower fees. -1 (no fee) counts as infinite.
+	for i := range rlarge {
+		if rsmall[i] != -1 && (rlarge[i] == -1 || rlarge[i] > rsmall[i]) {
+			t.Errorf("%d blocks: large %d > small %d", i+1, rlarge[i], rsmall[i])
+		}
+	}
+	if rlarge[0] == rsmall[0] {
+		t.Error("fees should be lower with larger blocks")
+	}
+}
+
+func TestTransientCapacityPct(t *testing.T) {
+	txsrc := loadMultiTxSource()
+	ref := loadIndBlockSource()
+	blksrc := NewIndBlockSource(ref.minfeerates,
+		[]TxSize{400000, 600000, 800000, 1000000, 1200000, 1400000, 1600000, 1800000, 2000000},
+		ref.blockrate)
+	c := TransientConfig{
+		MaxBlockConfirms: 12,
+		MinSuccessPct:    0.9,
+		NumIters:         200,
+		LowestFeeRate:    2000,
+	}
+	run := func(b BlockSource) []FeeRate {
+		s := NewSim(txsrc.Copy(1)[0], b, loadInitMempool("333931"))
+		return <-NewTransientSim(s, c).Run()
+	}
+	economical := run(blksrc.WithCapacityPct(0.9))
+	standard := run(blksrc)
+	conservative := run(blksrc.WithCapacityPct(0.1))
+	t.Log("economical:", economical)
+	t.Log("default:", standard)
+	t.Log("conservative:", conservative)
+	// -1 (no fee) counts as infinite.
+	le := func(a, b FeeRate) bool {
+		return b == -1 || (a != -1 && a <= b)
+	}
+	for i := range standard {
+		if !le(economical[i], standard[i]) || !le(standard[i], conservative[i]) {
+			t.Errorf("%d blocks: %d, %d, %d not ordered", i+1, economical[i], standard[i], conservative[i])
+		}
+	}
+	if economical[0] == conservative[0] {
+		t.Error("economical and conservative should differ")
+	}
+
+	// The quantiles
+	for pct, size := range map[float64]TxSize{0: 400000, 0.1: 400000, 0.5: 1200000, 0.9: 2000000, 1: 2000000} {
+		b := blksrc.WithCapacityPct(pct)
+		if err := testutil.CheckEqual(b.maxblocksizes, []TxSize{size}); err != nil {
+			t.Errorf("%.1f: %v", pct, err)
+		}
+		if err := testutil.CheckEqual(b.blockrate, blksrc.blockrate); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestAggregateMaxFeeRates(t *testing.T) {
+	tvars := genVariates(500)
+	c := TransientConfig{MaxBlockConfirms: 18, MinSuccessPct: 0.9}
+	exact := aggregate(tvars, c)
+	numExact := len(aggregateFeeRates(tvars, 0))
+	t.Log("distinct fee rates:", numExact)
+
+	for _, n := range []int{20, 100, 300} {
+		c.MaxFeeRates = n
+		f := aggregateFeeRates(tvars, n)
+		if len(f) > n {
+			t.Errorf("%d: grid has %d points", n, len(f))
+		}
+		for i := 1; i < len(f); i++ {
+			if f[i] >= f[i-1] {
+				t.Fatalf("%d: grid not decreasing at %d", n, i)
+			}
+		}
+		// The result is at most one grid step (rounded up) above the exact one.
+		ratio := math.Pow(float64(f[0])/float64(f[len(f)-1]), 1/float64(n-1))
+		result := aggregate(tvars, c)
+		for i, r := range result {
+			if (r == -1) != (exact[i] == -1) {
+				t.Errorf("%d: result %v, exact %v", n, result, exact)
+				break
+			}
+			if r < exact[i] || float64(r) > math.Ceil(float64(exact[i])*ratio)+1 {
+				t.Errorf("%d: target %d: result %d, exact %d", n, i+1, r, exact[i])
+			}
+		}
+	}
+
+	// No quantization if there are few enough distinct fee rates
+	c.MaxFeeRates = numExact
+	if err := testutil.CheckEqual(aggregate(tvars, c), exact); err != nil {
+		t.Error(err)
+	}
+}
+
+func BenchmarkAggregate(b *testing.B) {
+	tvars := genVariates(10000)
+	for _, n := range []int{0, 200} {
+		c := TransientConfig{MaxBlockConfirms: 18, MinSuccessPct: 0.9, MaxFeeRates: n}
+		b.Run(fmt.Sprintf("maxfeerates=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				aggregate(tvars, c)
+			}
+		})
+	}
+}
+
+// genVariates returns n transient variates of the reference sim.
+func genVariates(n int) []transientVar {
+	s := NewSim(loadMultiTxSource(), loadIndBlockSource(), loadInitMempool("333931"))
+	vc := make(chan transientVar)
+	go transientGen(s, 5000, 18, n, vc, make(chan struct{}), nil)
+	tvars := make([]transientVar, n)
+	for i := range tvars {
+		tvars[i] = <-vc
+	}
+	return tvars
+}
+
 func BenchmarkTransientGen(b *testing.B) {
 	txsrc := loadMultiTxSource()
 	blksrc := loadIndBlockSource()
@@ -223,3 +485,139 @@ func loadTxSample() (txrate float64, txs []Tx) {
 	}
 	return txrate, txs
 }
+
+func TestTransientEmptyProb(t *testing.T) {
+	txsrc := loadMultiTxSource()
+	blksrc := loadIndBlockSource()
+	c := TransientConfig{
+		MaxBlockConfirms: 12,
+		MinSuccessPct:    0.9,
+		NumIters:         200,
+		LowestFeeRate:    5000,
+	}
+	run := func(b BlockSource) []FeeRate {
+		s := NewSim(txsrc.Copy(1)[0], b, loadInitMempool("333931"))
+		return <-NewTransientSim(s, c).Run()
+	}
+	ref, empty := run(blksrc), run(blksrc.WithEmptyProb(0.15))
+	t.Log("ref:", ref)
+	t.Log("empty:", empty)
+	// With 15% empty blocks, 1-block confirmation can't attain 90% success.
+	if err := testutil.CheckEqual(empty[0], FeeRate(-1)); err != nil {
+		t.Error(err)
+	}
+	if ref[0] == -1 {
+		t.Error("1-block estimate should exist without empty blocks")
+	}
+	// -1 (no fee) counts as infinite.
+	for i := range ref {
+		if ref[i] != -1 && empty[i] != -1 && empty[i] < ref[i] {
+			t.Errorf("%d blocks: empty %d < ref %d", i+1, empty[i], ref[i])
+		}
+	}
+}
+
+func TestTransientWithConfidence(t *testing.T) {
+	c := TransientConfig{
+		MaxBlockConfirms: 18,
+		MinSuccessPct:    0.9,
+		NumIters:         100,
+		LowestFeeRate:    5000,
+		KeepVariates:     true,
+	}
+	s := NewSim(loadMultiTxSource(), loadIndBlockSource(), loadInitMempool("333931"))
+
+	// No bounds by default
+	ts := NewTransientSim(s, c)
+	result := <-ts.RunWithBounds()
+	ref := AggregateVariates(ts.Variates(), c)
+	if err := testutil.CheckEqual(result, TransientResult{FeeRates: ref}); err != nil {
+		t.Error(err)
+	}
+
+	c.WithConfidence = true
+	ts = NewTransientSim(s, c)
+	r := ts.RunWithBounds()
+	result = <-r
+	t.Logf("%+v", result)
+	if err := testutil.CheckEqual(result.FeeRates, AggregateVariates(ts.Variates(), c)); err != nil {
+		t.Error(err)
+	}
+	// -1 (no fee) counts as infinite.
+	for i, f := range result.FeeRates {
+		lower, upper := result.Lower[i], result.Upper[i]
+		if f == -1 {
+			if upper != -1 {
+				t.Errorf("%d blocks: upper bound %d of an unattainable target", i+1, upper)
+			}
+			continue
+		}
+		if lower == -1 || lower > f || (upper != -1 && upper < f) {
+			t.Errorf("%d blocks: %d not within [%d, %d]", i+1, f, lower, upper)
+		}
+	}
+	// Test that result was closed
+	if result, ok := <-r; ok {
+		t.Error("r should be closed, got", result)
+	}
+
+	// With 100 iters, the upper bound of 90% + 1.96 * 3% is 96 successes,
+	// which is attained by all the fee rates at the max fee rate.
+	tvars := []transientVar{}
+	for i := 0; i < 100; i++ {
+		v := transientVar{feeRates: []FeeRate{10000, 5000}, confTimes: []int{1, 3}}
+		if i < 5 {
+			v.confTimes = []int{2, 3}
+		}
+		tvars = append(tvars, v)
+	}
+	c.MaxBlockConfirms = 2
+	// As in run with WithConfidence
+	result = newSuccessCounts(tvars, c).withBounds(c.MinSuccessPct)
+	if err := testutil.CheckEqual(result, TransientResult{
+		FeeRates: []FeeRate{10000, 10000},
+		Lower:    []FeeRate{10000, 10000},
+		Upper:    []FeeRate{-1, 10000},
+	}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTransientPercentileFeeRates(t *testing.T) {
+	c := TransientConfig{
+		MaxBlockConfirms: 18,
+		MinSuccessPct:    0.9,
+		NumIters:         100,
+		LowestFeeRate:    5000,
+		KeepVariates:     true,
+	}
+	s := NewSim(loadMultiTxSource(), loadIndBlockSource(), loadInitMempool("333931"))
+	ts := NewTransientSim(s, c)
+	if ts.PercentileFeeRates([]float64{0.9}) != nil {
+		t.Error("percentiles should be nil before the run")
+	}
+	result := <-ts.Run()
+
+	pcts := []float64{0.5, 0.8, 0.9, 0.95}
+	p := ts.PercentileFeeRates(pcts)
+	for k, pct := range pcts {
+		t.Logf("%.0f%%: %v", pct*100, p[k])
+		_c := c
+		_c.MinSuccessPct = pct
+		if err := testutil.CheckEqual(p[k], AggregateVariates(ts.Variates(), _c)); err != nil {
+			t.Error(err)
+		}
+	}
+	// The MinSuccessPct row is the result.
+	if err := testutil.CheckEqual(p[2], result); err != nil {
+		t.Error(err)
+	}
+	// A higher success pct requires a higher fee rate, for each target.
+	for k := 1; k < len(pcts); k++ {
+		for i := range p[k] {
+			if p[k-1][i] != -1 && p[k][i] != -1 && p[k][i] < p[k-1][i] {
+				t.Errorf("%d blocks: %d at %v < %d at %v", i+1, p[k][i], pcts[k], p[k-1][i], pcts[k-1])
+			}
+		}
+	}
+}
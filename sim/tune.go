@@ -0,0 +1,95 @@
+package sim
+
+import (
+	"errors"
+	"math"
+)
+
+var errTuneStopped = errors.New("tuning stopped")
+
+// TuneLevel is the stability of the transient sim result with NumIters
+// iterations, across repeated runs.
+type TuneLevel struct {
+	NumIters int `json:"numiters"`
+
+	// The max over the targets of the relative std dev (std dev / mean) of
+	// the fee estimate across runs. A target which is attainable in some
+	// runs but not in others counts as 1 (i.e. 100%); a target which is
+	// attainable in none is skipped.
+	RelStdDev float64 `json:"relstddev"`
+}
+
+// TuneNumIters runs the transient sim of s, with config cfg, runs times for
+// each of numIters (which should be increasing), stopping at the first
+// NumIters whose RelStdDev is at most tol. It returns the levels run, and
+// the recommended NumIters, i.e. that of the last level, or 0 if none was
+// stable enough. s is reused for each run, so it must not be in use
+// elsewhere. Closing done aborts the tuning.
+func TuneNumIters(s *Sim, cfg TransientConfig, numIters []int, runs int, tol float64,
+	done <-chan struct{}) ([]TuneLevel, int, error) {
+
+	if runs < 2 {
+		return nil, 0, errors.New("runs must be >= 2")
+	}
+	var levels []TuneLevel
+	for _, n := range numIters {
+		cfg.NumIters = n
+		results := make([][]FeeRate, runs)
+		for i := range results {
+			ts := NewTransientSim(s, cfg)
+			select {
+			case results[i] = <-ts.Run():
+			case <-done:
+				ts.Stop()
+				return nil, 0, errTuneStopped
+			}
+		}
+		level := TuneLevel{NumIters: n, RelStdDev: relStdDev(results)}
+		levels = append(levels, level)
+		if level.RelStdDev <= tol {
+			return levels, n, nil
+		}
+	}
+	return levels, 0, nil
+}
+
+// relStdDev returns the max over the targets of the relative std dev of
+// results; see TuneLevel.
+func relStdDev(results [][]FeeRate) float64 {
+	var maxRel float64
+	for j := range results[0] {
+		var (
+			sum, sumsq float64
+			numNoFee   int
+		)
+		for _, r := range results {
+			if r[j] == -1 {
+				numNoFee++
+				continue
+			}
+			f := float64(r[j])
+			sum += f
+			sumsq += f * f
+		}
+		if numNoFee == len(results) {
+			continue
+		}
+		if numNoFee > 0 {
+			maxRel = math.Max(maxRel, 1)
+			continue
+		}
+		n := float64(len(results))
+		mean := sum / n
+		if mean <= 0 {
+			continue
+		}
+		variance := (sumsq - n*mean*mean) / (n - 1)
+		if variance < 0 {
+			variance = 0 // Rounding
+		}
+		if rel := math.Sqrt(variance) / mean; rel > maxRel {
+			maxRel = rel
+		}
+	}
+	return maxRel
+}
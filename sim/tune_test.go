@@ -0,0 +1,75 @@
+package sim
+
+import (
+	"testing"
+
+	"github.com/bitcoinfees/feesim/testutil"
+)
+
+func TestTuneNumIters(t *testing.T) {
+	txsrc := loadMultiTxSource()
+	blksrc := loadIndBlockSource()
+	// With NumProcs 1, each run continues the random stream of the sim, so
+	// that the runs differ.
+	c := TransientConfig{
+		MaxBlockConfirms: 3,
+		MinSuccessPct:    0.9,
+		NumProcs:         1,
+		LowestFeeRate:    5000,
+	}
+	s := NewSim(txsrc, blksrc, loadInitMempool("333931"))
+	numIters := []int{10, 40, 160, 640}
+
+	loose, nLoose, err := TuneNumIters(s, c, numIters, 3, 0.3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tight, nTight, err := TuneNumIters(s, c, numIters, 3, 0.15, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("loose: %+v", loose)
+	t.Logf("tight: %+v", tight)
+	if nLoose == 0 || nTight == 0 {
+		t.Fatal("should recommend a NumIters")
+	}
+	if nTight <= nLoose {
+		t.Errorf("tight recommendation %d should exceed loose %d", nTight, nLoose)
+	}
+	if err := testutil.CheckEqual(tight[len(tight)-1].NumIters, nTight); err != nil {
+		t.Error(err)
+	}
+
+	// No NumIters is stable enough
+	levels, n, err := TuneNumIters(s, c, numIters[:1], 3, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(n, 0); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(len(levels), 1); err != nil {
+		t.Error(err)
+	}
+
+	// Aborted
+	done := make(chan struct{})
+	close(done)
+	if _, _, err := TuneNumIters(s, c, numIters, 3, 0, done); err != errTuneStopped {
+		t.Error("errTuneStopped should be returned, got", err)
+	}
+}
+
+func TestRelStdDev(t *testing.T) {
+	results := [][]FeeRate{
+		{1000, -1, -1},
+		{3000, -1, 5000},
+	}
+	// Target 1: mean 2000, std dev 1414; target 2 skipped; target 3 mixed.
+	if err := testutil.CheckEqual(relStdDev(results), 1.0); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckPctDiff(relStdDev([][]FeeRate{{1000, -1}, {3000, -1}}), 0.7071, 1e-4); err != nil {
+		t.Error(err)
+	}
+}
@@ -62,6 +62,23 @@ func (s *UniTxSource) Copy(n int) []TxSource {
 	return ss
 }
 
+func (s *UniTxSource) SampleSize() int {
+	return len(s.txs)
+}
+
+func (s *UniTxSource) Downsample(n int) TxSource {
+	if n <= 0 || n >= len(s.txs) {
+		return s.Copy(1)[0]
+	}
+	feerates := make([]FeeRate, n)
+	sizes := make([]TxSize, n)
+	for i := range feerates {
+		j := i * len(s.txs) / n
+		feerates[i], sizes[i] = s.txs[j].FeeRate, s.txs[j].Size
+	}
+	return NewUniTxSource(feerates, sizes, s.txrate)
+}
+
 func (s *UniTxSource) MinSize() TxSize {
 	return s.minSize
 }
@@ -96,6 +96,16 @@ func TestUniTxSource(t *testing.T) {
 	// Test RateFn approx
 	approx := ratefn.Approx(20)
 	t.Log("TxRateFn approx:", approx)
+	// n exceeds the number of distinct points, so all points are returned.
+	if err := testutil.CheckEqual(approx, ratefn); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(ratefn.Approx(0), ratefn); err != nil {
+		t.Error(err)
+	}
+	if n := len(ratefn.Approx(2).(TxRateFn).x); n > 2 {
+		t.Errorf("Approx(2) returned %d points", n)
+	}
 
 	// Test null source
 	txsrc = NewUniTxSource([]FeeRate{}, []TxSize{}, 0)
@@ -111,3 +121,29 @@ func TestUniTxSource(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestUniTxSourceDownsample(t *testing.T) {
+	f := []FeeRate{40000, 30000, 20000, 10000, 40000, 30000, 20000, 10000}
+	s := []TxSize{250, 250, 250, 250, 500, 500, 500, 500}
+	txsrc := NewUniTxSource(f, s, 2)
+	var _ SampledTxSource = txsrc
+
+	d := txsrc.Downsample(4).(*UniTxSource)
+	if err := testutil.CheckEqual(d.SampleSize(), 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(d.txs, []Tx{
+		{FeeRate: 40000, Size: 250}, {FeeRate: 20000, Size: 250},
+		{FeeRate: 40000, Size: 500}, {FeeRate: 20000, Size: 500},
+	}); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(d.txrate, txsrc.txrate); err != nil {
+		t.Error(err)
+	}
+	for _, n := range []int{0, 8, 100} {
+		if err := testutil.CheckEqual(txsrc.Downsample(n).(*UniTxSource).txs, txsrc.txs); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package sim
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// UnmarshalTxSource reconstructs a tx source from its MarshalJSON encoding,
+// according to the "type" field. As with Copy, the random state isn't
+// preserved.
+func UnmarshalTxSource(b []byte) (s TxSource, err error) {
+	var v struct {
+		Type string `json:"type"`
+
+		// MultiTxSource / UniTxSource
+		FeeRates []int64   `json:"feerates"`
+		Sizes    []int64   `json:"sizes"`
+		Weights  []float64 `json:"weights"`
+		TxRate   float64   `json:"txrate"`
+
+		// BumpTxSource / RBFTxSource
+		Source      json.RawMessage `json:"source"`
+		Mult        float64         `json:"mult"`
+		ReplaceProb float64         `json:"replaceprob"`
+		MeanBump    float64         `json:"meanbump"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	// The constructors panic on invalid params.
+	defer func() {
+		if r := recover(); r != nil {
+			s, err = nil, fmt.Errorf("%s: %v", v.Type, r)
+		}
+	}()
+
+	switch v.Type {
+	case "MultiTxSource", "UniTxSource":
+		if len(v.FeeRates) != len(v.Sizes) {
+			return nil, fmt.Errorf("%s: feerates and sizes must have same len", v.Type)
+		}
+		feerates := make([]FeeRate, len(v.FeeRates))
+		sizes := make([]TxSize, len(v.Sizes))
+		for i := range feerates {
+			feerates[i], sizes[i] = FeeRate(v.FeeRates[i]), TxSize(v.Sizes[i])
+		}
+		if v.Type == "UniTxSource" {
+			return NewUniTxSource(feerates, sizes, v.TxRate), nil
+		}
+		return NewMultiTxSource(feerates, sizes, v.Weights, v.TxRate), nil
+	case "BumpTxSource", "RBFTxSource":
+		src, err := UnmarshalTxSource(v.Source)
+		if err != nil {
+			return nil, err
+		}
+		if v.Type == "BumpTxSource" {
+			return NewBumpTxSource(src, v.Mult)
+		}
+		cfg := RBFConfig{Enabled: true, ReplaceProb: v.ReplaceProb, MeanBump: v.MeanBump}
+		return NewRBFTxSource(src, cfg), nil
+	default:
+		return nil, fmt.Errorf("unknown tx source type %q", v.Type)
+	}
+}
+
+// UnmarshalBlockSource reconstructs a block source from its MarshalJSON
+// encoding, according to the "type" field. As with Copy, the random state
+// isn't preserved.
+func UnmarshalBlockSource(b []byte) (s BlockSource, err error) {
+	var v struct {
+		Type string `json:"type"`
+
+		// IndBlockSource / ConstBlockSource
+		MinFeeRates   []float64 `json:"minfeerates"`
+		MaxBlockSizes []float64 `json:"maxblocksizes"`
+		Interval      float64   `json:"interval"`
+
+		// PairedBlockSource
+		Policies [][2]float64 `json:"policies"`
+
+		BlockRate     float64 `json:"blockrate"`
+		EmptyProb     float64 `json:"emptyprob"`
+		LowConfidence bool    `json:"lowconfidence"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	// The constructors panic on invalid params.
+	defer func() {
+		if r := recover(); r != nil {
+			s, err = nil, fmt.Errorf("%s: %v", v.Type, r)
+		}
+	}()
+
+	minfeerates := make([]FeeRate, len(v.MinFeeRates))
+	for i, f := range v.MinFeeRates {
+		minfeerates[i] = unmarshalMinFeeRate(f)
+	}
+	maxblocksizes := make([]TxSize, len(v.MaxBlockSizes))
+	for i, size := range v.MaxBlockSizes {
+		maxblocksizes[i] = TxSize(size)
+	}
+
+	switch v.Type {
+	case "IndBlockSource":
+		b := NewIndBlockSource(minfeerates, maxblocksizes, v.BlockRate)
+		return b.WithEmptyProb(v.EmptyProb).WithLowConfidence(v.LowConfidence), nil
+	case "PairedBlockSource":
+		policies := make([]BlockPolicy, len(v.Policies))
+		for i, p := range v.Policies {
+			policies[i] = BlockPolicy{MinFeeRate: unmarshalMinFeeRate(p[0]), MaxBlockSize: TxSize(p[1])}
+		}
+		b := NewPairedBlockSource(policies, v.BlockRate)
+		return b.WithEmptyProb(v.EmptyProb).WithLowConfidence(v.LowConfidence), nil
+	case "ConstBlockSource":
+		interval := time.Duration(v.Interval * float64(time.Second))
+		return NewConstBlockSource(minfeerates, maxblocksizes, interval), nil
+	default:
+		return nil, fmt.Errorf("unknown block source type %q", v.Type)
+	}
+}
+
+// unmarshalMinFeeRate decodes a min fee rate of a block source's JSON, in
+// which MaxFeeRate is encoded as -1.
+func unmarshalMinFeeRate(f float64) FeeRate {
+	if f < 0 {
+		return MaxFeeRate
+	}
+	return FeeRate(f)
+}
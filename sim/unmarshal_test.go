@@ -0,0 +1,126 @@
+package sim
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/bitcoinfees/feesim/testutil"
+)
+
+var roundTripFeeRates = []float64{-1, 0, 999, 1000, 5000, 10000, 10001, 20000, 50000, 1e6}
+
+func TestUnmarshalTxSource(t *testing.T) {
+	multi := loadMultiTxSource()
+	uni := loadUniTxSource()
+	rbfCfg := RBFConfig{Enabled: true, ReplaceProb: 0.2, MeanBump: 0.5}
+	bump15, err := NewBumpTxSource(multi, 1.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bump2, err := NewBumpTxSource(uni, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []TxSource{
+		multi,
+		uni,
+		NewMultiTxSource(nil, nil, nil, 0),
+		bump15,
+		NewRBFTxSource(bump2, rbfCfg),
+	} {
+		b, err := json.Marshal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := UnmarshalTxSource(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := testutil.CheckEqual(u.MinSize(), s.MinSize()); err != nil {
+			t.Error(err)
+		}
+		for _, x := range roundTripFeeRates {
+			if err := testutil.CheckPctDiff(u.RateFn().Eval(x), s.RateFn().Eval(x), 1e-9); err != nil {
+				t.Errorf("%T at %v: %v", s, x, err)
+			}
+		}
+	}
+
+	for _, b := range []string{
+		`{"type": "BogusTxSource"}`,
+		`{"type": "UniTxSource", "feerates": [1000], "sizes": []}`,
+		`{"type": "BumpTxSource", "source": {"type": "UniTxSource"}, "mult": 0.5}`,
+		`[]`,
+	} {
+		if _, err := UnmarshalTxSource([]byte(b)); err == nil {
+			t.Errorf("%s should not unmarshal", b)
+		}
+	}
+}
+
+func TestUnmarshalBlockSource(t *testing.T) {
+	ind := loadIndBlockSource()
+	policies := []BlockPolicy{
+		{MinFeeRate: 1000, MaxBlockSize: 1000000},
+		{MinFeeRate: MaxFeeRate, MaxBlockSize: 750000},
+	}
+	for _, s := range []BlockSource{
+		ind,
+		ind.WithEmptyProb(0.1).WithLowConfidence(true),
+		NewIndBlockSource([]FeeRate{1000, MaxFeeRate}, []TxSize{1000000}, 1./600),
+		NewPairedBlockSource(policies, 1./600).WithEmptyProb(0.05),
+		NewConstBlockSource([]FeeRate{20000, 1000, MaxFeeRate}, []TxSize{1000000, 500000}, 600*time.Second),
+	} {
+		b, err := json.Marshal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := UnmarshalBlockSource(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := testutil.CheckEqual(u.BlockRate(), s.BlockRate()); err != nil {
+			t.Error(err)
+		}
+		for _, x := range roundTripFeeRates {
+			if err := testutil.CheckPctDiff(u.RateFn().Eval(x), s.RateFn().Eval(x), 1e-9); err != nil {
+				t.Errorf("%T at %v: %v", s, x, err)
+			}
+		}
+		// Re-marshalling gives the same JSON.
+		ub, err := json.Marshal(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := testutil.CheckEqual(string(ub), string(b)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// The block order of a ConstBlockSource is kept.
+	c := NewConstBlockSource([]FeeRate{20000, 1000}, []TxSize{1000000}, 600*time.Second)
+	b, _ := json.Marshal(c)
+	u, err := UnmarshalBlockSource(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		_, pRef := c.Next()
+		_, p := u.Next()
+		if err := testutil.CheckEqual(p, pRef); err != nil {
+			t.Error(err)
+		}
+	}
+
+	for _, b := range []string{
+		`{"type": "BogusBlockSource"}`,
+		`{"type": "IndBlockSource", "minfeerates": [1000], "maxblocksizes": [], "blockrate": 0.001}`,
+		`{"type": "ConstBlockSource", "minfeerates": [1000], "maxblocksizes": [1000000], "interval": 0}`,
+		`[]`,
+	} {
+		if _, err := UnmarshalBlockSource([]byte(b)); err == nil {
+			t.Errorf("%s should not unmarshal", b)
+		}
+	}
+}
@@ -4,16 +4,97 @@ import (
 	"math"
 	"math/rand"
 	"sort"
+	"sync"
 	"time"
 )
 
-// getrand returns n seeded *rand.Rand instances.
-// Don't call this too often i.e. on the order of nanoseconds.
-var getrand = func(n int) []*rand.Rand {
-	initseed := time.Now().UnixNano()
+// RandSource returns n seeded *rand.Rand instances. The sources get their
+// random number generators from the package RandSource (see SetRandSource),
+// when constructed and when copied.
+//
+// Seeding contract: every instance returned, within a call and across calls,
+// should have a distinct seed, so that the random streams of the source copies
+// are independent (see TxSource.Copy). In particular, Sim.Copy gets instances
+// for both the tx source and the block source; with consecutive seeds based on
+// the time, calls made within n nanoseconds of each other would share seeds,
+// and the copies' tx arrivals and block discoveries would be correlated.
+type RandSource func(n int) []*rand.Rand
+
+var randSource = struct {
+	sync.RWMutex
+	f RandSource
+}{f: newRands}
+
+// SetRandSource sets the package RandSource to f, returning the previous one.
+// If f is nil, the default is restored, which is seeded with the time. Only
+// sources constructed or copied afterwards are affected.
+func SetRandSource(f RandSource) RandSource {
+	if f == nil {
+		f = newRands
+	}
+	randSource.Lock()
+	defer randSource.Unlock()
+	prev := randSource.f
+	randSource.f = f
+	return prev
+}
+
+// SeededRandSource returns a RandSource which draws its seeds from a generator
+// seeded with seed, so that the random streams of the sources (and of NewRand)
+// are reproducible, provided that they are constructed and copied in the same
+// order. The sim results are then reproducible for the same sources and
+// initial mempool; randomness outside the package, e.g. that of the tx source
+// estimators in package estimate, isn't covered.
+func SeededRandSource(seed int64) RandSource {
+	var mux sync.Mutex
+	gen := rand.New(rand.NewSource(seed))
+	return func(n int) []*rand.Rand {
+		mux.Lock()
+		defer mux.Unlock()
+		return drawRands(gen, n)
+	}
+}
+
+// NewRand returns a *rand.Rand from the package RandSource, for randomness
+// outside the sources which should also follow SetRandSource (e.g. the mempool
+// size fn sample).
+func NewRand() *rand.Rand {
+	return getrand(1)[0]
+}
+
+// getrand returns n *rand.Rand instances from the package RandSource.
+func getrand(n int) []*rand.Rand {
+	randSource.RLock()
+	f := randSource.f
+	randSource.RUnlock()
+	return f(n)
+}
+
+var seedGen = struct {
+	sync.Mutex
+	rand *rand.Rand
+}{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// newRands returns n *rand.Rand instances with seeds drawn from the package
+// seed generator, which is seeded once with the time.
+func newRands(n int) []*rand.Rand {
+	seedGen.Lock()
+	defer seedGen.Unlock()
+	return drawRands(seedGen.rand, n)
+}
+
+// drawRands returns n *rand.Rand instances with distinct seeds drawn from gen.
+func drawRands(gen *rand.Rand, n int) []*rand.Rand {
+	seeds := make(map[int64]bool, n)
 	r := make([]*rand.Rand, n)
 	for i := range r {
-		r[i] = rand.New(rand.NewSource(initseed + int64(i)))
+		seed := gen.Int63()
+		for seeds[seed] {
+			// Vanishingly unlikely, but cheap to guarantee within a call.
+			seed = gen.Int63()
+		}
+		seeds[seed] = true
+		r[i] = rand.New(rand.NewSource(seed))
 	}
 	return r
 }
@@ -0,0 +1,144 @@
+package sim
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestNewRandsIndependence(t *testing.T) {
+	const (
+		n       = 2000 // Streams per call
+		samples = 1000 // Samples per stream
+	)
+	// Back-to-back calls, as in Sim.Copy
+	r := append(newRands(n), newRands(n)...)
+
+	// No two streams are the same, i.e. no shared seeds.
+	first := make(map[int64]int)
+	streams := make([][]float64, len(r))
+	for i, ri := range r {
+		x := ri.Int63()
+		if j, ok := first[x]; ok {
+			t.Fatalf("streams %d and %d have the same first value", j, i)
+		}
+		first[x] = i
+		streams[i] = make([]float64, samples)
+		for k := range streams[i] {
+			streams[i][k] = ri.Float64()
+		}
+	}
+
+	// Each correlation coefficient is approximately N(0, 1/samples) if the
+	// streams are independent; allow 6 std devs. Check the pairs that would
+	// be correlated with time-based consecutive seeding, as well as random
+	// pairs.
+	tol := 6 / math.Sqrt(samples)
+	rng := rand.New(rand.NewSource(0))
+	check := func(i, j int) {
+		if c := corrcoef(streams[i], streams[j]); math.Abs(c) > tol {
+			t.Errorf("streams %d and %d have correlation %.3f", i, j, c)
+		}
+	}
+	for i := 0; i < n; i++ {
+		check(i, i+1)
+		check(i, i+n)
+		j := rng.Intn(len(r))
+		if j != i {
+			check(i, j)
+		}
+	}
+}
+
+func TestCopyIndependence(t *testing.T) {
+	defer SetRandSource(SetRandSource(nil))
+
+	const n = 1000
+	txsrc := NewUniTxSource([]FeeRate{1000}, []TxSize{250}, 1)
+	blksrc := NewIndBlockSource([]FeeRate{1000}, []TxSize{1e6}, 1./600)
+	s := NewSim(txsrc, blksrc, nil)
+	first := make(map[int64]bool)
+	for _, c := range s.Copy(n) {
+		for _, r := range []*rand.Rand{
+			c.txsource.(*UniTxSource).rand, c.blocksource.(*IndBlockSource).rand} {
+			x := r.Int63()
+			if first[x] {
+				t.Fatal("sim copies have shared random streams")
+			}
+			first[x] = true
+		}
+	}
+}
+
+func corrcoef(x, y []float64) float64 {
+	var mx, my float64
+	for i := range x {
+		mx += x[i]
+		my += y[i]
+	}
+	mx /= float64(len(x))
+	my /= float64(len(y))
+	var sxy, sxx, syy float64
+	for i := range x {
+		dx, dy := x[i]-mx, y[i]-my
+		sxy += dx * dy
+		sxx += dx * dx
+		syy += dy * dy
+	}
+	return sxy / math.Sqrt(sxx*syy)
+}
+
+func TestSeededRandSource(t *testing.T) {
+	defer SetRandSource(SetRandSource(nil))
+
+	// The SFRs of a sim copy, with the sources constructed after setting a
+	// seeded RandSource.
+	sfrs := func(seed int64) []FeeRate {
+		SetRandSource(SeededRandSource(seed))
+		txsrc := NewMultiTxSource([]FeeRate{5000, 10000, 20000}, []TxSize{250, 500, 1000},
+			[]float64{1, 1, 1}, 1.5)
+		blksrc := NewIndBlockSource([]FeeRate{1000, 5000}, []TxSize{500000, 1000000}, 1./600)
+		s := NewSim(txsrc, blksrc, nil).Copy(2)[1]
+		r := make([]FeeRate, 20)
+		for i := range r {
+			r[i], _ = s.NextBlock()
+		}
+		return r
+	}
+	equal := func(a, b []FeeRate) bool {
+		for i := range a {
+			if a[i] != b[i] {
+				return false
+			}
+		}
+		return true
+	}
+	ref := sfrs(1)
+	if r := sfrs(1); !equal(r, ref) {
+		t.Errorf("same seed yielded different SFRs: %v, %v", r, ref)
+	}
+	if r := sfrs(2); equal(r, ref) {
+		t.Errorf("different seeds yielded the same SFRs: %v", r)
+	}
+
+	// NewRand draws from the RandSource as well.
+	SetRandSource(SeededRandSource(1))
+	a := NewRand().Int63()
+	SetRandSource(SeededRandSource(1))
+	if b := NewRand().Int63(); a != b {
+		t.Errorf("same seed yielded different NewRand draws: %d, %d", a, b)
+	}
+
+	// Within a RandSource, the seeds are distinct.
+	r := SeededRandSource(1)
+	seen := make(map[int64]bool)
+	for i := 0; i < 10; i++ {
+		for _, rng := range r(10) {
+			x := rng.Int63()
+			if seen[x] {
+				t.Fatal("seeded RandSource returned shared random streams")
+			}
+			seen[x] = true
+		}
+	}
+}
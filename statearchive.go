@@ -0,0 +1,132 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+
+	col "github.com/bitcoinfees/feesim/collect"
+	est "github.com/bitcoinfees/feesim/estimate"
+	"github.com/bitcoinfees/feesim/predict"
+)
+
+const stateArchiveVersion = 1
+
+// stateArchive is the estimator state in the DBs, for moving it between hosts
+// or snapshotting it. It's stored as gzipped JSON.
+type stateArchive struct {
+	Version    int                   `json:"version"`
+	Txs        []est.Tx              `json:"txs"`
+	BlockStats []*est.BlockStat      `json:"blockstats"`
+	PredictTxs map[string]predict.Tx `json:"predicttxs"`
+	Attained   []float64             `json:"attained"`
+	Exceeded   []float64             `json:"exceeded"`
+	Outcomes   []predict.Outcome     `json:"outcomes"`
+
+	// Fee rate scores, which are absent in archives of earlier versions.
+	FeeAttained [][]float64 `json:"feeattained,omitempty"`
+	FeeExceeded [][]float64 `json:"feeexceeded,omitempty"`
+}
+
+// statePredictDB is a predict.DB which can list all its txs, and which retains
+// outcomes and fee rate scores.
+type statePredictDB interface {
+	predict.DB
+	predict.OutcomeDB
+	predict.FeeScoreDB
+	AllTxs() (map[string]predict.Tx, error)
+}
+
+// writeStateArchive writes an archive of all the data in the DBs to w.
+func writeStateArchive(w io.Writer, txdb est.TxDB, blkdb est.BlockStatDB, predictdb statePredictDB) (stateArchive, error) {
+	a := stateArchive{Version: stateArchiveVersion}
+	var err error
+	if a.Txs, err = txdb.Get(0, math.MaxInt64); err != nil {
+		return a, fmt.Errorf("TxDB.Get: %v", err)
+	}
+	if a.BlockStats, err = blkdb.Get(0, math.MaxInt64); err != nil {
+		return a, fmt.Errorf("BlockStatDB.Get: %v", err)
+	}
+	if a.PredictTxs, err = predictdb.AllTxs(); err != nil {
+		return a, fmt.Errorf("PredictDB.AllTxs: %v", err)
+	}
+	if a.Attained, a.Exceeded, err = predictdb.GetScores(); err != nil {
+		return a, fmt.Errorf("PredictDB.GetScores: %v", err)
+	}
+	if a.FeeAttained, a.FeeExceeded, err = predictdb.GetFeeScores(); err != nil {
+		return a, fmt.Errorf("PredictDB.GetFeeScores: %v", err)
+	}
+	if a.Outcomes, err = predictdb.GetOutcomes(); err != nil {
+		return a, fmt.Errorf("PredictDB.GetOutcomes: %v", err)
+	}
+
+	zw := gzip.NewWriter(w)
+	if err := json.NewEncoder(zw).Encode(a); err != nil {
+		return a, err
+	}
+	return a, zw.Close()
+}
+
+// readStateArchive reads an archive written by writeStateArchive from r, and puts its
+// data into the DBs. Existing data with the same keys (tx times, block
+// heights, txids) is overwritten, and the scores and retained outcomes are
+// replaced.
+//
+// Txs older than txGapTol at the next start are discarded then (see
+// FeeSim.normalizeTxDB), so if the latest tx is more than txGapTol seconds
+// before timeNow, nothing is imported and an error is returned, unless
+// shift is set, in which case the tx times are shifted forward so that the
+// latest is at timeNow.
+func readStateArchive(r io.Reader, txdb col.TxDB, blkdb col.BlockStatDB, predictdb statePredictDB,
+	timeNow, txGapTol int64, shift bool) (stateArchive, error) {
+
+	var a stateArchive
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return a, err
+	}
+	if err := json.NewDecoder(zr).Decode(&a); err != nil {
+		return a, err
+	}
+	if a.Version != stateArchiveVersion {
+		return a, fmt.Errorf("unsupported state archive version %d", a.Version)
+	}
+	if n := len(a.Txs); n > 0 {
+		if d := timeNow - a.Txs[n-1].Time; shift {
+			for i := range a.Txs {
+				a.Txs[i].Time += d
+			}
+		} else if d > txGapTol {
+			return a, fmt.Errorf("the latest tx is %ds old, more than txgaptol (%ds), so the txs "+
+				"would be discarded on start; use -shift to shift them to the current time", d, txGapTol)
+		}
+	}
+
+	if err := txdb.Put(a.Txs); err != nil {
+		return a, fmt.Errorf("TxDB.Put: %v", err)
+	}
+	if err := blkdb.Put(a.BlockStats); err != nil {
+		return a, fmt.Errorf("BlockStatDB.Put: %v", err)
+	}
+	if err := predictdb.PutTxs(a.PredictTxs); err != nil {
+		return a, fmt.Errorf("PredictDB.PutTxs: %v", err)
+	}
+	if a.Attained != nil || a.Exceeded != nil {
+		if err := predictdb.PutScores(a.Attained, a.Exceeded); err != nil {
+			return a, fmt.Errorf("PredictDB.PutScores: %v", err)
+		}
+	}
+	if a.FeeAttained != nil || a.FeeExceeded != nil {
+		if err := predictdb.PutFeeScores(a.FeeAttained, a.FeeExceeded); err != nil {
+			return a, fmt.Errorf("PredictDB.PutFeeScores: %v", err)
+		}
+	}
+	if len(a.Outcomes) > 0 {
+		if err := predictdb.PutOutcomes(a.Outcomes, len(a.Outcomes)); err != nil {
+			return a, fmt.Errorf("PredictDB.PutOutcomes: %v", err)
+		}
+	}
+	return a, nil
+}
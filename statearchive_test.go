@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	est "github.com/bitcoinfees/feesim/estimate"
+	"github.com/bitcoinfees/feesim/predict"
+	"github.com/bitcoinfees/feesim/testutil"
+)
+
+func TestStateArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "feesim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	loadDBs := func(name string) (TxDB, BlockStatDB, statePredictDB) {
+		if err := os.Mkdir(filepath.Join(dir, name), 0700); err != nil {
+			t.Fatal(err)
+		}
+		cfg := config{DataDir: filepath.Join(dir, name)}
+		txdb, blkdb, predictdb, err := loadStateDBs(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return txdb, blkdb, predictdb
+	}
+
+	// Populate the source DBs
+	txdb, blkdb, predictdb := loadDBs("src")
+	defer closeStateDBs(txdb, blkdb, predictdb)
+	txs := []est.Tx{
+		{FeeRate: 10000, Size: 250, Time: 1000},
+		{FeeRate: 20000, Size: 500, Time: 1001},
+		{FeeRate: 5000, Size: 1000, Time: 1002},
+	}
+	if err := txdb.Put(txs); err != nil {
+		t.Fatal(err)
+	}
+	var stats []*est.BlockStat
+	for h := int64(100); h < 105; h++ {
+		stats = append(stats, &est.BlockStat{
+			Height:            h,
+			Size:              900000,
+			SFRStat:           est.SFRStat{SFR: 10000, AK: 5, AN: 5, BK: 3, BN: 4},
+			MempoolSize:       2000000,
+			MempoolSizeRemain: 1100000,
+			Time:              1000 + 600*h,
+			NumHashes:         1e20,
+		})
+	}
+	if err := blkdb.Put(stats); err != nil {
+		t.Fatal(err)
+	}
+	predictTxs := map[string]predict.Tx{
+		"a": {ConfirmIn: 1, ConfirmBy: 105, Size: 250},
+		"b": {ConfirmIn: 2, ConfirmBy: math.MaxInt64},
+	}
+	if err := predictdb.PutTxs(predictTxs); err != nil {
+		t.Fatal(err)
+	}
+	attained, exceeded := []float64{1, 2}, []float64{0.5, 0.25}
+	if err := predictdb.PutScores(attained, exceeded); err != nil {
+		t.Fatal(err)
+	}
+	feeAttained, feeExceeded := [][]float64{{0, 1}, {2, 0}}, [][]float64{{0, 0.5}, {0.25, 0}}
+	if err := predictdb.PutFeeScores(feeAttained, feeExceeded); err != nil {
+		t.Fatal(err)
+	}
+	outcomes := []predict.Outcome{{ConfirmIn: 1, ConfirmBy: 101, Height: 101, Size: 250, FeeRate: 20000}}
+	if err := predictdb.PutOutcomes(outcomes, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := writeStateArchive(&buf, txdb, blkdb, predictdb); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restore into empty DBs
+	txdb2, blkdb2, predictdb2 := loadDBs("dst")
+	defer closeStateDBs(txdb2, blkdb2, predictdb2)
+	a, err := readStateArchive(bytes.NewReader(buf.Bytes()), txdb2, blkdb2, predictdb2, 1002+3600, 3600, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(len(a.Txs), len(txs)); err != nil {
+		t.Error(err)
+	}
+
+	if txsGot, err := txdb2.Get(0, math.MaxInt64); err != nil {
+		t.Fatal(err)
+	} else if err := testutil.CheckEqual(txsGot, txs); err != nil {
+		t.Error(err)
+	}
+	if statsGot, err := blkdb2.Get(0, math.MaxInt64); err != nil {
+		t.Fatal(err)
+	} else if err := testutil.CheckEqual(statsGot, stats); err != nil {
+		t.Error(err)
+	}
+	if predictTxsGot, err := predictdb2.AllTxs(); err != nil {
+		t.Fatal(err)
+	} else if err := testutil.CheckEqual(predictTxsGot, predictTxs); err != nil {
+		t.Error(err)
+	}
+	if attainedGot, exceededGot, err := predictdb2.GetScores(); err != nil {
+		t.Fatal(err)
+	} else if err := testutil.CheckEqual([][]float64{attainedGot, exceededGot},
+		[][]float64{attained, exceeded}); err != nil {
+		t.Error(err)
+	}
+	if feeAttainedGot, feeExceededGot, err := predictdb2.GetFeeScores(); err != nil {
+		t.Fatal(err)
+	} else if err := testutil.CheckEqual([][][]float64{feeAttainedGot, feeExceededGot},
+		[][][]float64{feeAttained, feeExceeded}); err != nil {
+		t.Error(err)
+	}
+	if outcomesGot, err := predictdb2.GetOutcomes(); err != nil {
+		t.Fatal(err)
+	} else if err := testutil.CheckEqual(outcomesGot, outcomes); err != nil {
+		t.Error(err)
+	}
+
+	// Not an archive
+	if _, err := readStateArchive(bytes.NewReader([]byte("{}")), txdb2, blkdb2, predictdb2, 1002, 3600, false); err == nil {
+		t.Error("reading a non-archive should fail")
+	}
+
+	// The txs would be discarded on start, so nothing is imported
+	txdb3, blkdb3, predictdb3 := loadDBs("old")
+	defer closeStateDBs(txdb3, blkdb3, predictdb3)
+	if _, err := readStateArchive(bytes.NewReader(buf.Bytes()), txdb3, blkdb3, predictdb3, 1002+3601, 3600, false); err == nil {
+		t.Error("importing txs older than txgaptol should fail")
+	}
+	if n, err := txdb3.Count(0, math.MaxInt64); err != nil {
+		t.Fatal(err)
+	} else if err := testutil.CheckEqual(n, 0); err != nil {
+		t.Error(err)
+	}
+	if n, err := blkdb3.Count(0, math.MaxInt64); err != nil {
+		t.Fatal(err)
+	} else if err := testutil.CheckEqual(n, 0); err != nil {
+		t.Error(err)
+	}
+
+	// Unless shifted to the current time
+	if _, err := readStateArchive(bytes.NewReader(buf.Bytes()), txdb3, blkdb3, predictdb3, 10002, 3600, true); err != nil {
+		t.Fatal(err)
+	}
+	shifted := []est.Tx{
+		{FeeRate: 10000, Size: 250, Time: 10000},
+		{FeeRate: 20000, Size: 500, Time: 10001},
+		{FeeRate: 5000, Size: 1000, Time: 10002},
+	}
+	if txsGot, err := txdb3.Get(0, math.MaxInt64); err != nil {
+		t.Fatal(err)
+	} else if err := testutil.CheckEqual(txsGot, shifted); err != nil {
+		t.Error(err)
+	}
+}
@@ -61,8 +61,11 @@ type MempoolEntry struct {
 }
 
 // Returns the tx fee rate in satoshis / kB
-// Panics if called with a zero-value receiver
+// Returns 0 if the entry has a non-positive size.
 func (m *MempoolEntry) FeeRate() int64 {
+	if m.Size <= 0 {
+		return 0
+	}
 	return int64(m.Fee*coin*1000) / int64(m.Size)
 }
 
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/bitcoinfees/feesim/sim"
+)
+
+// tunableConfig is the subset of FeeSimConfig which may be changed while
+// Feesim is running. The workers read it through the getters, rather than
+// from FeeSim.cfg, which is read-only after NewFeeSim.
+type tunableConfig struct {
+	mux       sync.RWMutex
+	simPeriod int
+	transient sim.TransientConfig
+}
+
+// SimPeriod returns the current seconds between sim runs.
+func (s *FeeSim) SimPeriod() int {
+	s.tunables.mux.RLock()
+	defer s.tunables.mux.RUnlock()
+	return s.tunables.simPeriod
+}
+
+// SetSimPeriod sets the seconds between sim runs. It takes effect after the
+// current run.
+func (s *FeeSim) SetSimPeriod(period int) error {
+	if period <= 0 {
+		return fmt.Errorf("simperiod must be > 0, was %d", period)
+	}
+	s.tunables.mux.Lock()
+	defer s.tunables.mux.Unlock()
+	s.tunables.simPeriod = period
+	return nil
+}
+
+// NumIters returns the current number of transient sim iterations.
+func (s *FeeSim) NumIters() int {
+	s.tunables.mux.RLock()
+	defer s.tunables.mux.RUnlock()
+	return s.tunables.transient.NumIters
+}
+
+// Transient returns the current transient sim config.
+func (s *FeeSim) Transient() sim.TransientConfig {
+	s.tunables.mux.RLock()
+	defer s.tunables.mux.RUnlock()
+	return s.tunables.transient
+}
+
+// SetNumIters sets the number of transient sim iterations. It takes effect
+// from the next run.
+func (s *FeeSim) SetNumIters(n int) error {
+	if n <= 0 {
+		return fmt.Errorf("numiters must be > 0, was %d", n)
+	}
+	s.tunables.mux.Lock()
+	defer s.tunables.mux.Unlock()
+	s.tunables.transient.NumIters = n
+	return nil
+}
+
+// PredictHalflife returns the current halflife of the prediction scores.
+func (s *FeeSim) PredictHalflife() int {
+	return s.predictor.Halflife()
+}
+
+// SetPredictHalflife sets the halflife of the prediction scores. It takes
+// effect from the next block; the existing scores are not recomputed.
+func (s *FeeSim) SetPredictHalflife(halflife int) error {
+	return s.predictor.SetHalflife(halflife)
+}
+
+// Reconfigure applies the subset of cfg which can be changed while Feesim is
+// running: SimPeriod, Transient, Collect.PollPeriod and Predict.Halflife. The
+// rest of cfg is ignored. The collected data is kept. If any of the subset is
+// invalid, none of it is applied.
+//
+// As with the setters, SimPeriod and Transient take effect after the current
+// sim run, the poll period after the next poll, and the halflife from the next
+// block.
+func (s *FeeSim) Reconfigure(cfg FeeSimConfig) error {
+	if err := checkTunables(cfg); err != nil {
+		return err
+	}
+	if err := s.collect.SetPollPeriod(cfg.Collect.PollPeriod); err != nil {
+		return err
+	}
+	if err := s.predictor.SetHalflife(cfg.Predict.Halflife); err != nil {
+		return err
+	}
+	// Together, so that a sim run doesn't pick up half of the change.
+	s.tunables.mux.Lock()
+	s.tunables.simPeriod = cfg.SimPeriod
+	s.tunables.transient = cfg.Transient
+	s.tunables.mux.Unlock()
+	return nil
+}
+
+// checkTunables returns an error if the subset of cfg applied by Reconfigure
+// is invalid.
+func checkTunables(cfg FeeSimConfig) error {
+	if errs := tunableErrors(cfg); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// tunableErrors returns all the problems of the subset of cfg applied by
+// Reconfigure.
+func tunableErrors(cfg FeeSimConfig) []error {
+	var errs []error
+	t := cfg.Transient
+	if cfg.SimPeriod <= 0 {
+		errs = append(errs, fmt.Errorf("simperiod must be > 0, was %d", cfg.SimPeriod))
+	}
+	if cfg.Collect.PollPeriod <= 0 {
+		errs = append(errs, fmt.Errorf("pollperiod must be > 0, was %d", cfg.Collect.PollPeriod))
+	}
+	if cfg.Predict.Halflife <= 0 {
+		errs = append(errs, fmt.Errorf("halflife must be > 0, was %d", cfg.Predict.Halflife))
+	}
+	if t.NumIters <= 0 {
+		errs = append(errs, fmt.Errorf("numiters must be > 0, was %d", t.NumIters))
+	}
+	if t.MaxBlockConfirms <= 0 {
+		errs = append(errs, fmt.Errorf("maxblockconfirms must be > 0, was %d", t.MaxBlockConfirms))
+	}
+	if t.MinSuccessPct < 0 || t.MinSuccessPct >= 1 {
+		errs = append(errs, fmt.Errorf("minsuccesspct must be in [0, 1), was %g", t.MinSuccessPct))
+	}
+	return errs
+}
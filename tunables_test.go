@@ -0,0 +1,151 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bitcoinfees/feesim/sim"
+	"github.com/bitcoinfees/feesim/testutil"
+)
+
+// Run with -race to check that the tunables can be set while Feesim is
+// running (with -gcflags=all=-d=checkptr=0, since the vendored bolt trips the
+// checkptr instrumentation).
+func TestTunableConfig(t *testing.T) {
+	s, cleanup := newTestFeeSim(t, testGetState)
+	defer cleanup()
+	if err := testutil.CheckEqual(s.SimPeriod(), 1); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(s.PredictHalflife(), 8); err != nil {
+		t.Error(err)
+	}
+
+	runErr := make(chan error)
+	go func() { runErr <- s.Run() }()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 1; j <= 100; j++ {
+				if err := s.SetSimPeriod(j%2 + 1); err != nil {
+					t.Error(err)
+				}
+				if err := s.SetNumIters(1000 * j); err != nil {
+					t.Error(err)
+				}
+				if err := s.SetPredictHalflife(i + j); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				s.SimPeriod()
+				s.NumIters()
+				s.PredictHalflife()
+			}
+		}()
+	}
+	wg.Wait()
+	// Let the sim loop pick up the last period
+	time.Sleep(100 * time.Millisecond)
+
+	s.Stop()
+	if err := <-runErr; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := testutil.CheckEqual(s.SimPeriod(), 1); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(s.NumIters(), 100000); err != nil {
+		t.Error(err)
+	}
+
+	// Invalid values are rejected and leave the config unchanged
+	if err := s.SetSimPeriod(0); err == nil {
+		t.Error("simperiod 0 should be rejected")
+	}
+	if err := s.SetNumIters(-1); err == nil {
+		t.Error("numiters -1 should be rejected")
+	}
+	if err := s.SetPredictHalflife(0); err == nil {
+		t.Error("halflife 0 should be rejected")
+	}
+	if err := testutil.CheckEqual(s.SimPeriod(), 1); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(s.NumIters(), 100000); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	s, cleanup := newTestFeeSim(t, testGetState)
+	defer cleanup()
+
+	cfg := s.cfg
+	cfg.SimPeriod = 30
+	cfg.Transient = sim.TransientConfig{MaxBlockConfirms: 6, MinSuccessPct: 0.8, NumIters: 500}
+	cfg.Collect.PollPeriod = 5
+	cfg.Predict.Halflife = 16
+	cfg.TxMaxAge = 12345 // Ignored
+	if err := s.Reconfigure(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.CheckEqual(s.SimPeriod(), 30); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(s.Transient(), cfg.Transient); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(s.NumIters(), 500); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(s.collect.PollPeriod(), 5); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(s.PredictHalflife(), 16); err != nil {
+		t.Error(err)
+	}
+	if s.cfg.TxMaxAge == 12345 {
+		t.Error("TxMaxAge should not be reconfigured")
+	}
+
+	// Nothing is applied if any of it is invalid
+	for _, invalid := range []func(*FeeSimConfig){
+		func(c *FeeSimConfig) { c.SimPeriod = 0 },
+		func(c *FeeSimConfig) { c.Collect.PollPeriod = -1 },
+		func(c *FeeSimConfig) { c.Predict.Halflife = 0 },
+		func(c *FeeSimConfig) { c.Transient.NumIters = 0 },
+		func(c *FeeSimConfig) { c.Transient.MaxBlockConfirms = 0 },
+		func(c *FeeSimConfig) { c.Transient.MinSuccessPct = 1 },
+	} {
+		c := s.cfg
+		c.SimPeriod = 60
+		c.Transient = sim.TransientConfig{MaxBlockConfirms: 2, NumIters: 100}
+		c.Collect.PollPeriod = 10
+		c.Predict.Halflife = 4
+		invalid(&c)
+		if err := s.Reconfigure(c); err == nil {
+			t.Errorf("%+v should be rejected", c)
+		}
+	}
+	if err := testutil.CheckEqual(s.SimPeriod(), 30); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(s.Transient(), cfg.Transient); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(s.collect.PollPeriod(), 5); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CheckEqual(s.PredictHalflife(), 16); err != nil {
+		t.Error(err)
+	}
+}